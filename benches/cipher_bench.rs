@@ -0,0 +1,92 @@
+// cipher_bench.rs - transport cipher throughput benchmarks
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Run with `cargo +nightly bench --features nightly`.
+
+#![feature(test)]
+
+extern crate test;
+extern crate rand_core;
+extern crate x25519_dalek_ng;
+extern crate mix_link;
+
+use std::collections::HashMap;
+
+use test::Bencher;
+use rand_core::OsRng;
+use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+use mix_link::constants::NOISE_MESSAGE_HEADER_SIZE;
+use mix_link::messages::{MessageBuilder, SessionConfig, CipherSuite, PeerAuthenticator,
+                         ProviderAuthenticatorState, ClientAuthenticatorState};
+
+const MESSAGE_SIZE: usize = 32 * 1024;
+
+fn transport_pair(cipher: CipherSuite) -> (MessageBuilder, MessageBuilder) {
+    let server_secret = StaticSecret::new(OsRng);
+    let client_secret = StaticSecret::new(OsRng);
+
+    let mut client_map = HashMap::new();
+    client_map.insert(PublicKey::from(&client_secret), true);
+    let provider_auth = ProviderAuthenticatorState {
+        mix_map: HashMap::default(),
+        client_map: client_map,
+        from_client: false,
+        from_mix: false,
+    };
+    let mut server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret.clone(), None, vec![]);
+    server_config.cipher = cipher;
+    let mut server = MessageBuilder::new(server_config, false).unwrap();
+
+    let client_auth = ClientAuthenticatorState{
+        peer_public_key: PublicKey::from(&server_secret),
+    };
+    let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(PublicKey::from(&server_secret)), vec![]);
+    client_config.cipher = cipher;
+    let mut client = MessageBuilder::new(client_config, true).unwrap();
+
+    let client_handshake1 = client.client_handshake1().unwrap();
+    client.sent_client_handshake1();
+    let server_handshake1 = server.received_client_handshake1(&client_handshake1).unwrap();
+    server.sent_server_handshake1();
+    client.received_server_handshake1(&server_handshake1).unwrap();
+    let client_handshake2 = client.client_handshake2().unwrap();
+    client.sent_client_handshake2();
+    server.received_client_handshake2(&client_handshake2).unwrap();
+
+    (client.into_transport_mode().unwrap(), server.into_transport_mode().unwrap())
+}
+
+fn bench_transport(b: &mut Bencher, cipher: CipherSuite) {
+    let (mut client, mut server) = transport_pair(cipher);
+    let message = vec![0u8; MESSAGE_SIZE];
+    b.bytes = MESSAGE_SIZE as u64;
+    b.iter(|| {
+        let ciphertext = client.encrypt_message(&message).unwrap();
+        server.decrypt_message_header(&ciphertext).unwrap();
+        server.decrypt_message(&ciphertext[NOISE_MESSAGE_HEADER_SIZE..]).unwrap()
+    });
+}
+
+#[bench]
+fn bench_chachapoly_transport(b: &mut Bencher) {
+    bench_transport(b, CipherSuite::ChaChaPoly);
+}
+
+#[bench]
+fn bench_aesgcm_transport(b: &mut Bencher) {
+    bench_transport(b, CipherSuite::AESGCM);
+}
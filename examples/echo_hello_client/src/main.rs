@@ -7,6 +7,7 @@ extern crate rustc_serialize;
 extern crate x25519_dalek_ng;
 extern crate mix_link;
 
+use std::env;
 use std::net::TcpStream;
 //use rand::os::OsRng;
 //use rustc_serialize::hex::{FromHex, ToHex};
@@ -16,6 +17,7 @@ use x25519_dalek_ng::{PublicKey, StaticSecret};
 use mix_link::sync::{Session};
 use mix_link::messages::{SessionConfig, PeerAuthenticator, ClientAuthenticatorState};
 use mix_link::commands::{Command};
+use mix_link::keyfile::load_private_key;
 
 
 fn main() {
@@ -28,8 +30,19 @@ fn main() {
     return;
      */
 
-    let private_key_bytes = "7136a09854d112beb513dcd892af8789e277925386c44f7f85f29e98deb14eda".from_hex().unwrap();
-    let private_key = StaticSecret::from(*array_ref![private_key_bytes, 0, 32]);
+    // Real deployments should load their key from an encrypted key
+    // file written by mix_link::keyfile::save_private_key. Without one
+    // we fall back to the demo key the echo server is configured with.
+    let private_key = match env::args().nth(1) {
+        Some(key_file) => {
+            let passphrase = env::var("MIX_LINK_KEY_PASSPHRASE").expect("MIX_LINK_KEY_PASSPHRASE is not set");
+            load_private_key(key_file, passphrase.as_bytes()).unwrap()
+        },
+        None => {
+            let private_key_bytes = "7136a09854d112beb513dcd892af8789e277925386c44f7f85f29e98deb14eda".from_hex().unwrap();
+            StaticSecret::from(*array_ref![private_key_bytes, 0, 32])
+        },
+    };
     //println!("public_key: {}\n", private_key.public_key().to_vec().to_hex());
     // public key is c8de601616d781d8e26589cc78399541ed9a89ef1fa7013a3c930a5b4da10f06
 
@@ -43,12 +56,7 @@ fn main() {
     };
     let client_authenticator = PeerAuthenticator::Client(client_auth);
     
-    let client_config = SessionConfig {
-        authenticator: client_authenticator,
-        authentication_key: private_key,
-        peer_public_key: Some(server_public_key),
-        additional_data: vec![],
-    };
+    let client_config = SessionConfig::new(client_authenticator, private_key, Some(server_public_key), vec![]);
     let mut session = Session::new(client_config, true).unwrap();
     let stream = TcpStream::connect(server_addr.clone()).expect("connection failed");
 
@@ -0,0 +1,460 @@
+// cbor.rs - CBOR encoding of commands
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! CBOR encoding of commands, see RFC 8949.
+//!
+//! Each command is a map with text keys. The "type" key holds the
+//! command name, see Command::name, and the other keys are the
+//! command's field names, holding unsigned integers or byte strings.
+//! Decoders ignore keys they do not know, so fields may be added
+//! without a new protocol version. Sessions negotiating
+//! CBOR_PROTOCOL_VERSION use this encoding unless configured with
+//! another codec.
+
+use std::collections::HashMap;
+
+use x25519_dalek_ng::PublicKey;
+
+use super::codec::Codec;
+use super::commands::Command;
+use super::errors::CommandError;
+
+const MAJOR_UNSIGNED: u8 = 0;
+const MAJOR_BYTES: u8 = 2;
+const MAJOR_TEXT: u8 = 3;
+const MAJOR_ARRAY: u8 = 4;
+const MAJOR_MAP: u8 = 5;
+const MAJOR_TAG: u8 = 6;
+
+// Nesting limit for skipping unknown values.
+const MAX_DEPTH: usize = 16;
+
+#[derive(PartialEq, Debug)]
+enum Value<'a> {
+    Unsigned(u64),
+    Bytes(&'a [u8]),
+    Text(&'a str),
+    // Any other item, which only unknown keys may hold.
+    Other,
+}
+
+fn write_head(out: &mut Vec<u8>, major: u8, arg: u64) {
+    let major = major << 5;
+    if arg < 24 {
+        out.push(major | arg as u8);
+    } else if arg <= u8::max_value() as u64 {
+        out.push(major | 24);
+        out.push(arg as u8);
+    } else if arg <= u16::max_value() as u64 {
+        out.push(major | 25);
+        out.extend_from_slice(&(arg as u16).to_be_bytes());
+    } else if arg <= u32::max_value() as u64 {
+        out.push(major | 26);
+        out.extend_from_slice(&(arg as u32).to_be_bytes());
+    } else {
+        out.push(major | 27);
+        out.extend_from_slice(&arg.to_be_bytes());
+    }
+}
+
+fn write_value(out: &mut Vec<u8>, value: &Value) {
+    match *value {
+        Value::Unsigned(x) => write_head(out, MAJOR_UNSIGNED, x),
+        Value::Bytes(x) => {
+            write_head(out, MAJOR_BYTES, x.len() as u64);
+            out.extend_from_slice(x);
+        },
+        Value::Text(x) => {
+            write_head(out, MAJOR_TEXT, x.len() as u64);
+            out.extend_from_slice(x.as_bytes());
+        },
+        Value::Other => unreachable!(),
+    }
+}
+
+fn encode_map(name: &str, fields: &[(&str, Value)]) -> Vec<u8> {
+    let mut out = vec![];
+    write_head(&mut out, MAJOR_MAP, fields.len() as u64 + 1);
+    write_value(&mut out, &Value::Text("type"));
+    write_value(&mut out, &Value::Text(name));
+    for (key, value) in fields {
+        write_value(&mut out, &Value::Text(key));
+        write_value(&mut out, value);
+    }
+    out
+}
+
+struct Reader<'a> {
+    b: &'a [u8],
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, n: u64) -> Result<&'a [u8], CommandError> {
+        if n > self.b.len() as u64 {
+            return Err(CommandError::CborDecodeError);
+        }
+        let (head, rest) = self.b.split_at(n as usize);
+        self.b = rest;
+        Ok(head)
+    }
+
+    // Reads an item head, returning its major type and argument.
+    // Indefinite lengths are not supported.
+    fn head(&mut self) -> Result<(u8, u64), CommandError> {
+        let initial = self.take(1)?[0];
+        let arg = match initial & 0x1f {
+            x if x < 24 => x as u64,
+            24 => self.take(1)?[0] as u64,
+            25 => self.take(2)?.iter().fold(0u64, |acc, x| acc << 8 | *x as u64),
+            26 => self.take(4)?.iter().fold(0u64, |acc, x| acc << 8 | *x as u64),
+            27 => self.take(8)?.iter().fold(0u64, |acc, x| acc << 8 | *x as u64),
+            _ => return Err(CommandError::CborDecodeError),
+        };
+        Ok((initial >> 5, arg))
+    }
+
+    fn value(&mut self, depth: usize) -> Result<Value<'a>, CommandError> {
+        if depth > MAX_DEPTH {
+            return Err(CommandError::CborDecodeError);
+        }
+        let (major, arg) = self.head()?;
+        match major {
+            MAJOR_UNSIGNED => Ok(Value::Unsigned(arg)),
+            MAJOR_BYTES => Ok(Value::Bytes(self.take(arg)?)),
+            MAJOR_TEXT => match ::std::str::from_utf8(self.take(arg)?) {
+                Ok(x) => Ok(Value::Text(x)),
+                Err(_) => Err(CommandError::CborDecodeError),
+            },
+            MAJOR_ARRAY | MAJOR_MAP => {
+                let items = if major == MAJOR_MAP { arg.saturating_mul(2) } else { arg };
+                for _ in 0..items {
+                    self.value(depth + 1)?;
+                }
+                Ok(Value::Other)
+            },
+            MAJOR_TAG => {
+                self.value(depth + 1)?;
+                Ok(Value::Other)
+            },
+            // negative integers, floats and simple values
+            _ => Ok(Value::Other),
+        }
+    }
+}
+
+struct Fields<'a> {
+    fields: HashMap<&'a str, Value<'a>>,
+}
+
+impl<'a> Fields<'a> {
+    fn from_bytes(b: &'a [u8]) -> Result<Fields<'a>, CommandError> {
+        let mut reader = Reader{ b };
+        let (major, count) = reader.head()?;
+        if major != MAJOR_MAP {
+            return Err(CommandError::CborDecodeError);
+        }
+        let mut fields = HashMap::new();
+        for _ in 0..count {
+            let key = match reader.value(0)? {
+                Value::Text(x) => x,
+                _ => return Err(CommandError::CborDecodeError),
+            };
+            let value = reader.value(0)?;
+            if fields.insert(key, value).is_some() {
+                return Err(CommandError::CborDecodeError);
+            }
+        }
+        if !reader.b.is_empty() {
+            return Err(CommandError::CborDecodeError);
+        }
+        Ok(Fields{ fields })
+    }
+
+    fn get(&self, key: &str) -> Result<&Value<'a>, CommandError> {
+        match self.fields.get(key) {
+            Some(x) => Ok(x),
+            None => Err(CommandError::CborDecodeError),
+        }
+    }
+
+    fn text(&self, key: &str) -> Result<&'a str, CommandError> {
+        match *self.get(key)? {
+            Value::Text(x) => Ok(x),
+            _ => Err(CommandError::CborDecodeError),
+        }
+    }
+
+    fn unsigned(&self, key: &str, max: u64) -> Result<u64, CommandError> {
+        match *self.get(key)? {
+            Value::Unsigned(x) if x <= max => Ok(x),
+            _ => Err(CommandError::CborDecodeError),
+        }
+    }
+
+    fn u8(&self, key: &str) -> Result<u8, CommandError> {
+        Ok(self.unsigned(key, u8::max_value() as u64)? as u8)
+    }
+
+    fn u32(&self, key: &str) -> Result<u32, CommandError> {
+        Ok(self.unsigned(key, u32::max_value() as u64)? as u32)
+    }
+
+    fn u64(&self, key: &str) -> Result<u64, CommandError> {
+        self.unsigned(key, u64::max_value())
+    }
+
+    fn bytes(&self, key: &str) -> Result<&'a [u8], CommandError> {
+        match *self.get(key)? {
+            Value::Bytes(x) => Ok(x),
+            _ => Err(CommandError::CborDecodeError),
+        }
+    }
+
+    fn vec(&self, key: &str) -> Result<Vec<u8>, CommandError> {
+        Ok(self.bytes(key)?.to_vec())
+    }
+
+    fn array<T: Default + AsMut<[u8]>>(&self, key: &str) -> Result<T, CommandError> {
+        let bytes = self.bytes(key)?;
+        let mut out = T::default();
+        if out.as_mut().len() != bytes.len() {
+            return Err(CommandError::CborDecodeError);
+        }
+        out.as_mut().copy_from_slice(bytes);
+        Ok(out)
+    }
+}
+
+/// Encodes cmd as a CBOR map.
+pub fn to_cbor(cmd: &Command) -> Vec<u8> {
+    use self::Value::*;
+    let padding = match cmd {
+        Command::Padding{ size } => vec![0u8; *size as usize],
+        _ => vec![],
+    };
+    let fields = match cmd {
+        Command::NoOp{} | Command::CloseWrite{} | Command::Rekey{} | Command::GetVersion{} => vec![],
+        // Decoded as a NoOp, which ignores the field.
+        Command::Padding{..} => vec![("padding", Bytes(&padding))],
+        Command::GetConsensus{ epoch } => vec![("epoch", Unsigned(*epoch))],
+        Command::Consensus{ error_code, payload } => vec![("error_code", Unsigned(*error_code as u64)), ("payload", Bytes(payload))],
+        Command::PostDescriptor{ epoch, payload } => vec![("epoch", Unsigned(*epoch)), ("payload", Bytes(payload))],
+        Command::PostDescriptorStatus{ error_code } => vec![("error_code", Unsigned(*error_code as u64))],
+        Command::Vote{ epoch, public_key, payload } => vec![("epoch", Unsigned(*epoch)), ("public_key", Bytes(public_key.as_bytes())), ("payload", Bytes(payload))],
+        Command::VoteStatus{ error_code } => vec![("error_code", Unsigned(*error_code as u64))],
+        Command::Disconnect{ reason } => vec![("reason", Unsigned(*reason as u64))],
+        Command::ReauthChallenge{ nonce } => vec![("nonce", Bytes(nonce))],
+        Command::ReauthResponse{ nonce, additional_data } => vec![("nonce", Bytes(nonce)), ("additional_data", Bytes(additional_data))],
+        Command::LinkParameters{ max_packet_size, forward_payload_size } => vec![("max_packet_size", Unsigned(*max_packet_size as u64)), ("forward_payload_size", Unsigned(*forward_payload_size as u64))],
+        Command::Echo{ cookie } | Command::EchoReply{ cookie } => vec![("cookie", Bytes(cookie))],
+        Command::Error{ reason } => vec![("reason", Unsigned(*reason as u64))],
+        Command::Sequenced{ sequence, command } => vec![("sequence", Unsigned(*sequence)), ("command", Bytes(command))],
+        Command::Credit{ packets } => vec![("packets", Unsigned(*packets as u64))],
+        Command::Ping{ timestamp, cookie } | Command::Pong{ timestamp, cookie } => vec![("timestamp", Unsigned(*timestamp)), ("cookie", Bytes(cookie))],
+        Command::Version{ implementation, commands, max_message_size } => vec![("implementation", Bytes(implementation)), ("commands", Bytes(commands)), ("max_message_size", Unsigned(*max_message_size as u64))],
+        Command::AcceptCompression{ max_size } => vec![("max_size", Unsigned(*max_size as u64))],
+        Command::Compressed{ algorithm, uncompressed_size, payload } => vec![("algorithm", Unsigned(*algorithm as u64)), ("uncompressed_size", Unsigned(*uncompressed_size as u64)), ("payload", Bytes(payload))],
+        Command::StreamOpen{ stream_id } | Command::StreamClose{ stream_id } => vec![("stream_id", Unsigned(*stream_id as u64))],
+        Command::Traced{ trace_id, command } => vec![("trace_id", Bytes(trace_id)), ("command", Bytes(command))],
+        Command::DatagramKey{ key } => vec![("key", Bytes(key))],
+        Command::StreamWindow{ stream_id, increment } => vec![("stream_id", Unsigned(*stream_id as u64)), ("increment", Unsigned(*increment as u64))],
+        Command::StreamData{ stream_id, payload } => vec![("stream_id", Unsigned(*stream_id as u64)), ("payload", Bytes(payload))],
+        Command::Ack{ sequence } => vec![("sequence", Unsigned(*sequence))],
+        Command::Batch{ commands } => vec![("commands", Bytes(commands))],
+        Command::Fragment{ total_size, offset, payload } => vec![("total_size", Unsigned(*total_size as u64)), ("offset", Unsigned(*offset as u64)), ("payload", Bytes(payload))],
+        Command::SendPacket{ sphinx_packet } => vec![("sphinx_packet", Bytes(sphinx_packet))],
+        Command::Data{ payload } => vec![("payload", Bytes(payload))],
+        Command::RetrieveMessage{ sequence } => vec![("sequence", Unsigned(*sequence as u64))],
+        Command::MessageAck{ queue_size_hint, sequence, id, payload } => vec![("queue_size_hint", Unsigned(*queue_size_hint as u64)), ("sequence", Unsigned(*sequence as u64)), ("id", Bytes(id)), ("payload", Bytes(payload))],
+        Command::MessageMessage{ queue_size_hint, sequence, payload } => vec![("queue_size_hint", Unsigned(*queue_size_hint as u64)), ("sequence", Unsigned(*sequence as u64)), ("payload", Bytes(payload))],
+        Command::MessageEmpty{ sequence } => vec![("sequence", Unsigned(*sequence as u64))],
+        Command::Application{ id, payload } => vec![("id", Unsigned(*id as u64)), ("payload", Bytes(payload))],
+    };
+    encode_map(cmd.name(), &fields)
+}
+
+/// Decodes a command encoded with to_cbor.
+pub fn from_cbor(b: &[u8]) -> Result<Command, CommandError> {
+    let f = Fields::from_bytes(b)?;
+    let cmd = match f.text("type")? {
+        "NoOp" => Command::NoOp{},
+        "CloseWrite" => Command::CloseWrite{},
+        "Rekey" => Command::Rekey{},
+        "GetConsensus" => Command::GetConsensus{ epoch: f.u64("epoch")? },
+        "Consensus" => Command::Consensus{ error_code: f.u8("error_code")?, payload: f.vec("payload")? },
+        "PostDescriptor" => Command::PostDescriptor{ epoch: f.u64("epoch")?, payload: f.vec("payload")? },
+        "PostDescriptorStatus" => Command::PostDescriptorStatus{ error_code: f.u8("error_code")? },
+        "Vote" => Command::Vote{
+            epoch: f.u64("epoch")?,
+            public_key: PublicKey::from(f.array::<[u8; 32]>("public_key")?),
+            payload: f.vec("payload")?,
+        },
+        "VoteStatus" => Command::VoteStatus{ error_code: f.u8("error_code")? },
+        "Disconnect" => Command::Disconnect{ reason: f.u8("reason")? },
+        "ReauthChallenge" => Command::ReauthChallenge{ nonce: f.array("nonce")? },
+        "ReauthResponse" => Command::ReauthResponse{ nonce: f.array("nonce")?, additional_data: f.vec("additional_data")? },
+        "LinkParameters" => Command::LinkParameters{
+            max_packet_size: f.u32("max_packet_size")?,
+            forward_payload_size: f.u32("forward_payload_size")?,
+        },
+        "Echo" => Command::Echo{ cookie: f.array("cookie")? },
+        "EchoReply" => Command::EchoReply{ cookie: f.array("cookie")? },
+        "Error" => Command::Error{ reason: f.u8("reason")? },
+        "Sequenced" => Command::Sequenced{ sequence: f.u64("sequence")?, command: f.vec("command")? },
+        "Credit" => Command::Credit{ packets: f.u32("packets")? },
+        "Ping" => Command::Ping{ timestamp: f.u64("timestamp")?, cookie: f.array("cookie")? },
+        "Pong" => Command::Pong{ timestamp: f.u64("timestamp")?, cookie: f.array("cookie")? },
+        "GetVersion" => Command::GetVersion{},
+        "Version" => Command::Version{
+            implementation: f.vec("implementation")?,
+            commands: f.vec("commands")?,
+            max_message_size: f.u32("max_message_size")?,
+        },
+        "AcceptCompression" => Command::AcceptCompression{ max_size: f.u32("max_size")? },
+        "Compressed" => Command::Compressed{
+            algorithm: f.u8("algorithm")?,
+            uncompressed_size: f.u32("uncompressed_size")?,
+            payload: f.vec("payload")?,
+        },
+        "StreamOpen" => Command::StreamOpen{ stream_id: f.u32("stream_id")? },
+        "StreamData" => Command::StreamData{ stream_id: f.u32("stream_id")?, payload: f.vec("payload")? },
+        "StreamClose" => Command::StreamClose{ stream_id: f.u32("stream_id")? },
+        "Traced" => Command::Traced{ trace_id: f.array("trace_id")?, command: f.vec("command")? },
+        "DatagramKey" => Command::DatagramKey{ key: f.array("key")? },
+        "StreamWindow" => Command::StreamWindow{ stream_id: f.u32("stream_id")?, increment: f.u32("increment")? },
+        "Ack" => Command::Ack{ sequence: f.u64("sequence")? },
+        "Batch" => Command::Batch{ commands: f.vec("commands")? },
+        "Fragment" => Command::Fragment{ total_size: f.u32("total_size")?, offset: f.u32("offset")?, payload: f.vec("payload")? },
+        "SendPacket" => Command::SendPacket{ sphinx_packet: f.vec("sphinx_packet")? },
+        "Data" => Command::Data{ payload: f.vec("payload")? },
+        "RetrieveMessage" => Command::RetrieveMessage{ sequence: f.u32("sequence")? },
+        "MessageAck" => Command::MessageAck{
+            queue_size_hint: f.u8("queue_size_hint")?,
+            sequence: f.u32("sequence")?,
+            id: f.array("id")?,
+            payload: f.vec("payload")?,
+        },
+        "MessageMessage" => Command::MessageMessage{
+            queue_size_hint: f.u8("queue_size_hint")?,
+            sequence: f.u32("sequence")?,
+            payload: f.vec("payload")?,
+        },
+        "MessageEmpty" => Command::MessageEmpty{ sequence: f.u32("sequence")? },
+        "Application" => Command::Application{ id: f.u8("id")?, payload: f.vec("payload")? },
+        _ => return Err(CommandError::UnknownCommand),
+    };
+    Ok(cmd)
+}
+
+/// The CBOR command encoding.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct CborCodec;
+
+impl Codec for CborCodec {
+    fn encode(&self, cmd: &Command) -> Vec<u8> {
+        to_cbor(cmd)
+    }
+
+    fn decode(&self, b: &[u8]) -> Result<Command, CommandError> {
+        from_cbor(b)
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use super::*;
+    use self::rand_core::OsRng;
+
+    #[test]
+    fn cbor_test() {
+        let commands = vec![
+            Command::NoOp{},
+            Command::GetConsensus{ epoch: u64::max_value() },
+            Command::Consensus{ error_code: 1, payload: vec![1u8; 300] },
+            Command::Vote{ epoch: 7, public_key: PublicKey::from(&StaticSecret::new(OsRng)), payload: vec![2u8; 70000] },
+            Command::Disconnect{ reason: 2 },
+            Command::ReauthResponse{ nonce: [3u8; 32], additional_data: vec![] },
+            Command::LinkParameters{ max_packet_size: 65536, forward_payload_size: 23 },
+            Command::EchoReply{ cookie: [4u8; 8] },
+            Command::SendPacket{ sphinx_packet: vec![5u8; 24] },
+            Command::MessageAck{ queue_size_hint: 9, sequence: 10, id: [6u8; 16], payload: vec![7u8; 10] },
+            Command::Application{ id: 200, payload: vec![8u8] },
+            Command::Pong{ timestamp: u64::max_value(), cookie: [9u8; 8] },
+            Command::Version{ implementation: b"mix_link".to_vec(), commands: vec![0, 1, 200], max_message_size: 70000 },
+            Command::Compressed{ algorithm: 1, uncompressed_size: 1000, payload: vec![10u8; 100] },
+            Command::StreamData{ stream_id: 3, payload: vec![11u8; 10] },
+            Command::Traced{ trace_id: [12u8; 16], command: vec![0u8; 10] },
+            Command::DatagramKey{ key: [13u8; 32] },
+            Command::StreamWindow{ stream_id: 4, increment: 1 << 18 },
+        ];
+        for cmd in commands {
+            assert_eq!(from_cbor(&to_cbor(&cmd)).unwrap(), cmd);
+        }
+
+        // {"type": "NoOp"}
+        let no_op = [0xa1, 0x64, b't', b'y', b'p', b'e', 0x64, b'N', b'o', b'O', b'p'];
+        assert_eq!(to_cbor(&Command::NoOp{}), no_op.to_vec());
+
+        // unknown keys are ignored, whatever they hold
+        let mut raw = vec![0xa3];
+        raw.extend_from_slice(&to_cbor(&Command::RetrieveMessage{ sequence: 5 })[1..]);
+        raw.extend_from_slice(&[0x63, b'n', b'e', b'w', 0x82, 0x20, 0xc1, 0x01]);
+        assert_eq!(from_cbor(&raw).unwrap(), Command::RetrieveMessage{ sequence: 5 });
+    }
+
+    #[test]
+    fn cbor_invalid_test() {
+        let raw = to_cbor(&Command::RetrieveMessage{ sequence: 5 });
+        // trailing bytes
+        let mut trailing = raw.clone();
+        trailing.push(0);
+        assert!(from_cbor(&trailing).is_err());
+        // truncated
+        assert!(from_cbor(&raw[..raw.len() - 1]).is_err());
+        // out of range field
+        assert!(from_cbor(&encode_map("Disconnect", &[("reason", Value::Unsigned(256))])).is_err());
+        assert!(from_cbor(&encode_map("Disconnect", &[("reason", Value::Bytes(&[1]))])).is_err());
+        // missing field
+        assert!(from_cbor(&encode_map("RetrieveMessage", &[])).is_err());
+        // unknown command and not a map
+        match from_cbor(&encode_map("Unknown", &[])) {
+            Err(CommandError::UnknownCommand) => {},
+            _ => panic!("expected an unknown command"),
+        }
+        assert!(from_cbor(&[0x80]).is_err());
+        // indefinite length map
+        assert!(from_cbor(&[0xbf, 0xff]).is_err());
+        // duplicate key
+        assert!(from_cbor(&[0xa2, 0x64, b't', b'y', b'p', b'e', 0x64, b'N', b'o', b'O', b'p',
+                            0x64, b't', b'y', b'p', b'e', 0x64, b'N', b'o', b'O', b'p']).is_err());
+        // deeply nested unknown value
+        let mut nested = vec![0xa2];
+        nested.extend_from_slice(&no_op_entry());
+        nested.extend_from_slice(&[0x61, b'x']);
+        nested.extend_from_slice(&[0x81; 64]);
+        nested.push(0x00);
+        assert!(from_cbor(&nested).is_err());
+    }
+
+    fn no_op_entry() -> Vec<u8> {
+        to_cbor(&Command::NoOp{})[1..].to_vec()
+    }
+}
@@ -0,0 +1,80 @@
+// codec.rs - command encodings
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Command encodings. A session encodes each command it sends with
+//! its codec before framing and encryption, and decodes each frame it
+//! receives with it, so an alternative encoding changes nothing else
+//! about the link. Both peers must use the same codec, which by
+//! default is chosen by the negotiated protocol version.
+
+use std::sync::Arc;
+
+use super::cbor::CborCodec;
+use super::commands::{Command, CommandRef};
+use super::constants::CBOR_PROTOCOL_VERSION;
+use super::errors::CommandError;
+
+/// Encodes commands to and decodes them from frame plaintexts.
+pub trait Codec: Send + Sync {
+    fn encode(&self, cmd: &Command) -> Vec<u8>;
+
+    fn decode(&self, b: &[u8]) -> Result<Command, CommandError>;
+
+    /// Decodes a command which may borrow from b, see
+    /// Session::recv_command_into. By default commands are owned.
+    fn decode_ref<'a>(&self, b: &'a [u8]) -> Result<CommandRef<'a>, CommandError> {
+        self.decode(b).map(CommandRef::Owned)
+    }
+
+    /// Encodes a command which may borrow its payload, see
+    /// Session::send_packet. By default the payload is first copied
+    /// into an owned command.
+    fn encode_ref(&self, cmd: &CommandRef) -> Vec<u8> {
+        self.encode(&cmd.to_command())
+    }
+}
+
+/// The Katzenpost command encoding, used unless a session is
+/// configured with another codec.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct DefaultCodec;
+
+impl Codec for DefaultCodec {
+    fn encode(&self, cmd: &Command) -> Vec<u8> {
+        cmd.to_vec()
+    }
+
+    fn decode(&self, b: &[u8]) -> Result<Command, CommandError> {
+        Command::from_bytes(b)
+    }
+
+    fn decode_ref<'a>(&self, b: &'a [u8]) -> Result<CommandRef<'a>, CommandError> {
+        CommandRef::from_bytes(b)
+    }
+
+    fn encode_ref(&self, cmd: &CommandRef) -> Vec<u8> {
+        cmd.to_vec()
+    }
+}
+
+/// Returns the codec used by default with a protocol version:
+/// CborCodec for CBOR_PROTOCOL_VERSION and DefaultCodec otherwise.
+pub fn codec_for_version(version: u8) -> Arc<dyn Codec> {
+    match version {
+        CBOR_PROTOCOL_VERSION => Arc::new(CborCodec),
+        _ => Arc::new(DefaultCodec),
+    }
+}
@@ -26,7 +26,7 @@ use sphinxcrypto::constants::{FORWARD_PAYLOAD_SIZE,
                               USER_FORWARD_PAYLOAD_SIZE};
 
 use super::errors::CommandError;
-use super::constants::KEY_SIZE;
+use super::constants::{KEY_SIZE, MAC_SIZE, NOISE_MESSAGE_MAX_SIZE};
 
 const CMD_OVERHEAD: usize = 1 + 1 + 4;
 
@@ -47,6 +47,46 @@ const PUBLIC_KEY_SIZE: usize = KEY_SIZE;
 const VOTE_OVERHEAD: usize = 8 + PUBLIC_KEY_SIZE;
 const VOTE_STATUS_SIZE: usize = 1;
 
+/// The size of the nonce in reauthentication commands.
+pub const REAUTH_NONCE_SIZE: usize = 32;
+
+const LINK_PARAMETERS_SIZE: usize = 4 + 4;
+
+pub const ECHO_COOKIE_SIZE: usize = 8;
+
+const ERROR_SIZE: usize = 1;
+const FRAGMENT_BASE_SIZE: usize = 4 + 4;
+
+/// The size of the length preceding each command in a Batch.
+pub const BATCH_ENTRY_OVERHEAD: usize = 4;
+
+const SEQUENCED_BASE_SIZE: usize = 8;
+
+/// The size of the trace ID of a Traced command.
+pub const TRACE_ID_SIZE: usize = 16;
+
+/// The size of the key of a DatagramKey command.
+pub const DATAGRAM_KEY_SIZE: usize = 32;
+const ACK_SIZE: usize = 8;
+const CREDIT_SIZE: usize = 4;
+const PING_SIZE: usize = 8 + ECHO_COOKIE_SIZE;
+const VERSION_BASE_SIZE: usize = 4 + 1;
+const ACCEPT_COMPRESSION_SIZE: usize = 4;
+const COMPRESSED_BASE_SIZE: usize = 1 + 4;
+
+/// The algorithm of Compressed commands compressed with zstd.
+pub const COMPRESSION_ZSTD: u8 = 1;
+const DISCONNECT_SIZE: usize = 1;
+
+/// The largest Data payload that fits in a single transport message.
+pub const MAX_DATA_SIZE: usize = NOISE_MESSAGE_MAX_SIZE - MAC_SIZE - CMD_OVERHEAD;
+
+const STREAM_ID_SIZE: usize = 4;
+const STREAM_WINDOW_SIZE: usize = STREAM_ID_SIZE + 4;
+
+/// The largest StreamData payload that fits in a single transport message.
+pub const MAX_STREAM_DATA_SIZE: usize = MAX_DATA_SIZE - STREAM_ID_SIZE;
+
 const MESSAGE_TYPE_MESSAGE: u8 = 0;
 const MESSAGE_TYPE_ACK: u8 = 1;
 const MESSAGE_TYPE_EMPTY: u8 = 2;
@@ -55,6 +95,19 @@ const MESSAGE_TYPE_EMPTY: u8 = 2;
 const NO_OP: u8 = 0;
 const DISCONNECT: u8 = 1;
 const SEND_PACKET: u8 = 2;
+const REKEY: u8 = 3;
+const REAUTH_CHALLENGE: u8 = 4;
+const REAUTH_RESPONSE: u8 = 5;
+const LINK_PARAMETERS: u8 = 6;
+const DATA: u8 = 7;
+const CLOSE_WRITE: u8 = 8;
+const ECHO: u8 = 9;
+const ECHO_REPLY: u8 = 10;
+const ERROR: u8 = 11;
+const FRAGMENT: u8 = 12;
+const BATCH: u8 = 13;
+const SEQUENCED: u8 = 14;
+const ACK: u8 = 15;
 
 // Implementation defined commands.
 const RETRIEVE_MESSAGE: u8 = 16;
@@ -66,6 +119,41 @@ const POST_DESCRIPTOR_STATUS: u8 = 21;
 const VOTE: u8 = 22;
 const VOTE_STATUS: u8 = 23;
 
+// Flow control commands.
+const CREDIT: u8 = 64;
+
+// Liveness commands.
+const PING: u8 = 65;
+const PONG: u8 = 66;
+
+// Introspection commands.
+const GET_VERSION: u8 = 67;
+const VERSION: u8 = 68;
+
+// Compression commands.
+const ACCEPT_COMPRESSION: u8 = 69;
+const COMPRESSED: u8 = 70;
+
+// Multiplexing commands.
+const STREAM_OPEN: u8 = 71;
+const STREAM_DATA: u8 = 72;
+const STREAM_CLOSE: u8 = 73;
+
+// Debugging commands.
+const TRACED: u8 = 74;
+
+// Datagram mode commands.
+const DATAGRAM_KEY: u8 = 75;
+
+// Multiplexing flow control commands.
+const STREAM_WINDOW: u8 = 76;
+
+/// Command IDs from here up are left to applications, see the
+/// registry module. IDs 24 to 63 are left to commands Katzenpost may
+/// add after VOTE_STATUS, and link commands added from CREDIT on take
+/// IDs from 64 below this.
+pub const MIN_APPLICATION_COMMAND_ID: u8 = 128;
+
 // CONSENSUS_OK signifies that the GetConsensus request has completed
 // successfully.
 pub const CONSENSUS_OK: u8 = 0;
@@ -118,6 +206,34 @@ pub const VOTE_MALFORMED: u8 = 5;
 // VOTE_ALREADY_RECEIVED signifies that the vote from that peer was already received.
 pub const VOTE_ALREADY_RECEIVED: u8 = 6;
 
+// DISCONNECT_NORMAL signifies an ordinary close. It is sent without a
+// payload, as Katzenpost does; Katzenpost has no other reasons.
+pub const DISCONNECT_NORMAL: u8 = 0;
+
+// DISCONNECT_SHUTDOWN signifies that the sender is shutting down or
+// restarting.
+pub const DISCONNECT_SHUTDOWN: u8 = 1;
+
+// DISCONNECT_IDLE_TIMEOUT signifies that the session was idle for too
+// long.
+pub const DISCONNECT_IDLE_TIMEOUT: u8 = 2;
+
+// ERROR_PROTOCOL_VIOLATION signifies that the peer sent something the
+// protocol does not allow.
+pub const ERROR_PROTOCOL_VIOLATION: u8 = 0;
+
+// ERROR_UNSUPPORTED_COMMAND signifies that the peer sent a command the
+// sender does not implement.
+pub const ERROR_UNSUPPORTED_COMMAND: u8 = 1;
+
+// ERROR_AUTH_EXPIRED signifies that the peer's credentials are no
+// longer accepted, for example after a PKI update.
+pub const ERROR_AUTH_EXPIRED: u8 = 2;
+
+// ERROR_OVERLOADED signifies that the sender is shedding load and the
+// peer should retry later, possibly elsewhere.
+pub const ERROR_OVERLOADED: u8 = 3;
+
 
 
 #[derive(Clone)]
@@ -125,6 +241,13 @@ pub const VOTE_ALREADY_RECEIVED: u8 = 6;
 #[derive(Debug)]
 pub enum Command {
     NoOp {},
+    /// Padding is a NoOp whose encoding is padded with size zero
+    /// bytes, so that traffic shaping can send frames of an exact
+    /// size, see Session::padding_for_frame. The peer receives it as
+    /// a NoOp, and it is named and counted as one.
+    Padding {
+        size: u32,
+    },
     GetConsensus {
         epoch: u64,
     },
@@ -147,13 +270,164 @@ pub enum Command {
     VoteStatus {
         error_code: u8,
     },
-    Disconnect {},
+    /// Disconnect tells the receiver that the sender is closing the
+    /// session, see the DISCONNECT_* reason codes.
+    Disconnect {
+        reason: u8,
+    },
+    /// CloseWrite tells the receiver that the sender will send no
+    /// more commands but still receives.
+    CloseWrite {},
+    /// Rekey tells the receiver that the sender has rekeyed its
+    /// outgoing cipher state after sending this command.
+    Rekey {},
+    /// ReauthChallenge asks the peer to answer with a ReauthResponse
+    /// echoing the nonce along with its current additional data.
+    ReauthChallenge {
+        nonce: [u8; REAUTH_NONCE_SIZE],
+    },
+    ReauthResponse {
+        nonce: [u8; REAUTH_NONCE_SIZE],
+        additional_data: Vec<u8>,
+    },
+    /// LinkParameters advertises the sender's Sphinx packet geometry.
+    LinkParameters {
+        max_packet_size: u32,
+        forward_payload_size: u32,
+    },
+    /// Echo asks the peer to answer with an EchoReply carrying the
+    /// same cookie, for measuring the round trip time.
+    Echo {
+        cookie: [u8; ECHO_COOKIE_SIZE],
+    },
+    EchoReply {
+        cookie: [u8; ECHO_COOKIE_SIZE],
+    },
+    /// Error tells the receiver why the sender is about to close the
+    /// session, see the ERROR_* reason codes.
+    Error {
+        reason: u8,
+    },
+    /// Fragment carries the part of a command's encoding starting at
+    /// offset, for commands too large for one frame. Sessions split
+    /// and reassemble such commands themselves, sending the fragments
+    /// of a command back to back.
+    Fragment {
+        total_size: u32,
+        offset: u32,
+        payload: Vec<u8>,
+    },
+    /// Batch carries several commands in one frame, each encoded and
+    /// preceded by its length as a big endian u32, see
+    /// push_batch_entry. Sessions send it from send_commands and split
+    /// it back out.
+    Batch {
+        commands: Vec<u8>,
+    },
+    /// Sequenced carries an encoded command numbered by the sender,
+    /// see Session::send_sequenced. The receiving session answers with
+    /// an Ack once it has delivered the command.
+    Sequenced {
+        sequence: u64,
+        command: Vec<u8>,
+    },
+    /// Ack tells the receiver that the sender has delivered every
+    /// Sequenced command up to and including sequence.
+    Ack {
+        sequence: u64,
+    },
+    /// Credit grants the receiver leave to send this many more
+    /// SendPacket commands, see SessionConfig::flow_control.
+    Credit {
+        packets: u32,
+    },
+    /// Ping asks the peer to answer with a Pong carrying the same
+    /// timestamp and cookie, see Session::ping. The timestamp is the
+    /// sender's time in microseconds since the Unix epoch.
+    Ping {
+        timestamp: u64,
+        cookie: [u8; ECHO_COOKIE_SIZE],
+    },
+    Pong {
+        timestamp: u64,
+        cookie: [u8; ECHO_COOKIE_SIZE],
+    },
+    /// GetVersion asks the peer to answer with a Version command, see
+    /// Session::peer_version.
+    GetVersion {},
+    /// Version reports the sender's implementation name and version,
+    /// at most 255 bytes of UTF-8, the IDs of the commands it
+    /// supports, including registered application commands, and the
+    /// largest command it accepts.
+    Version {
+        implementation: Vec<u8>,
+        commands: Vec<u8>,
+        max_message_size: u32,
+    },
+    /// AcceptCompression tells the receiver that the sender accepts
+    /// Compressed commands decompressing to at most max_size bytes,
+    /// see SessionConfig::compression_threshold.
+    AcceptCompression {
+        max_size: u32,
+    },
+    /// Compressed carries the encoding of another command compressed
+    /// with algorithm, which decompresses to uncompressed_size bytes.
+    Compressed {
+        algorithm: u8,
+        uncompressed_size: u32,
+        payload: Vec<u8>,
+    },
+    /// StreamOpen, StreamData and StreamClose carry the byte streams
+    /// of the mux module. StreamClose ends the sender's half of the
+    /// stream.
+    StreamOpen {
+        stream_id: u32,
+    },
+    StreamData {
+        stream_id: u32,
+        payload: Vec<u8>,
+    },
+    StreamClose {
+        stream_id: u32,
+    },
+    /// StreamWindow lets the peer send increment more bytes of
+    /// StreamData on the stream.
+    StreamWindow {
+        stream_id: u32,
+        increment: u32,
+    },
+    /// Traced carries an encoded command together with an opaque
+    /// trace ID chosen by the sender, see Session::send_traced, so
+    /// that debugging tools can follow an exchange across links.
+    Traced {
+        trace_id: [u8; TRACE_ID_SIZE],
+        command: Vec<u8>,
+    },
+    /// DatagramKey carries the key its sender encrypts datagrams with,
+    /// see the datagram module.
+    DatagramKey {
+        key: [u8; DATAGRAM_KEY_SIZE],
+    },
     SendPacket {
         sphinx_packet: Vec<u8>,
     },
+    /// Data carries opaque application bytes, see the stream module.
+    Data {
+        payload: Vec<u8>,
+    },
+    /// RetrieveMessage asks a provider for the next message queued for
+    /// the client. The provider answers with a MessageAck,
+    /// MessageMessage or MessageEmpty carrying the same sequence. A
+    /// request with the next sequence acknowledges the previous
+    /// answer, which the provider then removes from the queue, while
+    /// repeating a sequence retrieves the same answer again.
     RetrieveMessage {
         sequence: u32,
     },
+    /// MessageAck carries a SURB reply to the client, identified by
+    /// the SURB id. The queue_size_hint of this and MessageMessage is
+    /// the number of messages still queued after this one, saturating
+    /// at 255.
     MessageAck {
         queue_size_hint: u8,
         sequence: u32,
@@ -165,35 +439,36 @@ pub enum Command {
         sequence: u32,
         payload: Vec<u8>,
     },
+    /// MessageEmpty tells the client that nothing is queued.
     MessageEmpty {
         sequence: u32,
     },
+    /// An application defined command, see the registry module. The
+    /// id must be at least MIN_APPLICATION_COMMAND_ID.
+    Application {
+        id: u8,
+        payload: Vec<u8>,
+    },
 }
 
 impl Command {
     pub fn from_bytes(b: &[u8]) -> Result<Command, CommandError> {
-        if b.len() < CMD_OVERHEAD {
-            return Err(CommandError::TooSmallError);
-        }
-        let cmd_id = b[0];
-        if b[1] != 0 {
-            return Err(CommandError::InvalidReservedByte);
-        }
-        let cmd_len = BigEndian::read_u32(&b[2..6]);
-        let _cmd = &b[CMD_OVERHEAD..];
-        if _cmd.len() < cmd_len as usize {
-            let _padding = _cmd[cmd_len as usize..].to_vec();
-            let _zeros = vec![0u8; cmd_len as usize];
-            if _zeros.ct_eq(&_padding[..]).unwrap_u8() == 0 {
-                return Err(CommandError::MessageDecodeError);
-            }
+        let (cmd_id, cmd_len, _cmd) = split_command(b)?;
+        let cmd_len = cmd_len as u32;
+        if (cmd_id > VOTE_STATUS && cmd_id < CREDIT) || (cmd_id > STREAM_WINDOW && cmd_id < MIN_APPLICATION_COMMAND_ID) {
+            return Err(CommandError::UnknownCommand);
         }
 
         // handle commands with no payload
         if cmd_len == 0 {
             match cmd_id {
                 NO_OP => return Ok(Command::NoOp{}),
-                DISCONNECT => return Ok(Command::Disconnect{}),
+                DISCONNECT => return Ok(Command::Disconnect{ reason: DISCONNECT_NORMAL }),
+                REKEY => return Ok(Command::Rekey{}),
+                CLOSE_WRITE => return Ok(Command::CloseWrite{}),
+                GET_VERSION => return Ok(Command::GetVersion{}),
+                DATA => return Ok(Command::Data{ payload: vec![] }),
+                id if id >= MIN_APPLICATION_COMMAND_ID => return Ok(Command::Application{ id, payload: vec![] }),
                 SEND_PACKET => return Err(CommandError::MessageDecodeError),
                 POST_DESCRIPTOR => return Err(CommandError::MessageDecodeError),
                 _ => return Err(CommandError::MessageDecodeError),
@@ -201,19 +476,125 @@ impl Command {
         }
 
         match cmd_id {
-            SEND_PACKET => Ok(send_packet_from_bytes(_cmd).unwrap()),
-            RETRIEVE_MESSAGE => Ok(retrieve_message_from_bytes(_cmd).unwrap()),
-            MESSAGE => Ok(message_from_bytes(_cmd).unwrap()),
-            GET_CONSENSUS => Ok(get_consensus_from_bytes(_cmd).unwrap()),
-            CONSENSUS => Ok(consensus_from_bytes(_cmd).unwrap()),
-            POST_DESCRIPTOR => Ok(post_descriptor_from_bytes(_cmd).unwrap()),
-            POST_DESCRIPTOR_STATUS => Ok(post_descriptor_status_from_bytes(_cmd).unwrap()),
-            VOTE => Ok(vote_from_bytes(_cmd).unwrap()),
-            VOTE_STATUS => Ok(vote_status_from_bytes(_cmd).unwrap()),
+            SEND_PACKET => send_packet_from_bytes(&_cmd[..cmd_len as usize]),
+            RETRIEVE_MESSAGE => retrieve_message_from_bytes(&_cmd[..cmd_len as usize]),
+            MESSAGE => message_from_bytes(&_cmd[..cmd_len as usize]),
+            GET_CONSENSUS => get_consensus_from_bytes(&_cmd[..cmd_len as usize]),
+            CONSENSUS => consensus_from_bytes(&_cmd[..cmd_len as usize]),
+            POST_DESCRIPTOR => post_descriptor_from_bytes(&_cmd[..cmd_len as usize]),
+            POST_DESCRIPTOR_STATUS => post_descriptor_status_from_bytes(&_cmd[..cmd_len as usize]),
+            VOTE => vote_from_bytes(&_cmd[..cmd_len as usize]),
+            VOTE_STATUS => vote_status_from_bytes(&_cmd[..cmd_len as usize]),
+            REAUTH_CHALLENGE => reauth_challenge_from_bytes(&_cmd[..cmd_len as usize]),
+            REAUTH_RESPONSE => reauth_response_from_bytes(&_cmd[..cmd_len as usize]),
+            LINK_PARAMETERS => link_parameters_from_bytes(&_cmd[..cmd_len as usize]),
+            ECHO => Ok(Command::Echo{ cookie: echo_cookie_from_bytes(&_cmd[..cmd_len as usize])? }),
+            ECHO_REPLY => Ok(Command::EchoReply{ cookie: echo_cookie_from_bytes(&_cmd[..cmd_len as usize])? }),
+            ERROR => error_from_bytes(&_cmd[..cmd_len as usize]),
+            FRAGMENT => fragment_from_bytes(&_cmd[..cmd_len as usize]),
+            BATCH => Ok(Command::Batch{ commands: _cmd[..cmd_len as usize].to_vec() }),
+            SEQUENCED => sequenced_from_bytes(&_cmd[..cmd_len as usize]),
+            ACK => ack_from_bytes(&_cmd[..cmd_len as usize]),
+            CREDIT => credit_from_bytes(&_cmd[..cmd_len as usize]),
+            PING | PONG => ping_from_bytes(cmd_id, &_cmd[..cmd_len as usize]),
+            VERSION => version_from_bytes(&_cmd[..cmd_len as usize]),
+            ACCEPT_COMPRESSION => accept_compression_from_bytes(&_cmd[..cmd_len as usize]),
+            COMPRESSED => compressed_from_bytes(&_cmd[..cmd_len as usize]),
+            STREAM_OPEN | STREAM_DATA | STREAM_CLOSE => stream_from_bytes(cmd_id, &_cmd[..cmd_len as usize]),
+            TRACED => traced_from_bytes(&_cmd[..cmd_len as usize]),
+            DATAGRAM_KEY => datagram_key_from_bytes(&_cmd[..cmd_len as usize]),
+            STREAM_WINDOW => stream_window_from_bytes(&_cmd[..cmd_len as usize]),
+            DISCONNECT => disconnect_from_bytes(&_cmd[..cmd_len as usize]),
+            DATA => Ok(Command::Data{ payload: _cmd[..cmd_len as usize].to_vec() }),
+            id if id >= MIN_APPLICATION_COMMAND_ID => Ok(Command::Application{ id, payload: _cmd[..cmd_len as usize].to_vec() }),
             _ => Err(CommandError::MessageDecodeError),
         }
     }
 
+    /// Returns true if the command may be sent compressed. Only the
+    /// bulky PKI documents are: Sphinx packets are fixed size and
+    /// incompressible, and compressing secrets along with data an
+    /// attacker chooses leaks them through the compressed size.
+    pub fn is_compressible(&self) -> bool {
+        match self {
+            Command::Consensus{..} | Command::PostDescriptor{..} | Command::Vote{..} => true,
+            _ => false,
+        }
+    }
+
+    /// Returns true if Katzenpost has the command, so that sessions of
+    /// PROTOCOL_VERSION may send it. Its Disconnect carries no reason.
+    pub fn is_katzenpost(&self) -> bool {
+        match self {
+            Command::NoOp{} | Command::Padding{..} | Command::SendPacket{..} => true,
+            Command::Disconnect{ reason } => *reason == DISCONNECT_NORMAL,
+            Command::RetrieveMessage{..} | Command::MessageAck{..} | Command::MessageMessage{..} |
+            Command::MessageEmpty{..} => true,
+            Command::GetConsensus{..} | Command::Consensus{..} | Command::PostDescriptor{..} |
+            Command::PostDescriptorStatus{..} | Command::Vote{..} | Command::VoteStatus{..} => true,
+            _ => false,
+        }
+    }
+
+    /// Returns true if the command may safely be processed more than
+    /// once, such as when a client resends it after a failed connection.
+    pub fn is_idempotent(&self) -> bool {
+        match self {
+            Command::NoOp{} | Command::Padding{..} => true,
+            Command::GetConsensus{..} => true,
+            Command::RetrieveMessage{..} => true,
+            // Mixes drop replayed Sphinx packets.
+            Command::SendPacket{..} => true,
+            _ => false,
+        }
+    }
+
+    /// Returns the name of the command's type.
+    pub fn name(&self) -> &'static str {
+        match self {
+            Command::NoOp{} | Command::Padding{..} => "NoOp",
+            Command::GetConsensus{..} => "GetConsensus",
+            Command::Consensus{..} => "Consensus",
+            Command::PostDescriptor{..} => "PostDescriptor",
+            Command::PostDescriptorStatus{..} => "PostDescriptorStatus",
+            Command::Vote{..} => "Vote",
+            Command::VoteStatus{..} => "VoteStatus",
+            Command::Disconnect{..} => "Disconnect",
+            Command::CloseWrite{} => "CloseWrite",
+            Command::Rekey{} => "Rekey",
+            Command::ReauthChallenge{..} => "ReauthChallenge",
+            Command::ReauthResponse{..} => "ReauthResponse",
+            Command::LinkParameters{..} => "LinkParameters",
+            Command::Echo{..} => "Echo",
+            Command::EchoReply{..} => "EchoReply",
+            Command::Error{..} => "Error",
+            Command::Fragment{..} => "Fragment",
+            Command::Batch{..} => "Batch",
+            Command::Sequenced{..} => "Sequenced",
+            Command::Ack{..} => "Ack",
+            Command::Credit{..} => "Credit",
+            Command::Ping{..} => "Ping",
+            Command::Pong{..} => "Pong",
+            Command::GetVersion{} => "GetVersion",
+            Command::Version{..} => "Version",
+            Command::AcceptCompression{..} => "AcceptCompression",
+            Command::Compressed{..} => "Compressed",
+            Command::StreamOpen{..} => "StreamOpen",
+            Command::StreamData{..} => "StreamData",
+            Command::StreamClose{..} => "StreamClose",
+            Command::StreamWindow{..} => "StreamWindow",
+            Command::Traced{..} => "Traced",
+            Command::DatagramKey{..} => "DatagramKey",
+            Command::SendPacket{..} => "SendPacket",
+            Command::Data{..} => "Data",
+            Command::RetrieveMessage{..} => "RetrieveMessage",
+            Command::MessageAck{..} => "MessageAck",
+            Command::MessageMessage{..} => "MessageMessage",
+            Command::MessageEmpty{..} => "MessageEmpty",
+            Command::Application{..} => "Application",
+        }
+    }
+
     pub fn to_vec(&self) -> Vec<u8> {
         match self {
             Command::NoOp{} => {
@@ -221,6 +602,14 @@ impl Command {
                 out[0] = NO_OP;
                 out
             },
+            Command::Padding{
+                size
+            } => {
+                // The padding follows an empty body.
+                let mut out = vec![0; CMD_OVERHEAD + *size as usize];
+                out[0] = NO_OP;
+                out
+            },
             Command::GetConsensus{
                 epoch
             } => {
@@ -280,18 +669,259 @@ impl Command {
                 out[6] = *error_code;
                 out
             },
-            Command::Disconnect{} => {
-                let mut out = vec![0; CMD_OVERHEAD];
+            Command::Disconnect{
+                reason
+            } => {
+                if *reason == DISCONNECT_NORMAL {
+                    let mut out = vec![0; CMD_OVERHEAD];
+                    out[0] = DISCONNECT;
+                    return out
+                }
+                let mut out = vec![0; CMD_OVERHEAD + DISCONNECT_SIZE];
                 out[0] = DISCONNECT;
+                BigEndian::write_u32(&mut out[2..6], DISCONNECT_SIZE as u32);
+                out[6] = *reason;
+                out
+            },
+            Command::Rekey{} => {
+                let mut out = vec![0; CMD_OVERHEAD];
+                out[0] = REKEY;
+                out
+            },
+            Command::CloseWrite{} => {
+                let mut out = vec![0; CMD_OVERHEAD];
+                out[0] = CLOSE_WRITE;
+                out
+            },
+            Command::ReauthChallenge{
+                nonce
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + REAUTH_NONCE_SIZE];
+                out[0] = REAUTH_CHALLENGE;
+                BigEndian::write_u32(&mut out[2..6], REAUTH_NONCE_SIZE as u32);
+                out[6..].copy_from_slice(nonce);
+                out
+            },
+            Command::ReauthResponse{
+                nonce, additional_data
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + REAUTH_NONCE_SIZE + additional_data.len()];
+                out[0] = REAUTH_RESPONSE;
+                BigEndian::write_u32(&mut out[2..6], (REAUTH_NONCE_SIZE + additional_data.len()) as u32);
+                out[6..6 + REAUTH_NONCE_SIZE].copy_from_slice(nonce);
+                out[6 + REAUTH_NONCE_SIZE..].copy_from_slice(additional_data);
+                out
+            },
+            Command::LinkParameters{
+                max_packet_size, forward_payload_size
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + LINK_PARAMETERS_SIZE];
+                out[0] = LINK_PARAMETERS;
+                BigEndian::write_u32(&mut out[2..6], LINK_PARAMETERS_SIZE as u32);
+                BigEndian::write_u32(&mut out[6..10], *max_packet_size);
+                BigEndian::write_u32(&mut out[10..14], *forward_payload_size);
+                out
+            },
+            Command::Echo{
+                cookie
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + ECHO_COOKIE_SIZE];
+                out[0] = ECHO;
+                BigEndian::write_u32(&mut out[2..6], ECHO_COOKIE_SIZE as u32);
+                out[6..].copy_from_slice(cookie);
+                out
+            },
+            Command::EchoReply{
+                cookie
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + ECHO_COOKIE_SIZE];
+                out[0] = ECHO_REPLY;
+                BigEndian::write_u32(&mut out[2..6], ECHO_COOKIE_SIZE as u32);
+                out[6..].copy_from_slice(cookie);
+                out
+            },
+            Command::Error{
+                reason
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + ERROR_SIZE];
+                out[0] = ERROR;
+                BigEndian::write_u32(&mut out[2..6], ERROR_SIZE as u32);
+                out[6] = *reason;
+                out
+            },
+            Command::Fragment{
+                total_size, offset, payload
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + FRAGMENT_BASE_SIZE + payload.len()];
+                out[0] = FRAGMENT;
+                BigEndian::write_u32(&mut out[2..6], (FRAGMENT_BASE_SIZE + payload.len()) as u32);
+                BigEndian::write_u32(&mut out[6..10], *total_size);
+                BigEndian::write_u32(&mut out[10..14], *offset);
+                out[14..].copy_from_slice(payload);
+                out
+            },
+            Command::Batch{
+                commands
+            } => {
+                let mut out = vec![0; CMD_OVERHEAD + commands.len()];
+                out[0] = BATCH;
+                BigEndian::write_u32(&mut out[2..6], commands.len() as u32);
+                out[6..].copy_from_slice(commands);
+                out
+            },
+            Command::Sequenced{
+                sequence, command
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + SEQUENCED_BASE_SIZE + command.len()];
+                out[0] = SEQUENCED;
+                BigEndian::write_u32(&mut out[2..6], (SEQUENCED_BASE_SIZE + command.len()) as u32);
+                BigEndian::write_u64(&mut out[6..14], *sequence);
+                out[14..].copy_from_slice(command);
+                out
+            },
+            Command::Traced{
+                trace_id, command
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + TRACE_ID_SIZE + command.len()];
+                out[0] = TRACED;
+                BigEndian::write_u32(&mut out[2..6], (TRACE_ID_SIZE + command.len()) as u32);
+                out[6..6 + TRACE_ID_SIZE].copy_from_slice(trace_id);
+                out[6 + TRACE_ID_SIZE..].copy_from_slice(command);
+                out
+            },
+            Command::DatagramKey{
+                key
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + DATAGRAM_KEY_SIZE];
+                out[0] = DATAGRAM_KEY;
+                BigEndian::write_u32(&mut out[2..6], DATAGRAM_KEY_SIZE as u32);
+                out[6..].copy_from_slice(key);
+                out
+            },
+            Command::Ack{
+                sequence
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + ACK_SIZE];
+                out[0] = ACK;
+                BigEndian::write_u32(&mut out[2..6], ACK_SIZE as u32);
+                BigEndian::write_u64(&mut out[6..14], *sequence);
+                out
+            },
+            Command::Credit{
+                packets
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + CREDIT_SIZE];
+                out[0] = CREDIT;
+                BigEndian::write_u32(&mut out[2..6], CREDIT_SIZE as u32);
+                BigEndian::write_u32(&mut out[6..10], *packets);
+                out
+            },
+            Command::Ping{
+                timestamp,
+                cookie
+            } | Command::Pong{
+                timestamp,
+                cookie
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + PING_SIZE];
+                out[0] = match self { Command::Ping{..} => PING, _ => PONG };
+                BigEndian::write_u32(&mut out[2..6], PING_SIZE as u32);
+                BigEndian::write_u64(&mut out[6..14], *timestamp);
+                out[14..].copy_from_slice(cookie);
+                out
+            },
+            Command::GetVersion{} => {
+                let mut out = vec![0; CMD_OVERHEAD];
+                out[0] = GET_VERSION;
+                out
+            },
+            Command::Version{
+                implementation,
+                commands,
+                max_message_size
+            } => {
+                if implementation.len() > u8::max_value() as usize {
+                    panic!("invalid Version implementation when serializing");
+                }
+                let len = VERSION_BASE_SIZE + implementation.len() + commands.len();
+                let mut out = vec![0u8; CMD_OVERHEAD + len];
+                out[0] = VERSION;
+                BigEndian::write_u32(&mut out[2..6], len as u32);
+                BigEndian::write_u32(&mut out[6..10], *max_message_size);
+                out[10] = implementation.len() as u8;
+                out[11..11 + implementation.len()].copy_from_slice(implementation);
+                out[11 + implementation.len()..].copy_from_slice(commands);
+                out
+            },
+            Command::AcceptCompression{
+                max_size
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + ACCEPT_COMPRESSION_SIZE];
+                out[0] = ACCEPT_COMPRESSION;
+                BigEndian::write_u32(&mut out[2..6], ACCEPT_COMPRESSION_SIZE as u32);
+                BigEndian::write_u32(&mut out[6..10], *max_size);
+                out
+            },
+            Command::Compressed{
+                algorithm,
+                uncompressed_size,
+                payload
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + COMPRESSED_BASE_SIZE + payload.len()];
+                out[0] = COMPRESSED;
+                BigEndian::write_u32(&mut out[2..6], (COMPRESSED_BASE_SIZE + payload.len()) as u32);
+                out[6] = *algorithm;
+                BigEndian::write_u32(&mut out[7..11], *uncompressed_size);
+                out[11..].copy_from_slice(payload);
+                out
+            },
+            Command::StreamOpen{
+                stream_id
+            } | Command::StreamClose{
+                stream_id
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + STREAM_ID_SIZE];
+                out[0] = match self { Command::StreamOpen{..} => STREAM_OPEN, _ => STREAM_CLOSE };
+                BigEndian::write_u32(&mut out[2..6], STREAM_ID_SIZE as u32);
+                BigEndian::write_u32(&mut out[6..10], *stream_id);
+                out
+            },
+            Command::StreamWindow{
+                stream_id,
+                increment
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + STREAM_WINDOW_SIZE];
+                out[0] = STREAM_WINDOW;
+                BigEndian::write_u32(&mut out[2..6], STREAM_WINDOW_SIZE as u32);
+                BigEndian::write_u32(&mut out[6..10], *stream_id);
+                BigEndian::write_u32(&mut out[10..14], *increment);
+                out
+            },
+            Command::StreamData{
+                stream_id,
+                payload
+            } => {
+                let mut out = vec![0u8; CMD_OVERHEAD + STREAM_ID_SIZE + payload.len()];
+                out[0] = STREAM_DATA;
+                BigEndian::write_u32(&mut out[2..6], (STREAM_ID_SIZE + payload.len()) as u32);
+                BigEndian::write_u32(&mut out[6..10], *stream_id);
+                out[10..].copy_from_slice(payload);
                 out
             },
             Command::SendPacket{
                 sphinx_packet
+            } => payload_to_vec(SEND_PACKET, sphinx_packet),
+            Command::Data{
+                payload
+            } => payload_to_vec(DATA, payload),
+            Command::Application{
+                id,
+                payload
             } => {
-                let mut out = vec![0; CMD_OVERHEAD + sphinx_packet.len()];
-                out[0] = SEND_PACKET;
-                BigEndian::write_u32(&mut out[2..6], sphinx_packet.len() as u32);
-                out[6..].copy_from_slice(sphinx_packet);
+                let mut out = vec![0; CMD_OVERHEAD + payload.len()];
+                out[0] = *id;
+                BigEndian::write_u32(&mut out[2..6], payload.len() as u32);
+                out[6..].copy_from_slice(payload);
                 out
             },
             Command::RetrieveMessage{
@@ -323,7 +953,7 @@ impl Command {
                 queue_size_hint, sequence, payload
             } => {
                 if payload.len() != USER_FORWARD_PAYLOAD_SIZE {
-                    panic!("invalid MessageAck payload when serializing");
+                    panic!("invalid MessageMessage payload when serializing");
                 }
                 let mut out = vec![0; CMD_OVERHEAD + MESSAGE_MSG_SIZE + payload.len()];
                 out[0] = MESSAGE;
@@ -361,14 +991,9 @@ fn consensus_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
     if b.len() < CONSENSUS_BASE_SIZE {
         return Err(CommandError::ConsensusDecodeError);
     }
-    let _payload_len = (b.len() - CONSENSUS_BASE_SIZE) as u8;
-    let mut _payload: Vec<u8> = vec![];
-    if _payload_len > 0 {
-        _payload.extend_from_slice(&b[CONSENSUS_BASE_SIZE..]);
-    }
     Ok(Command::Consensus {
         error_code: b[0],
-        payload: _payload,
+        payload: b[CONSENSUS_BASE_SIZE..].to_vec(),
     })
 }
 
@@ -416,6 +1041,304 @@ fn vote_status_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
     })
 }
 
+fn reauth_challenge_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != REAUTH_NONCE_SIZE {
+        return Err(CommandError::ReauthDecodeError);
+    }
+    Ok(Command::ReauthChallenge{
+        nonce: *array_ref![b, 0, REAUTH_NONCE_SIZE],
+    })
+}
+
+fn reauth_response_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < REAUTH_NONCE_SIZE {
+        return Err(CommandError::ReauthDecodeError);
+    }
+    Ok(Command::ReauthResponse{
+        nonce: *array_ref![b, 0, REAUTH_NONCE_SIZE],
+        additional_data: b[REAUTH_NONCE_SIZE..].to_vec(),
+    })
+}
+
+fn link_parameters_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != LINK_PARAMETERS_SIZE {
+        return Err(CommandError::LinkParametersDecodeError);
+    }
+    Ok(Command::LinkParameters{
+        max_packet_size: BigEndian::read_u32(&b[0..4]),
+        forward_payload_size: BigEndian::read_u32(&b[4..8]),
+    })
+}
+
+fn echo_cookie_from_bytes(b: &[u8]) -> Result<[u8; ECHO_COOKIE_SIZE], CommandError> {
+    if b.len() != ECHO_COOKIE_SIZE {
+        return Err(CommandError::EchoDecodeError);
+    }
+    Ok(*array_ref![b, 0, ECHO_COOKIE_SIZE])
+}
+
+fn disconnect_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != DISCONNECT_SIZE {
+        return Err(CommandError::DisconnectDecodeError);
+    }
+    Ok(Command::Disconnect{
+        reason: b[0],
+    })
+}
+
+fn error_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != ERROR_SIZE {
+        return Err(CommandError::ErrorCommandDecodeError);
+    }
+    Ok(Command::Error{
+        reason: b[0],
+    })
+}
+
+fn fragment_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < FRAGMENT_BASE_SIZE {
+        return Err(CommandError::FragmentDecodeError);
+    }
+    Ok(Command::Fragment{
+        total_size: BigEndian::read_u32(&b[0..4]),
+        offset: BigEndian::read_u32(&b[4..8]),
+        payload: b[FRAGMENT_BASE_SIZE..].to_vec(),
+    })
+}
+
+fn sequenced_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < SEQUENCED_BASE_SIZE {
+        return Err(CommandError::SequenceDecodeError);
+    }
+    Ok(Command::Sequenced{
+        sequence: BigEndian::read_u64(&b[..SEQUENCED_BASE_SIZE]),
+        command: b[SEQUENCED_BASE_SIZE..].to_vec(),
+    })
+}
+
+fn ack_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != ACK_SIZE {
+        return Err(CommandError::SequenceDecodeError);
+    }
+    Ok(Command::Ack{
+        sequence: BigEndian::read_u64(b),
+    })
+}
+
+fn credit_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != CREDIT_SIZE {
+        return Err(CommandError::CreditDecodeError);
+    }
+    Ok(Command::Credit{
+        packets: BigEndian::read_u32(b),
+    })
+}
+
+fn version_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < VERSION_BASE_SIZE || b.len() < VERSION_BASE_SIZE + b[4] as usize {
+        return Err(CommandError::VersionDecodeError);
+    }
+    let implementation_end = VERSION_BASE_SIZE + b[4] as usize;
+    Ok(Command::Version{
+        implementation: b[VERSION_BASE_SIZE..implementation_end].to_vec(),
+        commands: b[implementation_end..].to_vec(),
+        max_message_size: BigEndian::read_u32(&b[..4]),
+    })
+}
+
+fn accept_compression_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != ACCEPT_COMPRESSION_SIZE {
+        return Err(CommandError::CompressedDecodeError);
+    }
+    Ok(Command::AcceptCompression{
+        max_size: BigEndian::read_u32(b),
+    })
+}
+
+fn compressed_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < COMPRESSED_BASE_SIZE {
+        return Err(CommandError::CompressedDecodeError);
+    }
+    Ok(Command::Compressed{
+        algorithm: b[0],
+        uncompressed_size: BigEndian::read_u32(&b[1..5]),
+        payload: b[COMPRESSED_BASE_SIZE..].to_vec(),
+    })
+}
+
+fn stream_from_bytes(cmd_id: u8, b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < STREAM_ID_SIZE || (cmd_id != STREAM_DATA && b.len() != STREAM_ID_SIZE) {
+        return Err(CommandError::StreamDecodeError);
+    }
+    let stream_id = BigEndian::read_u32(&b[..STREAM_ID_SIZE]);
+    match cmd_id {
+        STREAM_OPEN => Ok(Command::StreamOpen{ stream_id }),
+        STREAM_DATA => Ok(Command::StreamData{ stream_id, payload: b[STREAM_ID_SIZE..].to_vec() }),
+        _ => Ok(Command::StreamClose{ stream_id }),
+    }
+}
+
+fn stream_window_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != STREAM_WINDOW_SIZE {
+        return Err(CommandError::StreamDecodeError);
+    }
+    Ok(Command::StreamWindow{
+        stream_id: BigEndian::read_u32(&b[..STREAM_ID_SIZE]),
+        increment: BigEndian::read_u32(&b[STREAM_ID_SIZE..]),
+    })
+}
+
+fn traced_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() < TRACE_ID_SIZE {
+        return Err(CommandError::TraceDecodeError);
+    }
+    Ok(Command::Traced{
+        trace_id: *array_ref![b, 0, TRACE_ID_SIZE],
+        command: b[TRACE_ID_SIZE..].to_vec(),
+    })
+}
+
+fn datagram_key_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != DATAGRAM_KEY_SIZE {
+        return Err(CommandError::DatagramKeyDecodeError);
+    }
+    Ok(Command::DatagramKey{
+        key: *array_ref![b, 0, DATAGRAM_KEY_SIZE],
+    })
+}
+
+/// Returns the IDs of the commands this implementation supports,
+/// not counting application commands.
+pub fn command_ids() -> Vec<u8> {
+    (NO_OP..VOTE_STATUS + 1).chain(CREDIT..STREAM_WINDOW + 1).collect()
+}
+
+fn ping_from_bytes(cmd_id: u8, b: &[u8]) -> Result<Command, CommandError> {
+    if b.len() != PING_SIZE {
+        return Err(CommandError::PingDecodeError);
+    }
+    let timestamp = BigEndian::read_u64(&b[..8]);
+    let cookie = *array_ref![b, 8, ECHO_COOKIE_SIZE];
+    match cmd_id {
+        PING => Ok(Command::Ping{ timestamp, cookie }),
+        _ => Ok(Command::Pong{ timestamp, cookie }),
+    }
+}
+
+/// Appends an encoded command to the commands of a Batch.
+pub fn push_batch_entry(commands: &mut Vec<u8>, encoding: &[u8]) {
+    let mut len = [0u8; BATCH_ENTRY_OVERHEAD];
+    BigEndian::write_u32(&mut len, encoding.len() as u32);
+    commands.extend_from_slice(&len);
+    commands.extend_from_slice(encoding);
+}
+
+/// Splits the commands of a Batch into the encoded commands.
+pub fn batch_entries(mut commands: &[u8]) -> Result<Vec<&[u8]>, CommandError> {
+    let mut entries = vec![];
+    while !commands.is_empty() {
+        if commands.len() < BATCH_ENTRY_OVERHEAD {
+            return Err(CommandError::BatchDecodeError);
+        }
+        let len = BigEndian::read_u32(&commands[..BATCH_ENTRY_OVERHEAD]) as usize;
+        if len > commands.len() - BATCH_ENTRY_OVERHEAD {
+            return Err(CommandError::BatchDecodeError);
+        }
+        entries.push(&commands[BATCH_ENTRY_OVERHEAD..BATCH_ENTRY_OVERHEAD + len]);
+        commands = &commands[BATCH_ENTRY_OVERHEAD + len..];
+    }
+    Ok(entries)
+}
+
+/// A received command which may borrow its payload from the buffer
+/// it was decoded from, see Session::recv_command_into. SendPacket
+/// and Data commands are borrowed, any other command is owned.
+#[derive(PartialEq, Debug)]
+pub enum CommandRef<'a> {
+    SendPacket {
+        sphinx_packet: &'a [u8],
+    },
+    Data {
+        payload: &'a [u8],
+    },
+    Owned(Command),
+}
+
+impl<'a> CommandRef<'a> {
+    pub fn from_bytes(b: &'a [u8]) -> Result<CommandRef<'a>, CommandError> {
+        let (cmd_id, cmd_len, _cmd) = split_command(b)?;
+        match cmd_id {
+            SEND_PACKET if cmd_len != 0 => Ok(CommandRef::SendPacket{ sphinx_packet: &_cmd[..cmd_len] }),
+            DATA => Ok(CommandRef::Data{ payload: &_cmd[..cmd_len] }),
+            _ => Ok(CommandRef::Owned(Command::from_bytes(b)?)),
+        }
+    }
+
+    /// Returns true if the encoded command b is decoded by borrowing.
+    pub fn borrows(b: &[u8]) -> bool {
+        !b.is_empty() && (b[0] == SEND_PACKET || b[0] == DATA)
+    }
+
+    pub fn name(&self) -> &'static str {
+        match self {
+            CommandRef::SendPacket{..} => "SendPacket",
+            CommandRef::Data{..} => "Data",
+            CommandRef::Owned(cmd) => cmd.name(),
+        }
+    }
+
+    /// Copies the command into an owned Command.
+    pub fn to_command(&self) -> Command {
+        match self {
+            CommandRef::SendPacket{ sphinx_packet } => Command::SendPacket{ sphinx_packet: sphinx_packet.to_vec() },
+            CommandRef::Data{ payload } => Command::Data{ payload: payload.to_vec() },
+            CommandRef::Owned(cmd) => cmd.clone(),
+        }
+    }
+
+    /// Encodes the command like Command::to_vec, copying a borrowed
+    /// payload straight into the encoding.
+    pub fn to_vec(&self) -> Vec<u8> {
+        match self {
+            CommandRef::SendPacket{ sphinx_packet } => payload_to_vec(SEND_PACKET, sphinx_packet),
+            CommandRef::Data{ payload } => payload_to_vec(DATA, payload),
+            CommandRef::Owned(cmd) => cmd.to_vec(),
+        }
+    }
+}
+
+// Encodes a command whose body is just payload.
+fn payload_to_vec(cmd_id: u8, payload: &[u8]) -> Vec<u8> {
+    let mut out = vec![0; CMD_OVERHEAD + payload.len()];
+    out[0] = cmd_id;
+    BigEndian::write_u32(&mut out[2..6], payload.len() as u32);
+    out[6..].copy_from_slice(payload);
+    out
+}
+
+// Checks the command header, returning the command ID, the body
+// length and the body with any padding.
+fn split_command(b: &[u8]) -> Result<(u8, usize, &[u8]), CommandError> {
+    if b.len() < CMD_OVERHEAD {
+        return Err(CommandError::TooSmallError);
+    }
+    let cmd_id = b[0];
+    if b[1] != 0 {
+        return Err(CommandError::InvalidReservedByte);
+    }
+    let cmd_len = BigEndian::read_u32(&b[2..6]) as usize;
+    let _cmd = &b[CMD_OVERHEAD..];
+    if _cmd.len() < cmd_len {
+        return Err(CommandError::TooSmallError);
+    }
+    let _padding = &_cmd[cmd_len..];
+    let _zeros = vec![0u8; _padding.len()];
+    if _zeros.ct_eq(_padding).unwrap_u8() == 0 {
+        return Err(CommandError::MessageDecodeError);
+    }
+    Ok((cmd_id, cmd_len, _cmd))
+}
+
 fn send_packet_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
     Ok(Command::SendPacket{
         sphinx_packet: b.to_vec(),
@@ -459,8 +1382,8 @@ fn message_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
                 return Err(CommandError::MessageDecodeError);
             }
 
-            let zeros = [0u8; USER_FORWARD_PAYLOAD_SIZE];
-            if zeros.ct_eq(&_msg[USER_FORWARD_PAYLOAD_SIZE..]).unwrap_u8() != 0 {
+            let zeros = [0u8; MESSAGE_MSG_PADDING_SIZE];
+            if zeros.ct_eq(&_msg[USER_FORWARD_PAYLOAD_SIZE..]).unwrap_u8() == 0 {
                 return Err(CommandError::MessageDecodeError);
             }
             let _msg = &_msg[..USER_FORWARD_PAYLOAD_SIZE];
@@ -476,7 +1399,7 @@ fn message_from_bytes(b: &[u8]) -> Result<Command, CommandError> {
                 return Err(CommandError::MessageDecodeError);
             }
             let zeros = [0u8; MESSAGE_EMPTY_SIZE - MESSAGE_BASE_SIZE];
-            if zeros.ct_eq(&_msg[MESSAGE_EMPTY_SIZE - MESSAGE_BASE_SIZE..]).unwrap_u8() != 0 {
+            if zeros.ct_eq(_msg).unwrap_u8() == 0 {
                 return Err(CommandError::MessageDecodeError);
             }
             Ok(Command::MessageEmpty{
@@ -497,8 +1420,126 @@ mod tests {
 
     use self::rand_core::OsRng;
 
+    #[test]
+    fn command_ref_test() {
+        let cmd = Command::SendPacket{ sphinx_packet: vec![1u8; 100] };
+        let raw = cmd.to_vec();
+        assert_eq!(CommandRef::from_bytes(&raw).unwrap(), CommandRef::SendPacket{ sphinx_packet: &raw[CMD_OVERHEAD..] });
+        assert_eq!(CommandRef::from_bytes(&raw).unwrap().to_command(), cmd);
+        assert_eq!(CommandRef::SendPacket{ sphinx_packet: &[1u8; 100] }.to_vec(), raw);
+
+        let cmd = Command::Data{ payload: vec![] };
+        let raw = cmd.to_vec();
+        assert_eq!(CommandRef::from_bytes(&raw).unwrap(), CommandRef::Data{ payload: &[] });
+
+        let cmd = Command::RetrieveMessage{ sequence: 7 };
+        assert_eq!(CommandRef::from_bytes(&cmd.to_vec()).unwrap(), CommandRef::Owned(cmd));
+
+        // the body may not be shorter than the header claims
+        let mut raw = Command::Data{ payload: vec![1u8; 10] }.to_vec();
+        raw.truncate(raw.len() - 1);
+        assert!(CommandRef::from_bytes(&raw).is_err());
+        assert!(Command::from_bytes(&raw).is_err());
+
+        // zero padding after the body is not part of the payload
+        let mut raw = Command::SendPacket{ sphinx_packet: vec![1u8; 100] }.to_vec();
+        raw.extend(&[0u8; 20]);
+        assert_eq!(CommandRef::from_bytes(&raw).unwrap(), CommandRef::SendPacket{ sphinx_packet: &[1u8; 100] });
+        let mut raw = Command::Data{ payload: vec![1u8; 10] }.to_vec();
+        raw.extend(&[0u8; 20]);
+        assert_eq!(CommandRef::from_bytes(&raw).unwrap(), CommandRef::Data{ payload: &[1u8; 10] });
+    }
+
     #[test]
     fn commands_test() {
+        // test fragment
+        let fragment = Command::Fragment{ total_size: 100000, offset: 65000, payload: vec![1u8; 35000] };
+        assert_eq!(Command::from_bytes(&fragment.to_vec()).unwrap(), fragment);
+
+        // test batch
+        let mut commands = vec![];
+        push_batch_entry(&mut commands, &Command::NoOp{}.to_vec());
+        push_batch_entry(&mut commands, &[]);
+        let batch = Command::Batch{ commands };
+        match Command::from_bytes(&batch.to_vec()).unwrap() {
+            Command::Batch{ commands } => {
+                assert_eq!(batch_entries(&commands).unwrap(), vec![&Command::NoOp{}.to_vec()[..], &[]]);
+                assert!(batch_entries(&commands[..commands.len() - 1]).is_err());
+            },
+            _ => panic!("expected a batch"),
+        }
+
+        // test sequenced and ack
+        let sequenced = Command::Sequenced{ sequence: 7, command: Command::NoOp{}.to_vec() };
+        assert_eq!(Command::from_bytes(&sequenced.to_vec()).unwrap(), sequenced);
+        let ack = Command::Ack{ sequence: u64::max_value() };
+        assert_eq!(Command::from_bytes(&ack.to_vec()).unwrap(), ack);
+
+        // test credit
+        let credit = Command::Credit{ packets: 100 };
+        assert_eq!(Command::from_bytes(&credit.to_vec()).unwrap(), credit);
+
+        // test ping and pong
+        let ping = Command::Ping{ timestamp: 1234567890, cookie: [1u8; ECHO_COOKIE_SIZE] };
+        assert_eq!(Command::from_bytes(&ping.to_vec()).unwrap(), ping);
+        let pong = Command::Pong{ timestamp: 1234567890, cookie: [1u8; ECHO_COOKIE_SIZE] };
+        assert_eq!(Command::from_bytes(&pong.to_vec()).unwrap(), pong);
+        let pong_bytes = pong.to_vec();
+        assert!(Command::from_bytes(&pong_bytes[..pong_bytes.len() - 1]).is_err());
+
+        // test version
+        let get_version = Command::GetVersion{};
+        assert_eq!(Command::from_bytes(&get_version.to_vec()).unwrap(), get_version);
+        let version = Command::Version{
+            implementation: b"mix_link 0.2.0".to_vec(),
+            commands: command_ids(),
+            max_message_size: 1 << 24,
+        };
+        let version_bytes = version.to_vec();
+        assert_eq!(Command::from_bytes(&version_bytes).unwrap(), version);
+        // the implementation runs past the end
+        assert!(Command::from_bytes(&version_bytes[..CMD_OVERHEAD + VERSION_BASE_SIZE + 1]).is_err());
+        // the IDs left to Katzenpost are unknown
+        assert!(!command_ids().contains(&(VOTE_STATUS + 1)));
+        let mut reserved = Command::NoOp{}.to_vec();
+        reserved[0] = VOTE_STATUS + 1;
+        match Command::from_bytes(&reserved) {
+            Err(CommandError::UnknownCommand) => {},
+            x => panic!("expected an unknown command, got {:?}", x),
+        }
+
+        // test compression
+        let accept_compression = Command::AcceptCompression{ max_size: 1 << 20 };
+        assert_eq!(Command::from_bytes(&accept_compression.to_vec()).unwrap(), accept_compression);
+        let compressed = Command::Compressed{ algorithm: COMPRESSION_ZSTD, uncompressed_size: 1000, payload: vec![1u8; 100] };
+        assert_eq!(Command::from_bytes(&compressed.to_vec()).unwrap(), compressed);
+        assert!(Command::from_bytes(&compressed.to_vec()[..CMD_OVERHEAD + COMPRESSED_BASE_SIZE - 1]).is_err());
+
+        // test streams
+        for cmd in vec![
+            Command::StreamOpen{ stream_id: 1 },
+            Command::StreamData{ stream_id: 1, payload: vec![1u8; MAX_STREAM_DATA_SIZE] },
+            Command::StreamData{ stream_id: u32::max_value(), payload: vec![] },
+            Command::StreamClose{ stream_id: 2 },
+            Command::StreamWindow{ stream_id: 3, increment: u32::max_value() },
+        ] {
+            assert_eq!(Command::from_bytes(&cmd.to_vec()).unwrap(), cmd);
+        }
+        let mut stream_close_bytes = Command::StreamClose{ stream_id: 2 }.to_vec();
+        stream_close_bytes[5] += 1;
+        stream_close_bytes.push(0);
+        assert!(Command::from_bytes(&stream_close_bytes).is_err());
+
+        // test traced
+        let traced = Command::Traced{ trace_id: [3u8; TRACE_ID_SIZE], command: Command::NoOp{}.to_vec() };
+        assert_eq!(Command::from_bytes(&traced.to_vec()).unwrap(), traced);
+        assert!(Command::from_bytes(&traced.to_vec()[..CMD_OVERHEAD + TRACE_ID_SIZE - 1]).is_err());
+
+        // test datagram key
+        let datagram_key = Command::DatagramKey{ key: [4u8; DATAGRAM_KEY_SIZE] };
+        assert_eq!(Command::from_bytes(&datagram_key.to_vec()).unwrap(), datagram_key);
+        assert!(Command::from_bytes(&datagram_key.to_vec()[..CMD_OVERHEAD + DATAGRAM_KEY_SIZE - 1]).is_err());
+
         // test no op
         let no_op = Command::NoOp{};
         let no_op_bytes = no_op.clone().to_vec();
@@ -507,6 +1548,11 @@ mod tests {
         let no_op2_bytes = no_op2.to_vec();
         assert_eq!(no_op_bytes, no_op2_bytes);
 
+        // test padding
+        let padding_bytes = Command::Padding{ size: 100 }.to_vec();
+        assert_eq!(padding_bytes.len(), CMD_OVERHEAD + 100);
+        assert_eq!(Command::from_bytes(&padding_bytes).unwrap(), Command::NoOp{});
+
         // test get consensus
         let get_consensus = Command::GetConsensus{
             epoch: 123,
@@ -527,6 +1573,12 @@ mod tests {
         assert_eq!(consensus, consensus2);
         let consensus2_bytes = consensus2.to_vec();
         assert_eq!(consensus_bytes, consensus2_bytes);
+        let consensus = Command::Consensus{ error_code: CONSENSUS_OK, payload: vec![1u8; 256] };
+        assert_eq!(Command::from_bytes(&consensus.to_vec()).unwrap(), consensus);
+        let mut short = Command::GetConsensus{ epoch: 1 }.to_vec();
+        short[5] = 7;
+        short.pop();
+        assert!(Command::from_bytes(&short).is_err());
 
         // test post descriptor
         let post_descriptor = Command::PostDescriptor {
@@ -574,12 +1626,74 @@ mod tests {
         assert_eq!(vote_status_bytes, vote_status2_bytes);
 
         // test disconnect
-        let disconnect = Command::Disconnect{};
+        let disconnect = Command::Disconnect{ reason: DISCONNECT_NORMAL };
         let disconnect_bytes = disconnect.clone().to_vec();
+        assert_eq!(disconnect_bytes.len(), CMD_OVERHEAD);
         let disconnect2 = Command::from_bytes(&disconnect_bytes).unwrap();
         assert_eq!(disconnect, disconnect2);
         let disconnect2_bytes = disconnect2.to_vec();
         assert_eq!(disconnect_bytes, disconnect2_bytes);
+        let disconnect = Command::Disconnect{ reason: DISCONNECT_SHUTDOWN };
+        assert_eq!(disconnect, Command::from_bytes(&disconnect.to_vec()).unwrap());
+
+        // test rekey
+        let rekey = Command::Rekey{};
+        let rekey_bytes = rekey.clone().to_vec();
+        let rekey2 = Command::from_bytes(&rekey_bytes).unwrap();
+        assert_eq!(rekey, rekey2);
+        let rekey2_bytes = rekey2.to_vec();
+        assert_eq!(rekey_bytes, rekey2_bytes);
+
+        // test reauthentication
+        let reauth_challenge = Command::ReauthChallenge{
+            nonce: [3u8; REAUTH_NONCE_SIZE],
+        };
+        let reauth_challenge_bytes = reauth_challenge.to_vec();
+        assert_eq!(reauth_challenge, Command::from_bytes(&reauth_challenge_bytes).unwrap());
+        let reauth_response = Command::ReauthResponse{
+            nonce: [3u8; REAUTH_NONCE_SIZE],
+            additional_data: vec![1, 2, 3],
+        };
+        let reauth_response_bytes = reauth_response.to_vec();
+        assert_eq!(reauth_response, Command::from_bytes(&reauth_response_bytes).unwrap());
+
+        // test close write
+        let close_write = Command::CloseWrite{};
+        assert_eq!(close_write, Command::from_bytes(&close_write.to_vec()).unwrap());
+
+        // test data
+        let data = Command::Data{
+            payload: vec![1, 2, 3],
+        };
+        assert_eq!(data, Command::from_bytes(&data.to_vec()).unwrap());
+        let data = Command::Data{
+            payload: vec![],
+        };
+        assert_eq!(data, Command::from_bytes(&data.to_vec()).unwrap());
+
+        // test link parameters
+        let link_parameters = Command::LinkParameters{
+            max_packet_size: 52000,
+            forward_payload_size: 51200,
+        };
+        let link_parameters_bytes = link_parameters.to_vec();
+        assert_eq!(link_parameters, Command::from_bytes(&link_parameters_bytes).unwrap());
+
+        // test echo
+        let echo = Command::Echo{
+            cookie: [5u8; ECHO_COOKIE_SIZE],
+        };
+        assert_eq!(echo, Command::from_bytes(&echo.to_vec()).unwrap());
+        let echo_reply = Command::EchoReply{
+            cookie: [5u8; ECHO_COOKIE_SIZE],
+        };
+        assert_eq!(echo_reply, Command::from_bytes(&echo_reply.to_vec()).unwrap());
+
+        // test error
+        let error = Command::Error{
+            reason: ERROR_OVERLOADED,
+        };
+        assert_eq!(error, Command::from_bytes(&error.to_vec()).unwrap());
 
         // test send packet
         let send_packet = Command::SendPacket{
@@ -636,5 +1750,24 @@ mod tests {
         assert_eq!(message_empty, message_empty2);
         let message_empty2_bytes = message_empty2.to_vec();
         assert_eq!(message_empty_bytes, message_empty2_bytes);
+
+        // non-zero padding is rejected
+        let mut padded_bytes = message_message_bytes.clone();
+        let last = padded_bytes.len() - 1;
+        padded_bytes[last] = 1;
+        assert!(Command::from_bytes(&padded_bytes).is_err());
+        let mut padded_bytes = message_empty_bytes.clone();
+        let last = padded_bytes.len() - 1;
+        padded_bytes[last] = 1;
+        assert!(Command::from_bytes(&padded_bytes).is_err());
+
+        // truncated client commands are rejected
+        let retrieve_message_bytes = Command::RetrieveMessage{
+            sequence: 123,
+        }.to_vec();
+        let truncated = retrieve_message_bytes.len() - 1;
+        assert!(Command::from_bytes(&retrieve_message_bytes[..truncated]).is_err());
+        let truncated = message_ack_bytes.len() - 1;
+        assert!(Command::from_bytes(&message_ack_bytes[..truncated]).is_err());
     }
 }
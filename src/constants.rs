@@ -15,14 +15,26 @@
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
 pub const NOISE_PARAMS: & str = "Noise_XXhfs_25519+Kyber1024_ChaChaPoly_BLAKE2b";
-pub const PROLOGUE: [u8;1] = [2u8;1];
+/// Katzenpost's protocol version, which carries only Katzenpost's
+/// commands, see Command::is_katzenpost.
+pub const PROTOCOL_VERSION: u8 = 2;
+/// The implementation name and version reported in Version commands.
+pub const IMPLEMENTATION: &str = concat!("mix_link ", env!("CARGO_PKG_VERSION"));
+/// EXTENDED_PROTOCOL_VERSION with commands encoded as CBOR, see the
+/// cbor module.
+pub const CBOR_PROTOCOL_VERSION: u8 = 3;
+/// PROTOCOL_VERSION with the commands this crate adds, the default.
+pub const EXTENDED_PROTOCOL_VERSION: u8 = 4;
+pub const PROLOGUE: [u8;1] = [PROTOCOL_VERSION;1];
 pub const PROLOGUE_SIZE: usize = 1;
 pub const NOISE_MESSAGE_MAX_SIZE: usize = 65535;
+/// The default bound on the commands accepted from the peer.
+pub const DEFAULT_MAX_COMMAND_SIZE: usize = 16 * 1024 * 1024;
 pub const KEY_SIZE: usize = 32;
 pub const MAC_SIZE: usize = 16;
 pub const MAX_ADDITIONAL_DATA_SIZE: usize = 255;
 pub const AUTH_MESSAGE_SIZE: usize = 1 + 4 + MAX_ADDITIONAL_DATA_SIZE;
-const KYBER_SIZE: usize = 1568;
+pub const KYBER_SIZE: usize = 1568;
 
 pub const NOISE_HANDSHAKE_MESSAGE1_SIZE: usize = PROLOGUE_SIZE + KYBER_SIZE + KEY_SIZE;
 pub const NOISE_HANDSHAKE_MESSAGE2_SIZE: usize = KEY_SIZE + MAC_SIZE + MAC_SIZE + KYBER_SIZE + KEY_SIZE + MAC_SIZE + AUTH_MESSAGE_SIZE;
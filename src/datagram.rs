@@ -0,0 +1,299 @@
+// datagram.rs - commands over unreliable datagrams
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! An unreliable datagram mode, for experiments on links where TCP's
+//! head of line blocking hurts mixnet latency. Each command travels
+//! in its own UDP datagram, so a lost datagram delays no other
+//! command; lost commands are not resent, and commands may arrive out
+//! of order.
+//!
+//! The channel is keyed from an established session: each peer sends
+//! a fresh random key in a DatagramKey command, see
+//! Session::open_datagram_channel, and encrypts its datagrams with
+//! XChaCha20-Poly1305 under that key. A datagram carries its counter
+//! in the clear as the nonce, so that each is decrypted on its own,
+//! and the receiver refuses counters it has seen or that fall behind
+//! a window of the latest 128, so that datagrams cannot be replayed.
+//! Datagrams that fail to authenticate are dropped silently.
+
+extern crate chacha20poly1305;
+
+use std::io;
+use std::net::{SocketAddr, UdpSocket};
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::time::Duration;
+
+use byteorder::{ByteOrder, BigEndian};
+use zeroize::Zeroizing;
+
+use self::chacha20poly1305::{Key, KeyInit, XChaCha20Poly1305, XNonce};
+use self::chacha20poly1305::aead::{Aead, Payload};
+
+use super::commands::{Command, DATAGRAM_KEY_SIZE};
+use super::errors::{ReceiveMessageError, SendMessageError};
+
+const COUNTER_SIZE: usize = 8;
+const TAG_SIZE: usize = 16;
+
+/// The largest datagram, the most a UDP datagram carries over IPv4.
+/// Datagrams larger than the path MTU are fragmented by IP, and lost
+/// if any fragment is.
+pub const MAX_DATAGRAM_SIZE: usize = 65507;
+
+/// The largest encoded command a datagram carries.
+pub const MAX_DATAGRAM_COMMAND_SIZE: usize = MAX_DATAGRAM_SIZE - COUNTER_SIZE - TAG_SIZE;
+
+const WINDOW_SIZE: u64 = 128;
+
+fn nonce(counter: &[u8]) -> [u8; 24] {
+    let mut nonce = [0u8; 24];
+    nonce[24 - COUNTER_SIZE..].copy_from_slice(counter);
+    nonce
+}
+
+// The counters received, as a bitmap of those up to WINDOW_SIZE
+// behind the highest.
+struct ReplayWindow {
+    highest: u64,
+    bitmap: u128,
+}
+
+impl ReplayWindow {
+    fn is_fresh(&self, counter: u64) -> bool {
+        if counter > self.highest {
+            return true
+        }
+        let offset = self.highest - counter;
+        offset < WINDOW_SIZE && self.bitmap & (1 << offset) == 0
+    }
+
+    fn mark(&mut self, counter: u64) {
+        if counter > self.highest {
+            let shift = counter - self.highest;
+            self.bitmap = if shift >= WINDOW_SIZE { 0 } else { self.bitmap << shift };
+            self.bitmap |= 1;
+            self.highest = counter;
+        } else {
+            self.bitmap |= 1 << (self.highest - counter);
+        }
+    }
+}
+
+struct ReceiveState {
+    window: ReplayWindow,
+    dropped: u64,
+}
+
+/// Sends and receives commands in datagrams over a UDP socket. The
+/// listener's end sends to the address of the latest datagram
+/// received, so that clients may roam. Clones made with try_clone
+/// share the channel's state.
+pub struct DatagramChannel {
+    socket: UdpSocket,
+    peer_addr: Arc<Mutex<Option<SocketAddr>>>,
+    send_key: Arc<Zeroizing<[u8; DATAGRAM_KEY_SIZE]>>,
+    receive_key: Arc<Zeroizing<[u8; DATAGRAM_KEY_SIZE]>>,
+    // The counter of the next datagram sent; counters start at 1.
+    next_counter: Arc<AtomicU64>,
+    receive: Arc<Mutex<ReceiveState>>,
+}
+
+impl DatagramChannel {
+    /// Returns a channel over socket encrypting with send_key and
+    /// decrypting with receive_key, the peer's send key. Without
+    /// peer_addr, the channel sends nothing until a datagram arrives.
+    pub fn new(socket: UdpSocket, peer_addr: Option<SocketAddr>, send_key: Zeroizing<[u8; DATAGRAM_KEY_SIZE]>,
+               receive_key: [u8; DATAGRAM_KEY_SIZE]) -> DatagramChannel {
+        DatagramChannel {
+            socket,
+            peer_addr: Arc::new(Mutex::new(peer_addr)),
+            send_key: Arc::new(send_key),
+            receive_key: Arc::new(Zeroizing::new(receive_key)),
+            next_counter: Arc::new(AtomicU64::new(1)),
+            receive: Arc::new(Mutex::new(ReceiveState {
+                window: ReplayWindow {
+                    highest: 0,
+                    bitmap: 0,
+                },
+                dropped: 0,
+            })),
+        }
+    }
+
+    pub fn try_clone(&self) -> io::Result<DatagramChannel> {
+        Ok(DatagramChannel {
+            socket: self.socket.try_clone()?,
+            peer_addr: self.peer_addr.clone(),
+            send_key: self.send_key.clone(),
+            receive_key: self.receive_key.clone(),
+            next_counter: self.next_counter.clone(),
+            receive: self.receive.clone(),
+        })
+    }
+
+    /// Returns the address datagrams are sent to, which the listener's
+    /// end learns from the first datagram it receives.
+    pub fn peer_addr(&self) -> Option<SocketAddr> {
+        *self.peer_addr.lock().unwrap()
+    }
+
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        self.socket.local_addr()
+    }
+
+    /// Bounds each later receive, or removes the bound given None.
+    pub fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.socket.set_read_timeout(timeout)
+    }
+
+    /// Returns the number of datagrams dropped for failing to
+    /// authenticate or for being replayed or too far out of order.
+    pub fn dropped(&self) -> u64 {
+        self.receive.lock().unwrap().dropped
+    }
+
+    /// Sends cmd in one datagram. Delivery is not confirmed.
+    pub fn send_command(&self, cmd: &Command) -> Result<(), SendMessageError> {
+        let peer_addr = match self.peer_addr() {
+            Some(x) => x,
+            None => return Err(SendMessageError::IOError(io::Error::from(io::ErrorKind::NotConnected))),
+        };
+        let encoded = cmd.to_vec();
+        if encoded.len() > MAX_DATAGRAM_COMMAND_SIZE {
+            return Err(SendMessageError::InvalidMessageSize);
+        }
+        let counter = self.next_counter.fetch_add(1, Ordering::SeqCst);
+        if counter == u64::max_value() {
+            return Err(SendMessageError::SessionClosed);
+        }
+        let mut datagram = vec![0u8; COUNTER_SIZE];
+        BigEndian::write_u64(&mut datagram, counter);
+        let cipher = XChaCha20Poly1305::new(Key::from_slice(&self.send_key[..]));
+        let payload = Payload {
+            msg: &encoded,
+            aad: &datagram,
+        };
+        match cipher.encrypt(XNonce::from_slice(&nonce(&datagram)), payload) {
+            Ok(ciphertext) => datagram.extend(ciphertext),
+            Err(_) => return Err(SendMessageError::EncryptFail),
+        }
+        self.socket.send_to(&datagram, peer_addr).map_err(SendMessageError::IOError)?;
+        Ok(())
+    }
+
+    /// Receives the next command, dropping datagrams that fail to
+    /// authenticate. Returns TimeoutError once the read timeout
+    /// passes. A command that fails to decode fails this receive
+    /// only.
+    pub fn recv_command(&self) -> Result<Command, ReceiveMessageError> {
+        let mut datagram = vec![0u8; MAX_DATAGRAM_SIZE];
+        loop {
+            let (len, from) = match self.socket.recv_from(&mut datagram) {
+                Ok(x) => x,
+                Err(ref e) if e.kind() == io::ErrorKind::WouldBlock || e.kind() == io::ErrorKind::TimedOut => {
+                    return Err(ReceiveMessageError::TimeoutError)
+                },
+                Err(e) => return Err(ReceiveMessageError::IOError(e)),
+            };
+            let mut receive = self.receive.lock().unwrap();
+            if len < COUNTER_SIZE + TAG_SIZE {
+                receive.dropped += 1;
+                continue
+            }
+            let counter = BigEndian::read_u64(&datagram[..COUNTER_SIZE]);
+            if !receive.window.is_fresh(counter) {
+                receive.dropped += 1;
+                continue
+            }
+            let cipher = XChaCha20Poly1305::new(Key::from_slice(&self.receive_key[..]));
+            let payload = Payload {
+                msg: &datagram[COUNTER_SIZE..len],
+                aad: &datagram[..COUNTER_SIZE],
+            };
+            let encoded = match cipher.decrypt(XNonce::from_slice(&nonce(&datagram[..COUNTER_SIZE])), payload) {
+                Ok(x) => x,
+                Err(_) => {
+                    receive.dropped += 1;
+                    continue
+                },
+            };
+            if counter > receive.window.highest {
+                *self.peer_addr.lock().unwrap() = Some(from);
+            }
+            receive.window.mark(counter);
+            return Ok(Command::from_bytes(&encoded)?)
+        }
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn replay_window_test() {
+        let mut window = ReplayWindow{ highest: 0, bitmap: 0 };
+        for counter in &[3, 1, 2, 200, 100] {
+            assert!(window.is_fresh(*counter));
+            window.mark(*counter);
+            assert!(!window.is_fresh(*counter));
+        }
+        // 1, 2 and 3 fell out of the window
+        assert!(!window.is_fresh(60));
+        assert!(window.is_fresh(199));
+        assert!(window.is_fresh(201));
+    }
+
+    #[test]
+    fn datagram_test() {
+        let a = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let b = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let b_addr = b.local_addr().unwrap();
+        let (a_key, b_key) = (Zeroizing::new([1u8; DATAGRAM_KEY_SIZE]), Zeroizing::new([2u8; DATAGRAM_KEY_SIZE]));
+        let a = DatagramChannel::new(a, Some(b_addr), a_key.clone(), *b_key);
+        let b = DatagramChannel::new(b, None, b_key, *a_key);
+        b.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        a.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        assert!(b.send_command(&Command::NoOp{}).is_err());
+
+        let cmd = Command::SendPacket{ sphinx_packet: vec![1u8; 1000] };
+        a.send_command(&cmd).unwrap();
+        assert_eq!(b.recv_command().unwrap(), cmd);
+        assert_eq!(b.peer_addr(), Some(a.local_addr().unwrap()));
+        b.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(a.recv_command().unwrap(), Command::NoOp{});
+
+        // forged and replayed datagrams are dropped
+        let raw = UdpSocket::bind("127.0.0.1:0").unwrap();
+        raw.send_to(&[0u8; 100], b_addr).unwrap();
+        let mut replayed = vec![0u8; COUNTER_SIZE];
+        BigEndian::write_u64(&mut replayed, 1);
+        let cipher = XChaCha20Poly1305::new(Key::from_slice(&a.send_key[..]));
+        let ciphertext = cipher.encrypt(XNonce::from_slice(&nonce(&replayed)), Payload {
+            msg: &cmd.to_vec(),
+            aad: &replayed[..],
+        }).unwrap();
+        replayed.extend(ciphertext);
+        raw.send_to(&replayed, b_addr).unwrap();
+        a.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(b.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(b.dropped(), 2);
+        // the forgery did not move the peer address
+        assert_eq!(b.peer_addr(), Some(a.local_addr().unwrap()));
+    }
+}
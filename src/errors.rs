@@ -23,9 +23,37 @@ use std::io::{self};
 use snow::Error as SnowError;
 
 
+/// A coarse classification of failures, the same whichever of the
+/// error types below reports them, so that callers can branch on the
+/// cause of a failure without matching nested variants or messages.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum ErrorKind {
+    AuthenticationFailed,
+    HandshakeTimeout,
+    Timeout,
+    MessageTooLarge,
+    SessionClosed,
+    InvalidCommand,
+    Other,
+}
+
+fn io_error_kind(error: &io::Error) -> ErrorKind {
+    match error.kind() {
+        io::ErrorKind::UnexpectedEof |
+        io::ErrorKind::ConnectionReset |
+        io::ErrorKind::ConnectionAborted |
+        io::ErrorKind::BrokenPipe |
+        io::ErrorKind::NotConnected => ErrorKind::SessionClosed,
+        io::ErrorKind::WouldBlock | io::ErrorKind::TimedOut => ErrorKind::Timeout,
+        _ => ErrorKind::Other,
+    }
+}
+
 #[derive(Debug)]
 pub enum AuthenticationError {
     InvalidSize,
+    NoRemoteStatic,
+    InvalidPeer,
 }
 
 impl fmt::Display for AuthenticationError {
@@ -33,6 +61,8 @@ impl fmt::Display for AuthenticationError {
         use self::AuthenticationError::*;
         match self {
             InvalidSize => write!(f, "Invalid authentication message size."),
+            NoRemoteStatic => write!(f, "Peer static key is not known."),
+            InvalidPeer => write!(f, "Peer rejected by authenticator."),
         }
     }
 }
@@ -43,10 +73,12 @@ impl Error for AuthenticationError {
         "I'm a command error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::AuthenticationError::*;
         match self {
             InvalidSize => None,
+            NoRemoteStatic => None,
+            InvalidPeer => None,
         }
     }
 }
@@ -73,10 +105,10 @@ impl Error for RekeyError {
         "I'm a command error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::RekeyError::*;
         match self {
-            SnowError(_) => None,
+            SnowError(x) => Some(x),
         }
     }
 }
@@ -106,6 +138,28 @@ pub enum CommandError {
     MessageDecodeError,
     InvalidMessageType,
     InvalidStateError,
+    ReauthDecodeError,
+    LinkParametersDecodeError,
+    EchoDecodeError,
+    ErrorCommandDecodeError,
+    DisconnectDecodeError,
+    UnregisteredCommand,
+    CborDecodeError,
+    ProtobufDecodeError,
+    FragmentDecodeError,
+    InvalidFragment,
+    BatchDecodeError,
+    SequenceDecodeError,
+    InvalidSequence,
+    CreditDecodeError,
+    PingDecodeError,
+    VersionDecodeError,
+    CompressedDecodeError,
+    InvalidCompression,
+    StreamDecodeError,
+    UnknownCommand,
+    TraceDecodeError,
+    DatagramKeyDecodeError,
 }
 
 impl fmt::Display for CommandError {
@@ -126,6 +180,28 @@ impl fmt::Display for CommandError {
             MessageDecodeError => write!(f, "Failed to decode a Message command."),
             InvalidMessageType => write!(f, "Failed to decode a Message command with invalid type."),
             InvalidStateError => write!(f, "Encountered invalid state transition."),
+            ReauthDecodeError => write!(f, "Failed to decode a reauthentication command."),
+            LinkParametersDecodeError => write!(f, "Failed to decode a LinkParameters command."),
+            EchoDecodeError => write!(f, "Failed to decode an Echo or EchoReply command."),
+            ErrorCommandDecodeError => write!(f, "Failed to decode an Error command."),
+            DisconnectDecodeError => write!(f, "Failed to decode a Disconnect command."),
+            UnregisteredCommand => write!(f, "Application command ID is not registered."),
+            CborDecodeError => write!(f, "CBOR command decode error."),
+            ProtobufDecodeError => write!(f, "protobuf command decode error."),
+            FragmentDecodeError => write!(f, "Failed to decode a Fragment command."),
+            InvalidFragment => write!(f, "Fragment out of order or inconsistent with the command being reassembled."),
+            BatchDecodeError => write!(f, "Failed to decode a Batch command."),
+            SequenceDecodeError => write!(f, "Failed to decode a Sequenced or Ack command."),
+            InvalidSequence => write!(f, "Sequence number out of order or never sent."),
+            CreditDecodeError => write!(f, "Failed to decode a Credit command."),
+            PingDecodeError => write!(f, "Failed to decode a Ping or Pong command."),
+            VersionDecodeError => write!(f, "Failed to decode a Version command."),
+            CompressedDecodeError => write!(f, "Failed to decode a Compressed or AcceptCompression command."),
+            InvalidCompression => write!(f, "Invalid compressed command."),
+            StreamDecodeError => write!(f, "Failed to decode a StreamOpen, StreamData, StreamClose or StreamWindow command."),
+            UnknownCommand => write!(f, "Unknown command."),
+            TraceDecodeError => write!(f, "Failed to decode a Traced command."),
+            DatagramKeyDecodeError => write!(f, "Failed to decode a DatagramKey command."),
         }
     }
 }
@@ -135,9 +211,9 @@ impl Error for CommandError {
         "I'm a command error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::CommandError::*;
-        match *self {
+        match self {
             InvalidNoiseSpecError => None,
             InvalidLengthError => None,
             InvalidReservedByte => None,
@@ -152,6 +228,28 @@ impl Error for CommandError {
             MessageDecodeError => None,
             InvalidMessageType => None,
             InvalidStateError => None,
+            ReauthDecodeError => None,
+            LinkParametersDecodeError => None,
+            EchoDecodeError => None,
+            ErrorCommandDecodeError => None,
+            DisconnectDecodeError => None,
+            UnregisteredCommand => None,
+            CborDecodeError => None,
+            ProtobufDecodeError => None,
+            FragmentDecodeError => None,
+            InvalidFragment => None,
+            BatchDecodeError => None,
+            SequenceDecodeError => None,
+            InvalidSequence => None,
+            CreditDecodeError => None,
+            PingDecodeError => None,
+            VersionDecodeError => None,
+            CompressedDecodeError => None,
+            InvalidCompression => None,
+            StreamDecodeError => None,
+            UnknownCommand => None,
+            TraceDecodeError => None,
+            DatagramKeyDecodeError => None,
         }
     }
 }
@@ -199,9 +297,9 @@ impl Error for ClientHandshakeError {
         "I'm a client handshake error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::ClientHandshakeError::*;
-        match *self {
+        match self {
             InvalidNoiseSpecError => None,
             NoPeerKeyError => None,
             SessionCreateError => None,
@@ -214,7 +312,7 @@ impl Error for ClientHandshakeError {
             FailedToGetRemoteStatic => None,
             FailedToDecodeRemoteStatic => None,
             InvalidStateError => None,
-            SnowError(_) => None,
+            SnowError(x) => Some(x),
         }
     }
 }
@@ -241,6 +339,7 @@ pub enum ServerHandshakeError {
     FailedToGetRemoteStatic,
     FailedToDecodeRemoteStatic,
     InvalidStateError,
+    ReplayError,
     SnowError(SnowError),
 }
 
@@ -261,6 +360,7 @@ impl fmt::Display for ServerHandshakeError {
             FailedToGetRemoteStatic => write!(f, "Failed to get remote static key."),
             FailedToDecodeRemoteStatic => write!(f, "Failed to decode remote static key."),
             InvalidStateError => write!(f, "Invalid state transition."),
+            ReplayError => write!(f, "Replayed handshake message."),
             SnowError(x) => x.fmt(f),
         }
     }
@@ -271,9 +371,9 @@ impl Error for ServerHandshakeError {
         "I'm a server handshake error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::ServerHandshakeError::*;
-        match *self {
+        match self {
             PrologueMismatchError => None,
             InvalidNoiseSpecError => None,
             NoPeerKeyError => None,
@@ -287,7 +387,8 @@ impl Error for ServerHandshakeError {
             FailedToGetRemoteStatic => None,
             FailedToDecodeRemoteStatic => None,
             InvalidStateError => None,
-            SnowError(_) => None,
+            ReplayError => None,
+            SnowError(x) => Some(x),
         }
     }
 }
@@ -308,10 +409,15 @@ pub enum HandshakeError {
     ServerHandshakeError(ServerHandshakeError),
     InvalidStateError,
     InvalidHandshakeFinalize,
+    InvalidEarlyCommand,
+    TimeoutError,
     IOError(io::Error),
     SnowError(SnowError),
     ReceiveMessageError(ReceiveMessageError),
     SendMessageError(SendMessageError),
+    LinkParametersMismatch,
+    RandomError,
+    ConfigError(ConfigError),
 }
 
 impl fmt::Display for HandshakeError {
@@ -324,8 +430,16 @@ impl fmt::Display for HandshakeError {
             ClientHandshakeError(x) => x.fmt(f),
             ServerHandshakeError(x) => x.fmt(f),
             InvalidHandshakeFinalize => write!(f, "Invalid command received from handshake finalization."),
+            InvalidEarlyCommand => write!(f, "Early commands must be idempotent and sent by the initiator."),
+            TimeoutError => write!(f, "Handshake timed out."),
             InvalidStateError => write!(f, "Impossible error like this should never happen."),
-            _ => write!(f, "Impossible error like this should never happen."),
+            LinkParametersMismatch => write!(f, "Peer link parameters do not match ours."),
+            IOError(x) => x.fmt(f),
+            SnowError(x) => x.fmt(f),
+            ReceiveMessageError(x) => x.fmt(f),
+            SendMessageError(x) => x.fmt(f),
+            RandomError => write!(f, "Failed to get random bytes."),
+            ConfigError(x) => x.fmt(f),
         }
     }
 }
@@ -335,24 +449,55 @@ impl Error for HandshakeError {
         "I'm a handshake error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::HandshakeError::*;
         match self {
             InvalidNoiseSpecError => None,
             NoPeerKeyError => None,
             SessionCreateError => None,
-            ClientHandshakeError(x) => x.source(),
-            ServerHandshakeError(x) => x.source(),
+            ClientHandshakeError(x) => Some(x),
+            ServerHandshakeError(x) => Some(x),
             InvalidStateError => None,
-            IOError(x) => x.source(),
-            SnowError(_) => None,
-            ReceiveMessageError(x) => x.source(),
-            SendMessageError(x) => x.source(),
+            IOError(x) => Some(x),
+            SnowError(x) => Some(x),
+            ReceiveMessageError(x) => Some(x),
+            SendMessageError(x) => Some(x),
             InvalidHandshakeFinalize => None,
+            InvalidEarlyCommand => None,
+            TimeoutError => None,
+            LinkParametersMismatch => None,
+            RandomError => None,
+            ConfigError(x) => Some(x),
+        }
+    }
+}
+
+impl HandshakeError {
+    pub fn kind(&self) -> ErrorKind {
+        use self::HandshakeError::*;
+        match self {
+            ClientHandshakeError(self::ClientHandshakeError::AuthenticationError) |
+            ClientHandshakeError(self::ClientHandshakeError::FailedToGetRemoteStatic) |
+            ClientHandshakeError(self::ClientHandshakeError::FailedToDecodeRemoteStatic) |
+            ServerHandshakeError(self::ServerHandshakeError::AuthenticationError) |
+            ServerHandshakeError(self::ServerHandshakeError::FailedToGetRemoteStatic) |
+            ServerHandshakeError(self::ServerHandshakeError::FailedToDecodeRemoteStatic) => ErrorKind::AuthenticationFailed,
+            TimeoutError => ErrorKind::HandshakeTimeout,
+            InvalidHandshakeFinalize => ErrorKind::InvalidCommand,
+            IOError(x) => io_error_kind(x),
+            ReceiveMessageError(x) => x.kind(),
+            SendMessageError(x) => x.kind(),
+            _ => ErrorKind::Other,
         }
     }
 }
 
+impl From<ConfigError> for HandshakeError {
+    fn from(error: ConfigError) -> Self {
+        HandshakeError::ConfigError(error)
+    }
+}
+
 impl From<SendMessageError> for HandshakeError {
     fn from(error: SendMessageError) -> Self {
         HandshakeError::SendMessageError(error)
@@ -396,6 +541,10 @@ pub enum SendMessageError {
     EncryptFail,
     RekeyError(RekeyError),
     IOError(io::Error),
+    TimeoutError,
+    SessionClosed,
+    WouldBlock,
+    UnsupportedCommand(&'static str),
 }
 
 impl fmt::Display for SendMessageError {
@@ -406,6 +555,10 @@ impl fmt::Display for SendMessageError {
             EncryptFail => write!(f, "Failure to encrypt."),
             IOError(ref x) => x.fmt(f),
             RekeyError(x) => x.fmt(f),
+            TimeoutError => write!(f, "Timeout sending command."),
+            SessionClosed => write!(f, "Session is closed."),
+            WouldBlock => write!(f, "The send queue is full."),
+            UnsupportedCommand(name) => write!(f, "The protocol version does not carry {} commands.", name),
         }
     }
 }
@@ -415,13 +568,30 @@ impl Error for SendMessageError {
         "I'm a send message error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::SendMessageError::*;
         match self {
             InvalidMessageSize => None,
             EncryptFail => None,
-            IOError(_) => None,
-            RekeyError(x) => x.source(),
+            IOError(x) => Some(x),
+            RekeyError(x) => Some(x),
+            TimeoutError => None,
+            SessionClosed => None,
+            WouldBlock => None,
+            UnsupportedCommand(_) => None,
+        }
+    }
+}
+
+impl SendMessageError {
+    pub fn kind(&self) -> ErrorKind {
+        use self::SendMessageError::*;
+        match self {
+            InvalidMessageSize => ErrorKind::MessageTooLarge,
+            TimeoutError => ErrorKind::Timeout,
+            SessionClosed => ErrorKind::SessionClosed,
+            IOError(x) => io_error_kind(x),
+            _ => ErrorKind::Other,
         }
     }
 }
@@ -446,6 +616,10 @@ pub enum ReceiveMessageError {
     CommandError(CommandError),
     IOError(io::Error),
     RekeyError(RekeyError),
+    SendMessageError(SendMessageError),
+    TimeoutError,
+    IdleTimeout,
+    ReassemblyTimeout,
 }
 
 impl fmt::Display for ReceiveMessageError {
@@ -457,6 +631,10 @@ impl fmt::Display for ReceiveMessageError {
             CommandError(x) => x.fmt(f),
             IOError(ref x) => x.fmt(f),
             RekeyError(x) => x.fmt(f),
+            SendMessageError(x) => x.fmt(f),
+            TimeoutError => write!(f, "Timeout receiving command."),
+            IdleTimeout => write!(f, "Session closed after the idle timeout."),
+            ReassemblyTimeout => write!(f, "Timeout reassembling a fragmented command."),
         }
     }
 }
@@ -466,14 +644,33 @@ impl Error for ReceiveMessageError {
         "I'm a receive message error."
     }
 
-    fn cause(&self) -> Option<&dyn Error> {
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
         use self::ReceiveMessageError::*;
         match self {
             InvalidMessageSize => None,
             DecryptFail => None,
-            CommandError(_) => None,
-            IOError(_) => None,
-            RekeyError(x) => x.source(),
+            CommandError(x) => Some(x),
+            IOError(x) => Some(x),
+            RekeyError(x) => Some(x),
+            SendMessageError(x) => Some(x),
+            TimeoutError => None,
+            IdleTimeout => None,
+            ReassemblyTimeout => None,
+        }
+    }
+}
+
+impl ReceiveMessageError {
+    pub fn kind(&self) -> ErrorKind {
+        use self::ReceiveMessageError::*;
+        match self {
+            InvalidMessageSize => ErrorKind::MessageTooLarge,
+            CommandError(_) => ErrorKind::InvalidCommand,
+            TimeoutError => ErrorKind::Timeout,
+            IdleTimeout => ErrorKind::SessionClosed,
+            IOError(x) => io_error_kind(x),
+            SendMessageError(x) => x.kind(),
+            _ => ErrorKind::Other,
         }
     }
 }
@@ -490,8 +687,348 @@ impl From<CommandError> for ReceiveMessageError {
     }
 }
 
+impl From<SendMessageError> for ReceiveMessageError {
+    fn from(error: SendMessageError) -> Self {
+        ReceiveMessageError::SendMessageError(error)
+    }
+}
+
 impl From<io::Error> for ReceiveMessageError {
     fn from(error: io::Error) -> Self {
         ReceiveMessageError::IOError(error)
     }
 }
+
+
+#[derive(Debug)]
+pub enum KeyFileError {
+    InvalidFormat,
+    KeyDerivationError,
+    DecryptFail,
+    RandomError,
+    IOError(io::Error),
+}
+
+impl fmt::Display for KeyFileError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::KeyFileError::*;
+        match self {
+            InvalidFormat => write!(f, "Invalid key file format."),
+            KeyDerivationError => write!(f, "Failed to derive the key file encryption key."),
+            DecryptFail => write!(f, "Failed to decrypt key file, wrong passphrase or corrupted file."),
+            RandomError => write!(f, "Failed to get randomness from the operating system."),
+            IOError(x) => x.fmt(f),
+        }
+    }
+}
+
+impl Error for KeyFileError {
+    fn description(&self) -> &str {
+        "I'm a key file error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        use self::KeyFileError::*;
+        match self {
+            InvalidFormat => None,
+            KeyDerivationError => None,
+            DecryptFail => None,
+            RandomError => None,
+            IOError(x) => Some(x),
+        }
+    }
+}
+
+impl From<io::Error> for KeyFileError {
+    fn from(error: io::Error) -> Self {
+        KeyFileError::IOError(error)
+    }
+}
+
+
+#[derive(Debug)]
+pub enum PemError {
+    InvalidFormat,
+    InvalidLabel,
+    InvalidBase64,
+    InvalidSize,
+}
+
+impl fmt::Display for PemError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::PemError::*;
+        match self {
+            InvalidFormat => write!(f, "Invalid PEM block."),
+            InvalidLabel => write!(f, "Unexpected PEM label."),
+            InvalidBase64 => write!(f, "Invalid base64 in PEM block."),
+            InvalidSize => write!(f, "Invalid PEM payload size."),
+        }
+    }
+}
+
+impl Error for PemError {
+    fn description(&self) -> &str {
+        "I'm a PEM error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        None
+    }
+}
+
+
+#[derive(Debug)]
+pub enum ReauthenticationError {
+    RandomError,
+    AuthenticationError(AuthenticationError),
+    SendMessageError(SendMessageError),
+    ReceiveMessageError(ReceiveMessageError),
+}
+
+impl fmt::Display for ReauthenticationError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::ReauthenticationError::*;
+        match self {
+            RandomError => write!(f, "Failed to get randomness from the operating system."),
+            AuthenticationError(x) => x.fmt(f),
+            SendMessageError(x) => x.fmt(f),
+            ReceiveMessageError(x) => x.fmt(f),
+        }
+    }
+}
+
+impl Error for ReauthenticationError {
+    fn description(&self) -> &str {
+        "I'm a reauthentication error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        use self::ReauthenticationError::*;
+        match self {
+            RandomError => None,
+            AuthenticationError(x) => Some(x),
+            SendMessageError(x) => Some(x),
+            ReceiveMessageError(x) => Some(x),
+        }
+    }
+}
+
+impl ReauthenticationError {
+    pub fn kind(&self) -> ErrorKind {
+        use self::ReauthenticationError::*;
+        match self {
+            AuthenticationError(_) => ErrorKind::AuthenticationFailed,
+            SendMessageError(x) => x.kind(),
+            ReceiveMessageError(x) => x.kind(),
+            RandomError => ErrorKind::Other,
+        }
+    }
+}
+
+impl From<AuthenticationError> for ReauthenticationError {
+    fn from(error: AuthenticationError) -> Self {
+        ReauthenticationError::AuthenticationError(error)
+    }
+}
+
+impl From<SendMessageError> for ReauthenticationError {
+    fn from(error: SendMessageError) -> Self {
+        ReauthenticationError::SendMessageError(error)
+    }
+}
+
+impl From<ReceiveMessageError> for ReauthenticationError {
+    fn from(error: ReceiveMessageError) -> Self {
+        ReauthenticationError::ReceiveMessageError(error)
+    }
+}
+
+
+#[derive(Debug)]
+pub enum PkiError {
+    ConsensusNotFound,
+    ConsensusGone,
+    Rejected(u8),
+    UnexpectedCommand,
+    SendMessageError(SendMessageError),
+    ReceiveMessageError(ReceiveMessageError),
+}
+
+impl fmt::Display for PkiError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::PkiError::*;
+        match self {
+            ConsensusNotFound => write!(f, "No consensus for the epoch yet."),
+            ConsensusGone => write!(f, "The consensus for the epoch is no longer available."),
+            Rejected(x) => write!(f, "The authority rejected the request with status {}.", x),
+            UnexpectedCommand => write!(f, "Unexpected answer from the authority."),
+            SendMessageError(x) => x.fmt(f),
+            ReceiveMessageError(x) => x.fmt(f),
+        }
+    }
+}
+
+impl Error for PkiError {
+    fn description(&self) -> &str {
+        "I'm a PKI error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        use self::PkiError::*;
+        match self {
+            ConsensusNotFound => None,
+            ConsensusGone => None,
+            Rejected(_) => None,
+            UnexpectedCommand => None,
+            SendMessageError(x) => Some(x),
+            ReceiveMessageError(x) => Some(x),
+        }
+    }
+}
+
+impl PkiError {
+    pub fn kind(&self) -> ErrorKind {
+        use self::PkiError::*;
+        match self {
+            UnexpectedCommand => ErrorKind::InvalidCommand,
+            SendMessageError(x) => x.kind(),
+            ReceiveMessageError(x) => x.kind(),
+            _ => ErrorKind::Other,
+        }
+    }
+}
+
+impl From<SendMessageError> for PkiError {
+    fn from(error: SendMessageError) -> Self {
+        PkiError::SendMessageError(error)
+    }
+}
+
+impl From<ReceiveMessageError> for PkiError {
+    fn from(error: ReceiveMessageError) -> Self {
+        PkiError::ReceiveMessageError(error)
+    }
+}
+
+
+#[derive(Debug)]
+pub enum IdentityError {
+    InvalidSize,
+    InvalidIdentityKey,
+    InvalidSignature,
+}
+
+impl fmt::Display for IdentityError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::IdentityError::*;
+        match self {
+            InvalidSize => write!(f, "Invalid identity binding size."),
+            InvalidIdentityKey => write!(f, "Invalid identity public key."),
+            InvalidSignature => write!(f, "Identity signature verification failed."),
+        }
+    }
+}
+
+impl Error for IdentityError {
+    fn description(&self) -> &str {
+        "I'm an identity binding error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        None
+    }
+}
+
+
+/// A SessionConfig field that is invalid, see SessionConfig::validate.
+#[derive(Debug)]
+pub enum ConfigError {
+    AdditionalDataTooLarge,
+    NoVersions,
+    MissingPeerPublicKey,
+    NextAuthenticationKeyOnInitiator,
+    MultipleVersionsOnInitiator,
+    FirstContactOnResponder,
+    ZeroHandshakeTimeout,
+    ZeroMaxCommandSize,
+    ThresholdRekeyOnKatzenpost,
+    CompressionUnavailable,
+}
+
+impl fmt::Display for ConfigError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::ConfigError::*;
+        match self {
+            AdditionalDataTooLarge => write!(f, "additional_data is longer than MAX_ADDITIONAL_DATA_SIZE bytes."),
+            NoVersions => write!(f, "versions is empty."),
+            MissingPeerPublicKey => write!(f, "peer_public_key is required by the handshake pattern or authenticator."),
+            NextAuthenticationKeyOnInitiator => write!(f, "next_authentication_key is only used by responders."),
+            MultipleVersionsOnInitiator => write!(f, "versions holds more than one version, which only responders accept."),
+            FirstContactOnResponder => write!(f, "authenticator FirstContact is only used by initiators."),
+            ZeroHandshakeTimeout => write!(f, "handshake_timeout is zero."),
+            ZeroMaxCommandSize => write!(f, "max_command_size is zero."),
+            ThresholdRekeyOnKatzenpost => write!(f, "rekey_policy Threshold sends Rekey commands, which PROTOCOL_VERSION in versions does not carry."),
+            CompressionUnavailable => write!(f, "compression_threshold needs the compression feature."),
+        }
+    }
+}
+
+impl Error for ConfigError {
+    fn description(&self) -> &str {
+        "I'm a session configuration error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        None
+    }
+}
+
+
+/// An application command that cannot be registered, see
+/// CommandRegistry::register.
+#[derive(Debug)]
+pub enum RegistryError {
+    ReservedId,
+    DuplicateId,
+}
+
+impl fmt::Display for RegistryError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        use self::RegistryError::*;
+        match self {
+            ReservedId => write!(f, "Command ID is below MIN_APPLICATION_COMMAND_ID."),
+            DuplicateId => write!(f, "Command ID is already registered."),
+        }
+    }
+}
+
+impl Error for RegistryError {
+    fn description(&self) -> &str {
+        "I'm a command registry error."
+    }
+
+    fn source(&self) -> Option<&(dyn Error + 'static)> {
+        None
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn error_kind_test() {
+        let error = HandshakeError::from(ReceiveMessageError::from(io::Error::from(io::ErrorKind::UnexpectedEof)));
+        assert_eq!(error.kind(), ErrorKind::SessionClosed);
+        let error = HandshakeError::from(ServerHandshakeError::AuthenticationError);
+        assert_eq!(error.kind(), ErrorKind::AuthenticationFailed);
+        assert_eq!(HandshakeError::TimeoutError.kind(), ErrorKind::HandshakeTimeout);
+
+        // the wrapped errors are reachable through source
+        let error = HandshakeError::from(SendMessageError::from(io::Error::from(io::ErrorKind::BrokenPipe)));
+        let send_error = error.source().unwrap().downcast_ref::<SendMessageError>().unwrap();
+        assert_eq!(send_error.kind(), ErrorKind::SessionClosed);
+        assert!(send_error.source().unwrap().downcast_ref::<io::Error>().is_some());
+    }
+}
@@ -0,0 +1,101 @@
+// identity.rs - Ed25519 identity binding of link keys
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Ed25519 identity binding of link keys.
+//!
+//! A binding is an Ed25519 identity public key followed by its
+//! signature over the link public key. It is sent as the handshake
+//! additional data, so an authenticator can check that a peer's link
+//! key belongs to an identity without an out of band lookup.
+
+extern crate ed25519_dalek;
+
+use x25519_dalek_ng::PublicKey;
+
+use self::ed25519_dalek::{Signature, Signer, SigningKey, VerifyingKey};
+
+use super::constants::KEY_SIZE;
+use super::errors::IdentityError;
+use super::messages::PeerCredentials;
+
+const SIGNATURE_SIZE: usize = 64;
+const BINDING_CONTEXT: &[u8] = b"mix_link identity binding v1";
+
+/// The size of an identity binding.
+pub const IDENTITY_BINDING_SIZE: usize = KEY_SIZE + SIGNATURE_SIZE;
+
+fn signed_message(link_public_key: &PublicKey) -> Vec<u8> {
+    let mut message = BINDING_CONTEXT.to_vec();
+    message.extend_from_slice(link_public_key.as_bytes());
+    message
+}
+
+/// Returns the binding of link_public_key to identity_key, for use
+/// as the session's additional data.
+pub fn identity_binding(identity_key: &SigningKey, link_public_key: &PublicKey) -> Vec<u8> {
+    let signature = identity_key.sign(&signed_message(link_public_key));
+    let mut binding = identity_key.verifying_key().to_bytes().to_vec();
+    binding.extend_from_slice(&signature.to_bytes());
+    binding
+}
+
+/// Verifies the binding carried in a peer's additional data and
+/// returns the identity it binds the peer's link key to.
+pub fn verify_identity_binding(peer_credentials: &PeerCredentials) -> Result<VerifyingKey, IdentityError> {
+    let binding = &peer_credentials.additional_data;
+    if binding.len() != IDENTITY_BINDING_SIZE {
+        return Err(IdentityError::InvalidSize);
+    }
+    let identity_key = match VerifyingKey::from_bytes(array_ref![binding, 0, KEY_SIZE]) {
+        Ok(x) => x,
+        Err(_) => return Err(IdentityError::InvalidIdentityKey),
+    };
+    let signature = Signature::from_bytes(array_ref![binding, KEY_SIZE, SIGNATURE_SIZE]);
+    match identity_key.verify_strict(&signed_message(&peer_credentials.public_key), &signature) {
+        Ok(()) => Ok(identity_key),
+        Err(_) => Err(IdentityError::InvalidSignature),
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use super::*;
+    use self::rand_core::OsRng;
+
+    #[test]
+    fn identity_binding_test() {
+        let identity_key = SigningKey::from_bytes(&[7u8; KEY_SIZE]);
+        let link_public_key = PublicKey::from(&StaticSecret::new(OsRng));
+        let mut peer_credentials = PeerCredentials {
+            public_key: link_public_key,
+            additional_data: identity_binding(&identity_key, &link_public_key),
+        };
+        assert_eq!(peer_credentials.additional_data.len(), IDENTITY_BINDING_SIZE);
+        assert_eq!(verify_identity_binding(&peer_credentials).unwrap(), identity_key.verifying_key());
+
+        // the binding does not transfer to another link key
+        peer_credentials.public_key = PublicKey::from(&StaticSecret::new(OsRng));
+        match verify_identity_binding(&peer_credentials) {
+            Err(IdentityError::InvalidSignature) => {},
+            _ => panic!("expected signature verification to fail"),
+        }
+    }
+}
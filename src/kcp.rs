@@ -0,0 +1,1234 @@
+// kcp.rs - KCP reliable UDP transport
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! A reliable transport over UDP using KCP, for lossy, high latency
+//! paths such as satellite links and congested mobile networks where
+//! TCP throughput collapses. KCP is an ARQ protocol trading bandwidth
+//! for latency: it retransmits sooner than TCP, optionally on
+//! duplicate acknowledgements alone, and may send without congestion
+//! control. The segments are those of the reference implementation,
+//! ikcp, in stream mode; an empty segment marks the end of a side's
+//! stream, which ikcp lacks.
+//!
+//! KCP has no handshake, so dialing succeeds at once and the Noise
+//! handshake that follows finds out whether the peer is there. KCP
+//! adds no security of its own; Noise authenticates the peers and
+//! protects the session. The tuning knobs are in KcpConfig.
+//!
+//! UDP source addresses are trivially spoofed, so before a listener
+//! commits any state to a conversation it checks that the client
+//! receives at its address, as DTLS and WireGuard do. The listener
+//! answers the first datagram of an unknown conversation with a
+//! cookie, a MAC over the client's address and conversation under a
+//! secret of the listener's, in a segment no larger than the
+//! datagram; the client echoes the cookie ahead of its segments until
+//! the listener answers it. A spoofed client so never gets a
+//! conversation, and the listener sends it no more than it was sent.
+
+extern crate getrandom;
+extern crate hmac;
+extern crate sha2;
+
+use std::cmp;
+use std::collections::{HashMap, VecDeque};
+use std::io;
+use std::io::prelude::*;
+use std::net::{Shutdown, SocketAddr, ToSocketAddrs, UdpSocket};
+use std::sync::{Arc, Condvar, Mutex, MutexGuard};
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::mpsc::{channel, Receiver, Sender};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use byteorder::{ByteOrder, BigEndian, LittleEndian};
+use zeroize::Zeroizing;
+
+use self::hmac::{Hmac, Mac};
+use self::sha2::Sha256;
+
+use super::transport::Transport;
+
+const OVERHEAD: usize = 24;
+
+const CMD_PUSH: u8 = 81;
+const CMD_ACK: u8 = 82;
+const CMD_WASK: u8 = 83;
+const CMD_WINS: u8 = 84;
+// Not ikcp's: carries a listener's cookie, see the module
+// documentation.
+const CMD_COOKIE: u8 = 85;
+
+const COOKIE_SIZE: usize = 16;
+const COOKIE_SEGMENT_SIZE: usize = OVERHEAD + COOKIE_SIZE;
+// Cookies are accepted in the period they were made in and the next.
+const COOKIE_PERIOD_SECS: u64 = 60;
+// The most conversations a listener has waiting to be accepted, and
+// the most it runs at once.
+const MAX_PENDING: usize = 128;
+const MAX_CONVERSATIONS: usize = 1024;
+
+const ASK_SEND: u32 = 1;
+const ASK_TELL: u32 = 2;
+
+const RTO_NODELAY: u32 = 30;
+const RTO_MIN: u32 = 100;
+const RTO_DEFAULT: u32 = 200;
+const RTO_MAX: u32 = 60000;
+
+const MIN_RECEIVE_WINDOW: u32 = 128;
+const THRESH_INIT: u32 = 2;
+const THRESH_MIN: u32 = 2;
+const PROBE_INIT: u32 = 7000;
+const PROBE_LIMIT: u32 = 120000;
+const FAST_RESEND_LIMIT: u32 = 5;
+// Transmissions of a segment after which the peer is taken for gone.
+const DEAD_LINK: u32 = 20;
+
+// How long a connection whose handles are all dropped keeps
+// retransmitting what it has sent.
+const LINGER: Duration = Duration::from_secs(10);
+// How often reader threads check whether their connection is done.
+const POLL_INTERVAL: Duration = Duration::from_millis(100);
+const MAX_DATAGRAM_SIZE: usize = 65536;
+
+// Compares sequence numbers and timestamps, which wrap.
+fn diff(later: u32, earlier: u32) -> i32 {
+    later.wrapping_sub(earlier) as i32
+}
+
+/// The tuning knobs of KCP, see its documentation. The defaults are
+/// ikcp's, which behave much like TCP; fast is its fastest mode.
+#[derive(PartialEq, Debug, Clone)]
+pub struct KcpConfig {
+    /// Retransmits sooner and backs off more gently after a timeout,
+    /// with a minimum retransmission timeout of 30ms rather than
+    /// 100ms.
+    pub nodelay: bool,
+    /// The interval of the internal clock, between 10ms and 5s. A
+    /// shorter one reacts to loss sooner at some cost in CPU.
+    pub interval: Duration,
+    /// Retransmits a segment once this many later ones are
+    /// acknowledged, without waiting for a timeout; 0 waits.
+    pub fast_resend: u32,
+    /// Sends as fast as the windows allow, ignoring loss. This suits
+    /// links where loss is not a sign of congestion.
+    pub no_congestion_control: bool,
+    /// The most segments in flight.
+    pub send_window: u32,
+    /// The most segments buffered for reading, at least 128.
+    pub receive_window: u32,
+    /// The largest datagram sent.
+    pub mtu: usize,
+}
+
+impl Default for KcpConfig {
+    fn default() -> Self {
+        KcpConfig {
+            nodelay: false,
+            interval: Duration::from_millis(100),
+            fast_resend: 0,
+            no_congestion_control: false,
+            send_window: 32,
+            receive_window: 128,
+            mtu: 1400,
+        }
+    }
+}
+
+impl KcpConfig {
+    /// Returns the configuration KCP recommends for the lowest
+    /// latency, with larger windows for long fat paths.
+    pub fn fast() -> KcpConfig {
+        KcpConfig {
+            nodelay: true,
+            interval: Duration::from_millis(10),
+            fast_resend: 2,
+            no_congestion_control: true,
+            send_window: 256,
+            receive_window: 256,
+            mtu: 1400,
+        }
+    }
+}
+
+struct Segment {
+    cmd: u8,
+    wnd: u16,
+    ts: u32,
+    sn: u32,
+    una: u32,
+    resendts: u32,
+    rto: u32,
+    fastack: u32,
+    xmit: u32,
+    data: Vec<u8>,
+}
+
+impl Segment {
+    fn new(cmd: u8, data: Vec<u8>) -> Segment {
+        Segment {
+            cmd,
+            wnd: 0,
+            ts: 0,
+            sn: 0,
+            una: 0,
+            resendts: 0,
+            rto: 0,
+            fastack: 0,
+            xmit: 0,
+            data,
+        }
+    }
+
+    fn encode(&self, conv: u32, out: &mut Vec<u8>) {
+        let mut header = [0u8; OVERHEAD];
+        LittleEndian::write_u32(&mut header[0..4], conv);
+        header[4] = self.cmd;
+        LittleEndian::write_u16(&mut header[6..8], self.wnd);
+        LittleEndian::write_u32(&mut header[8..12], self.ts);
+        LittleEndian::write_u32(&mut header[12..16], self.sn);
+        LittleEndian::write_u32(&mut header[16..20], self.una);
+        LittleEndian::write_u32(&mut header[20..24], self.data.len() as u32);
+        out.extend(&header);
+        out.extend(&self.data);
+    }
+}
+
+// The KCP state machine, after ikcp. Time is in milliseconds from an
+// arbitrary start. Datagrams to send are left in output.
+struct Kcp {
+    conv: u32,
+    mtu: usize,
+    mss: usize,
+    dead: bool,
+    snd_una: u32,
+    snd_nxt: u32,
+    rcv_nxt: u32,
+    ssthresh: u32,
+    rx_rttval: i32,
+    rx_srtt: i32,
+    rx_rto: u32,
+    rx_minrto: u32,
+    snd_wnd: u32,
+    rcv_wnd: u32,
+    rmt_wnd: u32,
+    cwnd: u32,
+    incr: u32,
+    probe: u32,
+    current: u32,
+    interval: u32,
+    ts_flush: u32,
+    updated: bool,
+    ts_probe: u32,
+    probe_wait: u32,
+    nodelay: bool,
+    fastresend: u32,
+    nocwnd: bool,
+    snd_queue: VecDeque<Segment>,
+    snd_buf: VecDeque<Segment>,
+    rcv_queue: VecDeque<Segment>,
+    rcv_buf: VecDeque<Segment>,
+    acklist: Vec<(u32, u32)>,
+    output: Vec<Vec<u8>>,
+}
+
+impl Kcp {
+    fn new(conv: u32, config: &KcpConfig) -> Kcp {
+        let mtu = cmp::max(config.mtu, OVERHEAD + 1);
+        let interval = cmp::min(cmp::max(config.interval.as_millis() as u32, 10), 5000);
+        Kcp {
+            conv,
+            mtu,
+            mss: mtu - OVERHEAD,
+            dead: false,
+            snd_una: 0,
+            snd_nxt: 0,
+            rcv_nxt: 0,
+            ssthresh: THRESH_INIT,
+            rx_rttval: 0,
+            rx_srtt: 0,
+            rx_rto: RTO_DEFAULT,
+            rx_minrto: if config.nodelay { RTO_NODELAY } else { RTO_MIN },
+            snd_wnd: cmp::max(config.send_window, 1),
+            rcv_wnd: cmp::max(config.receive_window, MIN_RECEIVE_WINDOW),
+            rmt_wnd: MIN_RECEIVE_WINDOW,
+            cwnd: 0,
+            incr: 0,
+            probe: 0,
+            current: 0,
+            interval,
+            ts_flush: interval,
+            updated: false,
+            ts_probe: 0,
+            probe_wait: 0,
+            nodelay: config.nodelay,
+            fastresend: config.fast_resend,
+            nocwnd: config.no_congestion_control,
+            snd_queue: VecDeque::new(),
+            snd_buf: VecDeque::new(),
+            rcv_queue: VecDeque::new(),
+            rcv_buf: VecDeque::new(),
+            acklist: vec![],
+            output: vec![],
+        }
+    }
+
+    // Queues data, filling up the last segment queued first.
+    fn send(&mut self, mut data: &[u8]) {
+        if let Some(last) = self.snd_queue.back_mut() {
+            if !last.data.is_empty() && last.data.len() < self.mss {
+                let n = cmp::min(self.mss - last.data.len(), data.len());
+                last.data.extend(&data[..n]);
+                data = &data[n..];
+            }
+        }
+        for chunk in data.chunks(self.mss) {
+            self.snd_queue.push_back(Segment::new(CMD_PUSH, chunk.to_vec()));
+        }
+    }
+
+    // Queues the empty segment ending the stream.
+    fn send_fin(&mut self) {
+        self.snd_queue.push_back(Segment::new(CMD_PUSH, vec![]));
+    }
+
+    fn waitsnd(&self) -> usize {
+        self.snd_buf.len() + self.snd_queue.len()
+    }
+
+    // Treats the segments in flight as never sent, so that the next
+    // flush sends them at once, for when the listener dropped them
+    // for want of a cookie.
+    fn resend_all(&mut self) {
+        for seg in self.snd_buf.iter_mut() {
+            seg.xmit = 0;
+        }
+    }
+
+    // Reads into buf, returning None at the end of the stream.
+    fn recv(&mut self, buf: &mut [u8]) -> Option<usize> {
+        let recover = self.rcv_queue.len() as u32 >= self.rcv_wnd;
+        let mut n = 0;
+        while n < buf.len() {
+            // Segments are removed once read, so an empty one is the end.
+            let done = match self.rcv_queue.front_mut() {
+                None => break,
+                Some(ref seg) if seg.data.is_empty() => {
+                    if n == 0 {
+                        return None
+                    }
+                    break
+                },
+                Some(seg) => {
+                    let m = cmp::min(buf.len() - n, seg.data.len());
+                    buf[n..n + m].copy_from_slice(&seg.data[..m]);
+                    seg.data.drain(..m);
+                    n += m;
+                    seg.data.is_empty()
+                },
+            };
+            if done {
+                self.rcv_queue.pop_front();
+            }
+        }
+        self.move_received();
+        if recover && (self.rcv_queue.len() as u32) < self.rcv_wnd {
+            self.probe |= ASK_TELL;
+        }
+        Some(n)
+    }
+
+    fn has_data(&self) -> bool {
+        !self.rcv_queue.is_empty()
+    }
+
+    fn move_received(&mut self) {
+        while (self.rcv_queue.len() as u32) < self.rcv_wnd {
+            match self.rcv_buf.front() {
+                Some(seg) if seg.sn == self.rcv_nxt => {},
+                _ => break,
+            }
+            let seg = self.rcv_buf.pop_front().unwrap();
+            self.rcv_queue.push_back(seg);
+            self.rcv_nxt = self.rcv_nxt.wrapping_add(1);
+        }
+    }
+
+    fn update_ack(&mut self, rtt: i32) {
+        if self.rx_srtt == 0 {
+            self.rx_srtt = rtt;
+            self.rx_rttval = rtt / 2;
+        } else {
+            let delta = (rtt - self.rx_srtt).abs();
+            self.rx_rttval = (3 * self.rx_rttval + delta) / 4;
+            self.rx_srtt = cmp::max((7 * self.rx_srtt + rtt) / 8, 1);
+        }
+        let rto = self.rx_srtt as u32 + cmp::max(self.interval, 4 * self.rx_rttval as u32);
+        self.rx_rto = cmp::min(cmp::max(rto, self.rx_minrto), RTO_MAX);
+    }
+
+    fn shrink_buf(&mut self) {
+        self.snd_una = self.snd_buf.front().map_or(self.snd_nxt, |x| x.sn);
+    }
+
+    fn parse_ack(&mut self, sn: u32) {
+        if diff(sn, self.snd_una) < 0 || diff(sn, self.snd_nxt) >= 0 {
+            return
+        }
+        if let Some(i) = self.snd_buf.iter().position(|x| x.sn == sn) {
+            self.snd_buf.remove(i);
+        }
+    }
+
+    fn parse_una(&mut self, una: u32) {
+        while self.snd_buf.front().map_or(false, |x| diff(una, x.sn) > 0) {
+            self.snd_buf.pop_front();
+        }
+    }
+
+    fn parse_fastack(&mut self, sn: u32) {
+        if diff(sn, self.snd_una) < 0 || diff(sn, self.snd_nxt) >= 0 {
+            return
+        }
+        for seg in self.snd_buf.iter_mut() {
+            if diff(sn, seg.sn) < 0 {
+                break
+            }
+            if sn != seg.sn {
+                seg.fastack += 1;
+            }
+        }
+    }
+
+    fn parse_data(&mut self, seg: Segment) {
+        if diff(seg.sn, self.rcv_nxt.wrapping_add(self.rcv_wnd)) >= 0 || diff(seg.sn, self.rcv_nxt) < 0 {
+            return
+        }
+        let mut i = self.rcv_buf.len();
+        while i > 0 {
+            let sn = self.rcv_buf[i - 1].sn;
+            if sn == seg.sn {
+                return
+            }
+            if diff(seg.sn, sn) > 0 {
+                break
+            }
+            i -= 1;
+        }
+        self.rcv_buf.insert(i, seg);
+        self.move_received();
+    }
+
+    // Handles a datagram from the peer, failing if it is not KCP of
+    // this conversation.
+    fn input(&mut self, mut data: &[u8]) -> Result<(), ()> {
+        let prev_una = self.snd_una;
+        let mut max_ack = None;
+        if data.len() < OVERHEAD {
+            return Err(())
+        }
+        while data.len() >= OVERHEAD {
+            if LittleEndian::read_u32(&data[0..4]) != self.conv {
+                return Err(())
+            }
+            let cmd = data[4];
+            let wnd = LittleEndian::read_u16(&data[6..8]);
+            let ts = LittleEndian::read_u32(&data[8..12]);
+            let sn = LittleEndian::read_u32(&data[12..16]);
+            let una = LittleEndian::read_u32(&data[16..20]);
+            let len = LittleEndian::read_u32(&data[20..24]) as usize;
+            data = &data[OVERHEAD..];
+            if data.len() < len || cmd < CMD_PUSH || cmd > CMD_WINS {
+                return Err(())
+            }
+            self.rmt_wnd = wnd as u32;
+            self.parse_una(una);
+            self.shrink_buf();
+            match cmd {
+                CMD_ACK => {
+                    if diff(self.current, ts) >= 0 {
+                        let rtt = diff(self.current, ts);
+                        self.update_ack(rtt);
+                    }
+                    self.parse_ack(sn);
+                    self.shrink_buf();
+                    max_ack = match max_ack {
+                        Some(x) if diff(sn, x) <= 0 => Some(x),
+                        _ => Some(sn),
+                    };
+                },
+                CMD_PUSH => {
+                    if diff(sn, self.rcv_nxt.wrapping_add(self.rcv_wnd)) < 0 {
+                        self.acklist.push((sn, ts));
+                        if diff(sn, self.rcv_nxt) >= 0 {
+                            let mut seg = Segment::new(CMD_PUSH, data[..len].to_vec());
+                            seg.sn = sn;
+                            self.parse_data(seg);
+                        }
+                    }
+                },
+                CMD_WASK => self.probe |= ASK_TELL,
+                _ => {},
+            }
+            data = &data[len..];
+        }
+        if let Some(sn) = max_ack {
+            self.parse_fastack(sn);
+        }
+
+        if diff(self.snd_una, prev_una) > 0 && self.cwnd < self.rmt_wnd {
+            let mss = self.mss as u32;
+            if self.cwnd < self.ssthresh {
+                self.cwnd += 1;
+                self.incr += mss;
+            } else {
+                if self.incr < mss {
+                    self.incr = mss;
+                }
+                self.incr += (mss * mss) / self.incr + mss / 16;
+                if (self.cwnd + 1) * mss <= self.incr {
+                    self.cwnd = (self.incr + mss - 1) / mss;
+                }
+            }
+            if self.cwnd > self.rmt_wnd {
+                self.cwnd = self.rmt_wnd;
+                self.incr = self.rmt_wnd * mss;
+            }
+        }
+        Ok(())
+    }
+
+    fn wnd_unused(&self) -> u16 {
+        cmp::min(self.rcv_wnd.saturating_sub(self.rcv_queue.len() as u32), u16::max_value() as u32) as u16
+    }
+
+    // Sends acknowledgements, window probes and the segments due,
+    // packing segments into datagrams of up to mtu bytes.
+    fn flush(&mut self) {
+        let current = self.current;
+        let wnd = self.wnd_unused();
+        let mut output = vec![];
+        let mtu = self.mtu;
+        let mut buffer = Vec::with_capacity(mtu);
+        {
+            let mut emit = |seg: &Segment, conv: u32, buffer: &mut Vec<u8>| {
+                if buffer.len() + OVERHEAD + seg.data.len() > mtu && !buffer.is_empty() {
+                    output.push(buffer.clone());
+                    buffer.clear();
+                }
+                seg.encode(conv, buffer);
+            };
+
+            let mut seg = Segment::new(CMD_ACK, vec![]);
+            seg.wnd = wnd;
+            seg.una = self.rcv_nxt;
+            for &(sn, ts) in &self.acklist {
+                seg.sn = sn;
+                seg.ts = ts;
+                emit(&seg, self.conv, &mut buffer);
+            }
+            self.acklist.clear();
+
+            if self.rmt_wnd == 0 {
+                if self.probe_wait == 0 {
+                    self.probe_wait = PROBE_INIT;
+                    self.ts_probe = current.wrapping_add(self.probe_wait);
+                } else if diff(current, self.ts_probe) >= 0 {
+                    self.probe_wait = cmp::min(cmp::max(self.probe_wait, PROBE_INIT) * 3 / 2, PROBE_LIMIT);
+                    self.ts_probe = current.wrapping_add(self.probe_wait);
+                    self.probe |= ASK_SEND;
+                }
+            } else {
+                self.ts_probe = 0;
+                self.probe_wait = 0;
+            }
+            seg.sn = 0;
+            seg.ts = 0;
+            if self.probe & ASK_SEND != 0 {
+                seg.cmd = CMD_WASK;
+                emit(&seg, self.conv, &mut buffer);
+            }
+            if self.probe & ASK_TELL != 0 {
+                seg.cmd = CMD_WINS;
+                emit(&seg, self.conv, &mut buffer);
+            }
+            self.probe = 0;
+
+            let mut cwnd = cmp::min(self.snd_wnd, self.rmt_wnd);
+            if !self.nocwnd {
+                cwnd = cmp::min(self.cwnd, cwnd);
+            }
+            while diff(self.snd_nxt, self.snd_una.wrapping_add(cwnd)) < 0 {
+                let mut seg = match self.snd_queue.pop_front() {
+                    Some(x) => x,
+                    None => break,
+                };
+                seg.sn = self.snd_nxt;
+                self.snd_nxt = self.snd_nxt.wrapping_add(1);
+                self.snd_buf.push_back(seg);
+            }
+
+            let resent = if self.fastresend > 0 { self.fastresend } else { u32::max_value() };
+            let rtomin = if self.nodelay { 0 } else { self.rx_rto >> 3 };
+            let (rx_rto, nodelay, rcv_nxt, conv) = (self.rx_rto, self.nodelay, self.rcv_nxt, self.conv);
+            let (mut change, mut lost, mut dead) = (false, false, false);
+            for seg in self.snd_buf.iter_mut() {
+                let mut needsend = false;
+                if seg.xmit == 0 {
+                    needsend = true;
+                    seg.rto = rx_rto;
+                    seg.resendts = current.wrapping_add(seg.rto + rtomin);
+                } else if diff(current, seg.resendts) >= 0 {
+                    needsend = true;
+                    seg.rto += if nodelay { seg.rto / 2 } else { cmp::max(seg.rto, rx_rto) };
+                    seg.resendts = current.wrapping_add(seg.rto);
+                    lost = true;
+                } else if seg.fastack >= resent && seg.xmit <= FAST_RESEND_LIMIT {
+                    needsend = true;
+                    seg.fastack = 0;
+                    seg.resendts = current.wrapping_add(seg.rto);
+                    change = true;
+                }
+                if needsend {
+                    seg.xmit += 1;
+                    seg.ts = current;
+                    seg.wnd = wnd;
+                    seg.una = rcv_nxt;
+                    emit(seg, conv, &mut buffer);
+                    if seg.xmit >= DEAD_LINK {
+                        dead = true;
+                    }
+                }
+            }
+            self.dead |= dead;
+
+            let mss = self.mss as u32;
+            if change {
+                let inflight = self.snd_nxt.wrapping_sub(self.snd_una);
+                self.ssthresh = cmp::max(inflight / 2, THRESH_MIN);
+                self.cwnd = self.ssthresh.saturating_add(resent);
+                self.incr = self.cwnd.saturating_mul(mss);
+            }
+            if lost {
+                self.ssthresh = cmp::max(self.cwnd / 2, THRESH_MIN);
+                self.cwnd = 1;
+                self.incr = mss;
+            }
+            if self.cwnd < 1 {
+                self.cwnd = 1;
+                self.incr = mss;
+            }
+        }
+        if !buffer.is_empty() {
+            output.push(buffer);
+        }
+        self.output.extend(output);
+    }
+
+    // Advances the clock to current, flushing once an interval has
+    // passed since the last flush.
+    fn update(&mut self, current: u32) {
+        self.current = current;
+        if !self.updated {
+            self.updated = true;
+            self.ts_flush = current;
+        }
+        let mut slap = diff(current, self.ts_flush);
+        if slap >= 10000 || slap < -10000 {
+            self.ts_flush = current;
+            slap = 0;
+        }
+        if slap >= 0 {
+            self.ts_flush = self.ts_flush.wrapping_add(self.interval);
+            if diff(current, self.ts_flush) >= 0 {
+                self.ts_flush = current.wrapping_add(self.interval);
+            }
+            self.flush();
+        }
+    }
+}
+
+struct ConnState {
+    kcp: Kcp,
+    read_timeout: Option<Duration>,
+    write_timeout: Option<Duration>,
+    fin_sent: bool,
+    read_shutdown: bool,
+    // Set once every handle is dropped, with the time to give up.
+    released: Option<Instant>,
+    error: Option<io::ErrorKind>,
+    done: bool,
+    // A client's until the listener first answers: the cookie to echo
+    // ahead of its segments, once the listener has sent one.
+    awaiting_listener: bool,
+    cookie: Option<Vec<u8>>,
+}
+
+// A KCP conversation with one peer over a socket that may be shared
+// with other conversations.
+struct Conn {
+    state: Mutex<ConnState>,
+    changed: Condvar,
+    socket: Arc<UdpSocket>,
+    peer_addr: SocketAddr,
+    interval: Duration,
+    start: Instant,
+}
+
+impl Conn {
+    fn new(socket: Arc<UdpSocket>, peer_addr: SocketAddr, conv: u32, config: &KcpConfig,
+           awaiting_listener: bool) -> Arc<Conn> {
+        let kcp = Kcp::new(conv, config);
+        let conn = Arc::new(Conn {
+            interval: Duration::from_millis(kcp.interval as u64),
+            state: Mutex::new(ConnState {
+                kcp,
+                read_timeout: None,
+                write_timeout: None,
+                fin_sent: false,
+                read_shutdown: false,
+                released: None,
+                error: None,
+                done: false,
+                awaiting_listener,
+                cookie: None,
+            }),
+            changed: Condvar::new(),
+            socket,
+            peer_addr,
+            start: Instant::now(),
+        });
+        let timer = conn.clone();
+        thread::spawn(move|| {
+            while timer.tick() {
+                thread::sleep(timer.interval);
+            }
+        });
+        conn
+    }
+
+    fn now(&self) -> u32 {
+        self.start.elapsed().as_millis() as u32
+    }
+
+    // Sends the datagrams KCP has output, after the cookie if there is
+    // one to echo. The cookie takes datagrams up to 40 bytes past the
+    // MTU for the first round trip.
+    fn send_output(&self, state: &mut ConnState) {
+        let conv = state.kcp.conv;
+        for datagram in state.kcp.output.drain(..) {
+            let datagram = match state.cookie {
+                Some(ref cookie) if state.awaiting_listener => {
+                    let mut echoed = Vec::with_capacity(COOKIE_SEGMENT_SIZE + datagram.len());
+                    Segment::new(CMD_COOKIE, cookie.clone()).encode(conv, &mut echoed);
+                    echoed.extend(datagram);
+                    echoed
+                },
+                _ => datagram,
+            };
+            let _ = self.socket.send_to(&datagram, self.peer_addr);
+        }
+    }
+
+    fn is_done(&self) -> bool {
+        self.state.lock().unwrap().done
+    }
+
+    // Runs the clock, returning false once the conversation is over.
+    fn tick(&self) -> bool {
+        let mut state = self.state.lock().unwrap();
+        let now = self.now();
+        state.kcp.update(now);
+        self.send_output(&mut state);
+        if state.kcp.dead && state.error.is_none() {
+            state.error = Some(io::ErrorKind::ConnectionAborted);
+        }
+        if let Some(deadline) = state.released {
+            if state.kcp.waitsnd() == 0 || Instant::now() >= deadline {
+                state.done = true;
+            }
+        }
+        if state.error.is_some() {
+            state.done = true;
+        }
+        self.changed.notify_all();
+        !state.done
+    }
+
+    fn input(&self, datagram: &[u8]) {
+        let mut state = self.state.lock().unwrap();
+        state.kcp.current = self.now();
+        if state.awaiting_listener {
+            if let Some(cookie) = cookie_segment(datagram, state.kcp.conv) {
+                state.cookie = Some(cookie.to_vec());
+                state.kcp.resend_all();
+                state.kcp.flush();
+                self.send_output(&mut state);
+                return
+            }
+        }
+        if state.kcp.input(datagram).is_ok() {
+            state.awaiting_listener = false;
+            // Acknowledges at once rather than on the next tick.
+            state.kcp.flush();
+            self.send_output(&mut state);
+            self.changed.notify_all();
+        }
+    }
+
+    // Waits for a change until deadline, failing with kind once it
+    // passes.
+    fn wait<'a>(&self, state: MutexGuard<'a, ConnState>, deadline: Option<Instant>,
+                kind: io::ErrorKind) -> io::Result<MutexGuard<'a, ConnState>> {
+        match deadline {
+            None => Ok(self.changed.wait(state).unwrap()),
+            Some(deadline) => {
+                let now = Instant::now();
+                if now >= deadline {
+                    return Err(io::Error::from(kind));
+                }
+                Ok(self.changed.wait_timeout(state, deadline - now).unwrap().0)
+            },
+        }
+    }
+
+    fn send_fin(&self, state: &mut ConnState) {
+        if !state.fin_sent {
+            state.fin_sent = true;
+            state.kcp.send_fin();
+            state.kcp.current = self.now();
+            state.kcp.flush();
+            self.send_output(state);
+        }
+    }
+}
+
+// Shared by the clones of a stream; dropping the last ends the
+// stream and lets the connection finish sending.
+struct Handle {
+    conn: Arc<Conn>,
+}
+
+impl Drop for Handle {
+    fn drop(&mut self) {
+        let mut state = self.conn.state.lock().unwrap();
+        self.conn.send_fin(&mut state);
+        state.released = Some(Instant::now() + LINGER);
+        self.conn.changed.notify_all();
+    }
+}
+
+/// A KCP connection, implementing Transport.
+pub struct KcpStream {
+    handle: Arc<Handle>,
+}
+
+impl Read for KcpStream {
+    /// Reads end of file once the peer ends its side, and fails with
+    /// ConnectionAborted once the peer stops acknowledging.
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let conn = &self.handle.conn;
+        let mut state = conn.state.lock().unwrap();
+        let deadline = state.read_timeout.map(|x| Instant::now() + x);
+        loop {
+            if state.read_shutdown {
+                return Ok(0)
+            }
+            if state.kcp.has_data() {
+                let n = state.kcp.recv(buf).unwrap_or(0);
+                // Tells the peer at once if the window reopened.
+                if state.kcp.probe != 0 {
+                    state.kcp.current = conn.now();
+                    state.kcp.flush();
+                    conn.send_output(&mut state);
+                }
+                return Ok(n)
+            }
+            if let Some(kind) = state.error {
+                return Err(io::Error::from(kind));
+            }
+            if buf.is_empty() {
+                return Ok(0)
+            }
+            state = conn.wait(state, deadline, io::ErrorKind::WouldBlock)?;
+        }
+    }
+}
+
+impl Write for KcpStream {
+    /// Queues buf, waiting while twice the send window is queued.
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let conn = &self.handle.conn;
+        let mut state = conn.state.lock().unwrap();
+        let deadline = state.write_timeout.map(|x| Instant::now() + x);
+        loop {
+            if let Some(kind) = state.error {
+                return Err(io::Error::from(kind));
+            }
+            if state.fin_sent {
+                return Err(io::Error::from(io::ErrorKind::BrokenPipe));
+            }
+            if state.kcp.waitsnd() < 2 * state.kcp.snd_wnd as usize {
+                break
+            }
+            state = conn.wait(state, deadline, io::ErrorKind::WouldBlock)?;
+        }
+        state.kcp.send(buf);
+        state.kcp.current = conn.now();
+        state.kcp.flush();
+        conn.send_output(&mut state);
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Transport for KcpStream {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(KcpStream {
+            handle: self.handle.clone(),
+        }))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.handle.conn.state.lock().unwrap().read_timeout = timeout;
+        Ok(())
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.handle.conn.state.lock().unwrap().write_timeout = timeout;
+        Ok(())
+    }
+
+    /// Shutting down writes sends the segment ending the stream.
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        let conn = &self.handle.conn;
+        let mut state = conn.state.lock().unwrap();
+        if how != Shutdown::Read {
+            conn.send_fin(&mut state);
+        }
+        if how != Shutdown::Write {
+            state.read_shutdown = true;
+        }
+        conn.changed.notify_all();
+        Ok(())
+    }
+
+    fn peer_addr(&self) -> Option<SocketAddr> {
+        Some(self.handle.conn.peer_addr)
+    }
+
+    fn local_addr(&self) -> Option<SocketAddr> {
+        self.handle.conn.socket.local_addr().ok()
+    }
+}
+
+/// Opens a KCP connection to addr, a host and port, from a new UDP
+/// socket. Nothing is sent until the stream is written to.
+pub fn dial_kcp<A: ToSocketAddrs>(addr: A, config: &KcpConfig) -> io::Result<KcpStream> {
+    let peer_addr = match addr.to_socket_addrs()?.next() {
+        Some(x) => x,
+        None => return Err(io::Error::new(io::ErrorKind::InvalidInput, "no addresses for host")),
+    };
+    let socket = UdpSocket::bind(if peer_addr.is_ipv4() { "0.0.0.0:0" } else { "[::]:0" })?;
+    socket.connect(peer_addr)?;
+    socket.set_read_timeout(Some(POLL_INTERVAL))?;
+    let mut conv = [0u8; 4];
+    getrandom::getrandom(&mut conv).map_err(|e| io::Error::new(io::ErrorKind::Other, e.to_string()))?;
+    let conn = Conn::new(Arc::new(socket), peer_addr, LittleEndian::read_u32(&conv), config, true);
+    let reader = conn.clone();
+    thread::spawn(move|| {
+        let mut datagram = vec![0u8; MAX_DATAGRAM_SIZE];
+        while !reader.is_done() {
+            if let Ok(n) = reader.socket.recv(&mut datagram) {
+                reader.input(&datagram[..n]);
+            }
+        }
+    });
+    Ok(KcpStream {
+        handle: Arc::new(Handle { conn }),
+    })
+}
+
+// Returns the cookie of datagram if it is a cookie segment of
+// conversation conv.
+fn cookie_segment(datagram: &[u8], conv: u32) -> Option<&[u8]> {
+    if datagram.len() < COOKIE_SEGMENT_SIZE || LittleEndian::read_u32(&datagram[0..4]) != conv ||
+        datagram[4] != CMD_COOKIE || LittleEndian::read_u32(&datagram[20..24]) as usize != COOKIE_SIZE {
+        return None
+    }
+    Some(&datagram[OVERHEAD..COOKIE_SEGMENT_SIZE])
+}
+
+// Makes and checks a listener's cookies.
+struct Cookies {
+    secret: Zeroizing<[u8; 32]>,
+}
+
+impl Cookies {
+    fn generate() -> io::Result<Cookies> {
+        let mut secret = Zeroizing::new([0u8; 32]);
+        getrandom::getrandom(&mut secret[..]).map_err(|e| io::Error::new(io::ErrorKind::Other, e.to_string()))?;
+        Ok(Cookies { secret })
+    }
+
+    fn period() -> u64 {
+        SystemTime::now().duration_since(UNIX_EPOCH).map(|x| x.as_secs() / COOKIE_PERIOD_SECS).unwrap_or(0)
+    }
+
+    fn mac(&self, addr: &SocketAddr, conv: u32, period: u64) -> Hmac<Sha256> {
+        let mut mac = Hmac::<Sha256>::new_from_slice(&self.secret[..]).expect("HMAC takes keys of any size");
+        let mut fields = [0u8; 12];
+        LittleEndian::write_u32(&mut fields[..4], conv);
+        BigEndian::write_u64(&mut fields[4..], period);
+        mac.update(addr.to_string().as_bytes());
+        mac.update(&fields);
+        mac
+    }
+
+    fn cookie(&self, addr: &SocketAddr, conv: u32) -> Vec<u8> {
+        self.mac(addr, conv, Cookies::period()).finalize().into_bytes()[..COOKIE_SIZE].to_vec()
+    }
+
+    fn is_valid(&self, cookie: &[u8], addr: &SocketAddr, conv: u32) -> bool {
+        let period = Cookies::period();
+        [period, period.wrapping_sub(1)].iter().any(|x| self.mac(addr, conv, *x).verify_truncated_left(cookie).is_ok())
+    }
+}
+
+/// Accepts KCP connections on a UDP socket, telling peers apart by
+/// address. A peer's conversation starts only once it has echoed the
+/// listener's cookie, and at most 128 wait to be accepted; datagrams
+/// opening more are dropped, leaving their clients to retransmit.
+/// Connections accepted keep running after the listener is dropped.
+pub struct KcpListener {
+    local_addr: SocketAddr,
+    accepted: Mutex<Receiver<KcpStream>>,
+    pending: Arc<AtomicUsize>,
+    stopped: Arc<AtomicBool>,
+}
+
+impl KcpListener {
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        Ok(self.local_addr)
+    }
+
+    /// Waits for a peer to open a connection.
+    pub fn accept(&self) -> io::Result<KcpStream> {
+        let stream = self.accepted.lock().unwrap().recv().map_err(|_| io::Error::from(io::ErrorKind::ConnectionAborted))?;
+        self.pending.fetch_sub(1, Ordering::SeqCst);
+        Ok(stream)
+    }
+}
+
+impl Drop for KcpListener {
+    fn drop(&mut self) {
+        self.stopped.store(true, Ordering::SeqCst);
+    }
+}
+
+// Receives on a listener's socket until the listener is dropped and
+// its connections are done, handing datagrams to their connections
+// and starting conversations for clients that echo a cookie.
+fn dispatch(socket: Arc<UdpSocket>, config: KcpConfig, cookies: Cookies, accepted: Sender<KcpStream>,
+            pending: Arc<AtomicUsize>, stopped: Arc<AtomicBool>) {
+    let mut conns: HashMap<SocketAddr, Arc<Conn>> = HashMap::new();
+    let mut datagram = vec![0u8; MAX_DATAGRAM_SIZE];
+    loop {
+        conns.retain(|_, conn| !conn.is_done());
+        let stopping = stopped.load(Ordering::SeqCst);
+        if stopping && conns.is_empty() {
+            return
+        }
+        let (n, from) = match socket.recv_from(&mut datagram) {
+            Ok(x) => x,
+            Err(_) => continue,
+        };
+        if n < OVERHEAD {
+            continue
+        }
+        let conv = LittleEndian::read_u32(&datagram[..4]);
+        let cookie = cookie_segment(&datagram[..n], conv).map(|x| x.to_vec());
+        // The cookie is echoed until the client sees an answer.
+        let segments = if cookie.is_some() { &datagram[COOKIE_SEGMENT_SIZE..n] } else { &datagram[..n] };
+        if let Some(conn) = conns.get(&from) {
+            if conn.state.lock().unwrap().kcp.conv == conv {
+                conn.input(segments);
+                continue
+            }
+        }
+        // A new conversation opens with data, and the answer to a
+        // datagram without a cookie is no larger than it.
+        if stopping || segments.len() < OVERHEAD || segments[4] != CMD_PUSH {
+            continue
+        }
+        let cookie = match cookie {
+            Some(x) => x,
+            None => {
+                if n >= COOKIE_SEGMENT_SIZE {
+                    let mut answer = Vec::with_capacity(COOKIE_SEGMENT_SIZE);
+                    Segment::new(CMD_COOKIE, cookies.cookie(&from, conv)).encode(conv, &mut answer);
+                    let _ = socket.send_to(&answer, from);
+                }
+                continue
+            },
+        };
+        if !cookies.is_valid(&cookie, &from, conv) || pending.load(Ordering::SeqCst) >= MAX_PENDING ||
+            conns.len() >= MAX_CONVERSATIONS {
+            continue
+        }
+        let conn = Conn::new(socket.clone(), from, conv, &config, false);
+        conn.input(segments);
+        conns.insert(from, conn.clone());
+        pending.fetch_add(1, Ordering::SeqCst);
+        let _ = accepted.send(KcpStream {
+            handle: Arc::new(Handle { conn }),
+        });
+    }
+}
+
+/// Listens on addr for KCP connections.
+pub fn listen_kcp<A: ToSocketAddrs>(addr: A, config: &KcpConfig) -> io::Result<KcpListener> {
+    let socket = UdpSocket::bind(addr)?;
+    socket.set_read_timeout(Some(POLL_INTERVAL))?;
+    let local_addr = socket.local_addr()?;
+    let cookies = Cookies::generate()?;
+    let (tx, accepted) = channel();
+    let pending = Arc::new(AtomicUsize::new(0));
+    let stopped = Arc::new(AtomicBool::new(false));
+    let config = config.clone();
+    let (dispatch_pending, dispatch_stopped) = (pending.clone(), stopped.clone());
+    thread::spawn(move|| dispatch(Arc::new(socket), config, cookies, tx, dispatch_pending, dispatch_stopped));
+    Ok(KcpListener {
+        local_addr,
+        accepted: Mutex::new(accepted),
+        pending,
+        stopped,
+    })
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // Passes from's datagrams to to over a link that loses every third
+    // and delivers the rest in reverse order.
+    fn deliver(from: &mut Kcp, to: &mut Kcp, sent: &mut usize) {
+        let mut datagrams: Vec<Vec<u8>> = from.output.drain(..).collect();
+        datagrams.reverse();
+        for datagram in datagrams {
+            *sent += 1;
+            if *sent % 3 != 0 {
+                to.input(&datagram).unwrap();
+            }
+        }
+    }
+
+    #[test]
+    fn lossy_link_test() {
+        let config = KcpConfig::fast();
+        let (mut a, mut b) = (Kcp::new(7, &config), Kcp::new(7, &config));
+        let data: Vec<u8> = (0..100000u32).map(|x| x as u8).collect();
+        a.send(&data);
+        a.send_fin();
+        let mut received: Vec<u8> = vec![];
+        let mut buf = [0u8; 4096];
+        let mut sent = 0;
+        let mut finished = false;
+        for now in (0..60000u32).step_by(10) {
+            a.update(now);
+            b.update(now);
+            deliver(&mut a, &mut b, &mut sent);
+            deliver(&mut b, &mut a, &mut sent);
+            while b.has_data() {
+                match b.recv(&mut buf) {
+                    Some(n) => received.extend(&buf[..n]),
+                    None => {
+                        finished = true;
+                        break
+                    },
+                }
+            }
+            if finished {
+                break
+            }
+        }
+        assert!(finished);
+        assert_eq!(received, data);
+        assert!(Kcp::new(8, &config).input(&[0u8; OVERHEAD]).is_err());
+    }
+
+    #[test]
+    fn cookie_test() {
+        let listener = listen_kcp("127.0.0.1:0", &KcpConfig::default()).unwrap();
+        let addr = listener.local_addr().unwrap();
+        let client = UdpSocket::bind("127.0.0.1:0").unwrap();
+        client.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let mut push = vec![];
+        Segment::new(CMD_PUSH, vec![1u8; 32]).encode(9, &mut push);
+        client.send_to(&push, addr).unwrap();
+        let mut answer = [0u8; 1500];
+        let (n, _) = client.recv_from(&mut answer).unwrap();
+        assert!(n <= push.len());
+        let mut echoed = vec![];
+        Segment::new(CMD_COOKIE, cookie_segment(&answer[..n], 9).unwrap().to_vec()).encode(9, &mut echoed);
+        echoed.extend(&push);
+
+        // the cookie opens a conversation only from the client's address
+        UdpSocket::bind("127.0.0.1:0").unwrap().send_to(&echoed, addr).unwrap();
+        client.send_to(&echoed, addr).unwrap();
+        let stream = listener.accept().unwrap();
+        assert_eq!(stream.peer_addr(), client.local_addr().ok());
+        let mut data = [0u8; 32];
+        stream.try_clone_transport().unwrap().read_exact(&mut data).unwrap();
+        assert_eq!(data, [1u8; 32]);
+    }
+
+    #[test]
+    fn kcp_test() {
+        let listener = listen_kcp("127.0.0.1:0", &KcpConfig::fast()).unwrap();
+        let addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let mut server = listener.accept().unwrap();
+            let mut received = vec![0u8; 70000];
+            server.read_exact(&mut received).unwrap();
+            server.write_all(&received).unwrap();
+            let mut rest = vec![];
+            server.read_to_end(&mut rest).unwrap();
+            assert!(rest.is_empty());
+        });
+
+        let mut client = dial_kcp(addr, &KcpConfig::fast()).unwrap();
+        let data: Vec<u8> = (0..70000u32).map(|x| x as u8).collect();
+        client.write_all(&data).unwrap();
+        let mut received = vec![0u8; data.len()];
+        let mut reader = client.try_clone_transport().unwrap();
+        reader.set_read_timeout(Some(Duration::from_secs(10))).unwrap();
+        reader.read_exact(&mut received).unwrap();
+        assert_eq!(received, data);
+
+        Transport::shutdown(&client, Shutdown::Write).unwrap();
+        assert!(client.write(b"late").is_err());
+        drop(client);
+        let mut rest = vec![];
+        reader.read_to_end(&mut rest).unwrap();
+        assert!(rest.is_empty());
+        server.join().unwrap();
+    }
+}
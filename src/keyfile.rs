@@ -0,0 +1,215 @@
+// keyfile.rs - passphrase encrypted private key files
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Passphrase encrypted link private key files.
+//!
+//! A key file holds a format version, the Argon2id cost parameters,
+//! a salt and a nonce, followed by the XChaCha20-Poly1305 encrypted
+//! private key. The header is authenticated as additional data, so
+//! the cost parameters cannot be weakened without detection.
+
+extern crate argon2;
+extern crate chacha20poly1305;
+extern crate getrandom;
+
+use std::fs::{self, OpenOptions};
+use std::io::Write;
+use std::path::Path;
+
+use byteorder::{ByteOrder, BigEndian};
+use x25519_dalek_ng::StaticSecret;
+use zeroize::Zeroizing;
+
+use self::argon2::{Algorithm, Argon2, Params, Version};
+use self::chacha20poly1305::{Key, KeyInit, XChaCha20Poly1305, XNonce};
+use self::chacha20poly1305::aead::{Aead, Payload};
+
+use super::constants::{KEY_SIZE, MAC_SIZE};
+use super::errors::KeyFileError;
+
+const KEY_FILE_VERSION: u8 = 1;
+const SALT_SIZE: usize = 16;
+const NONCE_SIZE: usize = 24;
+const KEY_FILE_HEADER_SIZE: usize = 1 + 4 + 4 + 4 + SALT_SIZE + NONCE_SIZE;
+
+/// The size of an encrypted key file.
+pub const KEY_FILE_SIZE: usize = KEY_FILE_HEADER_SIZE + KEY_SIZE + MAC_SIZE;
+
+// Upper bounds on the cost parameters accepted from a key file, so
+// that a crafted file cannot make loading it exhaust the host.
+const MAX_MEMORY_KIB: u32 = 1 << 21;
+const MAX_ITERATIONS: u32 = 64;
+const MAX_PARALLELISM: u32 = 16;
+
+/// Argon2id cost parameters for deriving the key file encryption key.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub struct KdfParams {
+    /// Memory cost in KiB.
+    pub memory_kib: u32,
+    pub iterations: u32,
+    pub parallelism: u32,
+}
+
+impl Default for KdfParams {
+    fn default() -> Self {
+        KdfParams {
+            memory_kib: 64 * 1024,
+            iterations: 3,
+            parallelism: 1,
+        }
+    }
+}
+
+fn derive_key(passphrase: &[u8], salt: &[u8], params: &KdfParams) -> Result<Zeroizing<[u8; KEY_SIZE]>, KeyFileError> {
+    if params.memory_kib > MAX_MEMORY_KIB || params.iterations > MAX_ITERATIONS || params.parallelism > MAX_PARALLELISM {
+        return Err(KeyFileError::KeyDerivationError);
+    }
+    let argon2_params = match Params::new(params.memory_kib, params.iterations, params.parallelism, Some(KEY_SIZE)) {
+        Ok(x) => x,
+        Err(_) => return Err(KeyFileError::KeyDerivationError),
+    };
+    let mut key = Zeroizing::new([0u8; KEY_SIZE]);
+    match Argon2::new(Algorithm::Argon2id, Version::V0x13, argon2_params).hash_password_into(passphrase, salt, &mut key[..]) {
+        Ok(()) => Ok(key),
+        Err(_) => Err(KeyFileError::KeyDerivationError),
+    }
+}
+
+/// Encrypts private_key under passphrase, returning the key file bytes.
+pub fn encrypt_private_key(private_key: &StaticSecret, passphrase: &[u8], params: &KdfParams) -> Result<Vec<u8>, KeyFileError> {
+    let mut header = vec![0u8; KEY_FILE_HEADER_SIZE];
+    header[0] = KEY_FILE_VERSION;
+    BigEndian::write_u32(&mut header[1..5], params.memory_kib);
+    BigEndian::write_u32(&mut header[5..9], params.iterations);
+    BigEndian::write_u32(&mut header[9..13], params.parallelism);
+    if getrandom::getrandom(&mut header[13..]).is_err() {
+        return Err(KeyFileError::RandomError);
+    }
+    let key = derive_key(passphrase, &header[13..13 + SALT_SIZE], params)?;
+    let private_key_bytes = Zeroizing::new(private_key.to_bytes());
+    let cipher = XChaCha20Poly1305::new(Key::from_slice(&key[..]));
+    let payload = Payload {
+        msg: &private_key_bytes[..],
+        aad: &header,
+    };
+    let ciphertext = match cipher.encrypt(XNonce::from_slice(&header[13 + SALT_SIZE..]), payload) {
+        Ok(x) => x,
+        Err(_) => return Err(KeyFileError::InvalidFormat),
+    };
+    let mut out = header;
+    out.extend(ciphertext);
+    Ok(out)
+}
+
+/// Decrypts key file bytes produced by encrypt_private_key.
+pub fn decrypt_private_key(key_file: &[u8], passphrase: &[u8]) -> Result<StaticSecret, KeyFileError> {
+    if key_file.len() != KEY_FILE_SIZE || key_file[0] != KEY_FILE_VERSION {
+        return Err(KeyFileError::InvalidFormat);
+    }
+    let params = KdfParams {
+        memory_kib: BigEndian::read_u32(&key_file[1..5]),
+        iterations: BigEndian::read_u32(&key_file[5..9]),
+        parallelism: BigEndian::read_u32(&key_file[9..13]),
+    };
+    let header = &key_file[..KEY_FILE_HEADER_SIZE];
+    let key = derive_key(passphrase, &header[13..13 + SALT_SIZE], &params)?;
+    let cipher = XChaCha20Poly1305::new(Key::from_slice(&key[..]));
+    let payload = Payload {
+        msg: &key_file[KEY_FILE_HEADER_SIZE..],
+        aad: header,
+    };
+    let plaintext = match cipher.decrypt(XNonce::from_slice(&header[13 + SALT_SIZE..]), payload) {
+        Ok(x) => Zeroizing::new(x),
+        Err(_) => return Err(KeyFileError::DecryptFail),
+    };
+    let mut private_key_bytes = Zeroizing::new([0u8; KEY_SIZE]);
+    private_key_bytes.copy_from_slice(&plaintext);
+    Ok(StaticSecret::from(*private_key_bytes))
+}
+
+/// Writes private_key to path encrypted under passphrase, using the
+/// default cost parameters. On unix the file is created with mode 0600.
+pub fn save_private_key<P: AsRef<Path>>(path: P, private_key: &StaticSecret, passphrase: &[u8]) -> Result<(), KeyFileError> {
+    let key_file = encrypt_private_key(private_key, passphrase, &KdfParams::default())?;
+    let mut options = OpenOptions::new();
+    options.write(true).create(true).truncate(true);
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::OpenOptionsExt;
+        options.mode(0o600);
+    }
+    let mut file = options.open(path)?;
+    file.write_all(&key_file)?;
+    file.sync_all()?;
+    Ok(())
+}
+
+/// Reads and decrypts a private key written by save_private_key.
+pub fn load_private_key<P: AsRef<Path>>(path: P, passphrase: &[u8]) -> Result<StaticSecret, KeyFileError> {
+    let key_file = fs::read(path)?;
+    decrypt_private_key(&key_file, passphrase)
+}
+
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use std::env;
+    use std::fs;
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use super::*;
+    use self::rand_core::OsRng;
+
+    // Cheap parameters to keep the tests fast.
+    const TEST_PARAMS: KdfParams = KdfParams {
+        memory_kib: 64,
+        iterations: 1,
+        parallelism: 1,
+    };
+
+    #[test]
+    fn key_file_test() {
+        let private_key = StaticSecret::new(OsRng);
+        let key_file = encrypt_private_key(&private_key, b"correct horse", &TEST_PARAMS).unwrap();
+        assert_eq!(key_file.len(), KEY_FILE_SIZE);
+
+        let decrypted = decrypt_private_key(&key_file, b"correct horse").unwrap();
+        assert_eq!(PublicKey::from(&decrypted), PublicKey::from(&private_key));
+
+        match decrypt_private_key(&key_file, b"battery staple") {
+            Err(KeyFileError::DecryptFail) => {},
+            _ => panic!("expected wrong passphrase to fail"),
+        }
+
+        // the cost parameters are authenticated
+        let mut tampered = key_file.clone();
+        tampered[8] = 2;
+        assert!(decrypt_private_key(&tampered, b"correct horse").is_err());
+    }
+
+    #[test]
+    fn save_load_private_key_test() {
+        let path = env::temp_dir().join(format!("mix_link_key_file_test_{}", std::process::id()));
+        let private_key = StaticSecret::new(OsRng);
+        save_private_key(&path, &private_key, b"passphrase").unwrap();
+        let loaded = load_private_key(&path, b"passphrase").unwrap();
+        fs::remove_file(&path).unwrap();
+        assert_eq!(PublicKey::from(&loaded), PublicKey::from(&private_key));
+    }
+}
@@ -29,12 +29,38 @@ extern crate byteorder;
 extern crate subtle;
 extern crate x25519_dalek_ng;
 extern crate sphinxcrypto;
+extern crate zeroize;
 
 pub mod errors;
 pub mod constants;
 pub mod commands;
+pub mod registry;
+pub mod codec;
+pub mod cbor;
+pub mod protobuf;
 pub mod messages;
+pub mod keyfile;
+pub mod pem;
+pub mod identity;
+pub mod replay;
+pub mod logger;
+pub mod transport;
+pub mod dialer;
+pub mod websocket;
+#[cfg(feature = "tls")]
+pub mod tls;
+pub mod obfs;
+pub mod pt;
+pub mod kcp;
+#[cfg(feature = "quic")]
+pub mod quic;
 pub mod sync;
+pub mod stream;
+pub mod mux;
+pub mod datagram;
+pub mod pki;
+pub mod queue;
+pub mod testing;
 
 
 #[cfg(test)]
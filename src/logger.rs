@@ -0,0 +1,31 @@
+// logger.rs - logging interface
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+/// A minimal logging interface for forwarding session events into
+/// the host application's logging system, see SessionConfig::logger.
+/// Each message comes with the ID of the session it concerns.
+pub trait Logger: Send + Sync {
+    /// Routine events such as a session being established or closed.
+    fn debug(&self, session_id: u64, message: &str);
+
+    /// Failures caused by the peer or the network, such as a failed
+    /// handshake or a rejected peer.
+    fn warning(&self, session_id: u64, message: &str);
+
+    /// Protocol violations, such as frames that fail to decrypt or
+    /// commands that fail to decode.
+    fn error(&self, session_id: u64, message: &str);
+}
@@ -18,25 +18,36 @@ extern crate snow;
 extern crate x25519_dalek_ng;
 
 
-use std::time::{SystemTime, UNIX_EPOCH};
+use std::error::Error;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 use std::collections::HashMap;
+use std::net::{IpAddr, SocketAddr};
+use std::sync::{Arc, Mutex};
 
-use subtle::ConstantTimeEq;
 use byteorder::{ByteOrder, BigEndian};
 use snow::Builder;
+use snow::params::NoiseParams;
 use x25519_dalek_ng::{PublicKey, StaticSecret};
+use zeroize::{Zeroize, Zeroizing};
 
-use super::errors::{HandshakeError, AuthenticationError};
+use super::errors::{HandshakeError, AuthenticationError, ConfigError};
+use super::replay::ReplayCache;
+use super::logger::Logger;
+use super::registry::CommandRegistry;
+use super::codec::Codec;
 use super::errors::{ClientHandshakeError, ServerHandshakeError, ReceiveMessageError, SendMessageError};
 
 use super::constants::{NOISE_MESSAGE_MAX_SIZE,
+                       DEFAULT_MAX_COMMAND_SIZE,
                        NOISE_MESSAGE_HEADER_SIZE,
                        NOISE_HANDSHAKE_MESSAGE1_SIZE,
                        NOISE_HANDSHAKE_MESSAGE2_SIZE,
                        NOISE_HANDSHAKE_MESSAGE3_SIZE,
-                       NOISE_PARAMS,
+                       KEY_SIZE,
+                       KYBER_SIZE,
                        HEADER_SIZE,
-                       PROLOGUE,
+                       PROTOCOL_VERSION,
+                       EXTENDED_PROTOCOL_VERSION,
                        PROLOGUE_SIZE,
                        MAC_SIZE,
                        MAX_ADDITIONAL_DATA_SIZE,
@@ -85,7 +96,7 @@ pub struct PeerCredentials {
 
 impl PeerCredentials {
     pub fn wipe(&mut self) {
-        self.additional_data.clear();
+        self.additional_data.zeroize();
     }
 }
 
@@ -107,6 +118,89 @@ pub struct ClientAuthenticatorState{
     pub peer_public_key: PublicKey,
 }
 
+/// FirstContactAuthenticatorState is used by clients which do not
+/// yet know the responder's static key. The XX handshake transmits
+/// the responder's key in the second message; if `peer_public_key`
+/// is None that key is trusted on first use and pinned here,
+/// otherwise it must match the pinned key.
+#[derive(PartialEq, Debug, Clone)]
+pub struct FirstContactAuthenticatorState{
+    pub peer_public_key: Option<PublicKey>,
+}
+
+/// The credentials of the process at the other end of a local
+/// connection, as reported by the operating system. The pid is not
+/// known on every platform.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub struct PeerProcess {
+    pub pid: Option<u32>,
+    pub uid: u32,
+    pub gid: u32,
+}
+
+/// The network addresses of a session's connection, where the
+/// transport has them.
+#[derive(PartialEq, Debug, Clone, Copy, Default)]
+pub struct PeerAddresses {
+    pub local: Option<SocketAddr>,
+    pub remote: Option<SocketAddr>,
+    /// The peer process of a Unix domain socket, see Transport::peer_process.
+    pub process: Option<PeerProcess>,
+}
+
+/// An IP network given as an address and a prefix length.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub struct Network {
+    pub address: IpAddr,
+    pub prefix_len: u8,
+}
+
+impl Network {
+    /// Returns true if address is in the network. IPv4 and IPv6
+    /// networks never contain addresses of the other family.
+    pub fn contains(&self, address: IpAddr) -> bool {
+        fn prefix_eq(a: &[u8], b: &[u8], prefix_len: usize) -> bool {
+            if prefix_len > a.len() * 8 {
+                return false
+            }
+            let bytes = prefix_len / 8;
+            if a[..bytes] != b[..bytes] {
+                return false
+            }
+            let bits = prefix_len % 8;
+            bits == 0 || (a[bytes] ^ b[bytes]) >> (8 - bits) == 0
+        }
+        match (self.address, address) {
+            (IpAddr::V4(a), IpAddr::V4(b)) => prefix_eq(&a.octets(), &b.octets(), self.prefix_len as usize),
+            (IpAddr::V6(a), IpAddr::V6(b)) => prefix_eq(&a.octets(), &b.octets(), self.prefix_len as usize),
+            _ => false,
+        }
+    }
+}
+
+/// AddressRestrictedAuthenticatorState wraps another authenticator
+/// and additionally requires peers whose keys are listed in networks
+/// to connect from one of their networks. Peers with unlisted keys
+/// are checked by the wrapped authenticator alone, and listed peers
+/// fail if the transport does not report a remote address.
+#[derive(PartialEq, Debug, Clone)]
+pub struct AddressRestrictedAuthenticatorState{
+    pub authenticator: Box<PeerAuthenticator>,
+    pub networks: HashMap<PublicKey, Vec<Network>>,
+}
+
+/// ProcessRestrictedAuthenticatorState wraps another authenticator
+/// and additionally requires peers whose keys are listed in uids to
+/// connect from a process running as one of their user IDs, combining
+/// key based and operating system authentication for components on
+/// the same host. Peers with unlisted keys are checked by the wrapped
+/// authenticator alone, and listed peers fail if the transport does
+/// not report the peer process.
+#[derive(PartialEq, Debug, Clone)]
+pub struct ProcessRestrictedAuthenticatorState{
+    pub authenticator: Box<PeerAuthenticator>,
+    pub uids: HashMap<PublicKey, Vec<u32>>,
+}
 
 /// PeerAuthenticator is used to authenticate wire protocol sessions.
 #[derive(PartialEq, Debug, Clone)]
@@ -119,10 +213,22 @@ pub enum PeerAuthenticator {
 
     /// An authenticator to be used on a client.
     Client(ClientAuthenticatorState),
+
+    /// An authenticator to be used on a client connecting to a
+    /// server whose static key is not yet known.
+    FirstContact(FirstContactAuthenticatorState),
+
+    /// An authenticator which also checks the peer's network address.
+    AddressRestricted(AddressRestrictedAuthenticatorState),
+
+    /// An authenticator which also checks the peer process's user ID.
+    ProcessRestricted(ProcessRestrictedAuthenticatorState),
 }
 
 impl PeerAuthenticator {
-    pub fn is_peer_valid(&mut self, peer_credentials: &PeerCredentials) -> bool {
+    /// Returns true if the peer is allowed. addresses are those of
+    /// the connection the peer was authenticated on.
+    pub fn is_peer_valid(&mut self, peer_credentials: &PeerCredentials, addresses: &PeerAddresses) -> bool {
         match *self {
             PeerAuthenticator::Client(ref state) => state.peer_public_key.eq(&peer_credentials.public_key),
             PeerAuthenticator::Server(ref state) => state.mix_map.get(&peer_credentials.public_key).is_some(),
@@ -137,6 +243,35 @@ impl PeerAuthenticator {
                 }
                 return false
             },
+            PeerAuthenticator::FirstContact(ref mut state) => {
+                match state.peer_public_key {
+                    Some(ref key) => key.eq(&peer_credentials.public_key),
+                    None => {
+                        state.peer_public_key = Some(peer_credentials.public_key);
+                        true
+                    },
+                }
+            },
+            PeerAuthenticator::AddressRestricted(ref mut state) => {
+                if let Some(networks) = state.networks.get(&peer_credentials.public_key) {
+                    let allowed = match addresses.remote {
+                        Some(remote) => networks.iter().any(|x| x.contains(remote.ip())),
+                        None => false,
+                    };
+                    if !allowed {
+                        return false
+                    }
+                }
+                state.authenticator.is_peer_valid(peer_credentials, addresses)
+            },
+            PeerAuthenticator::ProcessRestricted(ref mut state) => {
+                if let Some(uids) = state.uids.get(&peer_credentials.public_key) {
+                    if !addresses.process.map_or(false, |x| uids.contains(&x.uid)) {
+                        return false
+                    }
+                }
+                state.authenticator.is_peer_valid(peer_credentials, addresses)
+            },
         }
     }
 
@@ -145,6 +280,9 @@ impl PeerAuthenticator {
             PeerAuthenticator::Client(ref _state) => return false,
             PeerAuthenticator::Server(ref _state) => return false,
             PeerAuthenticator::Provider(ref state) => return state.from_client,
+            PeerAuthenticator::FirstContact(ref _state) => return false,
+            PeerAuthenticator::AddressRestricted(ref state) => return state.authenticator.is_peer_client(),
+            PeerAuthenticator::ProcessRestricted(ref state) => return state.authenticator.is_peer_client(),
         }
     }
 }
@@ -161,6 +299,217 @@ pub enum State {
     Invalid,
 }
 
+/// HandshakePattern selects the Noise handshake pattern used by a
+/// session. Every pattern uses the hfs modifier. XX is the Katzenpost
+/// wire protocol pattern; the others require the initiator to know
+/// the responder's static key in advance.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum HandshakePattern {
+    /// Mutual authentication where both static keys are transmitted.
+    XX,
+
+    /// Mutual authentication where the responder's key is known in
+    /// advance and the initiator's identity is hidden until the
+    /// third message.
+    XK,
+
+    /// Mutual authentication in two messages where the responder's
+    /// key is known in advance and the initiator's key is sent in
+    /// the first message.
+    IK,
+
+    /// The responder's key is known in advance and the initiator
+    /// is anonymous; the responder's authenticator is not consulted.
+    NK,
+}
+
+impl Default for HandshakePattern {
+    fn default() -> Self {
+        HandshakePattern::XX
+    }
+}
+
+impl HandshakePattern {
+    /// Returns the pattern name used in the Noise protocol name.
+    pub fn name(&self) -> &'static str {
+        match *self {
+            HandshakePattern::XX => "XX",
+            HandshakePattern::XK => "XK",
+            HandshakePattern::IK => "IK",
+            HandshakePattern::NK => "NK",
+        }
+    }
+
+    /// Returns the number of handshake messages.
+    pub fn message_count(&self) -> usize {
+        match *self {
+            HandshakePattern::XX | HandshakePattern::XK => 3,
+            HandshakePattern::IK | HandshakePattern::NK => 2,
+        }
+    }
+
+    /// Returns the on the wire size of each handshake message.
+    /// The first message includes the prologue byte.
+    pub fn message_sizes(&self) -> Vec<usize> {
+        match *self {
+            HandshakePattern::XX => vec![NOISE_HANDSHAKE_MESSAGE1_SIZE,
+                                         NOISE_HANDSHAKE_MESSAGE2_SIZE,
+                                         NOISE_HANDSHAKE_MESSAGE3_SIZE],
+            HandshakePattern::XK => vec![NOISE_HANDSHAKE_MESSAGE1_SIZE + MAC_SIZE,
+                                         KEY_SIZE + KYBER_SIZE + MAC_SIZE + AUTH_MESSAGE_SIZE + MAC_SIZE,
+                                         NOISE_HANDSHAKE_MESSAGE3_SIZE],
+            HandshakePattern::IK => vec![NOISE_HANDSHAKE_MESSAGE1_SIZE + KEY_SIZE + MAC_SIZE + AUTH_MESSAGE_SIZE + MAC_SIZE,
+                                         KEY_SIZE + KYBER_SIZE + MAC_SIZE + AUTH_MESSAGE_SIZE + MAC_SIZE],
+            HandshakePattern::NK => vec![NOISE_HANDSHAKE_MESSAGE1_SIZE + MAC_SIZE,
+                                         KEY_SIZE + KYBER_SIZE + MAC_SIZE + AUTH_MESSAGE_SIZE + MAC_SIZE],
+        }
+    }
+
+    /// Returns true if the initiator sends its static key and
+    /// authentication message in the first handshake message.
+    fn initiator_auth_in_first_message(&self) -> bool {
+        *self == HandshakePattern::IK
+    }
+
+    /// Returns true if the initiator must know the responder's
+    /// static key before the handshake.
+    fn requires_peer_key(&self) -> bool {
+        *self != HandshakePattern::XX
+    }
+}
+
+/// CipherSuite selects the Noise AEAD cipher. The cipher is part of
+/// the Noise protocol name, so peers configured with different
+/// ciphers fail the handshake. Only ChaChaPoly interoperates with
+/// Katzenpost.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum CipherSuite {
+    ChaChaPoly,
+    AESGCM,
+}
+
+impl Default for CipherSuite {
+    fn default() -> Self {
+        CipherSuite::ChaChaPoly
+    }
+}
+
+impl CipherSuite {
+    /// Returns the cipher name used in the Noise protocol name.
+    pub fn name(&self) -> &'static str {
+        match *self {
+            CipherSuite::ChaChaPoly => "ChaChaPoly",
+            CipherSuite::AESGCM => "AESGCM",
+        }
+    }
+}
+
+/// HashFunction selects the Noise hash function. Like the cipher it
+/// is part of the Noise protocol name. Only BLAKE2b interoperates with
+/// Katzenpost.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum HashFunction {
+    BLAKE2b,
+    BLAKE2s,
+    SHA256,
+    SHA512,
+}
+
+impl Default for HashFunction {
+    fn default() -> Self {
+        HashFunction::BLAKE2b
+    }
+}
+
+impl HashFunction {
+    /// Returns the hash name used in the Noise protocol name.
+    pub fn name(&self) -> &'static str {
+        match *self {
+            HashFunction::BLAKE2b => "BLAKE2b",
+            HashFunction::BLAKE2s => "BLAKE2s",
+            HashFunction::SHA256 => "SHA256",
+            HashFunction::SHA512 => "SHA512",
+        }
+    }
+}
+
+/// LinkParameters describes the Sphinx packet geometry a peer uses.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub struct LinkParameters {
+    pub max_packet_size: u32,
+    pub forward_payload_size: u32,
+}
+
+/// RekeyPolicy determines when the transport cipher states are rekeyed.
+///
+/// With EveryMessage both peers implicitly rekey after every frame.
+/// With Threshold the sender rekeys its outgoing cipher state once
+/// either limit is reached and tells the peer with a Rekey command,
+/// so the limits need not match, but both peers must agree on which
+/// of the two variants is in use; the variant is bound into the
+/// handshake, which fails if they differ. A limit of zero is ignored.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum RekeyPolicy {
+    EveryMessage,
+    Threshold {
+        messages: u64,
+        bytes: u64,
+    },
+}
+
+impl Default for RekeyPolicy {
+    fn default() -> Self {
+        RekeyPolicy::EveryMessage
+    }
+}
+
+/// Called with the session ID and the peer credentials once a session
+/// is established.
+pub type HandshakeCompleteCallback = Arc<dyn Fn(u64, &PeerCredentials) + Send + Sync>;
+
+/// Called once when a session is closed, with the session ID and the
+/// error that caused the close if there was one.
+pub type CloseCallback = Arc<dyn Fn(u64, Option<&dyn Error>) + Send + Sync>;
+
+/// The direction of a frame passed to a TraceCallback.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum Direction {
+    Sent,
+    Received,
+}
+
+/// Called for each transport frame with the session ID, the frame's
+/// direction, its length on the wire and the name of the command it
+/// carries, see Command::name. It is called with the session's locks
+/// held, so it must not call into the session.
+pub type TraceCallback = Arc<dyn Fn(u64, Direction, usize, &'static str) + Send + Sync>;
+
+/// Called with the session ID and the encoding of a command the
+/// session does not know, see UnknownCommandPolicy.
+pub type UnknownCommandHandler = Arc<dyn Fn(u64, &[u8]) + Send + Sync>;
+
+/// UnknownCommandPolicy determines what a session does with commands
+/// whose IDs it does not know, either because a newer peer sent a
+/// command this implementation does not define or because an
+/// application command is not in the command registry. Dropping them
+/// lets new commands be rolled out across a network peer by peer.
+/// Commands that are known but fail to decode always fail the session.
+#[derive(Clone)]
+pub enum UnknownCommandPolicy {
+    /// Receiving fails with UnknownCommand, or UnregisteredCommand.
+    Fail,
+    /// The command is dropped, as if it were a NoOp.
+    Drop,
+    /// The command is passed to the handler and then dropped.
+    Handle(UnknownCommandHandler),
+}
+
+impl Default for UnknownCommandPolicy {
+    fn default() -> Self {
+        UnknownCommandPolicy::Fail
+    }
+}
+
 /// A session configuration type.
 #[derive(Clone)]
 pub struct SessionConfig {
@@ -168,6 +517,323 @@ pub struct SessionConfig {
     pub authentication_key: StaticSecret,
     pub peer_public_key: Option<PublicKey>,
     pub additional_data: Vec<u8>,
+    pub pattern: HandshakePattern,
+    /// Protocol versions in order of preference. Responders accept any
+    /// of them; initiators offer their only one, without retrying with
+    /// another if the responder rejects it. The default is
+    /// EXTENDED_PROTOCOL_VERSION; peers speaking Katzenpost's
+    /// PROTOCOL_VERSION can send only Katzenpost's commands.
+    pub versions: Vec<u8>,
+    /// Application specific prologue bound into the handshake after
+    /// the protocol version byte. Both peers must use the same value.
+    pub prologue: Vec<u8>,
+    pub rekey_policy: RekeyPolicy,
+    pub cipher: CipherSuite,
+    pub hash: HashFunction,
+    /// Bounds the time Session spends in the handshake, including
+    /// handshake finalization. None waits indefinitely.
+    pub handshake_timeout: Option<Duration>,
+    /// When set, a responder that rejects a handshake for any reason
+    /// holds the connection open until this long after it was
+    /// accepted before closing it, so that malformed messages, bad
+    /// MACs and unauthorized peers all look the same on the wire.
+    pub rejection_delay: Option<Duration>,
+    /// A responder's next authentication key during a key rotation.
+    /// Initiators using XK, IK or NK may then address either key; XX
+    /// responders always present authentication_key.
+    pub next_authentication_key: Option<StaticSecret>,
+    /// Sphinx packet geometry exchanged during handshake finalization.
+    /// Sessions fail to finalize if the peer's parameters differ. Both
+    /// peers must set this, as the exchange is not Katzenpost compatible.
+    pub link_parameters: Option<LinkParameters>,
+    /// An optional network wide pre-shared key mixed into the first
+    /// handshake message with the Noise psk0 modifier. Responders
+    /// drop initiators that do not hold it before authenticating them.
+    pub network_key: Option<Zeroizing<[u8; KEY_SIZE]>>,
+    pub on_handshake_complete: Option<HandshakeCompleteCallback>,
+    pub on_close: Option<CloseCallback>,
+    /// When set, an established session that has sent nothing for
+    /// this long sends a NoOp, keeping NAT bindings alive.
+    pub keepalive_interval: Option<Duration>,
+    /// When set, an established session that has neither sent nor
+    /// received a command other than NoOp for this long is closed,
+    /// and receiving on it fails with IdleTimeout. Keepalives do not
+    /// hold it open.
+    pub idle_timeout: Option<Duration>,
+    /// Receives handshake failures, decode errors and lifecycle events.
+    pub logger: Option<Arc<dyn Logger>>,
+    pub trace: Option<TraceCallback>,
+    /// The application commands accepted from the peer. Without a
+    /// registry application commands are rejected.
+    pub command_registry: Option<Arc<CommandRegistry>>,
+    pub unknown_command_policy: UnknownCommandPolicy,
+    /// The command encoding. When None the codec is chosen by the
+    /// negotiated protocol version, see codec_for_version. Both peers
+    /// must use the same codec.
+    pub codec: Option<Arc<dyn Codec>>,
+    /// The largest command accepted from the peer, by the size of its
+    /// encoding, on constrained devices perhaps less than a frame and
+    /// on directory authorities perhaps more. Commands whose encoding
+    /// does not fit in one frame are sent as Fragment commands and
+    /// reassembled by the receiving session. The sizes of fragmented
+    /// and Compressed commands are checked before any of them is
+    /// buffered, while a frame, at most NOISE_MESSAGE_MAX_SIZE bytes,
+    /// is decrypted and decoded whole first. Commands in a Batch are
+    /// checked one by one.
+    pub max_command_size: usize,
+    /// When set, receiving fails with ReassemblyTimeout if any frame
+    /// arrives over this long after the first fragment of a command
+    /// still being reassembled.
+    pub reassembly_timeout: Option<Duration>,
+    /// When set, SendPacket commands are flow controlled: each takes
+    /// one of the credits granted by the peer with Session::grant_credits,
+    /// and sending blocks while none remain, until Credit commands
+    /// arrive through a receive on the session or a clone, or the
+    /// write deadline passes. Sessions start without credits.
+    pub flow_control: bool,
+    /// When set, the session tells the peer after the handshake that
+    /// it accepts Compressed commands of up to max_command_size
+    /// bytes, and once the peer has said the same sends the commands
+    /// for which Command::is_compressible holds compressed with zstd
+    /// if their encoding is at least this long and compression makes
+    /// it shorter. Needs the compression feature.
+    pub compression_threshold: Option<usize>,
+    /// Responder cache of recent initiator ephemeral keys used to
+    /// reject replayed handshakes. Share one cache between sessions.
+    pub replay_cache: Option<Arc<Mutex<ReplayCache>>>,
+}
+
+impl SessionConfig {
+    /// Returns a SessionConfig using the XX handshake pattern.
+    pub fn new(authenticator: PeerAuthenticator, authentication_key: StaticSecret,
+               peer_public_key: Option<PublicKey>, additional_data: Vec<u8>) -> SessionConfig {
+        SessionConfig {
+            authenticator,
+            authentication_key,
+            peer_public_key,
+            additional_data,
+            pattern: HandshakePattern::default(),
+            versions: vec![EXTENDED_PROTOCOL_VERSION],
+            prologue: vec![],
+            rekey_policy: RekeyPolicy::default(),
+            cipher: CipherSuite::default(),
+            hash: HashFunction::default(),
+            handshake_timeout: None,
+            rejection_delay: None,
+            next_authentication_key: None,
+            link_parameters: None,
+            network_key: None,
+            on_handshake_complete: None,
+            on_close: None,
+            keepalive_interval: None,
+            idle_timeout: None,
+            logger: None,
+            trace: None,
+            command_registry: None,
+            unknown_command_policy: UnknownCommandPolicy::default(),
+            codec: None,
+            max_command_size: DEFAULT_MAX_COMMAND_SIZE,
+            reassembly_timeout: None,
+            flow_control: false,
+            compression_threshold: None,
+            replay_cache: None,
+        }
+    }
+
+    // Options for chaining onto new, so that callers need not name
+    // every field and new fields do not break them.
+
+    pub fn with_pattern(mut self, pattern: HandshakePattern) -> Self {
+        self.pattern = pattern;
+        self
+    }
+
+    pub fn with_versions(mut self, versions: Vec<u8>) -> Self {
+        self.versions = versions;
+        self
+    }
+
+    pub fn with_prologue(mut self, prologue: Vec<u8>) -> Self {
+        self.prologue = prologue;
+        self
+    }
+
+    pub fn with_rekey_policy(mut self, rekey_policy: RekeyPolicy) -> Self {
+        self.rekey_policy = rekey_policy;
+        self
+    }
+
+    pub fn with_cipher(mut self, cipher: CipherSuite) -> Self {
+        self.cipher = cipher;
+        self
+    }
+
+    pub fn with_hash(mut self, hash: HashFunction) -> Self {
+        self.hash = hash;
+        self
+    }
+
+    pub fn with_handshake_timeout(mut self, timeout: Duration) -> Self {
+        self.handshake_timeout = Some(timeout);
+        self
+    }
+
+    pub fn with_rejection_delay(mut self, delay: Duration) -> Self {
+        self.rejection_delay = Some(delay);
+        self
+    }
+
+    pub fn with_next_authentication_key(mut self, key: StaticSecret) -> Self {
+        self.next_authentication_key = Some(key);
+        self
+    }
+
+    pub fn with_link_parameters(mut self, link_parameters: LinkParameters) -> Self {
+        self.link_parameters = Some(link_parameters);
+        self
+    }
+
+    pub fn with_network_key(mut self, key: [u8; KEY_SIZE]) -> Self {
+        self.network_key = Some(Zeroizing::new(key));
+        self
+    }
+
+    pub fn with_on_handshake_complete<F: Fn(u64, &PeerCredentials) + Send + Sync + 'static>(mut self, callback: F) -> Self {
+        self.on_handshake_complete = Some(Arc::new(callback));
+        self
+    }
+
+    pub fn with_on_close<F: Fn(u64, Option<&dyn Error>) + Send + Sync + 'static>(mut self, callback: F) -> Self {
+        self.on_close = Some(Arc::new(callback));
+        self
+    }
+
+    pub fn with_keepalive_interval(mut self, interval: Duration) -> Self {
+        self.keepalive_interval = Some(interval);
+        self
+    }
+
+    pub fn with_idle_timeout(mut self, timeout: Duration) -> Self {
+        self.idle_timeout = Some(timeout);
+        self
+    }
+
+    pub fn with_logger(mut self, logger: Arc<dyn Logger>) -> Self {
+        self.logger = Some(logger);
+        self
+    }
+
+    pub fn with_trace<F: Fn(u64, Direction, usize, &'static str) + Send + Sync + 'static>(mut self, callback: F) -> Self {
+        self.trace = Some(Arc::new(callback));
+        self
+    }
+
+    pub fn with_command_registry(mut self, command_registry: CommandRegistry) -> Self {
+        self.command_registry = Some(Arc::new(command_registry));
+        self
+    }
+
+    pub fn with_unknown_command_policy(mut self, policy: UnknownCommandPolicy) -> Self {
+        self.unknown_command_policy = policy;
+        self
+    }
+
+    pub fn with_codec<C: Codec + 'static>(mut self, codec: C) -> Self {
+        self.codec = Some(Arc::new(codec));
+        self
+    }
+
+    pub fn with_max_command_size(mut self, size: usize) -> Self {
+        self.max_command_size = size;
+        self
+    }
+
+    pub fn with_reassembly_timeout(mut self, timeout: Duration) -> Self {
+        self.reassembly_timeout = Some(timeout);
+        self
+    }
+
+    pub fn with_flow_control(mut self) -> Self {
+        self.flow_control = true;
+        self
+    }
+
+    pub fn with_compression_threshold(mut self, threshold: usize) -> Self {
+        self.compression_threshold = Some(threshold);
+        self
+    }
+
+    pub fn with_replay_cache(mut self, replay_cache: Arc<Mutex<ReplayCache>>) -> Self {
+        self.replay_cache = Some(replay_cache);
+        self
+    }
+
+    /// Checks the configuration for a session in the given role,
+    /// naming the offending field. Session::new calls this.
+    pub fn validate(&self, is_initiator: bool) -> Result<(), ConfigError> {
+        if self.additional_data.len() > MAX_ADDITIONAL_DATA_SIZE {
+            return Err(ConfigError::AdditionalDataTooLarge);
+        }
+        if self.versions.is_empty() {
+            return Err(ConfigError::NoVersions);
+        }
+        if self.handshake_timeout == Some(Duration::from_secs(0)) {
+            return Err(ConfigError::ZeroHandshakeTimeout);
+        }
+        if self.max_command_size == 0 {
+            return Err(ConfigError::ZeroMaxCommandSize);
+        }
+        if let RekeyPolicy::Threshold{..} = self.rekey_policy {
+            if self.versions.contains(&PROTOCOL_VERSION) {
+                return Err(ConfigError::ThresholdRekeyOnKatzenpost);
+            }
+        }
+        if self.compression_threshold.is_some() && !cfg!(feature = "compression") {
+            return Err(ConfigError::CompressionUnavailable);
+        }
+        if is_initiator {
+            if self.next_authentication_key.is_some() {
+                return Err(ConfigError::NextAuthenticationKeyOnInitiator);
+            }
+            if self.versions.len() > 1 {
+                return Err(ConfigError::MultipleVersionsOnInitiator);
+            }
+            // The XX pattern transmits the responder's static key in
+            // the second handshake message, so the initiator only
+            // needs to know it in advance if it wants it pinned.
+            if self.peer_public_key.is_none() {
+                match self.authenticator {
+                    PeerAuthenticator::FirstContact(_) if !self.pattern.requires_peer_key() => {},
+                    _ => return Err(ConfigError::MissingPeerPublicKey),
+                }
+            }
+        } else if let PeerAuthenticator::FirstContact(_) = self.authenticator {
+            return Err(ConfigError::FirstContactOnResponder);
+        }
+        Ok(())
+    }
+
+    /// Returns the Noise protocol name for this configuration.
+    pub fn noise_params(&self) -> String {
+        let modifiers = if self.network_key.is_some() { "hfs+psk0" } else { "hfs" };
+        format!("Noise_{}{}_25519+Kyber1024_{}_{}", self.pattern.name(), modifiers, self.cipher.name(), self.hash.name())
+    }
+}
+
+/// The protocol parameters a session's handshake used.
+#[derive(PartialEq, Debug, Clone)]
+pub struct NegotiatedParameters {
+    /// The full Noise protocol name, which shows the hybrid
+    /// forward secrecy modifier and the KEM.
+    pub noise_protocol: String,
+    pub pattern: HandshakePattern,
+    pub cipher: CipherSuite,
+    pub hash: HashFunction,
+    pub version: u8,
+    /// Whether a network key was mixed in, see SessionConfig::network_key.
+    pub network_key: bool,
+    /// The largest serialized command one frame can carry.
+    pub max_message_size: usize,
 }
 
 /// A cryptographic protocol message factory type.
@@ -175,97 +841,349 @@ pub struct SessionConfig {
 pub struct MessageBuilder {
     handshake_state: Option<snow::HandshakeState>,
     transport_state: Option<snow::TransportState>,
+    // Responder handshake states for each supported protocol
+    // version and authentication key, one of which is selected by
+    // the first message.
+    version_handshake_states: Vec<(u8, snow::HandshakeState)>,
     state: State,
+    pattern: HandshakePattern,
+    noise_protocol: String,
+    cipher: CipherSuite,
+    hash: HashFunction,
+    version: u8,
     additional_data: Vec<u8>,
     pub authenticator: PeerAuthenticator,
     is_initiator: bool,
-    clock_skew: u32,
+    clock_skew: i64,
     peer_credentials: Option<Box<PeerCredentials>>,
+    addresses: PeerAddresses,
+    rekey_policy: RekeyPolicy,
+    replay_cache: Option<Arc<Mutex<ReplayCache>>>,
+    // The initiator's ephemeral key, recorded unconfirmed in the replay
+    // cache until the final handshake message authenticates it.
+    replay_key: Option<Vec<u8>>,
+    // Whether a network key is mixed in with psk0.
+    psk: bool,
+    // Kept from the handshake state when entering transport mode.
+    handshake_hash: Option<Vec<u8>>,
+    // Messages and plaintext bytes sent since the last outgoing rekey.
+    sent_messages: u64,
+    sent_bytes: u64,
+}
+
+// The version byte is sent in the clear at the start of the first
+// handshake message and is also the first byte of the Noise prologue,
+// so tampering with it makes the handshake fail. Versions other than
+// Katzenpost's PROTOCOL_VERSION, which only rekeys every message, follow
+// it with a byte naming the rekey policy variant, so peers that
+// disagree on it fail the handshake rather than the first Rekey.
+fn noise_prologue(version: u8, rekey_policy: &RekeyPolicy, application_prologue: &[u8]) -> Vec<u8> {
+    let mut prologue = vec![version];
+    if version != PROTOCOL_VERSION {
+        prologue.push(match *rekey_policy {
+            RekeyPolicy::EveryMessage => 0,
+            RekeyPolicy::Threshold{..} => 1,
+        });
+    }
+    prologue.extend_from_slice(application_prologue);
+    prologue
 }
 
 impl MessageBuilder {
     pub fn new(config: SessionConfig, is_initiator: bool) -> Result<MessageBuilder, HandshakeError> {
-        let noise_params;
-        match NOISE_PARAMS.parse() {
+        config.validate(is_initiator)?;
+        let noise_params: NoiseParams;
+        match config.noise_params().parse() {
             Ok(x) => {
                 noise_params = x;
             },
             Err(_) => return Err(HandshakeError::InvalidNoiseSpecError),
         }
-        let noise_builder: Builder = Builder::new(noise_params);
+        let local_private_key = Zeroizing::new(config.authentication_key.to_bytes());
         if is_initiator {
-            if config.peer_public_key.is_none() {
-                return Err(HandshakeError::NoPeerKeyError);
+            // validate leaves initiators a single version.
+            let version = config.versions[0];
+            let prologue = noise_prologue(version, &config.rekey_policy, &config.prologue);
+            let mut noise_builder = Builder::new(noise_params)
+                .local_private_key(&local_private_key[..])
+                .prologue(&prologue);
+            if let Some(ref key) = config.network_key {
+                noise_builder = noise_builder.psk(0, &key[..]);
+            }
+            let peer_public_key;
+            if let Some(key) = config.peer_public_key {
+                peer_public_key = key.to_bytes();
+                noise_builder = noise_builder.remote_public_key(&peer_public_key);
             }
-            let handshake_state = match noise_builder
-                .local_private_key(&config.authentication_key.to_bytes())
-                .remote_public_key(&(config.peer_public_key.unwrap()).to_bytes())
-                .prologue(&PROLOGUE)
-                .build_initiator() {
-                    Ok(x) => x,
-                    Err(_) => return Err(HandshakeError::SessionCreateError),
-                };
+            let handshake_state = match noise_builder.build_initiator() {
+                Ok(x) => x,
+                Err(_) => return Err(HandshakeError::SessionCreateError),
+            };
             return Ok(MessageBuilder {
                 state: State::Init,
+                pattern: config.pattern,
+                noise_protocol: config.noise_params(),
+                cipher: config.cipher,
+                hash: config.hash,
+                version,
                 additional_data: config.additional_data,
                 authenticator: config.authenticator,
                 handshake_state: Some(handshake_state),
                 transport_state: None,
+                version_handshake_states: vec![],
                 is_initiator,
                 clock_skew: 0,
                 peer_credentials: None,
+                addresses: PeerAddresses::default(),
+                rekey_policy: config.rekey_policy,
+                replay_cache: None,
+                replay_key: None,
+                psk: config.network_key.is_some(),
+                handshake_hash: None,
+                sent_messages: 0,
+                sent_bytes: 0,
             });
         }
-        let handshake_state = match noise_builder
-            .local_private_key(&config.authentication_key.to_bytes())
-            .prologue(&PROLOGUE)
-            .build_responder() {
-                Ok(x) => x,
-                Err(_) => return Err(HandshakeError::SessionCreateError),
-            };
+        let mut local_private_keys = vec![local_private_key];
+        if let Some(ref key) = config.next_authentication_key {
+            local_private_keys.push(Zeroizing::new(key.to_bytes()));
+        }
+        let mut version_handshake_states = vec![];
+        for version in config.versions.iter() {
+            let prologue = noise_prologue(*version, &config.rekey_policy, &config.prologue);
+            for local_private_key in local_private_keys.iter() {
+                let mut noise_builder = Builder::new(noise_params.clone())
+                    .local_private_key(&local_private_key[..])
+                    .prologue(&prologue);
+                if let Some(ref key) = config.network_key {
+                    noise_builder = noise_builder.psk(0, &key[..]);
+                }
+                let handshake_state = match noise_builder.build_responder() {
+                        Ok(x) => x,
+                        Err(_) => return Err(HandshakeError::SessionCreateError),
+                    };
+                version_handshake_states.push((*version, handshake_state));
+            }
+        }
         Ok(MessageBuilder {
             state: State::Init,
+            pattern: config.pattern,
+            noise_protocol: config.noise_params(),
+            cipher: config.cipher,
+            hash: config.hash,
+            version: 0,
             additional_data: config.additional_data,
             authenticator: config.authenticator,
-            handshake_state: Some(handshake_state),
+            handshake_state: None,
             transport_state: None,
+            version_handshake_states,
             is_initiator,
             clock_skew: 0,
             peer_credentials: None,
+            addresses: PeerAddresses::default(),
+            rekey_policy: config.rekey_policy,
+            replay_cache: config.replay_cache,
+            replay_key: None,
+            psk: config.network_key.is_some(),
+            handshake_hash: None,
+            sent_messages: 0,
+            sent_bytes: 0,
         })
     }
 
     pub fn wipe(&mut self) {
-        self.additional_data.clear();
+        self.additional_data.zeroize();
         self.clock_skew = 0;
     }
 
+    /// Drops all handshake and transport state, which snow zeroizes,
+    /// and zeroizes the remaining session secrets. The builder cannot
+    /// be used afterwards; encrypting or decrypting fails.
+    pub fn destroy(&mut self) {
+        self.handshake_state = None;
+        self.transport_state = None;
+        self.version_handshake_states.clear();
+        if let Some(ref mut peer_credentials) = self.peer_credentials {
+            peer_credentials.wipe();
+        }
+        self.peer_credentials = None;
+        if let Some(ref mut handshake_hash) = self.handshake_hash {
+            handshake_hash.zeroize();
+        }
+        self.handshake_hash = None;
+        self.wipe();
+        self.state = State::Invalid;
+    }
+
     pub fn rekey_incoming(&mut self) {
-        self.transport_state.as_mut().unwrap().rekey_incoming();
+        if let Some(ref mut transport_state) = self.transport_state {
+            transport_state.rekey_incoming();
+        }
     }
 
     pub fn rekey_outgoing(&mut self) {
-        self.transport_state.as_mut().unwrap().rekey_outgoing();
+        if let Some(ref mut transport_state) = self.transport_state {
+            transport_state.rekey_outgoing();
+        }
+        self.sent_messages = 0;
+        self.sent_bytes = 0;
     }
 
-    pub fn peer_credentials(&self) -> &PeerCredentials {
-        self.peer_credentials.as_ref().unwrap()
+    pub fn rekey_policy(&self) -> RekeyPolicy {
+        self.rekey_policy
     }
 
-    pub fn clock_skew(&self) -> u32 {
+    /// Records an outgoing message of the given plaintext length and
+    /// returns true if the rekey policy now requires a rekey.
+    pub fn count_outgoing(&mut self, message_len: usize) -> bool {
+        self.sent_messages += 1;
+        self.sent_bytes += message_len as u64;
+        match self.rekey_policy {
+            RekeyPolicy::EveryMessage => true,
+            RekeyPolicy::Threshold { messages, bytes } => {
+                (messages != 0 && self.sent_messages >= messages) ||
+                    (bytes != 0 && self.sent_bytes >= bytes)
+            },
+        }
+    }
+
+    /// Returns the peer's credentials, or None if the peer has not
+    /// been authenticated or is anonymous.
+    pub fn peer_credentials(&self) -> Option<&PeerCredentials> {
+        self.peer_credentials.as_ref().map(|x| &**x)
+    }
+
+    /// Returns how many seconds the local clock is ahead of the clock
+    /// the responder reported during the handshake. Always zero for
+    /// responders, since clients do not send their time.
+    pub fn clock_skew(&self) -> i64 {
         self.clock_skew
     }
 
-    pub fn client_handshake1(&mut self) -> Result<[u8; NOISE_HANDSHAKE_MESSAGE1_SIZE], ClientHandshakeError> {
-	// -> (prologue), e, f
+    /// Returns the Noise handshake hash once the handshake is
+    /// finished, for binding higher level authentication to this
+    /// session. The hash is not secret.
+    pub fn handshake_hash(&self) -> Option<&[u8]> {
+        if self.state != State::DataTransfer {
+            return None
+        }
+        match self.handshake_state {
+            Some(ref handshake_state) => Some(handshake_state.get_handshake_hash()),
+            None => self.handshake_hash.as_ref().map(|x| &x[..]),
+        }
+    }
+
+    /// Sets the connection addresses passed to the authenticator.
+    pub fn set_addresses(&mut self, addresses: PeerAddresses) {
+        self.addresses = addresses;
+    }
+
+    pub fn addresses(&self) -> PeerAddresses {
+        self.addresses
+    }
+
+    /// Returns the additional data we authenticate with.
+    pub fn additional_data(&self) -> &[u8] {
+        &self.additional_data
+    }
+
+    /// Re-runs peer authentication with authenticator, for example
+    /// one built from an updated PKI document, using the peer's key
+    /// from the handshake and its current additional data.
+    pub fn reauthenticate_peer(&mut self, authenticator: PeerAuthenticator, additional_data: Vec<u8>) -> Result<(), AuthenticationError> {
+        self.authenticator = authenticator;
+        let peer_credentials = match self.peer_credentials {
+            Some(ref mut x) => x,
+            None => return Err(AuthenticationError::NoRemoteStatic),
+        };
+        peer_credentials.additional_data = additional_data;
+        if !self.authenticator.is_peer_valid(peer_credentials, &self.addresses) {
+            return Err(AuthenticationError::InvalidPeer);
+        }
+        Ok(())
+    }
+
+    pub fn pattern(&self) -> HandshakePattern {
+        self.pattern
+    }
+
+    /// Returns the protocol version offered by an initiator or, once
+    /// the first handshake message is received, selected by a responder.
+    pub fn protocol_version(&self) -> u8 {
+        self.version
+    }
+
+    pub fn negotiated_parameters(&self) -> NegotiatedParameters {
+        NegotiatedParameters {
+            noise_protocol: self.noise_protocol.clone(),
+            pattern: self.pattern,
+            cipher: self.cipher,
+            hash: self.hash,
+            version: self.version,
+            network_key: self.psk,
+            max_message_size: NOISE_MESSAGE_MAX_SIZE - MAC_SIZE,
+        }
+    }
+
+    /// Returns the on the wire size of the given handshake message.
+    pub fn handshake_message_size(&self, index: usize) -> usize {
+        let size = self.pattern.message_sizes()[index];
+        if !self.psk || index != 0 {
+            return size;
+        }
+        // psk0 keys the first message, encrypting e1 and, for XX,
+        // the otherwise plaintext payload.
+        match self.pattern {
+            HandshakePattern::XX => size + MAC_SIZE + MAC_SIZE,
+            _ => size + MAC_SIZE,
+        }
+    }
+
+    fn client_auth_message(&self) -> AuthenticateMessage {
+        AuthenticateMessage {
+            ad: self.additional_data.clone(),
+            // Clients should always send a zero unix_time so they don't
+            // leak their system time to the peer.
+            unix_time: 0,
+        }
+    }
+
+    // Records the credentials of the peer whose static key has been
+    // received or is known from a pre-message and checks them
+    // against our authenticator.
+    fn authenticate_peer(&mut self, peer_auth: AuthenticateMessage) -> Result<(), AuthenticationError> {
+        let peer_key = match self.handshake_state.as_ref().unwrap().get_remote_static() {
+            Some(x) => PublicKey::from(*array_ref![x, 0, 32]),
+            None => return Err(AuthenticationError::NoRemoteStatic),
+        };
+        self.peer_credentials = Some(Box::new(PeerCredentials {
+            additional_data: peer_auth.ad,
+            public_key: peer_key,
+        }));
+        if !self.authenticator.is_peer_valid(self.peer_credentials.as_ref().unwrap(), &self.addresses) {
+            return Err(AuthenticationError::InvalidPeer);
+        }
+        Ok(())
+    }
+
+    pub fn client_handshake1(&mut self) -> Result<Vec<u8>, ClientHandshakeError> {
+	// -> (prologue), e, e1[, es[, s, ss, (auth)]]
+        let mut payload = vec![];
+        if self.pattern.initiator_auth_in_first_message() {
+            payload = match self.client_auth_message().to_vec() {
+                Ok(x) => x,
+                Err(_) => return Err(ClientHandshakeError::AuthenticationError),
+            };
+        }
         let mut msg = [0u8; NOISE_MESSAGE_MAX_SIZE];
-        let _len = match self.handshake_state.as_mut().unwrap().write_message(&[0u8;0], &mut msg) {
+        let _len = match self.handshake_state.as_mut().unwrap().write_message(&payload, &mut msg) {
             Ok(x) => x,
             Err(_) => return Err(ClientHandshakeError::Noise1WriteError),
         };
-        let mut msg1 = [0u8; NOISE_HANDSHAKE_MESSAGE1_SIZE];
-        msg1[0] = PROLOGUE[0];
-        msg1[PROLOGUE_SIZE..].copy_from_slice(&msg[.._len]);
+        let mut msg1 = Vec::with_capacity(PROLOGUE_SIZE + _len);
+        msg1.push(self.version);
+        msg1.extend_from_slice(&msg[.._len]);
+        assert_eq!(self.handshake_message_size(0), msg1.len());
         Ok(msg1)
     }
 
@@ -277,69 +1195,118 @@ impl MessageBuilder {
         self.state = State::DataTransfer;
     }
 
-    pub fn received_server_handshake1(&mut self, message: [u8; NOISE_HANDSHAKE_MESSAGE2_SIZE]) -> Result<(), ClientHandshakeError> {
-        let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap().as_secs() as u32;
-        let mut raw_auth = [0u8; AUTH_MESSAGE_SIZE];
-        let _len = match self.handshake_state.as_mut().unwrap().read_message(&message, &mut raw_auth) {
+    pub fn received_server_handshake1(&mut self, message: &[u8]) -> Result<(), ClientHandshakeError> {
+        if self.state != State::SentClientHandshake1 {
+            return Err(ClientHandshakeError::InvalidStateError);
+        }
+        let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap().as_secs() as i64;
+        let mut raw_auth = [0u8; NOISE_MESSAGE_MAX_SIZE];
+        let _len = match self.handshake_state.as_mut().unwrap().read_message(message, &mut raw_auth) {
             Ok(x) => x,
             Err(_) => return Err(ClientHandshakeError::Noise2ReadError),
         };
-        let peer_auth = match AuthenticateMessage::from_bytes(&raw_auth) {
+        let peer_auth = match AuthenticateMessage::from_bytes(&raw_auth[.._len]) {
             Ok(x) => x,
             Err(_) => return Err(ClientHandshakeError::AuthenticationError),
         };
 
         // Authenticate the peer.
-        let raw_peer_key = match self.handshake_state.as_mut().unwrap().get_remote_static() {
-            Some(x) => x,
-            None => return Err(ClientHandshakeError::FailedToGetRemoteStatic),
-        };
-        let peer_key = PublicKey::from(*array_ref![raw_peer_key, 0, 32]);
-        self.peer_credentials = Some(Box::new(PeerCredentials {
-            additional_data: peer_auth.ad,
-            public_key: peer_key,
-        }));
-        let peer_key = self.peer_credentials.as_ref().unwrap();
-        if !self.authenticator.is_peer_valid(peer_key) {
-            return Err(ClientHandshakeError::AuthenticationError);
+        let peer_clock = peer_auth.unix_time;
+        match self.authenticate_peer(peer_auth) {
+            Ok(()) => {},
+            Err(AuthenticationError::NoRemoteStatic) => return Err(ClientHandshakeError::FailedToGetRemoteStatic),
+            Err(_) => return Err(ClientHandshakeError::AuthenticationError),
         }
 
         // Cache the clock skew.
-        let peer_clock = peer_auth.unix_time;
-        self.clock_skew = now - peer_clock;
+        self.clock_skew = now - peer_clock as i64;
 
-        self.state = State::ReceivedServerHandshake1;
+        if self.pattern.message_count() == 2 {
+            self.state = State::DataTransfer;
+        } else {
+            self.state = State::ReceivedServerHandshake1;
+        }
         Ok(())
     }
 
-    pub fn client_handshake2(&mut self) -> Result<[u8; NOISE_HANDSHAKE_MESSAGE3_SIZE], ClientHandshakeError> {
+    pub fn client_handshake2(&mut self) -> Result<Vec<u8>, ClientHandshakeError> {
+        if self.state != State::ReceivedServerHandshake1 {
+            return Err(ClientHandshakeError::InvalidStateError);
+        }
         let mut msg = [0u8; NOISE_MESSAGE_MAX_SIZE];
-        let our_auth = AuthenticateMessage {
-            ad: self.additional_data.clone(),
-            // Clients should always send a zero unix_time so they don't
-            // leak their system time to the peer.
-            unix_time: 0,
-        };
+        let our_auth = self.client_auth_message();
         let _len = match self.handshake_state.as_mut().unwrap().write_message(&our_auth.to_vec().unwrap(), &mut msg) {
             Ok(x) => x,
             Err(_) => return Err(ClientHandshakeError::Noise3WriteError),
         };
-        assert_eq!(NOISE_HANDSHAKE_MESSAGE3_SIZE, _len);
-        Ok(*array_ref![msg, 0, NOISE_HANDSHAKE_MESSAGE3_SIZE])
+        assert_eq!(self.handshake_message_size(2), _len);
+        Ok(msg[.._len].to_vec())
     }
 
-    pub fn received_client_handshake1(&mut self, message: [u8; NOISE_HANDSHAKE_MESSAGE1_SIZE]) -> Result<[u8; NOISE_HANDSHAKE_MESSAGE2_SIZE], ServerHandshakeError> {
+    pub fn received_client_handshake1(&mut self, message: &[u8]) -> Result<Vec<u8>, ServerHandshakeError> {
         if self.state != State::Init {
             return Err(ServerHandshakeError::InvalidStateError);
         }
-        if message[0..PROLOGUE_SIZE].ct_eq(&PROLOGUE).unwrap_u8() == 0 {
+        if message.len() < PROLOGUE_SIZE {
+            return Err(ServerHandshakeError::Noise1ReadError);
+        }
+        let version = message[0];
+        let candidates: Vec<snow::HandshakeState> = self.version_handshake_states.drain(..)
+            .filter(|x| x.0 == version)
+            .map(|x| x.1)
+            .collect();
+        if candidates.is_empty() {
             return Err(ServerHandshakeError::PrologueMismatchError);
         }
-        let mut _msg = [0u8; NOISE_HANDSHAKE_MESSAGE1_SIZE];
-        let _len = match self.handshake_state.as_mut().unwrap().read_message(&message[PROLOGUE_SIZE..], &mut _msg) {
-            Ok(x) => x,
-            Err(_) => return Err(ServerHandshakeError::Noise1ReadError),
-        };
+        self.version = version;
+        // With more than one authentication key, the first message
+        // only decrypts under the key the initiator addressed. XX does
+        // not encrypt the first message so the current key is used.
+        let mut raw_auth = [0u8; NOISE_MESSAGE_MAX_SIZE];
+        let mut _len = 0;
+        for mut handshake_state in candidates.into_iter() {
+            if let Ok(x) = handshake_state.read_message(&message[PROLOGUE_SIZE..], &mut raw_auth) {
+                _len = x;
+                self.handshake_state = Some(handshake_state);
+                break
+            }
+        }
+        if self.handshake_state.is_none() {
+            return Err(ServerHandshakeError::Noise1ReadError);
+        }
+        if self.pattern.initiator_auth_in_first_message() {
+            let peer_auth = match AuthenticateMessage::from_bytes(&raw_auth[.._len]) {
+                Ok(x) => x,
+                Err(_) => return Err(ServerHandshakeError::AuthenticationError),
+            };
+            match self.authenticate_peer(peer_auth) {
+                Ok(()) => {},
+                Err(AuthenticationError::NoRemoteStatic) => return Err(ServerHandshakeError::FailedToGetRemoteStatic),
+                Err(_) => return Err(ServerHandshakeError::AuthenticationError),
+            }
+        }
+        // Recording the key only now keeps messages that fail to
+        // decrypt or authenticate out of the cache. Keys from first
+        // messages that do not authenticate the initiator stay
+        // unconfirmed until received_client_handshake2, so that anyone
+        // sending junk cannot evict them.
+        if let Some(ref replay_cache) = self.replay_cache {
+            // Every pattern starts with the initiator's ephemeral key.
+            if message.len() < PROLOGUE_SIZE + KEY_SIZE {
+                return Err(ServerHandshakeError::Noise1ReadError);
+            }
+            let key = &message[PROLOGUE_SIZE..PROLOGUE_SIZE + KEY_SIZE];
+            let mut replay_cache = replay_cache.lock().unwrap();
+            let fresh = if self.pattern.initiator_auth_in_first_message() {
+                replay_cache.insert(key)
+            } else {
+                self.replay_key = Some(key.to_vec());
+                replay_cache.insert_unconfirmed(key)
+            };
+            if !fresh {
+                return Err(ServerHandshakeError::ReplayError);
+            }
+        }
         self.state = State::ReceivedClientHandshake1;
 
         // send server's handshake1 message
@@ -347,55 +1314,74 @@ impl MessageBuilder {
             ad: self.additional_data.clone(),
             unix_time: SystemTime::now().duration_since(UNIX_EPOCH).unwrap().as_secs() as u32,
         };
-        let mut mesg = [0u8; NOISE_HANDSHAKE_MESSAGE2_SIZE];
+        let mut mesg = [0u8; NOISE_MESSAGE_MAX_SIZE];
         let mut _len = match self.handshake_state.as_mut().unwrap().write_message(&our_auth.to_vec().unwrap(), &mut mesg) {
             Ok(x) => x,
             Err(_) => return Err(ServerHandshakeError::Noise2WriteError),
         };
-        assert_eq!(NOISE_HANDSHAKE_MESSAGE2_SIZE, _len);
-        Ok(mesg)
+        assert_eq!(self.handshake_message_size(1), _len);
+        Ok(mesg[.._len].to_vec())
     }
 
     pub fn sent_server_handshake1(&mut self) {
-        self.state = State::SentServerHandshake1;
+        if self.pattern.message_count() == 2 {
+            self.state = State::DataTransfer;
+        } else {
+            self.state = State::SentServerHandshake1;
+        }
     }
 
-    pub fn received_client_handshake2(&mut self, message: [u8; NOISE_HANDSHAKE_MESSAGE3_SIZE]) -> Result<(), ServerHandshakeError> {
+    pub fn received_client_handshake2(&mut self, message: &[u8]) -> Result<(), ServerHandshakeError> {
         if self.state != State::SentServerHandshake1 {
             return Err(ServerHandshakeError::InvalidStateError);
         }
-        let mut raw_auth = [0u8; AUTH_MESSAGE_SIZE];
-        let _match = self.handshake_state.as_mut().unwrap().read_message(&message, &mut raw_auth);
-        match _match {
+        let mut raw_auth = [0u8; NOISE_MESSAGE_MAX_SIZE];
+        let _len = match self.handshake_state.as_mut().unwrap().read_message(message, &mut raw_auth) {
             Ok(x) => x,
             Err(_) => return Err(ServerHandshakeError::Noise3ReadError),
         };
-        let peer_auth = AuthenticateMessage::from_bytes(&raw_auth).unwrap();
-        let raw_peer_key = self.handshake_state.as_mut().unwrap().get_remote_static().unwrap();
-        let peer_key = PublicKey::from(*array_ref![raw_peer_key, 0, 32]);
-        self.peer_credentials = Some(Box::new(PeerCredentials {
-            additional_data: peer_auth.ad,
-            public_key: peer_key,
-        }));
-        let peer_key = self.peer_credentials.as_ref().unwrap();
-        if !self.authenticator.is_peer_valid(peer_key) {
-            return Err(ServerHandshakeError::AuthenticationError);
+        let peer_auth = match AuthenticateMessage::from_bytes(&raw_auth[.._len]) {
+            Ok(x) => x,
+            Err(_) => return Err(ServerHandshakeError::AuthenticationError),
+        };
+        match self.authenticate_peer(peer_auth) {
+            Ok(()) => {},
+            Err(AuthenticationError::NoRemoteStatic) => return Err(ServerHandshakeError::FailedToGetRemoteStatic),
+            Err(_) => return Err(ServerHandshakeError::AuthenticationError),
+        }
+        if let (Some(replay_cache), Some(key)) = (self.replay_cache.as_ref(), self.replay_key.take()) {
+            replay_cache.lock().unwrap().confirm(&key);
         }
         self.state = State::DataTransfer;
         Ok(())
     }
-
     pub fn into_transport_mode(self) -> Result<Self, HandshakeError> {
         // Transition into transport mode after handshake is finished.
+        let handshake_state = self.handshake_state.unwrap();
+        let handshake_hash = handshake_state.get_handshake_hash().to_vec();
         Ok(Self {
             handshake_state: None,
-            transport_state: Some(self.handshake_state.unwrap().into_transport_mode()?),
+            transport_state: Some(handshake_state.into_transport_mode()?),
+            version_handshake_states: vec![],
             state: self.state,
+            pattern: self.pattern,
+            noise_protocol: self.noise_protocol,
+            cipher: self.cipher,
+            hash: self.hash,
+            version: self.version,
             additional_data: self.additional_data,
             authenticator: self.authenticator,
             is_initiator: self.is_initiator,
             clock_skew: self.clock_skew,
             peer_credentials: self.peer_credentials,
+            addresses: self.addresses,
+            rekey_policy: self.rekey_policy,
+            replay_cache: None,
+            replay_key: None,
+            psk: self.psk,
+            handshake_hash: Some(handshake_hash),
+            sent_messages: 0,
+            sent_bytes: 0,
         })
     }
 
@@ -404,10 +1390,14 @@ impl MessageBuilder {
         if ct_len > NOISE_MESSAGE_MAX_SIZE {
             return Err(SendMessageError::InvalidMessageSize);
         }
+        let transport_state = match self.transport_state {
+            Some(ref mut x) => x,
+            None => return Err(SendMessageError::EncryptFail),
+        };
         let mut ct_hdr = [0u8; 4];
         BigEndian::write_u32(&mut ct_hdr, ct_len as u32);
         let mut ciphertext_header = [0u8; NOISE_MESSAGE_MAX_SIZE];
-        let _result = self.transport_state.as_mut().unwrap().write_message(&ct_hdr, &mut ciphertext_header);
+        let _result = transport_state.write_message(&ct_hdr, &mut ciphertext_header);
         let _header_len;
         match _result {
             Ok(x) => {
@@ -418,7 +1408,7 @@ impl MessageBuilder {
             },
         }
         let mut ciphertext = [0u8; NOISE_MESSAGE_MAX_SIZE];
-        let _result = self.transport_state.as_mut().unwrap().write_message(&message, &mut ciphertext);
+        let _result = transport_state.write_message(&message, &mut ciphertext);
         let mut _payload_len;
         match _result {
             Ok(x) => {
@@ -435,8 +1425,12 @@ impl MessageBuilder {
     }
 
     pub fn decrypt_message_header(&mut self, message: &[u8]) -> Result<u32, ReceiveMessageError> {
+        let transport_state = match self.transport_state {
+            Some(ref mut x) => x,
+            None => return Err(ReceiveMessageError::DecryptFail),
+        };
         let mut header = [0u8; HEADER_SIZE];
-        match self.transport_state.as_mut().unwrap().read_message(&message[..NOISE_MESSAGE_HEADER_SIZE], &mut header) {
+        match transport_state.read_message(&message[..NOISE_MESSAGE_HEADER_SIZE], &mut header) {
             Ok(x) => {
                 assert_eq!(x, 4);
                 Ok(BigEndian::read_u32(&header))
@@ -446,9 +1440,23 @@ impl MessageBuilder {
     }
 
     pub fn decrypt_message(&mut self, message: &[u8]) -> Result<Vec<u8>, ReceiveMessageError> {
-        let mut plaintext = [0u8; NOISE_MESSAGE_MAX_SIZE];
-        match self.transport_state.as_mut().unwrap().read_message(&message, &mut plaintext) {
-            Ok(_len) => Ok(plaintext[.._len].to_vec()),
+        let mut plaintext = Zeroizing::new([0u8; NOISE_MESSAGE_MAX_SIZE]);
+        let len = self.decrypt_message_into(message, &mut plaintext[..])?;
+        Ok(plaintext[..len].to_vec())
+    }
+
+    /// Decrypts message into plaintext, which must hold at least
+    /// message.len() - MAC_SIZE bytes, returning the plaintext length.
+    pub fn decrypt_message_into(&mut self, message: &[u8], plaintext: &mut [u8]) -> Result<usize, ReceiveMessageError> {
+        let transport_state = match self.transport_state {
+            Some(ref mut x) => x,
+            None => return Err(ReceiveMessageError::DecryptFail),
+        };
+        if message.len() < MAC_SIZE || message.len() - MAC_SIZE > plaintext.len() {
+            return Err(ReceiveMessageError::InvalidMessageSize);
+        }
+        match transport_state.read_message(&message, plaintext) {
+            Ok(len) => Ok(len),
             Err(_) => Err(ReceiveMessageError::DecryptFail),
         }
     }
@@ -461,9 +1469,67 @@ mod tests {
     use super::super::sphinxcrypto::constants::USER_FORWARD_PAYLOAD_SIZE;
     use super::{PeerAuthenticator, ProviderAuthenticatorState};
     use super::super::commands::Command;
+    use super::super::constants::NOISE_PARAMS;
     use self::rand_core::OsRng;
     use super::*;
 
+    #[test]
+    fn address_restricted_authenticator_test() {
+        let key = PublicKey::from(&StaticSecret::new(OsRng));
+        let other_key = PublicKey::from(&StaticSecret::new(OsRng));
+        let mut mix_map = HashMap::new();
+        mix_map.insert(key, true);
+        mix_map.insert(other_key, true);
+        let mut networks = HashMap::new();
+        networks.insert(key, vec![Network{ address: "10.1.0.0".parse().unwrap(), prefix_len: 20 }]);
+        let mut authenticator = PeerAuthenticator::AddressRestricted(AddressRestrictedAuthenticatorState{
+            authenticator: Box::new(PeerAuthenticator::Server(ServerAuthenticatorState{ mix_map })),
+            networks,
+        });
+        let credentials = PeerCredentials{ additional_data: vec![], public_key: key };
+        let other_credentials = PeerCredentials{ additional_data: vec![], public_key: other_key };
+        let from = |x: &str| PeerAddresses{ local: None, remote: Some(x.parse().unwrap()), process: None };
+
+        assert!(authenticator.is_peer_valid(&credentials, &from("10.1.15.3:1234")));
+        assert!(!authenticator.is_peer_valid(&credentials, &from("10.1.16.3:1234")));
+        assert!(!authenticator.is_peer_valid(&credentials, &from("[::ffff:10.1.15.3]:1234")));
+        assert!(!authenticator.is_peer_valid(&credentials, &PeerAddresses::default()));
+        // unlisted keys are not restricted
+        assert!(authenticator.is_peer_valid(&other_credentials, &from("192.0.2.1:1234")));
+        let unknown = PeerCredentials{ additional_data: vec![], public_key: PublicKey::from(&StaticSecret::new(OsRng)) };
+        assert!(!authenticator.is_peer_valid(&unknown, &from("10.1.15.3:1234")));
+
+        let network = Network{ address: "2001:db8::".parse().unwrap(), prefix_len: 32 };
+        assert!(network.contains("2001:db8:1::1".parse().unwrap()));
+        assert!(!network.contains("2001:db9::1".parse().unwrap()));
+        assert!(Network{ address: "0.0.0.0".parse().unwrap(), prefix_len: 0 }.contains("192.0.2.1".parse().unwrap()));
+        assert!(!Network{ address: "0.0.0.0".parse().unwrap(), prefix_len: 33 }.contains("192.0.2.1".parse().unwrap()));
+    }
+
+    #[test]
+    fn process_restricted_authenticator_test() {
+        let key = PublicKey::from(&StaticSecret::new(OsRng));
+        let other_key = PublicKey::from(&StaticSecret::new(OsRng));
+        let mut mix_map = HashMap::new();
+        mix_map.insert(key, true);
+        mix_map.insert(other_key, true);
+        let mut uids = HashMap::new();
+        uids.insert(key, vec![1000]);
+        let mut authenticator = PeerAuthenticator::ProcessRestricted(ProcessRestrictedAuthenticatorState{
+            authenticator: Box::new(PeerAuthenticator::Server(ServerAuthenticatorState{ mix_map })),
+            uids,
+        });
+        let credentials = PeerCredentials{ additional_data: vec![], public_key: key };
+        let other_credentials = PeerCredentials{ additional_data: vec![], public_key: other_key };
+        let from = |uid| PeerAddresses{ local: None, remote: None, process: Some(PeerProcess{ pid: None, uid, gid: 1000 }) };
+
+        assert!(authenticator.is_peer_valid(&credentials, &from(1000)));
+        assert!(!authenticator.is_peer_valid(&credentials, &from(0)));
+        assert!(!authenticator.is_peer_valid(&credentials, &PeerAddresses::default()));
+        // unlisted keys are not restricted
+        assert!(authenticator.is_peer_valid(&other_credentials, &PeerAddresses::default()));
+    }
+
     #[test]
     fn authentication_message_test() {
         let auth1 = AuthenticateMessage{
@@ -491,12 +1557,7 @@ mod tests {
         };
         let provider_authenticator = PeerAuthenticator::Provider(provider_auth);
 
-        let server_config = SessionConfig {
-            authenticator: provider_authenticator,
-            authentication_key: server_secret.clone(),
-            peer_public_key: None,
-            additional_data: vec![],
-        };
+        let server_config = SessionConfig::new(provider_authenticator, server_secret.clone(), None, vec![]);
         let mut server_session = MessageBuilder::new(server_config, false).unwrap();
 
         // client
@@ -505,28 +1566,23 @@ mod tests {
         };
         let client_authenticator = PeerAuthenticator::Client(client_auth);
 
-        let client_config = SessionConfig {
-            authenticator: client_authenticator,
-            authentication_key: client_secret,
-            peer_public_key: Some(PublicKey::from(&server_secret)),
-            additional_data: vec![],
-        };
+        let client_config = SessionConfig::new(client_authenticator, client_secret, Some(PublicKey::from(&server_secret)), vec![]);
         let mut client_session = MessageBuilder::new(client_config, true).unwrap();
 
         // handshake
         // c -> s
         let client_handshake1 = client_session.client_handshake1().unwrap();
         let _ok = client_session.sent_client_handshake1();
-        let server_handshake1 = server_session.received_client_handshake1(client_handshake1).unwrap();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
 
         // s -> c
         server_session.sent_server_handshake1();
-        client_session.received_server_handshake1(server_handshake1).unwrap();
+        client_session.received_server_handshake1(&server_handshake1).unwrap();
 
         // c -> s
         let client_handshake2 = client_session.client_handshake2().unwrap();
         client_session.sent_client_handshake2();
-        server_session.received_client_handshake2(client_handshake2).unwrap();
+        server_session.received_client_handshake2(&client_handshake2).unwrap();
 
         // data transfer phase
         server_session = server_session.into_transport_mode().unwrap();
@@ -552,4 +1608,502 @@ mod tests {
         let raw_cmd = server_session.decrypt_message(&client_to_send[NOISE_MESSAGE_HEADER_SIZE..].to_vec()).unwrap();
         assert_eq!(raw_cmd, client_message);
     }
+
+    #[test]
+    fn first_contact_handshake_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+
+        // server
+        let mut client_map = HashMap::new();
+        client_map.insert(PublicKey::from(&client_secret), true);
+        let provider_auth = ProviderAuthenticatorState {
+            mix_map: HashMap::default(),
+            client_map: client_map,
+            from_client: false,
+            from_mix: false,
+        };
+        let server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret.clone(), None, vec![]);
+        let mut server_session = MessageBuilder::new(server_config, false).unwrap();
+
+        // client, without prior knowledge of the server's key
+        let first_contact_auth = FirstContactAuthenticatorState{
+            peer_public_key: None,
+        };
+        let client_config = SessionConfig::new(PeerAuthenticator::FirstContact(first_contact_auth), client_secret, None, vec![]);
+        let mut client_session = MessageBuilder::new(client_config, true).unwrap();
+
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        client_session.received_server_handshake1(&server_handshake1).unwrap();
+        let client_handshake2 = client_session.client_handshake2().unwrap();
+        client_session.sent_client_handshake2();
+        server_session.received_client_handshake2(&client_handshake2).unwrap();
+
+        // the server's key was learned during the handshake
+        assert_eq!(client_session.peer_credentials().unwrap().public_key, PublicKey::from(&server_secret));
+        let want = PeerAuthenticator::FirstContact(FirstContactAuthenticatorState{
+            peer_public_key: Some(PublicKey::from(&server_secret)),
+        });
+        assert_eq!(client_session.authenticator, want);
+    }
+
+    #[test]
+    fn handshake_patterns_test() {
+        let patterns = [HandshakePattern::XX, HandshakePattern::XK,
+                        HandshakePattern::IK, HandshakePattern::NK];
+        for pattern in patterns.iter() {
+            let server_secret = StaticSecret::new(OsRng);
+            let client_secret = StaticSecret::new(OsRng);
+
+            let mut client_map = HashMap::new();
+            client_map.insert(PublicKey::from(&client_secret), true);
+            let provider_auth = ProviderAuthenticatorState {
+                mix_map: HashMap::default(),
+                client_map: client_map,
+                from_client: false,
+                from_mix: false,
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret.clone(), None, vec![]);
+            server_config.pattern = *pattern;
+            let mut server_session = MessageBuilder::new(server_config, false).unwrap();
+
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(&server_secret),
+            };
+            let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(&server_secret)), vec![]);
+            client_config.pattern = *pattern;
+            let mut client_session = MessageBuilder::new(client_config, true).unwrap();
+
+            let client_handshake1 = client_session.client_handshake1().unwrap();
+            client_session.sent_client_handshake1();
+            let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+            assert_eq!(server_handshake1.len(), pattern.message_sizes()[1]);
+            server_session.sent_server_handshake1();
+            client_session.received_server_handshake1(&server_handshake1).unwrap();
+            if pattern.message_count() == 3 {
+                let client_handshake2 = client_session.client_handshake2().unwrap();
+                client_session.sent_client_handshake2();
+                server_session.received_client_handshake2(&client_handshake2).unwrap();
+            }
+
+            if *pattern == HandshakePattern::NK {
+                assert!(server_session.peer_credentials().is_none());
+            } else {
+                assert_eq!(server_session.peer_credentials().unwrap().public_key, PublicKey::from(&client_secret));
+            }
+
+            assert!(server_session.handshake_hash().is_some());
+            assert_eq!(server_session.handshake_hash(), client_session.handshake_hash());
+
+            let mut server_session = server_session.into_transport_mode().unwrap();
+            let mut client_session = client_session.into_transport_mode().unwrap();
+            assert_eq!(server_session.handshake_hash(), client_session.handshake_hash());
+            let client_message = Command::NoOp{}.to_vec();
+            let to_send = client_session.encrypt_message(&client_message).unwrap();
+            server_session.decrypt_message_header(&to_send).unwrap();
+            let raw_cmd = server_session.decrypt_message(&to_send[NOISE_MESSAGE_HEADER_SIZE..]).unwrap();
+            assert_eq!(raw_cmd, client_message);
+        }
+    }
+
+    #[test]
+    fn prologue_mismatch_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+
+        let server_auth = ServerAuthenticatorState {
+            mix_map: HashMap::default(),
+        };
+        let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+        server_config.prologue = b"network-a".to_vec();
+        let mut server_session = MessageBuilder::new(server_config, false).unwrap();
+
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(PublicKey::from(&server_secret)), vec![]);
+        client_config.prologue = b"network-b".to_vec();
+        let mut client_session = MessageBuilder::new(client_config, true).unwrap();
+
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        match client_session.received_server_handshake1(&server_handshake1) {
+            Err(ClientHandshakeError::Noise2ReadError) => {},
+            _ => panic!("expected prologue mismatch to fail the handshake"),
+        }
+    }
+
+    #[test]
+    fn rekey_policy_mismatch_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+
+        let server_auth = ServerAuthenticatorState {
+            mix_map: HashMap::default(),
+        };
+        let server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+        let mut server_session = MessageBuilder::new(server_config, false).unwrap();
+
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(PublicKey::from(&server_secret)), vec![]);
+        client_config.rekey_policy = RekeyPolicy::Threshold{ messages: 3, bytes: 0 };
+        let mut client_session = MessageBuilder::new(client_config, true).unwrap();
+
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        match client_session.received_server_handshake1(&server_handshake1) {
+            Err(ClientHandshakeError::Noise2ReadError) => {},
+            _ => panic!("expected a rekey policy mismatch to fail the handshake"),
+        }
+    }
+    #[test]
+    fn version_negotiation_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let new_session = |server_versions: Vec<u8>, client_versions: Vec<u8>| {
+            let server_auth = ServerAuthenticatorState {
+                mix_map: HashMap::default(),
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+            server_config.versions = server_versions;
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(&server_secret),
+            };
+            let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(&server_secret)), vec![]);
+            client_config.versions = client_versions;
+            (MessageBuilder::new(server_config, false).unwrap(), MessageBuilder::new(client_config, true).unwrap())
+        };
+
+        // the responder selects the offered version
+        let (mut server_session, mut client_session) = new_session(vec![3, 2], vec![2]);
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        client_session.received_server_handshake1(&server_handshake1).unwrap();
+        assert_eq!(server_session.protocol_version(), 2);
+
+        // unsupported versions are rejected
+        let (mut server_session, mut client_session) = new_session(vec![2], vec![3]);
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        match server_session.received_client_handshake1(&client_handshake1) {
+            Err(ServerHandshakeError::PrologueMismatchError) => {},
+            _ => panic!("expected unsupported version to be rejected"),
+        }
+
+        // rewriting the offered version is detected
+        let (mut server_session, mut client_session) = new_session(vec![3, 2], vec![3]);
+        let mut client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        client_handshake1[0] = 2;
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        assert!(client_session.received_server_handshake1(&server_handshake1).is_err());
+    }
+
+    #[test]
+    fn cipher_suite_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let default_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), None, vec![]);
+        assert_eq!(default_config.noise_params(), NOISE_PARAMS);
+        let new_session = |server_cipher: CipherSuite, client_cipher: CipherSuite| {
+            let server_auth = ServerAuthenticatorState {
+                mix_map: HashMap::default(),
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+            server_config.cipher = server_cipher;
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(&server_secret),
+            };
+            let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(&server_secret)), vec![]);
+            client_config.cipher = client_cipher;
+            (MessageBuilder::new(server_config, false).unwrap(), MessageBuilder::new(client_config, true).unwrap())
+        };
+
+        let (mut server_session, mut client_session) = new_session(CipherSuite::AESGCM, CipherSuite::AESGCM);
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        client_session.received_server_handshake1(&server_handshake1).unwrap();
+
+        // the cipher is bound into the handshake
+        let (mut server_session, mut client_session) = new_session(CipherSuite::ChaChaPoly, CipherSuite::AESGCM);
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        assert!(client_session.received_server_handshake1(&server_handshake1).is_err());
+    }
+
+    #[test]
+    fn session_config_options_test() {
+        let secret = StaticSecret::new(OsRng);
+        let auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&secret),
+        };
+        let config = SessionConfig::new(PeerAuthenticator::Client(auth), secret.clone(), None, vec![])
+            .with_pattern(HandshakePattern::IK)
+            .with_prologue(b"test".to_vec())
+            .with_handshake_timeout(Duration::from_secs(3))
+            .with_network_key([2u8; KEY_SIZE])
+            .with_on_close(|_, _| {});
+        assert_eq!(config.pattern, HandshakePattern::IK);
+        assert_eq!(config.prologue, b"test".to_vec());
+        assert_eq!(config.handshake_timeout, Some(Duration::from_secs(3)));
+        assert!(config.on_close.is_some());
+        assert!(config.on_handshake_complete.is_none());
+        assert_eq!(config.noise_params(), "Noise_IKhfs+psk0_25519+Kyber1024_ChaChaPoly_BLAKE2b");
+    }
+
+    #[test]
+    fn validate_test() {
+        let secret = StaticSecret::new(OsRng);
+        let auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&secret),
+        };
+        let config = SessionConfig::new(PeerAuthenticator::Client(auth), secret.clone(), None, vec![]);
+        match MessageBuilder::new(config.clone(), true) {
+            Err(HandshakeError::ConfigError(ConfigError::MissingPeerPublicKey)) => {},
+            _ => panic!("expected a missing peer key"),
+        }
+        let mut config = config;
+        config.peer_public_key = Some(PublicKey::from(&secret));
+        assert!(config.validate(true).is_ok());
+        config.additional_data = vec![0u8; MAX_ADDITIONAL_DATA_SIZE + 1];
+        match config.validate(true) {
+            Err(ConfigError::AdditionalDataTooLarge) => {},
+            _ => panic!("expected oversized additional data"),
+        }
+        config.additional_data = vec![];
+        config.max_command_size = 0;
+        match config.validate(true) {
+            Err(ConfigError::ZeroMaxCommandSize) => {},
+            _ => panic!("expected a zero max_command_size"),
+        }
+        config.max_command_size = DEFAULT_MAX_COMMAND_SIZE;
+        config.versions = vec![EXTENDED_PROTOCOL_VERSION, PROTOCOL_VERSION];
+        match config.validate(true) {
+            Err(ConfigError::MultipleVersionsOnInitiator) => {},
+            _ => panic!("expected an initiator offering more than one version"),
+        }
+        assert!(config.validate(false).is_ok());
+        config.versions = vec![EXTENDED_PROTOCOL_VERSION];
+        config.rekey_policy = RekeyPolicy::Threshold{ messages: 1, bytes: 0 };
+        assert!(config.validate(true).is_ok());
+        config.versions = vec![PROTOCOL_VERSION];
+        match config.validate(true) {
+            Err(ConfigError::ThresholdRekeyOnKatzenpost) => {},
+            _ => panic!("expected a Threshold rekey on Katzenpost's version"),
+        }
+        config.rekey_policy = RekeyPolicy::EveryMessage;
+        config.compression_threshold = Some(1000);
+        match config.validate(true) {
+            Ok(()) if cfg!(feature = "compression") => {},
+            Err(ConfigError::CompressionUnavailable) if !cfg!(feature = "compression") => {},
+            _ => panic!("expected compression_threshold to need the compression feature"),
+        }
+    }
+
+    #[test]
+    fn network_key_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let new_session = |server_key: Option<[u8; KEY_SIZE]>, client_key: Option<[u8; KEY_SIZE]>| {
+            let server_auth = ServerAuthenticatorState {
+                mix_map: HashMap::default(),
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+            server_config.network_key = server_key.map(Zeroizing::new);
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(&server_secret),
+            };
+            let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(&server_secret)), vec![]);
+            client_config.network_key = client_key.map(Zeroizing::new);
+            (MessageBuilder::new(server_config, false).unwrap(), MessageBuilder::new(client_config, true).unwrap())
+        };
+
+        let (mut server_session, mut client_session) = new_session(Some([1u8; KEY_SIZE]), Some([1u8; KEY_SIZE]));
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        client_session.received_server_handshake1(&server_handshake1).unwrap();
+
+        // the responder rejects the first message without the right key
+        let (mut server_session, mut client_session) = new_session(Some([1u8; KEY_SIZE]), Some([2u8; KEY_SIZE]));
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        assert!(server_session.received_client_handshake1(&client_handshake1).is_err());
+    }
+
+    #[test]
+    fn hash_function_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let new_session = |server_hash: HashFunction, client_hash: HashFunction| {
+            let server_auth = ServerAuthenticatorState {
+                mix_map: HashMap::default(),
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+            server_config.hash = server_hash;
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(&server_secret),
+            };
+            let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(&server_secret)), vec![]);
+            client_config.hash = client_hash;
+            (MessageBuilder::new(server_config, false).unwrap(), MessageBuilder::new(client_config, true).unwrap())
+        };
+
+        for hash in [HashFunction::BLAKE2s, HashFunction::SHA256, HashFunction::SHA512].iter() {
+            let (mut server_session, mut client_session) = new_session(*hash, *hash);
+            let client_handshake1 = client_session.client_handshake1().unwrap();
+            client_session.sent_client_handshake1();
+            let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+            server_session.sent_server_handshake1();
+            client_session.received_server_handshake1(&server_handshake1).unwrap();
+        }
+
+        // the hash function is bound into the handshake
+        let (mut server_session, mut client_session) = new_session(HashFunction::BLAKE2b, HashFunction::SHA512);
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        assert!(client_session.received_server_handshake1(&server_handshake1).is_err());
+    }
+
+    #[test]
+    fn replay_cache_handshake_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let replay_cache = Arc::new(Mutex::new(ReplayCache::new(Duration::from_secs(60))));
+        let new_server = || {
+            let server_auth = ServerAuthenticatorState {
+                mix_map: HashMap::default(),
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), server_secret.clone(), None, vec![]);
+            server_config.replay_cache = Some(replay_cache.clone());
+            server_config.pattern = HandshakePattern::NK;
+            MessageBuilder::new(server_config, false).unwrap()
+        };
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(PublicKey::from(&server_secret)), vec![]);
+        client_config.pattern = HandshakePattern::NK;
+        let mut client_session = MessageBuilder::new(client_config, true).unwrap();
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+
+        // a message that fails to decrypt is not recorded
+        let mut tampered = client_handshake1.clone();
+        *tampered.last_mut().unwrap() ^= 1;
+        assert!(new_server().received_client_handshake1(&tampered).is_err());
+        assert_eq!(replay_cache.lock().unwrap().len(), 0);
+
+        new_server().received_client_handshake1(&client_handshake1).unwrap();
+        match new_server().received_client_handshake1(&client_handshake1) {
+            Err(ServerHandshakeError::ReplayError) => {},
+            _ => panic!("expected replayed handshake to be rejected"),
+        }
+    }
+
+    #[test]
+    fn replay_cache_flood_test() {
+        let server_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let replay_cache = Arc::new(Mutex::new(ReplayCache::new(Duration::from_secs(60)).with_max_entries(4)));
+        let new_server = || {
+            let mut client_map = HashMap::new();
+            client_map.insert(PublicKey::from(&client_secret), true);
+            let provider_auth = ProviderAuthenticatorState {
+                mix_map: HashMap::default(),
+                client_map: client_map,
+                from_client: false,
+                from_mix: false,
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret.clone(), None, vec![]);
+            server_config.replay_cache = Some(replay_cache.clone());
+            MessageBuilder::new(server_config, false).unwrap()
+        };
+        let new_client = || {
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(&server_secret),
+            };
+            let client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(&server_secret)), vec![]);
+            MessageBuilder::new(client_config, true).unwrap()
+        };
+
+        // a genuine XX handshake confirms its key once msg3 authenticates
+        let mut server_session = new_server();
+        let mut client_session = new_client();
+        let client_handshake1 = client_session.client_handshake1().unwrap();
+        client_session.sent_client_handshake1();
+        let server_handshake1 = server_session.received_client_handshake1(&client_handshake1).unwrap();
+        server_session.sent_server_handshake1();
+        client_session.received_server_handshake1(&server_handshake1).unwrap();
+        let client_handshake2 = client_session.client_handshake2().unwrap();
+        client_session.sent_client_handshake2();
+        server_session.received_client_handshake2(&client_handshake2).unwrap();
+
+        // unauthenticated first messages flood the cache
+        for _ in 0..16 {
+            let junk = new_client().client_handshake1().unwrap();
+            new_server().received_client_handshake1(&junk).unwrap();
+        }
+        match new_server().received_client_handshake1(&client_handshake1) {
+            Err(ServerHandshakeError::ReplayError) => {},
+            _ => panic!("expected the flood to leave the genuine key in the cache"),
+        }
+    }
+
+    #[test]
+    fn key_rotation_test() {
+        let current_secret = StaticSecret::new(OsRng);
+        let next_secret = StaticSecret::new(OsRng);
+        let other_secret = StaticSecret::new(OsRng);
+        let client_secret = StaticSecret::new(OsRng);
+        let handshake = |server_key: &StaticSecret| {
+            let server_auth = ServerAuthenticatorState {
+                mix_map: HashMap::default(),
+            };
+            let mut server_config = SessionConfig::new(PeerAuthenticator::Server(server_auth), current_secret.clone(), None, vec![]);
+            server_config.pattern = HandshakePattern::NK;
+            server_config.next_authentication_key = Some(next_secret.clone());
+            let mut server_session = MessageBuilder::new(server_config, false).unwrap();
+
+            let client_auth = ClientAuthenticatorState{
+                peer_public_key: PublicKey::from(server_key),
+            };
+            let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret.clone(), Some(PublicKey::from(server_key)), vec![]);
+            client_config.pattern = HandshakePattern::NK;
+            let mut client_session = MessageBuilder::new(client_config, true).unwrap();
+
+            let client_handshake1 = client_session.client_handshake1().unwrap();
+            client_session.sent_client_handshake1();
+            let server_handshake1 = server_session.received_client_handshake1(&client_handshake1)?;
+            server_session.sent_server_handshake1();
+            client_session.received_server_handshake1(&server_handshake1).unwrap();
+            Ok(())
+        };
+
+        handshake(&current_secret).unwrap();
+        handshake(&next_secret).unwrap();
+        match handshake(&other_secret) {
+            Err(ServerHandshakeError::Noise1ReadError) => {},
+            _ => panic!("expected handshake to an unknown key to fail"),
+        }
+    }
 }
@@ -0,0 +1,378 @@
+// mux.rs - byte streams multiplexed over a session
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Byte streams multiplexed over one session, so that logical flows
+//! such as a directory fetch do not hold up each other or the
+//! commands sent alongside them. Each stream is carried in
+//! StreamData commands of at most one frame, which interleave with
+//! the frames of other streams and commands. As with TCP, a side
+//! ends its half of a stream with StreamClose and the stream is done
+//! once both halves are.
+//!
+//! Each side may send STREAM_WINDOW bytes on a stream before the
+//! reader grants more with StreamWindow, so a stream nobody reads
+//! holds up only its writer. A Mux has at most MAX_OPEN_STREAMS
+//! streams open at once; streams the peer opens beyond them are
+//! refused with StreamClose.
+//!
+//! Stream IDs opened by the handshake initiator are odd and those
+//! opened by the responder even, so that both may open streams at
+//! once. Katzenpost does not know the stream commands.
+
+use std::collections::HashMap;
+use std::io;
+use std::io::prelude::*;
+use std::sync::{Arc, Condvar, Mutex, MutexGuard};
+use std::sync::mpsc::{channel, Receiver, Sender};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::commands::{Command, MAX_STREAM_DATA_SIZE};
+use super::errors::{ReceiveMessageError, SendMessageError};
+use super::sync::Session;
+
+/// The most streams, opened by either side, a Mux has open at once.
+pub const MAX_OPEN_STREAMS: usize = 256;
+
+/// The bytes of StreamData a side may send on a stream before the
+/// reader grants more.
+pub const STREAM_WINDOW: u32 = 256 * 1024;
+
+struct StreamState {
+    // Delivers the stream's data, or None once the peer closes its
+    // half. It holds at most receive_window bytes.
+    incoming: Sender<Option<Vec<u8>>>,
+    // The bytes each side may still send before the other grants
+    // more.
+    send_window: u32,
+    receive_window: u32,
+}
+
+struct Streams {
+    open: Mutex<HashMap<u32, StreamState>>,
+    // Signalled when a send window grows or the session fails.
+    window_changed: Condvar,
+}
+
+// Adds stream_id to the open streams, returning None if it is open
+// already or MAX_OPEN_STREAMS are.
+fn open_stream(session: &Arc<Mutex<Session>>, streams: &Arc<Streams>, stream_id: u32) -> Option<MuxStream> {
+    let mut open = streams.open.lock().unwrap();
+    if open.len() >= MAX_OPEN_STREAMS || open.contains_key(&stream_id) {
+        return None
+    }
+    let (tx, incoming) = channel();
+    open.insert(stream_id, StreamState {
+        incoming: tx,
+        send_window: STREAM_WINDOW,
+        receive_window: STREAM_WINDOW,
+    });
+    Some(MuxStream {
+        stream_id,
+        session: session.clone(),
+        streams: streams.clone(),
+        incoming,
+        read_buffer: vec![],
+        read_offset: 0,
+        eof: false,
+        closed: false,
+        consumed: 0,
+        write_timeout: None,
+    })
+}
+
+/// Multiplexes streams over a session in transport mode. A
+/// background thread receives on a clone of the session, delivering
+/// stream data to the streams and any other command to recv_command.
+/// The session must not otherwise receive. The streams send on the
+/// session itself, guarded by a mutex.
+pub struct Mux {
+    session: Arc<Mutex<Session>>,
+    streams: Arc<Streams>,
+    next_id: u32,
+    accepted: Receiver<MuxStream>,
+    commands: Receiver<Command>,
+    errors: Receiver<ReceiveMessageError>,
+}
+
+impl Mux {
+    pub fn new(session: Session) -> Mux {
+        let streams = Arc::new(Streams {
+            open: Mutex::new(HashMap::new()),
+            window_changed: Condvar::new(),
+        });
+        let (accepted_tx, accepted) = channel();
+        let (command_tx, commands) = channel();
+        let (error_tx, errors) = channel();
+        let mut receiver = session.clone();
+        let next_id = if session.is_initiator() { 1 } else { 2 };
+        let session = Arc::new(Mutex::new(session));
+        let receiver_session = session.clone();
+        let receiver_streams = streams.clone();
+        thread::spawn(move|| {
+            let result = dispatch(&mut receiver, &receiver_session, &receiver_streams, &accepted_tx, &command_tx);
+            // Dropping the channels fails reads on the open streams,
+            // and writes waiting for window find their stream gone.
+            receiver_streams.open.lock().unwrap().clear();
+            receiver_streams.window_changed.notify_all();
+            if let Err(e) = result {
+                let _ = error_tx.send(e);
+            }
+        });
+        Mux {
+            session,
+            streams,
+            next_id,
+            accepted,
+            commands,
+            errors,
+        }
+    }
+
+    /// Returns the session, for sending commands other than stream
+    /// commands. Streams wait to write while it is held.
+    pub fn session(&self) -> MutexGuard<'_, Session> {
+        self.session.lock().unwrap()
+    }
+
+    /// Opens a stream, failing if MAX_OPEN_STREAMS are open.
+    pub fn open(&mut self) -> Result<MuxStream, SendMessageError> {
+        let stream_id = self.next_id;
+        let stream = match open_stream(&self.session, &self.streams, stream_id) {
+            Some(stream) => stream,
+            None => return Err(SendMessageError::IOError(io::Error::new(io::ErrorKind::Other, "too many open streams"))),
+        };
+        self.next_id = self.next_id.wrapping_add(2);
+        self.session.lock().unwrap().send_command(&Command::StreamOpen{ stream_id })?;
+        Ok(stream)
+    }
+
+    /// Waits for the peer to open a stream, returning None once the
+    /// session has failed.
+    pub fn accept(&self) -> Option<MuxStream> {
+        self.accepted.recv().ok()
+    }
+
+    /// Receives the next command other than a stream command.
+    pub fn recv_command(&self) -> Result<Command, ReceiveMessageError> {
+        match self.commands.recv() {
+            Ok(cmd) => Ok(cmd),
+            Err(_) => match self.errors.try_recv() {
+                Ok(e) => Err(e),
+                Err(_) => Err(ReceiveMessageError::IOError(io::Error::from(io::ErrorKind::ConnectionAborted))),
+            },
+        }
+    }
+}
+
+// Receives until the session fails, routing stream commands. It sends
+// only on receiver, never waiting for the shared session a stream may
+// hold while its write waits on the peer.
+fn dispatch(receiver: &mut Session, session: &Arc<Mutex<Session>>, streams: &Arc<Streams>,
+            accepted: &Sender<MuxStream>, commands: &Sender<Command>) -> Result<(), ReceiveMessageError> {
+    let theirs = if receiver.is_initiator() { 0 } else { 1 };
+    loop {
+        match receiver.recv_command()? {
+            // Opening an ID of ours or one already open is ignored.
+            Command::StreamOpen{ stream_id } => {
+                if stream_id % 2 != theirs || streams.open.lock().unwrap().contains_key(&stream_id) {
+                    continue
+                }
+                let refused = match open_stream(session, streams, stream_id) {
+                    None => true,
+                    Some(stream) => match accepted.send(stream) {
+                        Ok(()) => false,
+                        Err(e) => {
+                            let mut stream = e.0;
+                            stream.closed = true;
+                            true
+                        },
+                    },
+                };
+                if refused {
+                    receiver.send_command(&Command::StreamClose{ stream_id }).map_err(ReceiveMessageError::SendMessageError)?;
+                }
+            },
+            // Commands of streams already dropped are ignored.
+            Command::StreamData{ stream_id, payload } => {
+                if let Some(stream) = streams.open.lock().unwrap().get_mut(&stream_id) {
+                    if payload.len() > stream.receive_window as usize {
+                        return Err(ReceiveMessageError::IOError(io::Error::new(io::ErrorKind::InvalidData, "stream window exceeded")));
+                    }
+                    stream.receive_window -= payload.len() as u32;
+                    let _ = stream.incoming.send(Some(payload));
+                }
+            },
+            Command::StreamClose{ stream_id } => {
+                if let Some(stream) = streams.open.lock().unwrap().get(&stream_id) {
+                    let _ = stream.incoming.send(None);
+                }
+            },
+            Command::StreamWindow{ stream_id, increment } => {
+                if let Some(stream) = streams.open.lock().unwrap().get_mut(&stream_id) {
+                    stream.send_window = stream.send_window.saturating_add(increment);
+                    streams.window_changed.notify_all();
+                }
+            },
+            cmd => {
+                let _ = commands.send(cmd);
+            },
+        }
+    }
+}
+
+/// A stream of a Mux, implementing io::Read and io::Write. Dropping
+/// it closes its half of the stream if close_write has not.
+pub struct MuxStream {
+    stream_id: u32,
+    session: Arc<Mutex<Session>>,
+    streams: Arc<Streams>,
+    incoming: Receiver<Option<Vec<u8>>>,
+    read_buffer: Vec<u8>,
+    read_offset: usize,
+    eof: bool,
+    closed: bool,
+    // Bytes read since the peer was last granted window for them.
+    consumed: u32,
+    write_timeout: Option<Duration>,
+}
+
+impl MuxStream {
+    pub fn id(&self) -> u32 {
+        self.stream_id
+    }
+
+    /// Sets how long a write waits for the peer to grant window
+    /// before failing with TimedOut. None, the default, waits
+    /// indefinitely.
+    pub fn set_write_timeout(&mut self, timeout: Option<Duration>) {
+        self.write_timeout = timeout;
+    }
+
+    /// Closes this half of the stream, after which the peer reads end
+    /// of file once it has read the data sent.
+    pub fn close_write(&mut self) -> Result<(), SendMessageError> {
+        if self.closed {
+            return Ok(())
+        }
+        self.closed = true;
+        self.session.lock().unwrap().send_command(&Command::StreamClose{ stream_id: self.stream_id })
+    }
+
+    // Grants the peer window for the bytes consumed. The window grows
+    // before StreamWindow is sent, so the data it lets through always
+    // fits.
+    fn grant_window(&mut self) {
+        let increment = self.consumed;
+        match self.streams.open.lock().unwrap().get_mut(&self.stream_id) {
+            Some(stream) => stream.receive_window += increment,
+            None => return,
+        }
+        self.consumed = 0;
+        let _ = self.session.lock().unwrap().send_command(&Command::StreamWindow{ stream_id: self.stream_id, increment });
+    }
+
+    // Waits until the peer's window is open, taking up to n bytes of
+    // it.
+    fn reserve_window(&self, n: usize) -> io::Result<usize> {
+        let deadline = self.write_timeout.map(|x| Instant::now() + x);
+        let mut open = self.streams.open.lock().unwrap();
+        loop {
+            // Our own stream can only be gone once the session fails.
+            let stream = match open.get_mut(&self.stream_id) {
+                Some(stream) => stream,
+                None => return Err(io::Error::from(io::ErrorKind::ConnectionAborted)),
+            };
+            if stream.send_window > 0 {
+                let n = n.min(stream.send_window as usize);
+                stream.send_window -= n as u32;
+                return Ok(n)
+            }
+            open = match deadline {
+                None => self.streams.window_changed.wait(open).unwrap(),
+                Some(deadline) => {
+                    let now = Instant::now();
+                    if now >= deadline {
+                        return Err(io::Error::from(io::ErrorKind::TimedOut));
+                    }
+                    self.streams.window_changed.wait_timeout(open, deadline - now).unwrap().0
+                },
+            };
+        }
+    }
+}
+
+impl Read for MuxStream {
+    /// Reads data written to the peer's end of the stream. Returns end
+    /// of file once the peer closes its half, and ConnectionAborted
+    /// once the session fails.
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        while self.read_offset == self.read_buffer.len() {
+            if self.eof || buf.is_empty() {
+                return Ok(0)
+            }
+            match self.incoming.recv() {
+                Ok(Some(payload)) => {
+                    self.read_buffer = payload;
+                    self.read_offset = 0;
+                },
+                Ok(None) => self.eof = true,
+                Err(_) => return Err(io::Error::from(io::ErrorKind::ConnectionAborted)),
+            }
+        }
+        let n = buf.len().min(self.read_buffer.len() - self.read_offset);
+        buf[..n].copy_from_slice(&self.read_buffer[self.read_offset..self.read_offset + n]);
+        self.read_offset += n;
+        self.consumed += n as u32;
+        if self.consumed >= STREAM_WINDOW / 2 {
+            self.grant_window();
+        }
+        Ok(n)
+    }
+}
+
+impl Write for MuxStream {
+    /// Sends up to MAX_STREAM_DATA_SIZE bytes of buf in one StreamData
+    /// command, first waiting for the peer to grant window if it has
+    /// none left.
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if buf.is_empty() {
+            return Ok(0)
+        }
+        if self.closed {
+            return Err(io::Error::from(io::ErrorKind::BrokenPipe));
+        }
+        let n = self.reserve_window(buf.len().min(MAX_STREAM_DATA_SIZE))?;
+        let cmd = Command::StreamData{ stream_id: self.stream_id, payload: buf[..n].to_vec() };
+        match self.session.lock().unwrap().send_command(&cmd) {
+            Ok(()) => Ok(n),
+            Err(SendMessageError::IOError(e)) => Err(e),
+            Err(SendMessageError::TimeoutError) => Err(io::Error::from(io::ErrorKind::TimedOut)),
+            Err(e) => Err(io::Error::new(io::ErrorKind::Other, e.to_string())),
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Drop for MuxStream {
+    fn drop(&mut self) {
+        self.streams.open.lock().unwrap().remove(&self.stream_id);
+        let _ = self.close_write();
+    }
+}
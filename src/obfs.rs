@@ -0,0 +1,566 @@
+// obfs.rs - obfuscated transport
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! An obfuscating transport in the manner of obfs4, for networks where
+//! deep packet inspection blocks the link protocol. Every byte on the
+//! wire, handshake included, looks random to an observer, and frame
+//! lengths, and optionally the timing between frames, are randomized.
+//!
+//! The peers share a secret, distributed with the listener's address
+//! as obfs4 bridge lines are. The client opens with a random seed,
+//! random padding, a mark derived from the seed and a MAC over it all
+//! and the current hour; the listener answers likewise, and the
+//! seeds and the secret key the frames in each direction. Unlike
+//! obfs4 no public keys cross the wire, so none need Elligator
+//! encoding: the Noise handshake that follows runs inside the frames,
+//! which hide its keys too. A prober without the secret, or replaying
+//! a handshake, gets no answer.
+//!
+//! Frames are encrypted with XChaCha20-Poly1305 and prefixed by their
+//! length masked with a keyed stream. The obfuscation adds no
+//! security of its own beyond hiding the protocol; Noise still
+//! authenticates the peers and protects the session.
+
+extern crate chacha20poly1305;
+extern crate getrandom;
+extern crate hmac;
+extern crate sha2;
+
+use std::collections::HashMap;
+use std::io;
+use std::io::prelude::*;
+use std::net::{Shutdown, SocketAddr, TcpListener, TcpStream, ToSocketAddrs};
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use byteorder::{ByteOrder, BigEndian};
+use zeroize::Zeroizing;
+
+use self::chacha20poly1305::{Key, KeyInit, XChaCha20Poly1305, XNonce};
+use self::chacha20poly1305::aead::{Aead, Payload};
+use self::hmac::{Hmac, Mac};
+use self::sha2::Sha256;
+
+use super::transport::Transport;
+
+pub const SECRET_SIZE: usize = 32;
+
+const SEED_SIZE: usize = 32;
+const MARK_SIZE: usize = 16;
+const MAC_SIZE: usize = 16;
+const MAX_HANDSHAKE_PADDING: usize = 8192;
+const MAX_HANDSHAKE_SIZE: usize = SEED_SIZE + MAX_HANDSHAKE_PADDING + MARK_SIZE + MAC_SIZE;
+
+const KEY_SIZE: usize = 32;
+const TAG_SIZE: usize = 16;
+const LENGTH_SIZE: usize = 2;
+// The largest frame, after its length, keeps a frame with its TCP and
+// IP headers within a typical MTU, as obfs4's do.
+const MAX_FRAME_SIZE: usize = 1448;
+// The payload and padding a frame carries at most.
+const MAX_FRAME_CONTENT: usize = MAX_FRAME_SIZE - TAG_SIZE - LENGTH_SIZE;
+const MAX_FRAME_DELAY_MILLIS: usize = 10;
+
+// Handshakes are accepted this many hours either side of the
+// listener's clock.
+const EPOCH_SKEW: u64 = 1;
+
+fn invalid_data(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message.to_string())
+}
+
+fn keyed_hmac(key: &[u8], parts: &[&[u8]]) -> Hmac<Sha256> {
+    let mut mac = Hmac::<Sha256>::new_from_slice(key).expect("HMAC takes keys of any size");
+    for part in parts {
+        mac.update(part);
+    }
+    mac
+}
+
+fn hmac(key: &[u8], parts: &[&[u8]]) -> [u8; 32] {
+    let mut mac = [0u8; 32];
+    mac.copy_from_slice(&keyed_hmac(key, parts).finalize().into_bytes());
+    mac
+}
+
+fn random_bytes(len: usize) -> io::Result<Vec<u8>> {
+    let mut bytes = vec![0u8; len];
+    getrandom::getrandom(&mut bytes).map_err(|e| io::Error::new(io::ErrorKind::Other, e.to_string()))?;
+    Ok(bytes)
+}
+
+// Returns a random number below n, which may be slightly biased.
+fn random_below(n: usize) -> io::Result<usize> {
+    Ok(BigEndian::read_u32(&random_bytes(4)?) as usize % n)
+}
+
+fn epoch_hour() -> u64 {
+    SystemTime::now().duration_since(UNIX_EPOCH).map(|x| x.as_secs() / 3600).unwrap_or(0)
+}
+
+fn epoch_bytes(epoch: u64) -> [u8; 8] {
+    let mut bytes = [0u8; 8];
+    BigEndian::write_u64(&mut bytes, epoch);
+    bytes
+}
+
+/// The shared secret and options of an obfuscated transport. Clones
+/// share the listener's record of handshakes seen, which refuses
+/// replays.
+#[derive(Clone)]
+pub struct ObfsConfig {
+    secret: Zeroizing<[u8; SECRET_SIZE]>,
+    randomize_timing: bool,
+    seen: Arc<Mutex<HashMap<[u8; MAC_SIZE], u64>>>,
+}
+
+impl ObfsConfig {
+    pub fn new(secret: [u8; SECRET_SIZE]) -> ObfsConfig {
+        ObfsConfig {
+            secret: Zeroizing::new(secret),
+            randomize_timing: false,
+            seen: Arc::new(Mutex::new(HashMap::new())),
+        }
+    }
+
+    /// Returns a config with a new random secret.
+    pub fn generate() -> io::Result<ObfsConfig> {
+        let mut secret = [0u8; SECRET_SIZE];
+        secret.copy_from_slice(&random_bytes(SECRET_SIZE)?);
+        Ok(ObfsConfig::new(secret))
+    }
+
+    pub fn secret(&self) -> &[u8; SECRET_SIZE] {
+        &self.secret
+    }
+
+    /// Splits writes into frames of random size sent at random
+    /// intervals of up to 10ms, like obfs4's IAT mode, hiding the
+    /// sizes of writes at some cost in throughput and latency.
+    pub fn with_randomized_timing(mut self, randomize_timing: bool) -> ObfsConfig {
+        self.randomize_timing = randomize_timing;
+        self
+    }
+
+    fn key(&self, label: &[u8], client_seed: &[u8], server_seed: &[u8]) -> Zeroizing<[u8; KEY_SIZE]> {
+        Zeroizing::new(hmac(&self.secret[..], &[label, client_seed, server_seed]))
+    }
+
+    // Returns a handshake message: seed, padding, mark and a MAC bound
+    // to binding and epoch.
+    fn handshake(&self, label: &[u8], binding: &[u8], epoch: u64) -> io::Result<(Vec<u8>, Vec<u8>)> {
+        let mut message = random_bytes(SEED_SIZE)?;
+        message.extend(random_bytes(random_below(MAX_HANDSHAKE_PADDING + 1)?)?);
+        let mark = hmac(&self.secret[..], &[label, &message[..SEED_SIZE]]);
+        message.extend(&mark[..MARK_SIZE]);
+        let mac = hmac(&self.secret[..], &[&message, binding, &epoch_bytes(epoch)]);
+        message.extend(&mac[..MAC_SIZE]);
+        Ok((message[..SEED_SIZE].to_vec(), message))
+    }
+
+    // Reads a handshake message with a MAC bound to binding and one of
+    // epochs, returning its seed and MAC, the epoch and any bytes read
+    // past it.
+    fn read_handshake(&self, stream: &mut TcpStream, label: &[u8], binding: &[u8],
+                      epochs: &[u64]) -> io::Result<(Vec<u8>, Vec<u8>, u64, Vec<u8>)> {
+        let mut message = vec![];
+        let mut chunk = [0u8; 1024];
+        let mut mark = None;
+        loop {
+            if mark.is_none() && message.len() >= SEED_SIZE {
+                mark = Some(hmac(&self.secret[..], &[label, &message[..SEED_SIZE]]));
+            }
+            if let Some(mark) = mark {
+                let found = message[SEED_SIZE..].windows(MARK_SIZE).position(|x| x == &mark[..MARK_SIZE]);
+                if let Some(i) = found {
+                    let end = SEED_SIZE + i + MARK_SIZE;
+                    if message.len() >= end + MAC_SIZE {
+                        let mac = &message[end..end + MAC_SIZE];
+                        for epoch in epochs {
+                            let expected = keyed_hmac(&self.secret[..], &[&message[..end], binding, &epoch_bytes(*epoch)]);
+                            if expected.verify_truncated_left(mac).is_ok() {
+                                return Ok((message[..SEED_SIZE].to_vec(), mac.to_vec(), *epoch,
+                                           message[end + MAC_SIZE..].to_vec()))
+                            }
+                        }
+                        return Err(invalid_data("invalid obfuscated handshake"));
+                    }
+                }
+            }
+            if message.len() >= MAX_HANDSHAKE_SIZE {
+                return Err(invalid_data("invalid obfuscated handshake"));
+            }
+            let n = chunk.len().min(MAX_HANDSHAKE_SIZE - message.len());
+            let n = stream.read(&mut chunk[..n])?;
+            if n == 0 {
+                return Err(io::Error::from(io::ErrorKind::UnexpectedEof));
+            }
+            message.extend(&chunk[..n]);
+        }
+    }
+
+    // Records a client handshake MAC, returning false if it was seen
+    // before. MACs are forgotten once their epoch is out of reach.
+    fn check_replay(&self, mac: &[u8], epoch: u64) -> bool {
+        let now = epoch_hour();
+        let mut seen = self.seen.lock().unwrap();
+        seen.retain(|_, x| *x + 2 * EPOCH_SKEW >= now);
+        let mut key = [0u8; MAC_SIZE];
+        key.copy_from_slice(mac);
+        seen.insert(key, epoch).is_none()
+    }
+}
+
+struct ReadState {
+    key: Zeroizing<[u8; KEY_SIZE]>,
+    counter: u64,
+    // Bytes read past the handshake.
+    pending: Vec<u8>,
+    header: Vec<u8>,
+    frame_len: usize,
+    frame: Vec<u8>,
+    plaintext: Vec<u8>,
+    offset: usize,
+}
+
+struct WriteState {
+    key: Zeroizing<[u8; KEY_SIZE]>,
+    counter: u64,
+}
+
+fn nonce(counter: u64) -> [u8; 24] {
+    let mut nonce = [0u8; 24];
+    BigEndian::write_u64(&mut nonce[16..], counter);
+    nonce
+}
+
+// Masks the length of frame counter.
+fn length_mask(key: &[u8], counter: u64) -> u16 {
+    BigEndian::read_u16(&hmac(key, &[b"length", &nonce(counter)]))
+}
+
+/// An obfuscated connection, implementing Transport. Reads resume
+/// after timing out, so read deadlines work as they do over TCP.
+pub struct ObfsStream {
+    stream: TcpStream,
+    randomize_timing: bool,
+    read: Arc<Mutex<ReadState>>,
+    write: Arc<Mutex<WriteState>>,
+}
+
+impl ObfsStream {
+    fn new(stream: TcpStream, config: &ObfsConfig, read_key: Zeroizing<[u8; KEY_SIZE]>,
+           write_key: Zeroizing<[u8; KEY_SIZE]>, pending: Vec<u8>) -> ObfsStream {
+        ObfsStream {
+            stream,
+            randomize_timing: config.randomize_timing,
+            read: Arc::new(Mutex::new(ReadState {
+                key: read_key,
+                counter: 0,
+                pending,
+                header: vec![],
+                frame_len: 0,
+                frame: vec![],
+                plaintext: vec![],
+                offset: 0,
+            })),
+            write: Arc::new(Mutex::new(WriteState {
+                key: write_key,
+                counter: 0,
+            })),
+        }
+    }
+
+    /// Performs the client's handshake over stream, which may already
+    /// run through a proxy.
+    pub fn client(mut stream: TcpStream, config: &ObfsConfig) -> io::Result<ObfsStream> {
+        let epoch = epoch_hour();
+        let (client_seed, message) = config.handshake(b"client mark", b"", epoch)?;
+        stream.write_all(&message)?;
+        let client_mac = &message[message.len() - MAC_SIZE..];
+        let (server_seed, _, _, pending) = config.read_handshake(&mut stream, b"server mark", client_mac, &[epoch])?;
+        let read_key = config.key(b"server to client", &client_seed, &server_seed);
+        let write_key = config.key(b"client to server", &client_seed, &server_seed);
+        Ok(ObfsStream::new(stream, config, read_key, write_key, pending))
+    }
+
+    /// Performs the listener's handshake over stream. A handshake that
+    /// fails gets no answer, so callers should close the connection.
+    pub fn server(mut stream: TcpStream, config: &ObfsConfig) -> io::Result<ObfsStream> {
+        let now = epoch_hour();
+        let epochs: Vec<u64> = (now.saturating_sub(EPOCH_SKEW)..now + EPOCH_SKEW + 1).collect();
+        let (client_seed, client_mac, epoch, pending) = config.read_handshake(&mut stream, b"client mark", b"", &epochs)?;
+        if !config.check_replay(&client_mac, epoch) {
+            return Err(invalid_data("replayed obfuscated handshake"));
+        }
+        let (server_seed, message) = config.handshake(b"server mark", &client_mac, epoch)?;
+        stream.write_all(&message)?;
+        let read_key = config.key(b"client to server", &client_seed, &server_seed);
+        let write_key = config.key(b"server to client", &client_seed, &server_seed);
+        Ok(ObfsStream::new(stream, config, read_key, write_key, pending))
+    }
+
+    // Reads into buf from bytes left over from the handshake or else
+    // the socket, failing with UnexpectedEof at end of file.
+    fn read_some(&self, state: &mut ReadState, buf: &mut [u8]) -> io::Result<usize> {
+        let n = if !state.pending.is_empty() {
+            let n = buf.len().min(state.pending.len());
+            buf[..n].copy_from_slice(&state.pending[..n]);
+            state.pending.drain(..n);
+            n
+        } else {
+            (&self.stream).read(buf)?
+        };
+        if n == 0 {
+            return Err(io::Error::from(io::ErrorKind::UnexpectedEof));
+        }
+        Ok(n)
+    }
+
+    // Reads the next frame into state.plaintext, returning false at
+    // end of file between frames. Partly read frames are kept in
+    // state, so that a read that times out may be resumed.
+    fn read_frame(&self, state: &mut ReadState) -> io::Result<bool> {
+        let mut chunk = [0u8; MAX_FRAME_SIZE];
+        while state.header.len() < LENGTH_SIZE {
+            let needed = LENGTH_SIZE - state.header.len();
+            let n = match self.read_some(state, &mut chunk[..needed]) {
+                Err(ref e) if e.kind() == io::ErrorKind::UnexpectedEof && state.header.is_empty() => return Ok(false),
+                x => x?,
+            };
+            state.header.extend(&chunk[..n]);
+            if state.header.len() == LENGTH_SIZE {
+                state.frame_len = (BigEndian::read_u16(&state.header) ^ length_mask(&state.key[..], state.counter)) as usize;
+                if state.frame_len < TAG_SIZE + LENGTH_SIZE || state.frame_len > MAX_FRAME_SIZE {
+                    return Err(invalid_data("invalid obfuscated frame length"));
+                }
+            }
+        }
+        while state.frame.len() < state.frame_len {
+            let needed = state.frame_len - state.frame.len();
+            let n = self.read_some(state, &mut chunk[..needed])?;
+            state.frame.extend(&chunk[..n]);
+        }
+        let cipher = XChaCha20Poly1305::new(Key::from_slice(&state.key[..]));
+        let payload = Payload {
+            msg: &state.frame,
+            aad: &state.header,
+        };
+        let content = cipher.decrypt(XNonce::from_slice(&nonce(state.counter)), payload)
+            .map_err(|_| invalid_data("invalid obfuscated frame"))?;
+        let len = BigEndian::read_u16(&content) as usize;
+        if LENGTH_SIZE + len > content.len() {
+            return Err(invalid_data("invalid obfuscated frame"));
+        }
+        state.counter += 1;
+        state.header.clear();
+        state.frame.clear();
+        state.plaintext = content[LENGTH_SIZE..LENGTH_SIZE + len].to_vec();
+        state.offset = 0;
+        Ok(true)
+    }
+}
+
+impl Read for ObfsStream {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        if buf.is_empty() {
+            return Ok(0)
+        }
+        let mut state = self.read.lock().unwrap();
+        // Frames of padding alone carry no data.
+        while state.offset == state.plaintext.len() {
+            if !self.read_frame(&mut state)? {
+                return Ok(0)
+            }
+        }
+        let n = buf.len().min(state.plaintext.len() - state.offset);
+        buf[..n].copy_from_slice(&state.plaintext[state.offset..state.offset + n]);
+        state.offset += n;
+        Ok(n)
+    }
+}
+
+impl Write for ObfsStream {
+    /// Sends buf in frames with random padding. A write that fails
+    /// may have sent part of buf, leaving the connection unusable.
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let mut state = self.write.lock().unwrap();
+        let mut offset = 0;
+        while offset < buf.len() {
+            let mut len = (buf.len() - offset).min(MAX_FRAME_CONTENT);
+            if self.randomize_timing {
+                len = 1 + random_below(len)?;
+                if offset > 0 {
+                    thread::sleep(Duration::from_millis(random_below(MAX_FRAME_DELAY_MILLIS + 1)? as u64));
+                }
+            }
+            let padding = random_below(MAX_FRAME_CONTENT - len + 1)?;
+            let mut content = vec![0u8; LENGTH_SIZE + len + padding];
+            BigEndian::write_u16(&mut content, len as u16);
+            content[LENGTH_SIZE..LENGTH_SIZE + len].copy_from_slice(&buf[offset..offset + len]);
+
+            let mut frame = vec![0u8; LENGTH_SIZE];
+            let frame_len = (content.len() + TAG_SIZE) as u16;
+            BigEndian::write_u16(&mut frame, frame_len ^ length_mask(&state.key[..], state.counter));
+            let cipher = XChaCha20Poly1305::new(Key::from_slice(&state.key[..]));
+            let payload = Payload {
+                msg: &content,
+                aad: &frame,
+            };
+            let ciphertext = cipher.encrypt(XNonce::from_slice(&nonce(state.counter)), payload)
+                .map_err(|_| invalid_data("obfuscated frame encryption failed"))?;
+            frame.extend(ciphertext);
+            state.counter += 1;
+            (&self.stream).write_all(&frame)?;
+            offset += len;
+        }
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Transport for ObfsStream {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(ObfsStream {
+            stream: self.stream.try_clone()?,
+            randomize_timing: self.randomize_timing,
+            read: self.read.clone(),
+            write: self.write.clone(),
+        }))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.stream.set_read_timeout(timeout)
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.stream.set_write_timeout(timeout)
+    }
+
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        self.stream.shutdown(how)
+    }
+
+    fn peer_addr(&self) -> Option<SocketAddr> {
+        self.stream.peer_addr().ok()
+    }
+
+    fn local_addr(&self) -> Option<SocketAddr> {
+        self.stream.local_addr().ok()
+    }
+}
+
+/// Connects to addr, a host and port, and performs the client's
+/// handshake.
+pub fn dial_obfs(addr: &str, config: &ObfsConfig) -> io::Result<ObfsStream> {
+    ObfsStream::client(TcpStream::connect(addr)?, config)
+}
+
+/// Accepts obfuscated connections.
+pub struct ObfsListener {
+    listener: TcpListener,
+    config: ObfsConfig,
+}
+
+impl ObfsListener {
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        self.listener.local_addr()
+    }
+
+    /// Accepts a connection and performs the listener's handshake on
+    /// it. A failed handshake fails this call only, so callers should
+    /// keep accepting. The handshake is bounded by timeout if given.
+    pub fn accept(&self, timeout: Option<Duration>) -> io::Result<ObfsStream> {
+        let (stream, _) = self.listener.accept()?;
+        stream.set_read_timeout(timeout)?;
+        stream.set_write_timeout(timeout)?;
+        let obfs = ObfsStream::server(stream, &self.config)?;
+        obfs.stream.set_read_timeout(None)?;
+        obfs.stream.set_write_timeout(None)?;
+        Ok(obfs)
+    }
+}
+
+/// Listens on addr for obfuscated connections.
+pub fn listen_obfs<A: ToSocketAddrs>(addr: A, config: &ObfsConfig) -> io::Result<ObfsListener> {
+    Ok(ObfsListener {
+        listener: TcpListener::bind(addr)?,
+        config: config.clone(),
+    })
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn hmac_test() {
+        // RFC 4231 test case 2
+        let mac = hmac(b"Jefe", &[b"what do ya want ", b"for nothing?"]);
+        assert_eq!(&mac[..8], &[0x5b, 0xdc, 0xc1, 0x46, 0xbf, 0x60, 0x75, 0x4e]);
+    }
+
+    #[test]
+    fn obfs_test() {
+        let config = ObfsConfig::generate().unwrap().with_randomized_timing(true);
+        let listener = listen_obfs("127.0.0.1:0", &config).unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let server = thread::spawn(move|| {
+            // a prober without the secret gets no answer
+            assert!(listener.accept(Some(Duration::from_secs(1))).is_err());
+            let mut server = listener.accept(None).unwrap();
+            let mut received = vec![0u8; 5000];
+            server.read_exact(&mut received).unwrap();
+            server.write_all(&received).unwrap();
+            let mut rest = vec![];
+            server.read_to_end(&mut rest).unwrap();
+            assert!(rest.is_empty());
+        });
+        assert!(dial_obfs(&addr, &ObfsConfig::generate().unwrap()).is_err());
+
+        let mut client = dial_obfs(&addr, &config).unwrap();
+        let data: Vec<u8> = (0..5000u32).map(|x| x as u8).collect();
+        client.write_all(&data).unwrap();
+        let mut received = vec![0u8; data.len()];
+        let mut reader = client.try_clone_transport().unwrap();
+        reader.read_exact(&mut received).unwrap();
+        assert_eq!(received, data);
+
+        Transport::shutdown(&client, Shutdown::Write).unwrap();
+        let mut rest = vec![];
+        reader.read_to_end(&mut rest).unwrap();
+        assert!(rest.is_empty());
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn replay_test() {
+        let config = ObfsConfig::generate().unwrap();
+        let listener = listen_obfs("127.0.0.1:0", &config).unwrap();
+        let addr = listener.local_addr().unwrap();
+        let (_, message) = config.handshake(b"client mark", b"", epoch_hour()).unwrap();
+        for _ in 0..2 {
+            TcpStream::connect(addr).unwrap().write_all(&message).unwrap();
+        }
+        assert!(listener.accept(None).is_ok());
+        assert!(listener.accept(None).is_err());
+    }
+}
@@ -0,0 +1,169 @@
+// pem.rs - PEM encoding of link keys and peer credentials
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! PEM encoding of link keys and peer credentials. The key labels
+//! match those used by Katzenpost, whose PEM blocks hold the raw key
+//! bytes without headers.
+
+extern crate base64;
+
+use x25519_dalek_ng::{PublicKey, StaticSecret};
+use zeroize::Zeroizing;
+
+use self::base64::Engine;
+use self::base64::engine::general_purpose::STANDARD;
+
+use super::constants::{KEY_SIZE, MAX_ADDITIONAL_DATA_SIZE};
+use super::errors::PemError;
+use super::messages::PeerCredentials;
+
+pub const PUBLIC_KEY_LABEL: &str = "X25519 PUBLIC KEY";
+pub const PRIVATE_KEY_LABEL: &str = "X25519 PRIVATE KEY";
+pub const PEER_CREDENTIALS_LABEL: &str = "MIX LINK PEER CREDENTIALS";
+
+const LINE_LENGTH: usize = 64;
+
+/// Encodes data as a PEM block with the given label.
+pub fn encode(label: &str, data: &[u8]) -> String {
+    let encoded = STANDARD.encode(data);
+    let mut out = format!("-----BEGIN {}-----\n", label);
+    for line in encoded.as_bytes().chunks(LINE_LENGTH) {
+        out.push_str(::std::str::from_utf8(line).unwrap());
+        out.push('\n');
+    }
+    out.push_str(&format!("-----END {}-----\n", label));
+    out
+}
+
+/// Decodes the first PEM block in pem, which must have the given label.
+pub fn decode(label: &str, pem: &str) -> Result<Vec<u8>, PemError> {
+    let mut lines = pem.lines().map(|x| x.trim()).skip_while(|x| x.is_empty());
+    let begin = match lines.next() {
+        Some(x) => x,
+        None => return Err(PemError::InvalidFormat),
+    };
+    if !begin.starts_with("-----BEGIN ") || !begin.ends_with("-----") {
+        return Err(PemError::InvalidFormat);
+    }
+    if begin != format!("-----BEGIN {}-----", label) {
+        return Err(PemError::InvalidLabel);
+    }
+    let end = format!("-----END {}-----", label);
+    let mut body = String::new();
+    loop {
+        match lines.next() {
+            Some(x) if x == end => break,
+            Some(x) => body.push_str(x),
+            None => return Err(PemError::InvalidFormat),
+        }
+    }
+    match STANDARD.decode(&body) {
+        Ok(x) => Ok(x),
+        Err(_) => Err(PemError::InvalidBase64),
+    }
+}
+
+fn decode_key(label: &str, pem: &str) -> Result<Zeroizing<[u8; KEY_SIZE]>, PemError> {
+    let raw = Zeroizing::new(decode(label, pem)?);
+    if raw.len() != KEY_SIZE {
+        return Err(PemError::InvalidSize);
+    }
+    let mut key = Zeroizing::new([0u8; KEY_SIZE]);
+    key.copy_from_slice(&raw);
+    Ok(key)
+}
+
+pub fn public_key_to_pem(public_key: &PublicKey) -> String {
+    encode(PUBLIC_KEY_LABEL, public_key.as_bytes())
+}
+
+pub fn public_key_from_pem(pem: &str) -> Result<PublicKey, PemError> {
+    Ok(PublicKey::from(*decode_key(PUBLIC_KEY_LABEL, pem)?))
+}
+
+/// Encodes a private key without encryption, see the keyfile module
+/// for storing private keys at rest.
+pub fn private_key_to_pem(private_key: &StaticSecret) -> Zeroizing<String> {
+    Zeroizing::new(encode(PRIVATE_KEY_LABEL, &Zeroizing::new(private_key.to_bytes())[..]))
+}
+
+pub fn private_key_from_pem(pem: &str) -> Result<StaticSecret, PemError> {
+    Ok(StaticSecret::from(*decode_key(PRIVATE_KEY_LABEL, pem)?))
+}
+
+/// Encodes peer credentials as the public key followed by the
+/// additional data.
+pub fn peer_credentials_to_pem(peer_credentials: &PeerCredentials) -> String {
+    let mut raw = peer_credentials.public_key.as_bytes().to_vec();
+    raw.extend_from_slice(&peer_credentials.additional_data);
+    encode(PEER_CREDENTIALS_LABEL, &raw)
+}
+
+pub fn peer_credentials_from_pem(pem: &str) -> Result<PeerCredentials, PemError> {
+    let raw = decode(PEER_CREDENTIALS_LABEL, pem)?;
+    if raw.len() < KEY_SIZE || raw.len() > KEY_SIZE + MAX_ADDITIONAL_DATA_SIZE {
+        return Err(PemError::InvalidSize);
+    }
+    Ok(PeerCredentials {
+        public_key: PublicKey::from(*array_ref![raw, 0, KEY_SIZE]),
+        additional_data: raw[KEY_SIZE..].to_vec(),
+    })
+}
+
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use super::*;
+    use self::rand_core::OsRng;
+
+    #[test]
+    fn key_pem_test() {
+        let private_key = StaticSecret::new(OsRng);
+        let public_key = PublicKey::from(&private_key);
+
+        let pem = public_key_to_pem(&public_key);
+        assert!(pem.starts_with("-----BEGIN X25519 PUBLIC KEY-----\n"));
+        assert_eq!(public_key_from_pem(&pem).unwrap(), public_key);
+
+        let pem = private_key_to_pem(&private_key);
+        let decoded = private_key_from_pem(&pem).unwrap();
+        assert_eq!(PublicKey::from(&decoded), public_key);
+
+        match public_key_from_pem(&pem) {
+            Err(PemError::InvalidLabel) => {},
+            _ => panic!("expected label mismatch"),
+        }
+    }
+
+    #[test]
+    fn peer_credentials_pem_test() {
+        let private_key = StaticSecret::new(OsRng);
+        let peer_credentials = PeerCredentials {
+            public_key: PublicKey::from(&private_key),
+            additional_data: vec![7u8; 100],
+        };
+        let pem = peer_credentials_to_pem(&peer_credentials);
+        assert!(pem.lines().all(|x| x.len() <= LINE_LENGTH || x.starts_with("-----")));
+        assert_eq!(peer_credentials_from_pem(&pem).unwrap(), peer_credentials);
+
+        let truncated = encode(PEER_CREDENTIALS_LABEL, &[1, 2, 3]);
+        assert!(peer_credentials_from_pem(&truncated).is_err());
+    }
+}
@@ -0,0 +1,75 @@
+// pki.rs - directory authority requests over a session
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Directory authority requests, so that PKI traffic can use an
+//! authenticated link rather than a separate channel. Documents
+//! larger than a frame are sent in fragments, which the receiving
+//! session bounds by SessionConfig::max_command_size; an
+//! authority's clients must allow for the largest consensus.
+//!
+//! Each function sends its request and receives until the answer
+//! arrives, so nothing else may receive on the session meanwhile.
+//! Bound the wait with Session::set_read_deadline.
+
+use x25519_dalek_ng::PublicKey;
+
+use super::commands::{Command, CONSENSUS_OK, CONSENSUS_NOT_FOUND, CONSENSUS_GONE, DESCRIPTOR_OK, VOTE_OK};
+use super::errors::PkiError;
+use super::sync::Session;
+
+// Receives the next command, skipping NoOps such as keepalives.
+fn receive_answer(session: &mut Session) -> Result<Command, PkiError> {
+    loop {
+        match session.recv_command()? {
+            Command::NoOp{} => {},
+            cmd => return Ok(cmd),
+        }
+    }
+}
+
+/// Fetches the consensus document for epoch.
+pub fn get_consensus(session: &mut Session, epoch: u64) -> Result<Vec<u8>, PkiError> {
+    session.send_command(&Command::GetConsensus{ epoch })?;
+    match receive_answer(session)? {
+        Command::Consensus{ error_code: CONSENSUS_OK, payload } => Ok(payload),
+        Command::Consensus{ error_code: CONSENSUS_NOT_FOUND, .. } => Err(PkiError::ConsensusNotFound),
+        Command::Consensus{ error_code: CONSENSUS_GONE, .. } => Err(PkiError::ConsensusGone),
+        Command::Consensus{ error_code, .. } => Err(PkiError::Rejected(error_code)),
+        _ => Err(PkiError::UnexpectedCommand),
+    }
+}
+
+/// Posts a descriptor for epoch. A refusal is returned as Rejected
+/// with one of the DESCRIPTOR_* codes.
+pub fn post_descriptor(session: &mut Session, epoch: u64, descriptor: Vec<u8>) -> Result<(), PkiError> {
+    session.send_command(&Command::PostDescriptor{ epoch, payload: descriptor })?;
+    match receive_answer(session)? {
+        Command::PostDescriptorStatus{ error_code: DESCRIPTOR_OK } => Ok(()),
+        Command::PostDescriptorStatus{ error_code } => Err(PkiError::Rejected(error_code)),
+        _ => Err(PkiError::UnexpectedCommand),
+    }
+}
+
+/// Posts an authority's vote for epoch. A refusal is returned as
+/// Rejected with one of the VOTE_* codes.
+pub fn post_vote(session: &mut Session, epoch: u64, public_key: PublicKey, vote: Vec<u8>) -> Result<(), PkiError> {
+    session.send_command(&Command::Vote{ epoch, public_key, payload: vote })?;
+    match receive_answer(session)? {
+        Command::VoteStatus{ error_code: VOTE_OK } => Ok(()),
+        Command::VoteStatus{ error_code } => Err(PkiError::Rejected(error_code)),
+        _ => Err(PkiError::UnexpectedCommand),
+    }
+}
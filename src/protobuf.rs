@@ -0,0 +1,442 @@
+// protobuf.rs - protobuf encoding of commands
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Protobuf encoding of commands, following the schema in
+//! proto/commands.proto, so that implementations in other languages
+//! can use generated code. Fields holding their default value are
+//! omitted as in proto3 and unknown fields are skipped, so that the
+//! schema can evolve. The encoding is used by sessions configured
+//! with ProtobufCodec.
+
+use std::collections::HashMap;
+
+use x25519_dalek_ng::PublicKey;
+
+use super::codec::Codec;
+use super::commands::Command;
+use super::errors::CommandError;
+
+const WIRE_VARINT: u64 = 0;
+const WIRE_FIXED64: u64 = 1;
+const WIRE_LENGTH_DELIMITED: u64 = 2;
+const WIRE_FIXED32: u64 = 5;
+
+// The Command oneof field numbers.
+const NO_OP: u64 = 1;
+const DISCONNECT: u64 = 2;
+const SEND_PACKET: u64 = 3;
+const REKEY: u64 = 4;
+const REAUTH_CHALLENGE: u64 = 5;
+const REAUTH_RESPONSE: u64 = 6;
+const LINK_PARAMETERS: u64 = 7;
+const DATA: u64 = 8;
+const CLOSE_WRITE: u64 = 9;
+const ECHO: u64 = 10;
+const ECHO_REPLY: u64 = 11;
+const ERROR: u64 = 12;
+const FRAGMENT: u64 = 13;
+const BATCH: u64 = 14;
+const SEQUENCED: u64 = 15;
+const ACK: u64 = 16;
+const RETRIEVE_MESSAGE: u64 = 17;
+const MESSAGE_ACK: u64 = 18;
+const MESSAGE_MESSAGE: u64 = 19;
+const MESSAGE_EMPTY: u64 = 20;
+const GET_CONSENSUS: u64 = 21;
+const CONSENSUS: u64 = 22;
+const POST_DESCRIPTOR: u64 = 23;
+const POST_DESCRIPTOR_STATUS: u64 = 24;
+const VOTE: u64 = 25;
+const VOTE_STATUS: u64 = 26;
+const CREDIT: u64 = 27;
+const PING: u64 = 28;
+const PONG: u64 = 29;
+const GET_VERSION: u64 = 30;
+const VERSION: u64 = 31;
+const ACCEPT_COMPRESSION: u64 = 32;
+const COMPRESSED: u64 = 33;
+const STREAM_OPEN: u64 = 34;
+const STREAM_DATA: u64 = 35;
+const STREAM_CLOSE: u64 = 36;
+const TRACED: u64 = 37;
+const DATAGRAM_KEY: u64 = 38;
+const STREAM_WINDOW: u64 = 39;
+const APPLICATION: u64 = 129;
+
+#[derive(PartialEq, Debug, Clone, Copy)]
+enum Value<'a> {
+    Varint(u64),
+    Bytes(&'a [u8]),
+}
+
+fn write_varint(out: &mut Vec<u8>, mut x: u64) {
+    while x >= 0x80 {
+        out.push(x as u8 | 0x80);
+        x >>= 7;
+    }
+    out.push(x as u8);
+}
+
+// Encodes a message, omitting fields holding their default value.
+fn encode_message(fields: &[(u64, Value)]) -> Vec<u8> {
+    let mut out = vec![];
+    for (number, value) in fields {
+        match *value {
+            Value::Varint(0) => {},
+            Value::Varint(x) => {
+                write_varint(&mut out, number << 3 | WIRE_VARINT);
+                write_varint(&mut out, x);
+            },
+            Value::Bytes(x) if x.is_empty() => {},
+            Value::Bytes(x) => {
+                write_varint(&mut out, number << 3 | WIRE_LENGTH_DELIMITED);
+                write_varint(&mut out, x.len() as u64);
+                out.extend_from_slice(x);
+            },
+        }
+    }
+    out
+}
+
+struct Reader<'a> {
+    b: &'a [u8],
+}
+
+impl<'a> Reader<'a> {
+    fn take(&mut self, n: u64) -> Result<&'a [u8], CommandError> {
+        if n > self.b.len() as u64 {
+            return Err(CommandError::ProtobufDecodeError);
+        }
+        let (head, rest) = self.b.split_at(n as usize);
+        self.b = rest;
+        Ok(head)
+    }
+
+    fn varint(&mut self) -> Result<u64, CommandError> {
+        let mut x = 0u64;
+        for i in 0..10 {
+            let byte = self.take(1)?[0];
+            if i == 9 && byte > 1 {
+                return Err(CommandError::ProtobufDecodeError);
+            }
+            x |= ((byte & 0x7f) as u64) << (7 * i);
+            if byte < 0x80 {
+                return Ok(x)
+            }
+        }
+        Err(CommandError::ProtobufDecodeError)
+    }
+
+    // Reads the next field, returning None for fields of the fixed
+    // size wire types, which no command uses.
+    fn field(&mut self) -> Result<(u64, Option<Value<'a>>), CommandError> {
+        let key = self.varint()?;
+        let number = key >> 3;
+        if number == 0 {
+            return Err(CommandError::ProtobufDecodeError);
+        }
+        let value = match key & 7 {
+            WIRE_VARINT => Some(Value::Varint(self.varint()?)),
+            WIRE_LENGTH_DELIMITED => {
+                let len = self.varint()?;
+                Some(Value::Bytes(self.take(len)?))
+            },
+            WIRE_FIXED64 => {
+                self.take(8)?;
+                None
+            },
+            WIRE_FIXED32 => {
+                self.take(4)?;
+                None
+            },
+            // groups are not supported
+            _ => return Err(CommandError::ProtobufDecodeError),
+        };
+        Ok((number, value))
+    }
+}
+
+// The fields of a decoded message. Later occurrences of a field
+// replace earlier ones, as in protobuf.
+struct Fields<'a> {
+    fields: HashMap<u64, Value<'a>>,
+}
+
+impl<'a> Fields<'a> {
+    fn from_bytes(b: &'a [u8]) -> Result<Fields<'a>, CommandError> {
+        let mut reader = Reader{ b };
+        let mut fields = HashMap::new();
+        while !reader.b.is_empty() {
+            if let (number, Some(value)) = reader.field()? {
+                fields.insert(number, value);
+            }
+        }
+        Ok(Fields{ fields })
+    }
+
+    fn get(&self, number: u64) -> Option<Value<'a>> {
+        self.fields.get(&number).cloned()
+    }
+
+    fn varint(&self, number: u64, max: u64) -> Result<u64, CommandError> {
+        match self.get(number) {
+            None => Ok(0),
+            Some(Value::Varint(x)) if x <= max => Ok(x),
+            _ => Err(CommandError::ProtobufDecodeError),
+        }
+    }
+
+    fn u8(&self, number: u64) -> Result<u8, CommandError> {
+        Ok(self.varint(number, u8::max_value() as u64)? as u8)
+    }
+
+    fn u32(&self, number: u64) -> Result<u32, CommandError> {
+        Ok(self.varint(number, u32::max_value() as u64)? as u32)
+    }
+
+    fn u64(&self, number: u64) -> Result<u64, CommandError> {
+        self.varint(number, u64::max_value())
+    }
+
+    fn bytes(&self, number: u64) -> Result<&'a [u8], CommandError> {
+        match self.get(number) {
+            None => Ok(&[]),
+            Some(Value::Bytes(x)) => Ok(x),
+            _ => Err(CommandError::ProtobufDecodeError),
+        }
+    }
+
+    fn vec(&self, number: u64) -> Result<Vec<u8>, CommandError> {
+        Ok(self.bytes(number)?.to_vec())
+    }
+
+    fn array<T: Default + AsMut<[u8]>>(&self, number: u64) -> Result<T, CommandError> {
+        let bytes = self.bytes(number)?;
+        let mut out = T::default();
+        if out.as_mut().len() != bytes.len() {
+            return Err(CommandError::ProtobufDecodeError);
+        }
+        out.as_mut().copy_from_slice(bytes);
+        Ok(out)
+    }
+}
+
+/// Encodes cmd as a protobuf Command message.
+pub fn to_protobuf(cmd: &Command) -> Vec<u8> {
+    use self::Value::*;
+    let padding = match cmd {
+        Command::Padding{ size } => vec![0u8; *size as usize],
+        _ => vec![],
+    };
+    let (number, fields) = match cmd {
+        Command::NoOp{} => (NO_OP, vec![]),
+        Command::Padding{..} => (NO_OP, vec![(1, Bytes(&padding))]),
+        Command::Disconnect{ reason } => (DISCONNECT, vec![(1, Varint(*reason as u64))]),
+        Command::SendPacket{ sphinx_packet } => (SEND_PACKET, vec![(1, Bytes(sphinx_packet))]),
+        Command::Rekey{} => (REKEY, vec![]),
+        Command::ReauthChallenge{ nonce } => (REAUTH_CHALLENGE, vec![(1, Bytes(nonce))]),
+        Command::ReauthResponse{ nonce, additional_data } => (REAUTH_RESPONSE, vec![(1, Bytes(nonce)), (2, Bytes(additional_data))]),
+        Command::LinkParameters{ max_packet_size, forward_payload_size } => (LINK_PARAMETERS, vec![(1, Varint(*max_packet_size as u64)), (2, Varint(*forward_payload_size as u64))]),
+        Command::Data{ payload } => (DATA, vec![(1, Bytes(payload))]),
+        Command::CloseWrite{} => (CLOSE_WRITE, vec![]),
+        Command::Echo{ cookie } => (ECHO, vec![(1, Bytes(cookie))]),
+        Command::EchoReply{ cookie } => (ECHO_REPLY, vec![(1, Bytes(cookie))]),
+        Command::Error{ reason } => (ERROR, vec![(1, Varint(*reason as u64))]),
+        Command::Sequenced{ sequence, command } => (SEQUENCED, vec![(1, Varint(*sequence)), (2, Bytes(command))]),
+        Command::Credit{ packets } => (CREDIT, vec![(1, Varint(*packets as u64))]),
+        Command::Ping{ timestamp, cookie } => (PING, vec![(1, Varint(*timestamp)), (2, Bytes(cookie))]),
+        Command::Pong{ timestamp, cookie } => (PONG, vec![(1, Varint(*timestamp)), (2, Bytes(cookie))]),
+        Command::GetVersion{} => (GET_VERSION, vec![]),
+        Command::Version{ implementation, commands, max_message_size } => (VERSION, vec![(1, Bytes(implementation)), (2, Bytes(commands)), (3, Varint(*max_message_size as u64))]),
+        Command::AcceptCompression{ max_size } => (ACCEPT_COMPRESSION, vec![(1, Varint(*max_size as u64))]),
+        Command::Compressed{ algorithm, uncompressed_size, payload } => (COMPRESSED, vec![(1, Varint(*algorithm as u64)), (2, Varint(*uncompressed_size as u64)), (3, Bytes(payload))]),
+        Command::StreamOpen{ stream_id } => (STREAM_OPEN, vec![(1, Varint(*stream_id as u64))]),
+        Command::StreamData{ stream_id, payload } => (STREAM_DATA, vec![(1, Varint(*stream_id as u64)), (2, Bytes(payload))]),
+        Command::StreamClose{ stream_id } => (STREAM_CLOSE, vec![(1, Varint(*stream_id as u64))]),
+        Command::Traced{ trace_id, command } => (TRACED, vec![(1, Bytes(trace_id)), (2, Bytes(command))]),
+        Command::DatagramKey{ key } => (DATAGRAM_KEY, vec![(1, Bytes(key))]),
+        Command::StreamWindow{ stream_id, increment } => (STREAM_WINDOW, vec![(1, Varint(*stream_id as u64)), (2, Varint(*increment as u64))]),
+        Command::Ack{ sequence } => (ACK, vec![(1, Varint(*sequence))]),
+        Command::Batch{ commands } => (BATCH, vec![(1, Bytes(commands))]),
+        Command::Fragment{ total_size, offset, payload } => (FRAGMENT, vec![(1, Varint(*total_size as u64)), (2, Varint(*offset as u64)), (3, Bytes(payload))]),
+        Command::RetrieveMessage{ sequence } => (RETRIEVE_MESSAGE, vec![(1, Varint(*sequence as u64))]),
+        Command::MessageAck{ queue_size_hint, sequence, id, payload } => (MESSAGE_ACK, vec![(1, Varint(*queue_size_hint as u64)), (2, Varint(*sequence as u64)), (3, Bytes(id)), (4, Bytes(payload))]),
+        Command::MessageMessage{ queue_size_hint, sequence, payload } => (MESSAGE_MESSAGE, vec![(1, Varint(*queue_size_hint as u64)), (2, Varint(*sequence as u64)), (3, Bytes(payload))]),
+        Command::MessageEmpty{ sequence } => (MESSAGE_EMPTY, vec![(1, Varint(*sequence as u64))]),
+        Command::GetConsensus{ epoch } => (GET_CONSENSUS, vec![(1, Varint(*epoch))]),
+        Command::Consensus{ error_code, payload } => (CONSENSUS, vec![(1, Varint(*error_code as u64)), (2, Bytes(payload))]),
+        Command::PostDescriptor{ epoch, payload } => (POST_DESCRIPTOR, vec![(1, Varint(*epoch)), (2, Bytes(payload))]),
+        Command::PostDescriptorStatus{ error_code } => (POST_DESCRIPTOR_STATUS, vec![(1, Varint(*error_code as u64))]),
+        Command::Vote{ epoch, public_key, payload } => (VOTE, vec![(1, Varint(*epoch)), (2, Bytes(public_key.as_bytes())), (3, Bytes(payload))]),
+        Command::VoteStatus{ error_code } => (VOTE_STATUS, vec![(1, Varint(*error_code as u64))]),
+        Command::Application{ id, payload } => (APPLICATION, vec![(1, Varint(*id as u64)), (2, Bytes(payload))]),
+    };
+    // The oneof field is sent even when its message is empty.
+    let body = encode_message(&fields);
+    let mut out = vec![];
+    write_varint(&mut out, number << 3 | WIRE_LENGTH_DELIMITED);
+    write_varint(&mut out, body.len() as u64);
+    out.extend(body);
+    out
+}
+
+/// Decodes a Command message.
+pub fn from_protobuf(b: &[u8]) -> Result<Command, CommandError> {
+    // The last oneof field present wins, as in protobuf.
+    let mut command = None;
+    let mut reader = Reader{ b };
+    while !reader.b.is_empty() {
+        match reader.field()? {
+            (number, Some(Value::Bytes(body))) => command = Some((number, body)),
+            (_, Some(Value::Varint(_))) => return Err(CommandError::ProtobufDecodeError),
+            (_, None) => {},
+        }
+    }
+    let (number, body) = match command {
+        Some(x) => x,
+        None => return Err(CommandError::ProtobufDecodeError),
+    };
+    let f = Fields::from_bytes(body)?;
+    let cmd = match number {
+        NO_OP => Command::NoOp{},
+        DISCONNECT => Command::Disconnect{ reason: f.u8(1)? },
+        SEND_PACKET => Command::SendPacket{ sphinx_packet: f.vec(1)? },
+        REKEY => Command::Rekey{},
+        REAUTH_CHALLENGE => Command::ReauthChallenge{ nonce: f.array(1)? },
+        REAUTH_RESPONSE => Command::ReauthResponse{ nonce: f.array(1)?, additional_data: f.vec(2)? },
+        LINK_PARAMETERS => Command::LinkParameters{ max_packet_size: f.u32(1)?, forward_payload_size: f.u32(2)? },
+        DATA => Command::Data{ payload: f.vec(1)? },
+        CLOSE_WRITE => Command::CloseWrite{},
+        ECHO => Command::Echo{ cookie: f.array(1)? },
+        ECHO_REPLY => Command::EchoReply{ cookie: f.array(1)? },
+        ERROR => Command::Error{ reason: f.u8(1)? },
+        SEQUENCED => Command::Sequenced{ sequence: f.u64(1)?, command: f.vec(2)? },
+        CREDIT => Command::Credit{ packets: f.u32(1)? },
+        PING => Command::Ping{ timestamp: f.u64(1)?, cookie: f.array(2)? },
+        PONG => Command::Pong{ timestamp: f.u64(1)?, cookie: f.array(2)? },
+        GET_VERSION => Command::GetVersion{},
+        VERSION => Command::Version{ implementation: f.vec(1)?, commands: f.vec(2)?, max_message_size: f.u32(3)? },
+        ACCEPT_COMPRESSION => Command::AcceptCompression{ max_size: f.u32(1)? },
+        COMPRESSED => Command::Compressed{ algorithm: f.u8(1)?, uncompressed_size: f.u32(2)?, payload: f.vec(3)? },
+        STREAM_OPEN => Command::StreamOpen{ stream_id: f.u32(1)? },
+        STREAM_DATA => Command::StreamData{ stream_id: f.u32(1)?, payload: f.vec(2)? },
+        STREAM_CLOSE => Command::StreamClose{ stream_id: f.u32(1)? },
+        TRACED => Command::Traced{ trace_id: f.array(1)?, command: f.vec(2)? },
+        DATAGRAM_KEY => Command::DatagramKey{ key: f.array(1)? },
+        STREAM_WINDOW => Command::StreamWindow{ stream_id: f.u32(1)?, increment: f.u32(2)? },
+        ACK => Command::Ack{ sequence: f.u64(1)? },
+        BATCH => Command::Batch{ commands: f.vec(1)? },
+        FRAGMENT => Command::Fragment{ total_size: f.u32(1)?, offset: f.u32(2)?, payload: f.vec(3)? },
+        RETRIEVE_MESSAGE => Command::RetrieveMessage{ sequence: f.u32(1)? },
+        MESSAGE_ACK => Command::MessageAck{ queue_size_hint: f.u8(1)?, sequence: f.u32(2)?, id: f.array(3)?, payload: f.vec(4)? },
+        MESSAGE_MESSAGE => Command::MessageMessage{ queue_size_hint: f.u8(1)?, sequence: f.u32(2)?, payload: f.vec(3)? },
+        MESSAGE_EMPTY => Command::MessageEmpty{ sequence: f.u32(1)? },
+        GET_CONSENSUS => Command::GetConsensus{ epoch: f.u64(1)? },
+        CONSENSUS => Command::Consensus{ error_code: f.u8(1)?, payload: f.vec(2)? },
+        POST_DESCRIPTOR => Command::PostDescriptor{ epoch: f.u64(1)?, payload: f.vec(2)? },
+        POST_DESCRIPTOR_STATUS => Command::PostDescriptorStatus{ error_code: f.u8(1)? },
+        VOTE => Command::Vote{ epoch: f.u64(1)?, public_key: PublicKey::from(f.array::<[u8; 32]>(2)?), payload: f.vec(3)? },
+        VOTE_STATUS => Command::VoteStatus{ error_code: f.u8(1)? },
+        APPLICATION => Command::Application{ id: f.u8(1)?, payload: f.vec(2)? },
+        _ => return Err(CommandError::UnknownCommand),
+    };
+    Ok(cmd)
+}
+
+/// The protobuf command encoding.
+#[derive(Clone, Copy, Debug, Default)]
+pub struct ProtobufCodec;
+
+impl Codec for ProtobufCodec {
+    fn encode(&self, cmd: &Command) -> Vec<u8> {
+        to_protobuf(cmd)
+    }
+
+    fn decode(&self, b: &[u8]) -> Result<Command, CommandError> {
+        from_protobuf(b)
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use super::*;
+    use self::rand_core::OsRng;
+
+    #[test]
+    fn protobuf_test() {
+        let commands = vec![
+            Command::NoOp{},
+            Command::Disconnect{ reason: 0 },
+            Command::GetConsensus{ epoch: u64::max_value() },
+            Command::Consensus{ error_code: 1, payload: vec![1u8; 300] },
+            Command::Vote{ epoch: 7, public_key: PublicKey::from(&StaticSecret::new(OsRng)), payload: vec![2u8; 70000] },
+            Command::ReauthResponse{ nonce: [3u8; 32], additional_data: vec![] },
+            Command::LinkParameters{ max_packet_size: 65536, forward_payload_size: 23 },
+            Command::EchoReply{ cookie: [4u8; 8] },
+            Command::SendPacket{ sphinx_packet: vec![5u8; 24] },
+            Command::MessageAck{ queue_size_hint: 9, sequence: 10, id: [6u8; 16], payload: vec![7u8; 10] },
+            Command::Application{ id: 200, payload: vec![8u8] },
+            Command::Fragment{ total_size: 100000, offset: 0, payload: vec![9u8; 1000] },
+            Command::Ping{ timestamp: 1234567890, cookie: [10u8; 8] },
+            Command::GetVersion{},
+            Command::AcceptCompression{ max_size: 1 << 24 },
+            Command::StreamClose{ stream_id: 4 },
+            Command::Traced{ trace_id: [11u8; 16], command: vec![0u8; 10] },
+            Command::DatagramKey{ key: [12u8; 32] },
+            Command::StreamWindow{ stream_id: 5, increment: 1 << 18 },
+            Command::Version{ implementation: b"mix_link".to_vec(), commands: vec![0, 1, 200], max_message_size: 70000 },
+        ];
+        for cmd in commands {
+            assert_eq!(from_protobuf(&to_protobuf(&cmd)).unwrap(), cmd);
+        }
+
+        // retrieve_message { sequence: 300 }
+        let raw = [0x8a, 0x01, 0x03, 0x08, 0xac, 0x02];
+        assert_eq!(to_protobuf(&Command::RetrieveMessage{ sequence: 300 }), raw.to_vec());
+        assert_eq!(to_protobuf(&Command::NoOp{}), vec![0x0a, 0x00]);
+
+        // unknown fields are skipped
+        let raw = [0x8a, 0x01, 0x0c, 0x08, 0xac, 0x02, 0x12, 0x02, 0xff, 0xff, 0x1d, 0x01, 0x02, 0x03, 0x04];
+        assert_eq!(from_protobuf(&raw).unwrap(), Command::RetrieveMessage{ sequence: 300 });
+    }
+
+    #[test]
+    fn protobuf_invalid_test() {
+        let raw = to_protobuf(&Command::RetrieveMessage{ sequence: 300 });
+        // truncated
+        assert!(from_protobuf(&raw[..raw.len() - 1]).is_err());
+        // no command
+        assert!(from_protobuf(&[]).is_err());
+        // unknown command
+        match from_protobuf(&[0xa2, 0x06, 0x00]) {
+            Err(CommandError::UnknownCommand) => {},
+            _ => panic!("expected an unknown command"),
+        }
+        // out of range field
+        assert!(from_protobuf(&[0x12, 0x03, 0x08, 0x80, 0x02]).is_err());
+        // wrong wire type
+        assert!(from_protobuf(&[0x1a, 0x02, 0x08, 0x01]).is_err());
+        // a fixed size field of the wrong size
+        assert!(from_protobuf(&[0x52, 0x03, 0x0a, 0x01, 0x00]).is_err());
+        // overlong varint
+        assert!(from_protobuf(&[0x12, 0x0b, 0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f]).is_err());
+    }
+}
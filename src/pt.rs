@@ -0,0 +1,432 @@
+// pt.rs - pluggable transports
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Pluggable transports, such as obfs4proxy and snowflake, run as
+//! managed child processes speaking the pluggable transport protocol
+//! Tor uses (pt-spec, and the managed process interface of PT 2.x).
+//! A transport is configured by a spec string in the form of a torrc
+//! transport plugin line, such as "obfs4 exec /usr/bin/obfs4proxy".
+//!
+//! On the client, PtClient runs the transport as a local SOCKS5 proxy
+//! and returns Dialers carrying the listener's transport arguments.
+//! On the listener, PtServer runs the transport on a public address,
+//! forwarding the connections it accepts to a local listener, and
+//! reports the arguments clients need, such as obfs4's cert. The
+//! peer address of connections accepted this way is the transport's.
+
+use std::io;
+use std::io::prelude::*;
+use std::io::BufReader;
+use std::net::{SocketAddr, TcpListener, TcpStream};
+use std::path::Path;
+use std::process::{Child, Command, Stdio};
+use std::sync::mpsc::{channel, Receiver, RecvTimeoutError};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::dialer::{Dialer, Socks5Proxy, StreamIsolation};
+
+// The length of a SOCKS5 username or password.
+const MAX_CREDENTIAL_SIZE: usize = 255;
+
+fn pt_error(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::Other, message.to_string())
+}
+
+/// A pluggable transport and how to run it.
+#[derive(PartialEq, Debug, Clone)]
+pub struct PtSpec {
+    pub name: String,
+    pub program: String,
+    pub args: Vec<String>,
+}
+
+impl PtSpec {
+    /// Parses a spec of the form "<name> exec <program> [<arg>...]".
+    pub fn parse(spec: &str) -> io::Result<PtSpec> {
+        let mut words = spec.split_whitespace();
+        match (words.next(), words.next(), words.next()) {
+            (Some(name), Some("exec"), Some(program)) => Ok(PtSpec {
+                name: name.to_string(),
+                program: program.to_string(),
+                args: words.map(|x| x.to_string()).collect(),
+            }),
+            _ => Err(io::Error::new(io::ErrorKind::InvalidInput, "invalid pluggable transport spec")),
+        }
+    }
+
+    fn command(&self, state_dir: &Path) -> Command {
+        let mut command = Command::new(&self.program);
+        command.args(&self.args)
+            .env("TOR_PT_MANAGED_TRANSPORT_VER", "1")
+            .env("TOR_PT_STATE_LOCATION", state_dir)
+            .env("TOR_PT_EXIT_ON_STDIN_CLOSE", "1")
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped());
+        command
+    }
+}
+
+// Escapes the characters pt-spec reserves in arguments.
+fn escape(value: &str, reserved: &[char]) -> String {
+    let mut escaped = String::new();
+    for c in value.chars() {
+        if c == '\\' || reserved.contains(&c) {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+// Splits value at unescaped separators, removing the escapes.
+fn split_escaped(value: &str, separator: char) -> Vec<String> {
+    let mut parts = vec![String::new()];
+    let mut chars = value.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '\\' => if let Some(c) = chars.next() {
+                parts.last_mut().unwrap().push(c);
+            },
+            c if c == separator => parts.push(String::new()),
+            c => parts.last_mut().unwrap().push(c),
+        }
+    }
+    parts
+}
+
+/// Encodes transport arguments as SOCKS5 credentials, as the client
+/// passes them to the transport.
+pub fn socks_credentials(args: &[(String, String)]) -> io::Result<(String, String)> {
+    let encoded: Vec<String> = args.iter()
+        .map(|&(ref key, ref value)| format!("{}={}", escape(key, &['=', ';']), escape(value, &['=', ';'])))
+        .collect();
+    let encoded = encoded.join(";");
+    if encoded.len() <= MAX_CREDENTIAL_SIZE {
+        // The password of a short argument list is a single NUL.
+        return Ok((encoded, "\0".to_string()))
+    }
+    if encoded.len() > 2 * MAX_CREDENTIAL_SIZE || !encoded.is_char_boundary(MAX_CREDENTIAL_SIZE) {
+        return Err(io::Error::new(io::ErrorKind::InvalidInput, "pluggable transport arguments too long"));
+    }
+    let (username, password) = encoded.split_at(MAX_CREDENTIAL_SIZE);
+    Ok((username.to_string(), password.to_string()))
+}
+
+// A running transport. Its protocol messages are read from stdout in
+// the background, so that later log lines never block it.
+struct Managed {
+    child: Child,
+    lines: Receiver<String>,
+}
+
+impl Managed {
+    fn launch(mut command: Command) -> io::Result<Managed> {
+        let mut child = command.spawn()?;
+        let stdout = child.stdout.take().expect("stdout is piped");
+        let (tx, lines) = channel();
+        thread::spawn(move|| {
+            // Lines are still drained once nobody listens.
+            for line in BufReader::new(stdout).lines() {
+                match line {
+                    Ok(line) => {
+                        let _ = tx.send(line);
+                    },
+                    Err(_) => return,
+                }
+            }
+        });
+        Ok(Managed {
+            child,
+            lines,
+        })
+    }
+
+    // Returns the words of the next protocol message, failing if the
+    // transport reports an error or says nothing before deadline.
+    fn next_message(&self, deadline: Instant) -> io::Result<Vec<String>> {
+        let now = Instant::now();
+        let timeout = if deadline > now { deadline - now } else { Duration::from_secs(0) };
+        let line = match self.lines.recv_timeout(timeout) {
+            Ok(line) => line,
+            Err(RecvTimeoutError::Timeout) => return Err(io::Error::new(io::ErrorKind::TimedOut, "pluggable transport did not start")),
+            Err(RecvTimeoutError::Disconnected) => return Err(pt_error("pluggable transport exited")),
+        };
+        let words: Vec<String> = line.split_whitespace().map(|x| x.to_string()).collect();
+        match words.first().map(|x| x.as_str()) {
+            Some("VERSION-ERROR") | Some("ENV-ERROR") | Some("CMETHOD-ERROR") | Some("SMETHOD-ERROR") | Some("PROXY-ERROR") => {
+                Err(pt_error(&format!("pluggable transport failed: {}", line)))
+            },
+            Some("VERSION") if words.get(1).map(|x| x.as_str()) != Some("1") => {
+                Err(pt_error("unsupported pluggable transport version"))
+            },
+            _ => Ok(words),
+        }
+    }
+
+    fn is_running(&mut self) -> bool {
+        match self.child.try_wait() {
+            Ok(None) => true,
+            _ => false,
+        }
+    }
+}
+
+impl Drop for Managed {
+    fn drop(&mut self) {
+        // Closing stdin asks the transport to exit.
+        self.child.stdin.take();
+        let _ = self.child.kill();
+        let _ = self.child.wait();
+    }
+}
+
+fn parse_addr(addr: &str) -> io::Result<SocketAddr> {
+    addr.parse().map_err(|_| pt_error("invalid pluggable transport address"))
+}
+
+/// A client transport running as a local SOCKS5 proxy. Dropping it
+/// stops the transport.
+pub struct PtClient {
+    managed: Managed,
+    addr: SocketAddr,
+}
+
+impl PtClient {
+    /// Runs the transport of spec, keeping its state under state_dir,
+    /// and waits up to timeout for it to start.
+    pub fn launch(spec: &PtSpec, state_dir: &Path, timeout: Duration) -> io::Result<PtClient> {
+        let mut command = spec.command(state_dir);
+        command.env("TOR_PT_CLIENT_TRANSPORTS", &spec.name);
+        let managed = Managed::launch(command)?;
+        let deadline = Instant::now() + timeout;
+        let mut addr = None;
+        loop {
+            let words = managed.next_message(deadline)?;
+            match words.first().map(|x| x.as_str()) {
+                Some("CMETHOD") if words.len() >= 4 && words[1] == spec.name => {
+                    if words[2] != "socks5" {
+                        return Err(pt_error("pluggable transport does not offer SOCKS5"));
+                    }
+                    addr = Some(parse_addr(&words[3])?);
+                },
+                Some("CMETHODS") => break,
+                _ => {},
+            }
+        }
+        match addr {
+            Some(addr) => Ok(PtClient { managed, addr }),
+            None => Err(pt_error("pluggable transport did not start the transport")),
+        }
+    }
+
+    /// Returns the address of the transport's SOCKS5 proxy.
+    pub fn socks_addr(&self) -> SocketAddr {
+        self.addr
+    }
+
+    /// Returns whether the transport process is still running.
+    pub fn is_running(&mut self) -> bool {
+        self.managed.is_running()
+    }
+
+    /// Returns a Dialer connecting through the transport to listeners
+    /// whose transport arguments, as PtServer::args reports them, are
+    /// args.
+    pub fn dialer(&self, args: &[(String, String)]) -> io::Result<Dialer> {
+        let isolation = if args.is_empty() {
+            StreamIsolation::None
+        } else {
+            let (username, password) = socks_credentials(args)?;
+            StreamIsolation::Credentials(username, password)
+        };
+        Ok(Dialer::Socks5(Socks5Proxy {
+            addr: self.addr,
+            isolation,
+        }))
+    }
+}
+
+/// A server transport forwarding connections to a local listener.
+/// Dropping it stops the transport.
+pub struct PtServer {
+    managed: Managed,
+    listener: TcpListener,
+    addr: SocketAddr,
+    args: Vec<(String, String)>,
+}
+
+impl PtServer {
+    /// Runs the transport of spec on bind_addr with the transport's
+    /// server options, keeping its state under state_dir, and waits up
+    /// to timeout for it to start.
+    pub fn launch(spec: &PtSpec, bind_addr: SocketAddr, options: &[(String, String)],
+                  state_dir: &Path, timeout: Duration) -> io::Result<PtServer> {
+        let listener = TcpListener::bind("127.0.0.1:0")?;
+        let options: Vec<String> = options.iter()
+            .map(|&(ref key, ref value)| format!("{}:{}={}", spec.name, escape(key, &[':', '=', ';']),
+                                                 escape(value, &[':', '=', ';'])))
+            .collect();
+        let mut command = spec.command(state_dir);
+        command.env("TOR_PT_SERVER_TRANSPORTS", &spec.name)
+            .env("TOR_PT_SERVER_BINDADDR", format!("{}-{}", spec.name, bind_addr))
+            .env("TOR_PT_ORPORT", listener.local_addr()?.to_string());
+        if !options.is_empty() {
+            command.env("TOR_PT_SERVER_TRANSPORT_OPTIONS", options.join(";"));
+        }
+        let managed = Managed::launch(command)?;
+        let deadline = Instant::now() + timeout;
+        let mut method = None;
+        loop {
+            let words = managed.next_message(deadline)?;
+            match words.first().map(|x| x.as_str()) {
+                Some("SMETHOD") if words.len() >= 3 && words[1] == spec.name => {
+                    let mut args = vec![];
+                    for word in &words[3..] {
+                        if word.starts_with("ARGS:") {
+                            for arg in split_escaped(&word["ARGS:".len()..], ',') {
+                                let mut parts = arg.splitn(2, '=');
+                                if let (Some(key), Some(value)) = (parts.next(), parts.next()) {
+                                    args.push((key.to_string(), value.to_string()));
+                                }
+                            }
+                        }
+                    }
+                    method = Some((parse_addr(&words[2])?, args));
+                },
+                Some("SMETHODS") => break,
+                _ => {},
+            }
+        }
+        match method {
+            Some((addr, args)) => Ok(PtServer { managed, listener, addr, args }),
+            None => Err(pt_error("pluggable transport did not start the transport")),
+        }
+    }
+
+    /// Returns the address the transport listens on.
+    pub fn addr(&self) -> SocketAddr {
+        self.addr
+    }
+
+    /// Returns the arguments clients need, to pass to PtClient::dialer.
+    pub fn args(&self) -> &[(String, String)] {
+        &self.args
+    }
+
+    /// Accepts a connection the transport forwards.
+    pub fn accept(&self) -> io::Result<TcpStream> {
+        Ok(self.listener.accept()?.0)
+    }
+
+    /// Returns whether the transport process is still running.
+    pub fn is_running(&mut self) -> bool {
+        self.managed.is_running()
+    }
+}
+
+
+#[cfg(all(test, unix))]
+mod tests {
+    use std::env;
+    use std::fs;
+    use std::os::unix::fs::PermissionsExt;
+    use std::process;
+
+    use super::*;
+
+    // Speaks the managed transport protocol but carries nothing; the
+    // client method points at a SOCKS5 server of the test's.
+    const FAKE_TRANSPORT: &str = r#"#!/bin/sh
+[ "$TOR_PT_MANAGED_TRANSPORT_VER" = 1 ] || { echo VERSION-ERROR no-version; exit 1; }
+echo VERSION 1
+if [ -n "$TOR_PT_CLIENT_TRANSPORTS" ]; then
+    echo "CMETHOD $TOR_PT_CLIENT_TRANSPORTS socks5 $SOCKS_ADDR"
+    echo CMETHODS DONE
+else
+    echo "SMETHOD $TOR_PT_SERVER_TRANSPORTS ${TOR_PT_SERVER_BINDADDR#*-} ARGS:cert=a\,b,orport=$TOR_PT_ORPORT"
+    echo SMETHODS DONE
+fi
+exec cat > /dev/null
+"#;
+
+    #[test]
+    fn credentials_test() {
+        let args = vec![("cert".to_string(), "a=b;c".to_string()), ("iat-mode".to_string(), "0".to_string())];
+        assert_eq!(socks_credentials(&args).unwrap(), ("cert=a\\=b\\;c;iat-mode=0".to_string(), "\0".to_string()));
+        let args = vec![("cert".to_string(), "x".repeat(300))];
+        let (username, password) = socks_credentials(&args).unwrap();
+        assert_eq!(username.len(), MAX_CREDENTIAL_SIZE);
+        assert_eq!(format!("{}{}", username, password), format!("cert={}", "x".repeat(300)));
+        assert_eq!(split_escaped("a\\,b,c=d", ','), vec!["a,b", "c=d"]);
+        assert!(PtSpec::parse("obfs4 /usr/bin/obfs4proxy").is_err());
+    }
+
+    #[test]
+    fn pt_test() {
+        let state_dir = env::temp_dir().join(format!("mix_link_pt_test_{}", process::id()));
+        fs::create_dir_all(&state_dir).unwrap();
+        let program = state_dir.join("fake_transport");
+        fs::write(&program, FAKE_TRANSPORT).unwrap();
+        fs::set_permissions(&program, fs::Permissions::from_mode(0o755)).unwrap();
+        let spec = PtSpec::parse(&format!("obfs4 exec {}", program.display())).unwrap();
+        let timeout = Duration::from_secs(10);
+
+        let server = PtServer::launch(&spec, "127.0.0.1:9999".parse().unwrap(), &[], &state_dir, timeout).unwrap();
+        assert_eq!(server.addr(), "127.0.0.1:9999".parse().unwrap());
+        assert_eq!(server.args()[0], ("cert".to_string(), "a,b".to_string()));
+        // connections to the ORPort reach the local listener
+        let orport = server.args()[1].1.clone();
+        let _connection = TcpStream::connect(&orport).unwrap();
+        server.accept().unwrap();
+
+        let socks = TcpListener::bind("127.0.0.1:0").unwrap();
+        let mut command_spec = spec.clone();
+        command_spec.program = "env".to_string();
+        command_spec.args = vec![format!("SOCKS_ADDR={}", socks.local_addr().unwrap()), program.display().to_string()];
+        let mut client = PtClient::launch(&command_spec, &state_dir, timeout).unwrap();
+        assert_eq!(client.socks_addr(), socks.local_addr().unwrap());
+        let dialer = client.dialer(server.args()).unwrap();
+        let socks_server = thread::spawn(move|| {
+            let (mut stream, _) = socks.accept().unwrap();
+            let mut greeting = [0u8; 3];
+            stream.read_exact(&mut greeting).unwrap();
+            stream.write_all(&[5, 2]).unwrap();
+            let mut header = [0u8; 2];
+            stream.read_exact(&mut header).unwrap();
+            let mut username = vec![0u8; header[1] as usize];
+            stream.read_exact(&mut username).unwrap();
+            let mut len = [0u8; 1];
+            stream.read_exact(&mut len).unwrap();
+            let mut password = vec![0u8; len[0] as usize];
+            stream.read_exact(&mut password).unwrap();
+            stream.write_all(&[1, 0]).unwrap();
+            let mut request = [0u8; 10];
+            stream.read_exact(&mut request).unwrap();
+            stream.write_all(&[5, 0, 0, 1, 0, 0, 0, 0, 0, 0]).unwrap();
+            (username, password)
+        });
+        dialer.dial("127.0.0.1", 9999, Some(timeout)).unwrap();
+        let (username, password) = socks_server.join().unwrap();
+        assert_eq!(String::from_utf8(username).unwrap(), format!("cert=a,b;orport={}", orport));
+        assert_eq!(password, b"\0");
+
+        assert!(client.is_running());
+        drop(client);
+        drop(server);
+        fs::remove_dir_all(&state_dir).unwrap();
+    }
+}
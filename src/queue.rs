@@ -0,0 +1,377 @@
+// queue.rs - prioritized outbound command queue
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! A prioritized outbound command queue. Commands are written by a
+//! background thread, highest priority first and in order within a
+//! priority, so that control commands are not starved behind a
+//! backlog of packets on a congested link. Limits on what may be
+//! queued keep a slow peer from growing the queue without bound.
+//! Urgent commands skip the queue altogether, see SendQueue::send_urgent.
+
+use std::collections::VecDeque;
+use std::sync::{Arc, Condvar, Mutex};
+use std::thread;
+
+use super::commands::Command;
+use super::errors::SendMessageError;
+use super::sync::Session;
+
+/// The priority of a queued command.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum Priority {
+    High,
+    Normal,
+    Low,
+}
+
+impl Priority {
+    /// Returns the default priority of cmd: link control commands
+    /// are High, bulk SendPacket, Data, StreamData and Padding
+    /// commands are Low and the rest are Normal.
+    pub fn of(cmd: &Command) -> Priority {
+        match cmd {
+            Command::NoOp{} | Command::Disconnect{..} | Command::CloseWrite{} | Command::Rekey{} |
+            Command::ReauthChallenge{..} | Command::ReauthResponse{..} |
+            Command::Echo{..} | Command::EchoReply{..} | Command::Error{..} | Command::Ack{..} |
+            Command::Credit{..} | Command::Ping{..} | Command::Pong{..} => Priority::High,
+            Command::SendPacket{..} | Command::Data{..} | Command::StreamData{..} |
+            Command::Padding{..} => Priority::Low,
+            _ => Priority::Normal,
+        }
+    }
+
+    /// Returns true for the commands SendQueue::send sends on the
+    /// urgent lane: Disconnect, Rekey and Credit, which must reach the
+    /// peer however much is queued ahead of them.
+    pub fn is_urgent(cmd: &Command) -> bool {
+        match cmd {
+            Command::Disconnect{..} | Command::Rekey{} | Command::Credit{..} => true,
+            _ => false,
+        }
+    }
+
+    fn index(&self) -> usize {
+        match *self {
+            Priority::High => 0,
+            Priority::Normal => 1,
+            Priority::Low => 2,
+        }
+    }
+}
+
+/// What SendQueue::send does when a command would exceed the limits.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum OverflowPolicy {
+    /// Wait until the writer makes room.
+    Block,
+    /// Fail with WouldBlock.
+    WouldBlock,
+    /// Drop the most recently queued commands of lower priority than
+    /// the new command to make room, or else the new command itself.
+    /// Dropped commands are counted, see SendQueue::dropped.
+    DropLowest,
+}
+
+/// Limits on the commands waiting in a SendQueue. A command is always
+/// accepted into an empty queue, whatever its size.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub struct QueueLimits {
+    pub max_commands: Option<usize>,
+    /// Bounds the total serialized size of the queued commands.
+    pub max_bytes: Option<usize>,
+    pub policy: OverflowPolicy,
+}
+
+impl Default for QueueLimits {
+    fn default() -> Self {
+        QueueLimits {
+            max_commands: None,
+            max_bytes: None,
+            policy: OverflowPolicy::Block,
+        }
+    }
+}
+
+struct QueueState {
+    // Queued commands and their serialized sizes, by priority.
+    queues: [VecDeque<(Command, usize)>; 3],
+    limits: QueueLimits,
+    bytes: usize,
+    dropped: u64,
+    // Whether the writer is sending a command it popped.
+    in_flight: bool,
+    // Set by SendQueue's drop, after which the writer drains the
+    // queue and exits.
+    closed: bool,
+    // Set once a send fails and the writer exits.
+    failed: bool,
+}
+
+impl QueueState {
+    fn new(limits: QueueLimits) -> QueueState {
+        QueueState {
+            queues: [VecDeque::new(), VecDeque::new(), VecDeque::new()],
+            limits,
+            bytes: 0,
+            dropped: 0,
+            in_flight: false,
+            closed: false,
+            failed: false,
+        }
+    }
+
+    fn push(&mut self, cmd: Command, size: usize, priority: Priority) {
+        self.bytes += size;
+        self.queues[priority.index()].push_back((cmd, size));
+    }
+
+    fn pop(&mut self) -> Option<Command> {
+        let (cmd, size) = self.queues.iter_mut().filter_map(|x| x.pop_front()).next()?;
+        self.bytes -= size;
+        Some(cmd)
+    }
+
+    // Drops the newest command of lower priority than priority.
+    fn drop_lower(&mut self, priority: Priority) -> bool {
+        for queue in self.queues[priority.index() + 1..].iter_mut().rev() {
+            if let Some((_, size)) = queue.pop_back() {
+                self.bytes -= size;
+                self.dropped += 1;
+                return true
+            }
+        }
+        false
+    }
+
+    fn len(&self) -> usize {
+        self.queues.iter().map(|x| x.len()).sum()
+    }
+
+    fn is_empty(&self) -> bool {
+        self.queues.iter().all(|x| x.is_empty())
+    }
+
+    fn fits(&self, size: usize) -> bool {
+        self.is_empty() ||
+            (self.limits.max_commands.map_or(true, |x| self.len() < x) &&
+             self.limits.max_bytes.map_or(true, |x| self.bytes + size <= x))
+    }
+
+    // Queues cmd according to the overflow policy, returning false
+    // if the caller must wait for room.
+    fn offer(&mut self, cmd: Command, size: usize, priority: Priority) -> Result<bool, SendMessageError> {
+        if !self.fits(size) {
+            match self.limits.policy {
+                OverflowPolicy::Block => return Ok(false),
+                OverflowPolicy::WouldBlock => return Err(SendMessageError::WouldBlock),
+                OverflowPolicy::DropLowest => {
+                    while !self.fits(size) {
+                        if !self.drop_lower(priority) {
+                            self.dropped += 1;
+                            return Ok(true)
+                        }
+                    }
+                },
+            }
+        }
+        self.push(cmd, size, priority);
+        Ok(true)
+    }
+}
+
+struct Shared {
+    state: Mutex<QueueState>,
+    condvar: Condvar,
+}
+
+/// A handle for queueing commands on a session, see Session::send_queue.
+/// Dropping it lets the writer send what is still queued and exit.
+pub struct SendQueue {
+    shared: Arc<Shared>,
+    // A clone of the writer's session for the urgent lane.
+    urgent: Mutex<Session>,
+}
+
+impl SendQueue {
+    /// Starts a writer thread sending queued commands on session.
+    pub fn new(mut session: Session, limits: QueueLimits) -> SendQueue {
+        let urgent = Mutex::new(session.clone());
+        let shared = Arc::new(Shared {
+            state: Mutex::new(QueueState::new(limits)),
+            condvar: Condvar::new(),
+        });
+        let writer = shared.clone();
+        thread::spawn(move|| {
+            loop {
+                let cmd = {
+                    let mut state = writer.state.lock().unwrap();
+                    state.in_flight = false;
+                    writer.condvar.notify_all();
+                    while state.is_empty() && !state.closed {
+                        state = writer.condvar.wait(state).unwrap();
+                    }
+                    match state.pop() {
+                        Some(cmd) => {
+                            state.in_flight = true;
+                            writer.condvar.notify_all();
+                            cmd
+                        },
+                        None => return,
+                    }
+                };
+                if session.send_command(&cmd).is_err() {
+                    let mut state = writer.state.lock().unwrap();
+                    state.failed = true;
+                    state.in_flight = false;
+                    writer.condvar.notify_all();
+                    return
+                }
+            }
+        });
+        SendQueue {
+            shared,
+            urgent,
+        }
+    }
+
+    /// Queues cmd at its default priority, see Priority::of, or sends
+    /// it on the urgent lane if Priority::is_urgent holds.
+    pub fn send(&self, cmd: Command) -> Result<(), SendMessageError> {
+        if Priority::is_urgent(&cmd) {
+            return self.send_urgent(&cmd)
+        }
+        let priority = Priority::of(&cmd);
+        self.send_with_priority(cmd, priority)
+    }
+
+    /// Sends cmd from the calling thread rather than queueing it, so
+    /// that it goes out ahead of every queued command, once the frame
+    /// being written finishes, even when the queue is full or the
+    /// writer is waiting for flow control credits. Commands queued
+    /// behind an urgent Disconnect may never be sent.
+    pub fn send_urgent(&self, cmd: &Command) -> Result<(), SendMessageError> {
+        if self.shared.state.lock().unwrap().failed {
+            return Err(SendMessageError::SessionClosed);
+        }
+        self.urgent.lock().unwrap().send_command(cmd)
+    }
+
+    /// Queues cmd at priority, applying the queue's overflow policy
+    /// if the limits would be exceeded. Fails with SessionClosed once
+    /// the writer has failed to send a command.
+    pub fn send_with_priority(&self, cmd: Command, priority: Priority) -> Result<(), SendMessageError> {
+        let size = cmd.to_vec().len();
+        let mut state = self.shared.state.lock().unwrap();
+        loop {
+            if state.failed {
+                return Err(SendMessageError::SessionClosed);
+            }
+            if state.offer(cmd.clone(), size, priority)? {
+                break
+            }
+            state = self.shared.condvar.wait(state).unwrap();
+        }
+        self.shared.condvar.notify_all();
+        Ok(())
+    }
+
+    /// Blocks until every queued command has been sent, failing with
+    /// SessionClosed if the writer fails first.
+    pub fn flush(&self) -> Result<(), SendMessageError> {
+        let mut state = self.shared.state.lock().unwrap();
+        while !state.failed && (state.in_flight || !state.is_empty()) {
+            state = self.shared.condvar.wait(state).unwrap();
+        }
+        if state.failed {
+            return Err(SendMessageError::SessionClosed);
+        }
+        Ok(())
+    }
+
+    /// Returns the number of commands waiting to be sent.
+    pub fn len(&self) -> usize {
+        self.shared.state.lock().unwrap().len()
+    }
+
+    /// Returns the number of commands dropped by the DropLowest policy.
+    pub fn dropped(&self) -> u64 {
+        self.shared.state.lock().unwrap().dropped
+    }
+}
+
+impl Drop for SendQueue {
+    fn drop(&mut self) {
+        self.shared.state.lock().unwrap().closed = true;
+        self.shared.condvar.notify_all();
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use super::super::commands::DISCONNECT_NORMAL;
+
+    #[test]
+    fn priority_order_test() {
+        let mut state = QueueState::new(QueueLimits::default());
+        let packet = Command::SendPacket{ sphinx_packet: vec![1, 2, 3] };
+        state.push(packet.clone(), 9, Priority::of(&packet));
+        state.push(Command::RetrieveMessage{ sequence: 1 }, 10, Priority::Normal);
+        state.push(Command::RetrieveMessage{ sequence: 2 }, 10, Priority::Normal);
+        state.push(Command::Disconnect{ reason: DISCONNECT_NORMAL }, 6, Priority::of(&Command::Disconnect{ reason: DISCONNECT_NORMAL }));
+        assert_eq!(state.pop(), Some(Command::Disconnect{ reason: DISCONNECT_NORMAL }));
+        assert_eq!(state.pop(), Some(Command::RetrieveMessage{ sequence: 1 }));
+        assert_eq!(state.pop(), Some(Command::RetrieveMessage{ sequence: 2 }));
+        assert_eq!(state.pop(), Some(packet));
+        assert_eq!(state.pop(), None);
+        assert_eq!(state.bytes, 0);
+
+        assert!(Priority::is_urgent(&Command::Credit{ packets: 1 }));
+        assert!(!Priority::is_urgent(&Command::NoOp{}));
+    }
+
+    #[test]
+    fn overflow_policy_test() {
+        let packet = Command::SendPacket{ sphinx_packet: vec![1, 2, 3] };
+        let mut limits = QueueLimits {
+            max_commands: Some(2),
+            max_bytes: None,
+            policy: OverflowPolicy::WouldBlock,
+        };
+        let mut state = QueueState::new(limits);
+        assert!(state.offer(packet.clone(), 9, Priority::Low).unwrap());
+        assert!(state.offer(packet.clone(), 9, Priority::Low).unwrap());
+        match state.offer(packet.clone(), 9, Priority::Low) {
+            Err(SendMessageError::WouldBlock) => {},
+            _ => panic!("expected a full queue"),
+        }
+
+        limits.policy = OverflowPolicy::Block;
+        state.limits = limits;
+        assert!(!state.offer(packet.clone(), 9, Priority::Low).unwrap());
+
+        // a control command displaces a packet, another packet is dropped
+        limits.policy = OverflowPolicy::DropLowest;
+        state.limits = limits;
+        assert!(state.offer(Command::Disconnect{ reason: DISCONNECT_NORMAL }, 6, Priority::High).unwrap());
+        assert!(state.offer(packet.clone(), 9, Priority::Low).unwrap());
+        assert_eq!(state.len(), 2);
+        assert_eq!(state.dropped, 2);
+        assert_eq!(state.pop(), Some(Command::Disconnect{ reason: DISCONNECT_NORMAL }));
+        assert_eq!(state.pop(), Some(packet));
+    }
+}
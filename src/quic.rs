@@ -0,0 +1,690 @@
+// quic.rs - QUIC transport
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! A transport carrying sessions over QUIC, one bidirectional stream
+//! per connection. QUIC recovers from loss sooner than TCP on lossy
+//! paths, and a connection survives the client's address changing, as
+//! it does when a mobile client moves between networks.
+//!
+//! QUIC is run by quinn-proto, which does no I/O of its own: each
+//! endpoint has a thread receiving on its UDP socket and another
+//! running its timers, and streams read and write under the same lock,
+//! so sessions block on a QuicStream as they would on a TcpStream.
+//!
+//! QUIC sets up its connections with TLS 1.3. As with the TLS
+//! transport the Noise handshake still authenticates the peers, so
+//! tls::unverified_client_config and a self signed certificate do.
+//! Listeners make clients return a retry token before keeping any
+//! state for them, so that a spoofed address gets no connection.
+//!
+//! This module needs the quic feature. quinn-proto needs no async
+//! runtime, so it adds only QUIC and TLS to the crates built.
+
+extern crate bytes;
+extern crate quinn_proto;
+extern crate rustls;
+
+use std::cmp;
+use std::collections::HashMap;
+use std::convert::TryFrom;
+use std::io;
+use std::io::prelude::*;
+use std::net::{Shutdown, SocketAddr, ToSocketAddrs, UdpSocket};
+use std::sync::{Arc, Condvar, Mutex, MutexGuard};
+use std::sync::mpsc::{channel, Receiver, Sender};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use self::bytes::{Bytes, BytesMut};
+use self::quinn_proto::{ClientConfig, ConnectionError, ConnectionHandle, Connection, DatagramEvent, Dir,
+                        Endpoint, EndpointConfig, Event, ReadError, ServerConfig, StreamEvent, StreamId,
+                        Transmit, TransportConfig, VarInt, WriteError};
+use self::quinn_proto::crypto::rustls::{QuicClientConfig, QuicServerConfig};
+
+use super::transport::Transport;
+
+/// The ALPN protocol both sides set, which QUIC requires.
+pub const ALPN: &[u8] = b"mix_link";
+
+// The most connections a listener has waiting to be accepted, and the
+// most it runs at once.
+const MAX_PENDING: usize = 128;
+const MAX_CONNECTIONS: usize = 1024;
+
+// How often connections idle between sessions' own keepalives are
+// kept from QUIC's idle timeout.
+const KEEPALIVE_INTERVAL: Duration = Duration::from_secs(10);
+// How long a connection whose handles are all dropped waits for what
+// it has sent to be acknowledged before closing.
+const LINGER: Duration = Duration::from_secs(10);
+// How often the endpoint threads check whether they are done.
+const POLL_INTERVAL: Duration = Duration::from_millis(100);
+const MAX_DATAGRAM_SIZE: usize = 65536;
+
+fn quic_error<E: ToString>(error: E) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidInput, error.to_string())
+}
+
+// Limits the streams the peer may open to incoming_streams, and keeps
+// the connection alive while the session is quiet.
+fn transport_config(incoming_streams: u32) -> Arc<TransportConfig> {
+    let mut config = TransportConfig::default();
+    config.max_concurrent_bidi_streams(VarInt::from_u32(incoming_streams));
+    config.max_concurrent_uni_streams(VarInt::from_u32(0));
+    config.keep_alive_interval(Some(KEEPALIVE_INTERVAL));
+    Arc::new(config)
+}
+
+struct ConnState {
+    conn: Connection,
+    // The stream carrying the session, once the client opens it.
+    stream: Option<StreamId>,
+    read_timeout: Option<Duration>,
+    write_timeout: Option<Duration>,
+    read_shutdown: bool,
+    connected: bool,
+    // Set once everything written is acknowledged or the peer stops
+    // reading.
+    write_finished: bool,
+    // Set once a stream is made for the connection. released is set
+    // once every handle is dropped, with the time to give up lingering.
+    handed_out: bool,
+    released: Option<Instant>,
+    error: Option<io::ErrorKind>,
+}
+
+impl ConnState {
+    fn new(conn: Connection, handed_out: bool) -> ConnState {
+        ConnState {
+            conn,
+            stream: None,
+            read_timeout: None,
+            write_timeout: None,
+            read_shutdown: false,
+            connected: false,
+            write_finished: false,
+            handed_out,
+            released: None,
+            error: None,
+        }
+    }
+
+    // Whether a stream still refers to the connection. The endpoint
+    // may reuse a connection's handle once it is told the connection
+    // is drained, so it is not told while the connection is held.
+    fn is_held(&self) -> bool {
+        self.handed_out && self.released.is_none()
+    }
+
+    // Reads into buf, returning None if nothing has arrived yet.
+    fn read(&mut self, buf: &mut [u8]) -> Option<io::Result<usize>> {
+        let id = match self.stream {
+            Some(x) if !self.read_shutdown && !buf.is_empty() => x,
+            _ => return Some(Ok(0)),
+        };
+        let result = {
+            let mut stream = self.conn.recv_stream(id);
+            // The stream is gone once its end has been read.
+            let mut chunks = match stream.read(true) {
+                Ok(x) => x,
+                Err(_) => return Some(Ok(0)),
+            };
+            let result = match chunks.next(buf.len()) {
+                Ok(Some(chunk)) => {
+                    buf[..chunk.bytes.len()].copy_from_slice(&chunk.bytes);
+                    Some(Ok(chunk.bytes.len()))
+                },
+                Ok(None) => Some(Ok(0)),
+                Err(ReadError::Reset(_)) => Some(Err(io::Error::from(io::ErrorKind::ConnectionReset))),
+                Err(ReadError::Blocked) => None,
+            };
+            let _ = chunks.finalize();
+            result
+        };
+        result.or_else(|| self.error.map(|kind| Err(io::Error::from(kind))))
+    }
+
+    // Writes buf, returning None if flow control holds it back.
+    fn write(&mut self, buf: &[u8]) -> Option<io::Result<usize>> {
+        if let Some(kind) = self.error {
+            return Some(Err(io::Error::from(kind)))
+        }
+        let id = match self.stream {
+            Some(x) => x,
+            None => return Some(Err(io::Error::from(io::ErrorKind::NotConnected))),
+        };
+        if buf.is_empty() {
+            return Some(Ok(0))
+        }
+        match self.conn.send_stream(id).write(buf) {
+            Ok(n) => Some(Ok(n)),
+            Err(WriteError::Blocked) => None,
+            Err(_) => Some(Err(io::Error::from(io::ErrorKind::BrokenPipe))),
+        }
+    }
+
+    fn finish(&mut self) {
+        if let Some(id) = self.stream {
+            let _ = self.conn.send_stream(id).finish();
+        }
+    }
+}
+
+struct EndpointState {
+    endpoint: Endpoint,
+    conns: HashMap<ConnectionHandle, ConnState>,
+    // A listener's, for handing it connections once their client opens
+    // a stream; None once the listener is dropped, and for dialers.
+    accepted: Option<Sender<ConnectionHandle>>,
+    pending: usize,
+    stopped: bool,
+}
+
+impl EndpointState {
+    fn conn(&mut self, handle: ConnectionHandle) -> &mut ConnState {
+        self.conns.get_mut(&handle).expect("connections outlive their handles")
+    }
+
+    // Ends the stream of a connection no handle refers to any more.
+    fn release(&mut self, handle: ConnectionHandle) {
+        let state = self.conn(handle);
+        state.finish();
+        if let Some(id) = state.stream {
+            let _ = state.conn.recv_stream(id).stop(VarInt::from_u32(0));
+        }
+        state.released = Some(Instant::now() + LINGER);
+    }
+
+    fn is_done(&self) -> bool {
+        self.stopped && self.conns.is_empty()
+    }
+}
+
+// A QUIC endpoint on a UDP socket, with its connections.
+struct Driver {
+    state: Mutex<EndpointState>,
+    // Notified when connections change, and when their timers may have.
+    changed: Condvar,
+    timers_changed: Condvar,
+    socket: UdpSocket,
+}
+
+impl Driver {
+    fn start(socket: UdpSocket, state: EndpointState) -> Arc<Driver> {
+        let driver = Arc::new(Driver {
+            state: Mutex::new(state),
+            changed: Condvar::new(),
+            timers_changed: Condvar::new(),
+            socket,
+        });
+        let receiver = driver.clone();
+        thread::spawn(move|| receiver.receive());
+        let timer = driver.clone();
+        thread::spawn(move|| timer.run_timers());
+        driver
+    }
+
+    fn send(&self, transmit: &Transmit, buf: &[u8]) {
+        let _ = self.socket.send_to(&buf[..transmit.size], transmit.destination);
+    }
+
+    // Receives datagrams until the endpoint is done.
+    fn receive(&self) {
+        let mut datagram = vec![0u8; MAX_DATAGRAM_SIZE];
+        loop {
+            let received = self.socket.recv_from(&mut datagram);
+            let mut state = self.state.lock().unwrap();
+            if state.is_done() {
+                return
+            }
+            if let Ok((n, from)) = received {
+                self.input(&mut state, from, &datagram[..n]);
+                self.update(&mut state);
+            }
+        }
+    }
+
+    // Runs the connections' timers until the endpoint is done.
+    fn run_timers(&self) {
+        let mut state = self.state.lock().unwrap();
+        while !state.is_done() {
+            let now = Instant::now();
+            for conn in state.conns.values_mut() {
+                if conn.conn.poll_timeout().map_or(false, |x| x <= now) {
+                    conn.conn.handle_timeout(now);
+                }
+            }
+            self.drive(&mut state);
+            let next = state.conns.values_mut().filter_map(|x| x.conn.poll_timeout()).min();
+            let wait = next.map_or(POLL_INTERVAL, |x| cmp::min(x.saturating_duration_since(Instant::now()), POLL_INTERVAL));
+            state = self.timers_changed.wait_timeout(state, wait).unwrap().0;
+        }
+    }
+
+    fn input(&self, state: &mut EndpointState, from: SocketAddr, datagram: &[u8]) {
+        let mut buf = vec![];
+        let now = Instant::now();
+        match state.endpoint.handle(now, from, None, None, BytesMut::from(datagram), &mut buf) {
+            Some(DatagramEvent::ConnectionEvent(handle, event)) => {
+                if let Some(conn) = state.conns.get_mut(&handle) {
+                    conn.conn.handle_event(event);
+                }
+            },
+            Some(DatagramEvent::Response(transmit)) => self.send(&transmit, &buf),
+            Some(DatagramEvent::NewConnection(incoming)) => {
+                if state.stopped || state.pending >= MAX_PENDING || state.conns.len() >= MAX_CONNECTIONS {
+                    let transmit = state.endpoint.refuse(incoming, &mut buf);
+                    self.send(&transmit, &buf);
+                } else if !incoming.remote_address_validated() {
+                    match state.endpoint.retry(incoming, &mut buf) {
+                        Ok(transmit) => self.send(&transmit, &buf),
+                        Err(e) => state.endpoint.ignore(e.into_incoming()),
+                    }
+                } else {
+                    match state.endpoint.accept(incoming, now, &mut buf, None) {
+                        Ok((handle, conn)) => {
+                            state.conns.insert(handle, ConnState::new(conn, false));
+                        },
+                        Err(e) => {
+                            if let Some(transmit) = e.response {
+                                self.send(&transmit, &buf);
+                            }
+                        },
+                    }
+                }
+            },
+            None => {},
+        }
+    }
+
+    // Drives the connections after a change outside the timer thread.
+    fn update(&self, state: &mut EndpointState) {
+        self.drive(state);
+        self.timers_changed.notify_one();
+    }
+
+    // Closes lingering connections once they are done, hands events
+    // between the endpoint and its connections, sends what they have
+    // to send and forgets drained connections no stream refers to.
+    fn drive(&self, state: &mut EndpointState) {
+        let now = Instant::now();
+        let mut buf = vec![];
+        let EndpointState { ref mut endpoint, ref mut conns, ref accepted, ref mut pending, stopped } = *state;
+        conns.retain(|&handle, state| {
+            if let Some(deadline) = state.released {
+                if state.write_finished || state.stream.is_none() || state.error.is_some() || now >= deadline {
+                    state.conn.close(now, VarInt::from_u32(0), Bytes::new());
+                }
+            }
+            while !(state.is_held() && state.conn.is_drained()) {
+                let event = match state.conn.poll_endpoint_events() {
+                    Some(x) => x,
+                    None => break,
+                };
+                if let Some(event) = endpoint.handle_event(handle, event) {
+                    state.conn.handle_event(event);
+                }
+            }
+            while let Some(event) = state.conn.poll() {
+                match event {
+                    Event::Connected => state.connected = true,
+                    Event::ConnectionLost { reason } => {
+                        state.error = Some(match reason {
+                            ConnectionError::TimedOut => io::ErrorKind::TimedOut,
+                            ConnectionError::Reset => io::ErrorKind::ConnectionReset,
+                            _ => io::ErrorKind::ConnectionAborted,
+                        });
+                    },
+                    Event::Stream(StreamEvent::Opened { dir: Dir::Bi }) if state.stream.is_none() => {
+                        state.stream = state.conn.streams().accept(Dir::Bi);
+                        match *accepted {
+                            Some(ref accepted) if !stopped => {
+                                state.handed_out = true;
+                                *pending += 1;
+                                let _ = accepted.send(handle);
+                            },
+                            _ => state.conn.close(now, VarInt::from_u32(0), Bytes::new()),
+                        }
+                    },
+                    Event::Stream(StreamEvent::Finished { .. }) | Event::Stream(StreamEvent::Stopped { .. }) => {
+                        state.write_finished = true;
+                    },
+                    _ => {},
+                }
+            }
+            loop {
+                buf.clear();
+                match state.conn.poll_transmit(now, 1, &mut buf) {
+                    Some(transmit) => self.send(&transmit, &buf),
+                    None => break,
+                }
+            }
+            !(state.conn.is_drained() && !state.is_held())
+        });
+        self.changed.notify_all();
+    }
+
+    // Waits for a change until deadline, failing with WouldBlock once
+    // it passes.
+    fn wait<'a>(&self, state: MutexGuard<'a, EndpointState>,
+                deadline: Option<Instant>) -> io::Result<MutexGuard<'a, EndpointState>> {
+        match deadline {
+            None => Ok(self.changed.wait(state).unwrap()),
+            Some(deadline) => {
+                let now = Instant::now();
+                if now >= deadline {
+                    return Err(io::Error::from(io::ErrorKind::WouldBlock));
+                }
+                Ok(self.changed.wait_timeout(state, deadline - now).unwrap().0)
+            },
+        }
+    }
+}
+
+// Shared by the clones of a stream; dropping the last ends the
+// stream and closes the connection once the peer has what was sent.
+struct Handle {
+    driver: Arc<Driver>,
+    conn: ConnectionHandle,
+}
+
+impl Drop for Handle {
+    fn drop(&mut self) {
+        let mut state = self.driver.state.lock().unwrap();
+        state.release(self.conn);
+        self.driver.update(&mut state);
+    }
+}
+
+/// A QUIC connection, implementing Transport.
+pub struct QuicStream {
+    handle: Arc<Handle>,
+}
+
+impl QuicStream {
+    // Waits for the handshake, then opens the stream.
+    fn open(&self) -> io::Result<()> {
+        let driver = &self.handle.driver;
+        let mut state = driver.state.lock().unwrap();
+        driver.update(&mut state);
+        loop {
+            {
+                let conn = state.conn(self.handle.conn);
+                if let Some(kind) = conn.error {
+                    return Err(io::Error::from(kind));
+                }
+                if conn.connected {
+                    conn.stream = conn.conn.streams().open(Dir::Bi);
+                    return Ok(())
+                }
+            }
+            state = driver.wait(state, None)?;
+        }
+    }
+}
+
+impl Read for QuicStream {
+    /// Reads end of file once the peer ends its side, and fails once
+    /// the connection is lost.
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let driver = &self.handle.driver;
+        let mut state = driver.state.lock().unwrap();
+        let deadline = state.conn(self.handle.conn).read_timeout.map(|x| Instant::now() + x);
+        loop {
+            if let Some(result) = state.conn(self.handle.conn).read(buf) {
+                // Lets the peer send more.
+                driver.update(&mut state);
+                return result
+            }
+            state = driver.wait(state, deadline)?;
+        }
+    }
+}
+
+impl Write for QuicStream {
+    /// Writes as much of buf as the peer's flow control allows,
+    /// waiting while it allows none.
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let driver = &self.handle.driver;
+        let mut state = driver.state.lock().unwrap();
+        let deadline = state.conn(self.handle.conn).write_timeout.map(|x| Instant::now() + x);
+        loop {
+            if let Some(result) = state.conn(self.handle.conn).write(buf) {
+                driver.update(&mut state);
+                return result
+            }
+            state = driver.wait(state, deadline)?;
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Transport for QuicStream {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(QuicStream {
+            handle: self.handle.clone(),
+        }))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.handle.driver.state.lock().unwrap().conn(self.handle.conn).read_timeout = timeout;
+        Ok(())
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.handle.driver.state.lock().unwrap().conn(self.handle.conn).write_timeout = timeout;
+        Ok(())
+    }
+
+    /// Shutting down writes finishes the stream.
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        let driver = &self.handle.driver;
+        let mut state = driver.state.lock().unwrap();
+        {
+            let conn = state.conn(self.handle.conn);
+            if how != Shutdown::Read {
+                conn.finish();
+            }
+            if how != Shutdown::Write {
+                conn.read_shutdown = true;
+            }
+        }
+        driver.update(&mut state);
+        Ok(())
+    }
+
+    /// The peer's current address, which changes as a client migrates.
+    fn peer_addr(&self) -> Option<SocketAddr> {
+        Some(self.handle.driver.state.lock().unwrap().conn(self.handle.conn).conn.remote_address())
+    }
+
+    fn local_addr(&self) -> Option<SocketAddr> {
+        self.handle.driver.socket.local_addr().ok()
+    }
+}
+
+/// Connects to addr, a host and port, from a new UDP socket, and
+/// performs the QUIC handshake with server_name. ALPN is added to
+/// config.
+pub fn dial_quic<A: ToSocketAddrs>(addr: A, server_name: &str, config: Arc<rustls::ClientConfig>) -> io::Result<QuicStream> {
+    let peer_addr = match addr.to_socket_addrs()?.next() {
+        Some(x) => x,
+        None => return Err(io::Error::new(io::ErrorKind::InvalidInput, "no addresses for host")),
+    };
+    let mut tls = (*config).clone();
+    tls.alpn_protocols = vec![ALPN.to_vec()];
+    let mut config = ClientConfig::new(Arc::new(QuicClientConfig::try_from(Arc::new(tls)).map_err(quic_error)?));
+    config.transport_config(transport_config(0));
+    // The socket is left unconnected so that the client may migrate.
+    let socket = UdpSocket::bind(if peer_addr.is_ipv4() { "0.0.0.0:0" } else { "[::]:0" })?;
+    socket.set_read_timeout(Some(POLL_INTERVAL))?;
+    let mut endpoint = Endpoint::new(Arc::new(EndpointConfig::default()), None, true, None);
+    let (handle, conn) = endpoint.connect(Instant::now(), config, peer_addr, server_name).map_err(quic_error)?;
+    let mut conns = HashMap::new();
+    conns.insert(handle, ConnState::new(conn, true));
+    let driver = Driver::start(socket, EndpointState {
+        endpoint,
+        conns,
+        accepted: None,
+        pending: 0,
+        stopped: true,
+    });
+    let stream = QuicStream {
+        handle: Arc::new(Handle { driver, conn: handle }),
+    };
+    stream.open()?;
+    Ok(stream)
+}
+
+/// Accepts QUIC connections on a UDP socket. A client's connection
+/// starts only once it has returned a retry token, and at most 128 wait
+/// to be accepted; more are refused. Connections accepted keep running
+/// after the listener is dropped.
+pub struct QuicListener {
+    local_addr: SocketAddr,
+    driver: Arc<Driver>,
+    accepted: Mutex<Receiver<ConnectionHandle>>,
+}
+
+impl QuicListener {
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        Ok(self.local_addr)
+    }
+
+    /// Waits for a client to connect and open its stream.
+    pub fn accept(&self) -> io::Result<QuicStream> {
+        let conn = self.accepted.lock().unwrap().recv().map_err(|_| io::Error::from(io::ErrorKind::ConnectionAborted))?;
+        self.driver.state.lock().unwrap().pending -= 1;
+        Ok(QuicStream {
+            handle: Arc::new(Handle {
+                driver: self.driver.clone(),
+                conn,
+            }),
+        })
+    }
+}
+
+impl Drop for QuicListener {
+    fn drop(&mut self) {
+        let mut state = self.driver.state.lock().unwrap();
+        state.stopped = true;
+        state.accepted = None;
+        // Connections handed out but not accepted have no stream to
+        // release them.
+        while let Ok(conn) = self.accepted.get_mut().unwrap().try_recv() {
+            state.release(conn);
+        }
+        self.driver.update(&mut state);
+    }
+}
+
+/// Listens on addr for QUIC connections. ALPN is added to config.
+pub fn listen_quic<A: ToSocketAddrs>(addr: A, config: Arc<rustls::ServerConfig>) -> io::Result<QuicListener> {
+    let mut tls = (*config).clone();
+    tls.alpn_protocols = vec![ALPN.to_vec()];
+    let mut config = ServerConfig::with_crypto(Arc::new(QuicServerConfig::try_from(Arc::new(tls)).map_err(quic_error)?));
+    config.transport_config(transport_config(1));
+    let socket = UdpSocket::bind(addr)?;
+    socket.set_read_timeout(Some(POLL_INTERVAL))?;
+    let local_addr = socket.local_addr()?;
+    let (tx, accepted) = channel();
+    let endpoint = Endpoint::new(Arc::new(EndpointConfig::default()), Some(Arc::new(config)), true, None);
+    let driver = Driver::start(socket, EndpointState {
+        endpoint,
+        conns: HashMap::new(),
+        accepted: Some(tx),
+        pending: 0,
+        stopped: false,
+    });
+    Ok(QuicListener {
+        local_addr,
+        driver,
+        accepted: Mutex::new(accepted),
+    })
+}
+
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use super::super::tls::{server_config, unverified_client_config};
+    use super::super::tls::tests::{TEST_CERT, TEST_KEY};
+
+    #[test]
+    fn quic_test() {
+        let listener = listen_quic("127.0.0.1:0", server_config(TEST_CERT, TEST_KEY).unwrap()).unwrap();
+        let addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let mut server = listener.accept().unwrap();
+            let mut received = vec![0u8; 70000];
+            server.read_exact(&mut received).unwrap();
+            server.write_all(&received).unwrap();
+            let mut rest = vec![];
+            server.read_to_end(&mut rest).unwrap();
+            assert!(rest.is_empty());
+        });
+
+        let mut client = dial_quic(addr, "localhost", unverified_client_config()).unwrap();
+        assert_eq!(client.peer_addr(), Some(addr));
+        let data: Vec<u8> = (0..70000u32).map(|x| x as u8).collect();
+        client.write_all(&data).unwrap();
+        let mut received = vec![0u8; data.len()];
+        let mut reader = client.try_clone_transport().unwrap();
+        reader.set_read_timeout(Some(Duration::from_secs(10))).unwrap();
+        reader.read_exact(&mut received).unwrap();
+        assert_eq!(received, data);
+
+        Transport::shutdown(&client, Shutdown::Write).unwrap();
+        assert!(client.write(b"late").is_err());
+        drop(client);
+        let mut rest = vec![];
+        reader.read_to_end(&mut rest).unwrap();
+        assert!(rest.is_empty());
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn write_timeout_test() {
+        let listener = listen_quic("127.0.0.1:0", server_config(TEST_CERT, TEST_KEY).unwrap()).unwrap();
+        let addr = listener.local_addr().unwrap();
+        let mut client = dial_quic(addr, "localhost", unverified_client_config()).unwrap();
+        client.write_all(b"open").unwrap();
+        let mut server = listener.accept().unwrap();
+
+        // writes time out once the server's flow control window is full
+        client.set_write_timeout(Some(Duration::from_millis(100))).unwrap();
+        let data = vec![7u8; 65536];
+        let mut written = 0;
+        loop {
+            match client.write(&data) {
+                Ok(n) => written += n,
+                Err(e) => {
+                    assert_eq!(e.kind(), io::ErrorKind::WouldBlock);
+                    break
+                },
+            }
+        }
+        let mut received = vec![0u8; 4 + written];
+        server.read_exact(&mut received).unwrap();
+        assert_eq!(&received[..4], b"open");
+
+        // the server reading opens the window again
+        client.write_all(&data).unwrap();
+    }
+}
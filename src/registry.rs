@@ -0,0 +1,186 @@
+// registry.rs - application defined commands
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Application defined commands. Applications built on the link
+//! layer may define commands with IDs from MIN_APPLICATION_COMMAND_ID
+//! up, which are carried as Command::Application. A session rejects
+//! application commands whose IDs are not registered in the command
+//! registry of its SessionConfig.
+
+use std::collections::HashMap;
+
+use super::commands::{Command, MIN_APPLICATION_COMMAND_ID};
+use super::errors::{CommandError, RegistryError};
+
+/// An application defined command type.
+pub trait ApplicationCommand: Sized {
+    /// The command ID, at least MIN_APPLICATION_COMMAND_ID.
+    const ID: u8;
+
+    fn marshal(&self) -> Vec<u8>;
+
+    fn unmarshal(payload: &[u8]) -> Result<Self, CommandError>;
+
+    fn to_command(&self) -> Command {
+        Command::Application{ id: Self::ID, payload: self.marshal() }
+    }
+
+    /// Decodes cmd, returning None if it is not a command of this type.
+    fn from_command(cmd: &Command) -> Option<Result<Self, CommandError>> {
+        match cmd {
+            Command::Application{ id, payload } if *id == Self::ID => Some(Self::unmarshal(payload)),
+            _ => None,
+        }
+    }
+}
+
+fn check_payload<T: ApplicationCommand>(payload: &[u8]) -> Result<(), CommandError> {
+    T::unmarshal(payload).map(|_| ())
+}
+
+#[derive(Clone)]
+struct Registration {
+    name: &'static str,
+    check: fn(&[u8]) -> Result<(), CommandError>,
+}
+
+/// The application commands a session accepts.
+#[derive(Clone, Default)]
+pub struct CommandRegistry {
+    commands: HashMap<u8, Registration>,
+}
+
+impl CommandRegistry {
+    pub fn new() -> CommandRegistry {
+        CommandRegistry::default()
+    }
+
+    /// Registers the command type T under name.
+    pub fn register<T: ApplicationCommand>(&mut self, name: &'static str) -> Result<(), RegistryError> {
+        if T::ID < MIN_APPLICATION_COMMAND_ID {
+            return Err(RegistryError::ReservedId);
+        }
+        if self.commands.contains_key(&T::ID) {
+            return Err(RegistryError::DuplicateId);
+        }
+        self.commands.insert(T::ID, Registration {
+            name,
+            check: check_payload::<T>,
+        });
+        Ok(())
+    }
+
+    /// Returns the registered command IDs in ascending order.
+    pub fn ids(&self) -> Vec<u8> {
+        let mut ids: Vec<u8> = self.commands.keys().cloned().collect();
+        ids.sort();
+        ids
+    }
+
+    pub fn is_registered(&self, id: u8) -> bool {
+        self.commands.contains_key(&id)
+    }
+
+    /// Returns the name an application command ID is registered under.
+    pub fn name(&self, id: u8) -> Option<&'static str> {
+        self.commands.get(&id).map(|x| x.name)
+    }
+
+    /// Checks that an application command is registered and that its
+    /// payload decodes. Other commands are always accepted.
+    pub fn check(&self, cmd: &Command) -> Result<(), CommandError> {
+        match cmd {
+            Command::Application{ id, payload } => match self.commands.get(id) {
+                Some(registration) => (registration.check)(payload),
+                None => Err(CommandError::UnregisteredCommand),
+            },
+            _ => Ok(()),
+        }
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use byteorder::{ByteOrder, BigEndian};
+
+    use super::*;
+
+    #[derive(PartialEq, Debug)]
+    struct Ping {
+        sequence: u32,
+    }
+
+    impl ApplicationCommand for Ping {
+        const ID: u8 = 200;
+
+        fn marshal(&self) -> Vec<u8> {
+            let mut out = vec![0u8; 4];
+            BigEndian::write_u32(&mut out, self.sequence);
+            out
+        }
+
+        fn unmarshal(payload: &[u8]) -> Result<Self, CommandError> {
+            if payload.len() != 4 {
+                return Err(CommandError::MessageDecodeError);
+            }
+            Ok(Ping{ sequence: BigEndian::read_u32(payload) })
+        }
+    }
+
+    struct Reserved;
+
+    impl ApplicationCommand for Reserved {
+        const ID: u8 = 7;
+
+        fn marshal(&self) -> Vec<u8> {
+            vec![]
+        }
+
+        fn unmarshal(_payload: &[u8]) -> Result<Self, CommandError> {
+            Ok(Reserved)
+        }
+    }
+
+    #[test]
+    fn registry_test() {
+        let mut registry = CommandRegistry::new();
+        registry.register::<Ping>("Ping").unwrap();
+        assert_eq!(registry.ids(), vec![200]);
+        assert_eq!(registry.name(200), Some("Ping"));
+        match registry.register::<Ping>("Ping") {
+            Err(RegistryError::DuplicateId) => {},
+            _ => panic!("expected a duplicate ID"),
+        }
+        match registry.register::<Reserved>("Reserved") {
+            Err(RegistryError::ReservedId) => {},
+            _ => panic!("expected a reserved ID"),
+        }
+
+        let cmd = Ping{ sequence: 42 }.to_command();
+        let decoded = Command::from_bytes(&cmd.to_vec()).unwrap();
+        assert_eq!(decoded, cmd);
+        registry.check(&decoded).unwrap();
+        assert_eq!(Ping::from_command(&decoded).unwrap().unwrap(), Ping{ sequence: 42 });
+        assert!(Ping::from_command(&Command::NoOp{}).is_none());
+
+        assert!(registry.check(&Command::Application{ id: 200, payload: vec![1] }).is_err());
+        match registry.check(&Command::Application{ id: 201, payload: vec![] }) {
+            Err(CommandError::UnregisteredCommand) => {},
+            _ => panic!("expected an unregistered command"),
+        }
+    }
+}
@@ -0,0 +1,183 @@
+// replay.rs - handshake replay cache
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+use std::collections::{HashMap, VecDeque};
+use std::time::{Duration, Instant};
+
+/// The most keys a ReplayCache remembers unless set with
+/// with_max_entries.
+pub const DEFAULT_MAX_ENTRIES: usize = 65536;
+
+/// ReplayCache remembers the initiator ephemeral keys seen by a
+/// responder within a time window so that replayed handshake
+/// messages can be rejected. A single cache is usually shared by
+/// every session of a server, see SessionConfig::replay_cache.
+///
+/// Keys are only recorded once the first handshake message decrypts.
+/// Where that message does not authenticate the initiator the key is
+/// recorded as unconfirmed until the handshake authenticates it, see
+/// insert_unconfirmed. Once the cache holds max_entries confirmed keys,
+/// or as many unconfirmed ones, the oldest of that kind is forgotten
+/// early to make room, so a flood of unauthenticated handshakes never
+/// evicts a confirmed key.
+#[derive(Debug)]
+pub struct ReplayCache {
+    window: Duration,
+    max_entries: usize,
+    // Each key remembered and whether it is confirmed.
+    seen: HashMap<Vec<u8>, bool>,
+    // Insertion order of confirmed keys, used to expire entries.
+    order: VecDeque<(Instant, Vec<u8>)>,
+    // Insertion order of unconfirmed keys, some of which may since have
+    // been confirmed.
+    unconfirmed: VecDeque<(Instant, Vec<u8>)>,
+}
+
+impl ReplayCache {
+    pub fn new(window: Duration) -> ReplayCache {
+        ReplayCache {
+            window,
+            max_entries: DEFAULT_MAX_ENTRIES,
+            seen: HashMap::new(),
+            order: VecDeque::new(),
+            unconfirmed: VecDeque::new(),
+        }
+    }
+
+    /// Sets the most keys remembered at once.
+    pub fn with_max_entries(mut self, max_entries: usize) -> Self {
+        self.max_entries = max_entries;
+        self
+    }
+
+    /// Records key as confirmed and returns true if it was not seen
+    /// within the window, or false if it is a replay.
+    pub fn insert(&mut self, key: &[u8]) -> bool {
+        let now = Instant::now();
+        self.expire(now);
+        if self.seen.contains_key(key) {
+            return false
+        }
+        self.push_confirmed(now, key);
+        true
+    }
+
+    /// Records key as unconfirmed and returns true if it was not seen
+    /// within the window, or false if it is a replay. Unconfirmed keys
+    /// only make room by forgetting other unconfirmed keys.
+    pub fn insert_unconfirmed(&mut self, key: &[u8]) -> bool {
+        let now = Instant::now();
+        self.expire(now);
+        if self.seen.contains_key(key) {
+            return false
+        }
+        while self.unconfirmed.len() >= self.max_entries.max(1) {
+            let (_, key) = self.unconfirmed.pop_front().unwrap();
+            if self.seen.get(&key) == Some(&false) {
+                self.seen.remove(&key);
+            }
+        }
+        self.seen.insert(key.to_vec(), false);
+        self.unconfirmed.push_back((now, key.to_vec()));
+        true
+    }
+
+    /// Confirms a key recorded with insert_unconfirmed once its
+    /// handshake authenticates. Keys forgotten meanwhile are recorded
+    /// again.
+    pub fn confirm(&mut self, key: &[u8]) {
+        let now = Instant::now();
+        self.expire(now);
+        if self.seen.get(key) != Some(&true) {
+            self.push_confirmed(now, key);
+        }
+    }
+
+    /// Returns the number of keys currently remembered.
+    pub fn len(&self) -> usize {
+        self.seen.len()
+    }
+
+    fn push_confirmed(&mut self, now: Instant, key: &[u8]) {
+        while self.order.len() >= self.max_entries.max(1) {
+            let (_, key) = self.order.pop_front().unwrap();
+            self.seen.remove(&key);
+        }
+        self.seen.insert(key.to_vec(), true);
+        self.order.push_back((now, key.to_vec()));
+    }
+
+    fn expire(&mut self, now: Instant) {
+        while let Some(&(seen_at, _)) = self.order.front() {
+            if now.duration_since(seen_at) < self.window {
+                break
+            }
+            let (_, key) = self.order.pop_front().unwrap();
+            self.seen.remove(&key);
+        }
+        while let Some(&(seen_at, _)) = self.unconfirmed.front() {
+            if now.duration_since(seen_at) < self.window {
+                break
+            }
+            let (_, key) = self.unconfirmed.pop_front().unwrap();
+            if self.seen.get(&key) == Some(&false) {
+                self.seen.remove(&key);
+            }
+        }
+    }
+}
+
+
+#[cfg(test)]
+mod tests {
+    use std::thread;
+    use std::time::Duration;
+
+    use super::ReplayCache;
+
+    #[test]
+    fn replay_cache_test() {
+        let mut cache = ReplayCache::new(Duration::from_millis(100));
+        assert!(cache.insert(&[1, 2, 3]));
+        assert!(cache.insert(&[4, 5, 6]));
+        assert!(!cache.insert(&[1, 2, 3]));
+        assert_eq!(cache.len(), 2);
+
+        thread::sleep(Duration::from_millis(150));
+        assert!(cache.insert(&[1, 2, 3]));
+        assert_eq!(cache.len(), 1);
+
+        let mut cache = ReplayCache::new(Duration::from_secs(60)).with_max_entries(2);
+        assert!(cache.insert(&[1]));
+        assert!(cache.insert(&[2]));
+        assert!(cache.insert(&[3]));
+        assert_eq!(cache.len(), 2);
+        assert!(!cache.insert(&[3]));
+        assert!(cache.insert(&[1]));
+
+        // unconfirmed keys never evict confirmed ones
+        let mut cache = ReplayCache::new(Duration::from_secs(60)).with_max_entries(2);
+        assert!(cache.insert_unconfirmed(&[1]));
+        cache.confirm(&[1]);
+        for i in 2..100u8 {
+            assert!(cache.insert_unconfirmed(&[i]));
+        }
+        assert_eq!(cache.len(), 3);
+        assert!(!cache.insert_unconfirmed(&[1]));
+        assert!(!cache.insert_unconfirmed(&[99]));
+        assert!(cache.insert_unconfirmed(&[2]));
+    }
+}
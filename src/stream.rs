@@ -0,0 +1,154 @@
+// stream.rs - byte stream adapter over a session
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Byte streams carried over a session in Data commands. A Stream
+//! tunnels stream oriented protocols over an authenticated link for
+//! the rest of the session, while send_stream and recv_stream move a
+//! single bulk transfer, such as a PKI document, after which the
+//! session carries commands again. Katzenpost does not know the Data
+//! command.
+
+use std::io;
+use std::io::prelude::*;
+
+use super::commands::{Command, MAX_DATA_SIZE};
+use super::errors::{ReceiveMessageError, SendMessageError};
+use super::sync::Session;
+
+/// An io::Read and io::Write adapter over a session in transport mode.
+pub struct Stream {
+    session: Session,
+    read_buffer: Vec<u8>,
+    read_offset: usize,
+    eof: bool,
+}
+
+fn receive_error(error: ReceiveMessageError) -> io::Error {
+    match error {
+        ReceiveMessageError::IOError(e) => e,
+        ReceiveMessageError::TimeoutError => io::Error::from(io::ErrorKind::TimedOut),
+        e => io::Error::new(io::ErrorKind::InvalidData, e.to_string()),
+    }
+}
+
+fn send_error(error: SendMessageError) -> io::Error {
+    match error {
+        SendMessageError::IOError(e) => e,
+        SendMessageError::TimeoutError => io::Error::from(io::ErrorKind::TimedOut),
+        e => io::Error::new(io::ErrorKind::Other, e.to_string()),
+    }
+}
+
+impl Stream {
+    pub fn new(session: Session) -> Stream {
+        Stream {
+            session,
+            read_buffer: vec![],
+            read_offset: 0,
+            eof: false,
+        }
+    }
+
+    pub fn session(&mut self) -> &mut Session {
+        &mut self.session
+    }
+
+    /// Returns the session, discarding any buffered unread data.
+    pub fn into_session(self) -> Session {
+        self.session
+    }
+}
+
+impl Read for Stream {
+    /// Reads data sent by the peer's Stream. Returns end of file once
+    /// the peer sends Disconnect or CloseWrite. NoOp commands are skipped and any
+    /// other command is an InvalidData error.
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        while self.read_offset == self.read_buffer.len() {
+            if self.eof || buf.is_empty() {
+                return Ok(0)
+            }
+            match self.session.recv_command().map_err(receive_error)? {
+                Command::Data{ payload } => {
+                    self.read_buffer = payload;
+                    self.read_offset = 0;
+                },
+                Command::Disconnect{..} | Command::CloseWrite{} => self.eof = true,
+                Command::NoOp{} => {},
+                _ => return Err(io::Error::new(io::ErrorKind::InvalidData, "unexpected command in stream")),
+            }
+        }
+        let n = buf.len().min(self.read_buffer.len() - self.read_offset);
+        buf[..n].copy_from_slice(&self.read_buffer[self.read_offset..self.read_offset + n]);
+        self.read_offset += n;
+        Ok(n)
+    }
+}
+
+impl Write for Stream {
+    /// Sends up to MAX_DATA_SIZE bytes of buf in one Data command.
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        if buf.is_empty() {
+            return Ok(0)
+        }
+        let n = buf.len().min(MAX_DATA_SIZE);
+        let cmd = Command::Data{ payload: buf[..n].to_vec() };
+        self.session.send_command(&cmd).map_err(send_error)?;
+        Ok(n)
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+/// Sends everything read from reader as Data commands followed by an
+/// empty Data command marking the end of the transfer, returning the
+/// number of bytes sent.
+pub fn send_stream<R: Read>(session: &mut Session, reader: &mut R) -> io::Result<u64> {
+    let mut chunk = vec![0u8; MAX_DATA_SIZE];
+    let mut total = 0u64;
+    loop {
+        let n = match reader.read(&mut chunk) {
+            Ok(0) => break,
+            Ok(n) => n,
+            Err(ref e) if e.kind() == io::ErrorKind::Interrupted => continue,
+            Err(e) => return Err(e),
+        };
+        session.send_command(&Command::Data{ payload: chunk[..n].to_vec() }).map_err(send_error)?;
+        total += n as u64;
+    }
+    session.send_command(&Command::Data{ payload: vec![] }).map_err(send_error)?;
+    Ok(total)
+}
+
+/// Receives a transfer sent with send_stream into writer, returning
+/// the number of bytes received. NoOp commands are skipped and any
+/// other command is an InvalidData error.
+pub fn recv_stream<W: Write>(session: &mut Session, writer: &mut W) -> io::Result<u64> {
+    let mut total = 0u64;
+    loop {
+        match session.recv_command().map_err(receive_error)? {
+            Command::Data{ ref payload } if payload.is_empty() => return Ok(total),
+            Command::Data{ payload } => {
+                writer.write_all(&payload)?;
+                total += payload.len() as u64;
+            },
+            Command::NoOp{} => {},
+            _ => return Err(io::Error::new(io::ErrorKind::InvalidData, "unexpected command in stream")),
+        }
+    }
+}
@@ -16,193 +16,2775 @@
 
 extern crate snow;
 extern crate x25519_dalek_ng;
+extern crate getrandom;
 
-use std::net::{TcpStream, Shutdown};
+use std::net::{SocketAddr, TcpStream, Shutdown, UdpSocket};
+use std::io;
 use std::io::prelude::*;
-use std::sync::{Arc, Mutex};
+use std::collections::{HashMap, VecDeque};
+use std::error::Error;
+use std::cmp;
+use std::mem;
+use std::sync::{Arc, Condvar, Mutex};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::mpsc::{channel, Receiver, TryRecvError};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 
-use super::commands::{Command};
-use super::errors::{HandshakeError, ReceiveMessageError, SendMessageError};
-use super::messages::{MessageBuilder, SessionConfig, PeerCredentials};
-use super::constants::{NOISE_HANDSHAKE_MESSAGE1_SIZE, NOISE_HANDSHAKE_MESSAGE2_SIZE,
-                       NOISE_HANDSHAKE_MESSAGE3_SIZE};
+use byteorder::{ByteOrder, BigEndian};
+use zeroize::Zeroizing;
+
+use super::constants::{NOISE_MESSAGE_MAX_SIZE, IMPLEMENTATION, PROTOCOL_VERSION};
+use super::commands::{Command, CommandRef, DISCONNECT_NORMAL, DISCONNECT_IDLE_TIMEOUT};
+use super::commands::{REAUTH_NONCE_SIZE, ECHO_COOKIE_SIZE, BATCH_ENTRY_OVERHEAD, push_batch_entry, batch_entries, command_ids,
+                      COMPRESSION_ZSTD, TRACE_ID_SIZE, DATAGRAM_KEY_SIZE};
+use super::errors::{CommandError, ErrorKind, HandshakeError, ReauthenticationError, ReceiveMessageError, SendMessageError};
+use super::stream::Stream;
+use super::mux::Mux;
+use super::datagram::DatagramChannel;
+use super::transport::Transport;
+use super::queue::{SendQueue, QueueLimits};
+use super::logger::Logger;
+use super::registry::CommandRegistry;
+use super::codec::{Codec, DefaultCodec, codec_for_version};
+use super::messages::{MessageBuilder, SessionConfig, PeerAuthenticator, PeerCredentials, RekeyPolicy, LinkParameters,
+                      HandshakeCompleteCallback, CloseCallback, TraceCallback, Direction, NegotiatedParameters,
+                      PeerAddresses, UnknownCommandPolicy};
 
 
 const MAC_LEN: usize = 16;
-const MAX_MSG_LEN: usize = 1_048_576;
+// The bytes a frame adds to its plaintext: the encrypted length
+// header and the MAC of the plaintext.
+const FRAME_OVERHEAD: usize = 4 + MAC_LEN + MAC_LEN;
+// The most the encoding of a Fragment or Batch command grows by from
+// an empty payload to one filling a frame, in any of the codecs.
+const LENGTH_SLACK: usize = 16;
+
+/// The lifecycle state of a session.
+#[derive(PartialEq, Debug, Clone, Copy)]
+pub enum SessionState {
+    Init,
+    Handshaking,
+    Established,
+    /// Closing, or closed for sending, but still receiving.
+    Draining,
+    Closed,
+}
+
+/// Traffic counters of a session, shared by its clones. Byte counts
+/// are of the bytes on the wire, including handshake messages, frame
+/// headers, MACs and padding. Commands are counted by name, see
+/// Command::name, including link control commands such as Rekey. A
+/// command sent in fragments or in a batch counts once under its own
+/// name as well as under Fragment or Batch.
+#[derive(Debug, Clone, Default)]
+pub struct SessionStats {
+    pub bytes_sent: u64,
+    pub bytes_received: u64,
+    pub commands_sent: HashMap<&'static str, u64>,
+    pub commands_received: HashMap<&'static str, u64>,
+    /// The time from starting the handshake until it was finalized.
+    pub handshake_duration: Option<Duration>,
+    /// The number of times either cipher state was rekeyed.
+    pub rekeys: u64,
+    /// When a command was last sent.
+    pub last_sent: Option<Instant>,
+    /// When a frame was last received.
+    pub last_received: Option<Instant>,
+    /// When a command other than NoOp was last sent or received, the
+    /// activity that holds off the idle timeout.
+    pub last_active: Option<Instant>,
+}
+
+/// What a peer reported about itself in a Version command, see
+/// Session::peer_version.
+#[derive(Debug, Clone, PartialEq)]
+pub struct PeerVersion {
+    /// The implementation name and version, such as "mix_link 0.2.0".
+    pub implementation: String,
+    /// The IDs of the commands the peer supports, including its
+    /// registered application commands.
+    pub commands: Vec<u8>,
+    /// The largest command the peer accepts.
+    pub max_message_size: u32,
+}
+
+// Round trip time samples taken with Echo commands.
+#[derive(Default)]
+struct RttEstimate {
+    next_cookie: u64,
+    outstanding: Option<([u8; ECHO_COOKIE_SIZE], Instant)>,
+    ping: Option<([u8; ECHO_COOKIE_SIZE], Instant)>,
+    smoothed: Option<Duration>,
+}
+
+// The commands sent with send_sequenced that the peer has not yet
+// acknowledged, and the last sequence number sent.
+#[derive(Default)]
+struct SequenceState {
+    last_sent: u64,
+    unacknowledged: VecDeque<(u64, Command)>,
+}
+
+// A command being reassembled from Fragment commands.
+struct Reassembly {
+    encoding: Vec<u8>,
+    total_size: usize,
+    started: Instant,
+}
+
+impl RttEstimate {
+    // Smooths samples as TCP does, see RFC 6298.
+    fn sample(&mut self, rtt: Duration) {
+        self.smoothed = Some(match self.smoothed {
+            Some(smoothed) => smoothed * 7 / 8 + rtt / 8,
+            None => rtt,
+        });
+    }
+}
+
+/// A handshake running on its own thread, see Session::initialize_async.
+pub struct PendingHandshake {
+    result: Receiver<Result<Session, HandshakeError>>,
+    transport: Box<dyn Transport>,
+}
+
+fn handshake_thread_exited() -> HandshakeError {
+    HandshakeError::IOError(io::Error::new(io::ErrorKind::Other, "handshake thread exited"))
+}
+
+impl PendingHandshake {
+    /// Returns the outcome of the handshake if it has finished, or
+    /// None if it is still running. The outcome is returned once.
+    pub fn poll(&mut self) -> Option<Result<Session, HandshakeError>> {
+        match self.result.try_recv() {
+            Ok(x) => Some(x),
+            Err(TryRecvError::Empty) => None,
+            Err(TryRecvError::Disconnected) => Some(Err(handshake_thread_exited())),
+        }
+    }
+
+    /// Blocks until the handshake finishes.
+    pub fn wait(self) -> Result<Session, HandshakeError> {
+        match self.result.recv() {
+            Ok(x) => x,
+            Err(_) => Err(handshake_thread_exited()),
+        }
+    }
+
+    /// Aborts the handshake by shutting down the transport. The
+    /// handshake then fails with an IOError.
+    pub fn cancel(&self) {
+        let _ = self.transport.shutdown(Shutdown::Both);
+    }
+}
 
 /// A mixnet link layer protocol session.
 pub struct Session {
-    reader_tcp_stream: Option<TcpStream>,
-    writer_tcp_stream: Option<TcpStream>,
+    // Random, shared by clones, for correlating log events.
+    id: u64,
+    reader_transport: Option<Box<dyn Transport>>,
+    writer_transport: Option<Box<dyn Transport>>,
     is_initiator: bool,
     handshake_builder: Option<MessageBuilder>,
     transport_builder: Option<Arc<Mutex<MessageBuilder>>>,
+    early_command: Option<Command>,
+    // Bytes to write ahead of the next frame: the initiator's final
+    // handshake message, held back so that it can be written together
+    // with the early command, or the rest of a frame whose write
+    // missed the write deadline. Shared by clones, and locked while a
+    // frame is encrypted and written so that frames from clones on
+    // different threads are written whole and in nonce order.
+    pending_write: Arc<Mutex<Vec<u8>>>,
+    handshake_timeout: Option<Duration>,
+    handshake_deadline: Option<Instant>,
+    rejection_delay: Option<Duration>,
+    // Commands received while waiting for a reauthentication response,
+    // with their trace IDs.
+    received_commands: VecDeque<(Command, Option<[u8; TRACE_ID_SIZE]>)>,
+    link_parameters: Option<LinkParameters>,
+    peer_parameters: Option<LinkParameters>,
+    // Deadlines applied to each socket operation of a command.
+    read_deadline: Option<Instant>,
+    write_deadline: Option<Instant>,
+    // The part of the next frame read before the read deadline, and
+    // its length once the frame header is decrypted.
+    read_buffer: Vec<u8>,
+    frame_len: Option<usize>,
+    // Set by close_gracefully, shared by clones.
+    closing: Arc<AtomicBool>,
+    // Each state entered and when, shared by clones.
+    state_transitions: Arc<Mutex<Vec<(SessionState, Instant)>>>,
+    on_handshake_complete: Option<HandshakeCompleteCallback>,
+    on_close: Option<CloseCallback>,
+    stats: Arc<Mutex<SessionStats>>,
+    rtt: Arc<Mutex<RttEstimate>>,
+    logger: Option<Arc<dyn Logger>>,
+    trace: Option<TraceCallback>,
+    keepalive_interval: Option<Duration>,
+    idle_timeout: Option<Duration>,
+    // Set when the idle timer closes the session, shared by clones.
+    idle_closed: Arc<AtomicBool>,
+    // Whether receiving is paused, shared by clones.
+    paused: Arc<(Mutex<bool>, Condvar)>,
+    command_registry: Option<Arc<CommandRegistry>>,
+    codec: Arc<dyn Codec>,
+    // The codec from the config, overriding the version's codec.
+    configured_codec: Option<Arc<dyn Codec>>,
+    max_command_size: usize,
+    reassembly_timeout: Option<Duration>,
+    // The fragments received so far of the next command.
+    reassembly: Option<Reassembly>,
+    // The rest of the commands of a received Batch, with their trace
+    // IDs.
+    batched_commands: VecDeque<(Command, Option<[u8; TRACE_ID_SIZE]>)>,
+    // The trace ID of the command last received, see received_trace_id.
+    received_trace_id: Option<[u8; TRACE_ID_SIZE]>,
+    // Shared by clones. Sequence numbers are assigned under the
+    // pending_write lock so that they go out in order.
+    sequences: Arc<Mutex<SequenceState>>,
+    last_sequence_received: Option<u64>,
+    flow_control: bool,
+    // The SendPacket commands the peer has granted credits for,
+    // shared by clones.
+    credits: Arc<(Mutex<u64>, Condvar)>,
+    compression_threshold: Option<usize>,
+    // The largest command the peer accepts compressed, once it has
+    // sent AcceptCompression, shared by clones.
+    peer_compression: Arc<Mutex<Option<usize>>>,
+    unknown_command_policy: UnknownCommandPolicy,
+}
+
+// Returns the socket timeout for what remains until the deadline.
+fn remaining(deadline: Option<Instant>) -> io::Result<Option<Duration>> {
+    match deadline {
+        Some(deadline) => {
+            let now = Instant::now();
+            if now >= deadline {
+                return Err(io::Error::new(io::ErrorKind::TimedOut, "deadline exceeded"))
+            }
+            Ok(Some(deadline - now))
+        },
+        None => Ok(None),
+    }
+}
+
+// Sets the socket timeouts to what remains until the deadline.
+fn set_deadline(transport: &dyn Transport, deadline: Option<Instant>) -> Result<(), HandshakeError> {
+    let timeout = remaining(deadline)?;
+    transport.set_read_timeout(timeout)?;
+    transport.set_write_timeout(timeout)?;
+    Ok(())
+}
+
+fn is_timeout(error: &io::Error) -> bool {
+    error.kind() == io::ErrorKind::WouldBlock || error.kind() == io::ErrorKind::TimedOut
+}
+
+// Returns true if cmd carries other commands or acknowledges one.
+// Sequenced and Traced commands must carry neither, so that a peer
+// cannot nest them to recurse without bound.
+fn is_wrapper(cmd: &Command) -> bool {
+    match cmd {
+        Command::Sequenced{..} | Command::Ack{..} | Command::Traced{..} | Command::Batch{..} |
+        Command::Fragment{..} | Command::Compressed{..} => true,
+        _ => false,
+    }
+}
+
+// Reports socket timeouts during the handshake as TimeoutError.
+fn handshake_timeout_error(error: HandshakeError) -> HandshakeError {
+    match error {
+        HandshakeError::IOError(ref e) if is_timeout(e) => HandshakeError::TimeoutError,
+        HandshakeError::ReceiveMessageError(ReceiveMessageError::IOError(ref e)) if is_timeout(e) => HandshakeError::TimeoutError,
+        HandshakeError::SendMessageError(SendMessageError::IOError(ref e)) if is_timeout(e) => HandshakeError::TimeoutError,
+        e => e,
+    }
+}
+
+// Returns encoding compressed with zstd. Without the compression
+// feature sessions are never configured to compress.
+#[cfg(feature = "compression")]
+fn compress(encoding: &[u8]) -> Option<Vec<u8>> {
+    zstd::bulk::compress(encoding, 0).ok()
+}
+
+#[cfg(not(feature = "compression"))]
+fn compress(_encoding: &[u8]) -> Option<Vec<u8>> {
+    None
+}
+
+// Returns payload decompressed with zstd, of at most size bytes.
+#[cfg(feature = "compression")]
+fn decompress(payload: &[u8], size: usize) -> Option<Vec<u8>> {
+    zstd::bulk::decompress(payload, size).ok()
+}
+
+#[cfg(not(feature = "compression"))]
+fn decompress(_payload: &[u8], _size: usize) -> Option<Vec<u8>> {
+    None
 }
 
 impl Clone for Session {
     fn clone(&self) -> Session {
         Session {
-            reader_tcp_stream: Some(self.reader_tcp_stream.as_ref().unwrap().try_clone().unwrap()),
-            writer_tcp_stream: Some(self.writer_tcp_stream.as_ref().unwrap().try_clone().unwrap()),
+            id: self.id,
+            reader_transport: Some(self.reader_transport.as_ref().unwrap().try_clone_transport().unwrap()),
+            writer_transport: Some(self.writer_transport.as_ref().unwrap().try_clone_transport().unwrap()),
             is_initiator: self.is_initiator,
             handshake_builder: None,
             transport_builder: self.transport_builder.clone(),
+            early_command: None,
+            pending_write: self.pending_write.clone(),
+            handshake_timeout: self.handshake_timeout,
+            handshake_deadline: None,
+            rejection_delay: self.rejection_delay,
+            received_commands: VecDeque::new(),
+            link_parameters: self.link_parameters,
+            peer_parameters: self.peer_parameters,
+            read_deadline: None,
+            write_deadline: None,
+            read_buffer: vec![],
+            frame_len: None,
+            closing: self.closing.clone(),
+            state_transitions: self.state_transitions.clone(),
+            on_handshake_complete: self.on_handshake_complete.clone(),
+            on_close: self.on_close.clone(),
+            stats: self.stats.clone(),
+            rtt: self.rtt.clone(),
+            logger: self.logger.clone(),
+            trace: self.trace.clone(),
+            keepalive_interval: self.keepalive_interval,
+            idle_timeout: self.idle_timeout,
+            idle_closed: self.idle_closed.clone(),
+            paused: self.paused.clone(),
+            command_registry: self.command_registry.clone(),
+            codec: self.codec.clone(),
+            configured_codec: self.configured_codec.clone(),
+            max_command_size: self.max_command_size,
+            reassembly_timeout: self.reassembly_timeout,
+            reassembly: None,
+            batched_commands: VecDeque::new(),
+            received_trace_id: None,
+            sequences: self.sequences.clone(),
+            last_sequence_received: None,
+            flow_control: self.flow_control,
+            credits: self.credits.clone(),
+            compression_threshold: self.compression_threshold,
+            peer_compression: self.peer_compression.clone(),
+            unknown_command_policy: self.unknown_command_policy.clone(),
         }
     }
 }
 
 impl Session {
     pub fn new(cfg: SessionConfig, is_initiator: bool) -> Result<Session, HandshakeError> {
+        let handshake_timeout = cfg.handshake_timeout;
+        let link_parameters = cfg.link_parameters;
+        let rejection_delay = cfg.rejection_delay;
+        let on_handshake_complete = cfg.on_handshake_complete.clone();
+        let on_close = cfg.on_close.clone();
+        let logger = cfg.logger.clone();
+        let trace = cfg.trace.clone();
+        let command_registry = cfg.command_registry.clone();
+        let configured_codec = cfg.codec.clone();
+        let keepalive_interval = cfg.keepalive_interval;
+        let idle_timeout = cfg.idle_timeout;
+        let max_command_size = cfg.max_command_size;
+        let reassembly_timeout = cfg.reassembly_timeout;
+        let flow_control = cfg.flow_control;
+        let compression_threshold = cfg.compression_threshold;
+        let unknown_command_policy = cfg.unknown_command_policy.clone();
+        let mut id = [0u8; 8];
+        if getrandom::getrandom(&mut id).is_err() {
+            return Err(HandshakeError::RandomError);
+        }
         Ok(Session{
-            writer_tcp_stream: None,
-            reader_tcp_stream: None,
+            id: BigEndian::read_u64(&id),
+            writer_transport: None,
+            reader_transport: None,
             is_initiator,
             handshake_builder: Some(MessageBuilder::new(cfg, is_initiator)?),
             transport_builder: None,
+            early_command: None,
+            pending_write: Arc::new(Mutex::new(vec![])),
+            handshake_timeout,
+            handshake_deadline: None,
+            rejection_delay,
+            received_commands: VecDeque::new(),
+            link_parameters,
+            peer_parameters: None,
+            read_deadline: None,
+            write_deadline: None,
+            read_buffer: vec![],
+            frame_len: None,
+            closing: Arc::new(AtomicBool::new(false)),
+            state_transitions: Arc::new(Mutex::new(vec![(SessionState::Init, Instant::now())])),
+            on_handshake_complete,
+            on_close,
+            stats: Arc::new(Mutex::new(SessionStats::default())),
+            rtt: Arc::new(Mutex::new(RttEstimate::default())),
+            logger,
+            trace,
+            keepalive_interval,
+            idle_timeout,
+            idle_closed: Arc::new(AtomicBool::new(false)),
+            paused: Arc::new((Mutex::new(false), Condvar::new())),
+            command_registry,
+            codec: Arc::new(DefaultCodec),
+            configured_codec,
+            max_command_size,
+            reassembly_timeout,
+            reassembly: None,
+            batched_commands: VecDeque::new(),
+            received_trace_id: None,
+            sequences: Arc::new(Mutex::new(SequenceState::default())),
+            last_sequence_received: None,
+            flow_control,
+            credits: Arc::new((Mutex::new(0), Condvar::new())),
+            compression_threshold,
+            peer_compression: Arc::new(Mutex::new(None)),
+            unknown_command_policy,
         })
     }
 
+    /// Returns the session's random identifier, which its clones
+    /// share, for correlating events of one link in logs.
+    pub fn id(&self) -> u64 {
+        self.id
+    }
+
+    fn log<F: FnOnce(&dyn Logger)>(&self, f: F) {
+        if let Some(ref logger) = self.logger {
+            f(&**logger);
+        }
+    }
+
+    // Records entering state, returning false if already in it.
+    fn set_state(&self, state: SessionState) -> bool {
+        let mut state_transitions = self.state_transitions.lock().unwrap();
+        if state_transitions.last().map(|x| x.0) == Some(state) {
+            return false;
+        }
+        state_transitions.push((state, Instant::now()));
+        true
+    }
+
+    /// Returns the current lifecycle state.
+    pub fn state(&self) -> SessionState {
+        self.state_transitions.lock().unwrap().last().unwrap().0
+    }
+
+    /// Returns each state the session has entered, with the time it
+    /// was entered, oldest first.
+    pub fn state_transitions(&self) -> Vec<(SessionState, Instant)> {
+        self.state_transitions.lock().unwrap().clone()
+    }
+
     fn handshake(&mut self) -> Result<(), HandshakeError>{
-        let tcp_reader = self.reader_tcp_stream.as_mut().unwrap();
-        let tcp_writer = self.writer_tcp_stream.as_mut().unwrap();
+        let tcp_reader = self.reader_transport.as_mut().unwrap();
+        let tcp_writer = self.writer_transport.as_mut().unwrap();
         let factory = self.handshake_builder.as_mut().unwrap();
+        let deadline = self.handshake_deadline;
+        let three_way = factory.pattern().message_count() == 3;
+        let mut stats = self.stats.lock().unwrap();
         if self.is_initiator {
             // -> (prologue), e, e1
             let client_handshake1 = factory.client_handshake1()?;
+            set_deadline(&**tcp_writer, deadline)?;
             tcp_writer.write_all(&client_handshake1)?;
             factory.sent_client_handshake1();
+            stats.bytes_sent += client_handshake1.len() as u64;
 
 	    // <- e, ee, ekem1, s, es, (auth)
-            let mut server_handshake1 = [0; NOISE_HANDSHAKE_MESSAGE2_SIZE];
+            let mut server_handshake1 = vec![0u8; factory.handshake_message_size(1)];
+            set_deadline(&**tcp_reader, deadline)?;
             tcp_reader.read_exact(&mut server_handshake1)?;
-            factory.received_server_handshake1(server_handshake1)?;
+            stats.bytes_received += server_handshake1.len() as u64;
+            factory.received_server_handshake1(&server_handshake1)?;
 
-	    // -> s, se, (auth)
-            let client_handshake2 = factory.client_handshake2()?;
-            tcp_writer.write_all(&client_handshake2)?;
-            factory.sent_client_handshake2();
+            if three_way {
+                // -> s, se, (auth)
+                let client_handshake2 = factory.client_handshake2()?;
+                if self.early_command.is_some() {
+                    *self.pending_write.lock().unwrap() = client_handshake2;
+                } else {
+                    set_deadline(&**tcp_writer, deadline)?;
+                    tcp_writer.write_all(&client_handshake2)?;
+                    stats.bytes_sent += client_handshake2.len() as u64;
+                }
+                factory.sent_client_handshake2();
+            }
         } else {
 	    // -> (prologue), e, e1
-            let mut client_handshake1 = [0u8; NOISE_HANDSHAKE_MESSAGE1_SIZE];
+            let mut client_handshake1 = vec![0u8; factory.handshake_message_size(0)];
+            set_deadline(&**tcp_reader, deadline)?;
             tcp_reader.read_exact(&mut client_handshake1)?;
-            let server_handshake1 = factory.received_client_handshake1(client_handshake1).unwrap();
+            stats.bytes_received += client_handshake1.len() as u64;
+            let server_handshake1 = factory.received_client_handshake1(&client_handshake1)?;
 
 	    // <- e, ee, ekem1, s, es, (auth)
+            set_deadline(&**tcp_writer, deadline)?;
             tcp_writer.write_all(&server_handshake1)?;
             factory.sent_server_handshake1();
+            stats.bytes_sent += server_handshake1.len() as u64;
 
-	    // -> s, se, (auth)
-            let mut client_handshake2 = [0u8; NOISE_HANDSHAKE_MESSAGE3_SIZE];
-            tcp_reader.read_exact(&mut client_handshake2)?;
-            factory.received_client_handshake2(client_handshake2).unwrap();
+            if three_way {
+                // -> s, se, (auth)
+                let mut client_handshake2 = vec![0u8; factory.handshake_message_size(2)];
+                set_deadline(&**tcp_reader, deadline)?;
+                tcp_reader.read_exact(&mut client_handshake2)?;
+                stats.bytes_received += client_handshake2.len() as u64;
+                factory.received_client_handshake2(&client_handshake2)?;
+            }
         }
+        // Leave the socket blocking until finalization.
+        set_deadline(&**tcp_writer, None)?;
         Ok(())
     }
 
     pub fn finalize_handshake(&mut self) -> Result<(), HandshakeError>{
+        set_deadline(&**self.writer_transport.as_ref().unwrap(), self.handshake_deadline)?;
+        if let Err(e) = self.finalize() {
+            let e = handshake_timeout_error(e);
+            self.log(|l| l.warning(self.id, &format!("handshake finalization failed: {}", e)));
+            self.destroy_with_error(Some(&e));
+            return Err(e);
+        }
+        set_deadline(&**self.writer_transport.as_ref().unwrap(), None)?;
+        self.handshake_deadline = None;
+        self.set_state(SessionState::Established);
+        let started = self.state_transitions.lock().unwrap().iter().find(|x| x.0 == SessionState::Handshaking).map(|x| x.1);
+        self.stats.lock().unwrap().handshake_duration = started.map(|x| x.elapsed());
+        self.log(|l| l.debug(self.id, "session established"));
+        if let Some(interval) = self.keepalive_interval {
+            self.start_keepalive(interval);
+        }
+        if let Some(timeout) = self.idle_timeout {
+            self.start_idle_timer(timeout);
+        }
+        if let Some(ref callback) = self.on_handshake_complete {
+            let builder = self.transport_builder.as_ref().unwrap().lock().unwrap();
+            if let Some(peer_credentials) = builder.peer_credentials() {
+                callback(self.id, peer_credentials);
+            }
+        }
+        Ok(())
+    }
+
+    // Sends a NoOp whenever nothing was sent for interval, until the
+    // session stops being established. The thread holds a clone of
+    // the session, which it drops within interval of the session
+    // closing.
+    fn start_keepalive(&self, interval: Duration) {
+        let mut session = self.clone();
+        let started = Instant::now();
+        thread::spawn(move|| {
+            loop {
+                let last_sent = session.stats.lock().unwrap().last_sent.unwrap_or(started);
+                let idle = last_sent.elapsed();
+                if idle < interval {
+                    thread::sleep(interval - idle);
+                    continue
+                }
+                if session.state() != SessionState::Established || session.send_command(&Command::NoOp{}).is_err() {
+                    return
+                }
+            }
+        });
+    }
+
+    // Closes the session, telling the peer, once no command other than
+    // NoOp was sent or received for timeout.
+    fn start_idle_timer(&self, timeout: Duration) {
+        let mut session = self.clone();
+        let started = Instant::now();
+        thread::spawn(move|| {
+            loop {
+                let last_active = session.stats.lock().unwrap().last_active.map_or(started, |x| x.max(started));
+                let idle = last_active.elapsed();
+                if idle < timeout {
+                    thread::sleep(timeout - idle);
+                    continue
+                }
+                if session.state() == SessionState::Closed {
+                    return
+                }
+                session.idle_closed.store(true, Ordering::SeqCst);
+                session.closing.store(true, Ordering::SeqCst);
+                session.write_deadline = Some(Instant::now() + Duration::from_secs(1));
+                // Katzenpost's Disconnect carries no reason.
+                let reason = if session.is_katzenpost() { DISCONNECT_NORMAL } else { DISCONNECT_IDLE_TIMEOUT };
+                let _ = session.write_command(&Command::Disconnect{ reason });
+                session.destroy_with_error(Some(&ReceiveMessageError::IdleTimeout));
+                return
+            }
+        });
+    }
+
+    fn finalize(&mut self) -> Result<(), HandshakeError>{
+        // The peer's AcceptCompression is handled whenever it arrives,
+        // so peers need not agree on compression.
+        if self.compression_threshold.is_some() && !self.is_katzenpost() {
+            let max_size = cmp::min(self.max_command_size, u32::max_value() as usize) as u32;
+            self.send_command(&Command::AcceptCompression{ max_size })?;
+        }
+        if let Some(ours) = self.link_parameters {
+            self.exchange_link_parameters(ours)?;
+        }
         if self.is_initiator {
-            let cmd = self.recv_command().unwrap();
+            let cmd = self.recv_command()?;
             match cmd {
                 Command::NoOp{} => return Ok(()),
                 _ => return Err(HandshakeError::InvalidHandshakeFinalize),
             }
         }
         let cmd = Command::NoOp{};
-        self.send_command(&cmd).unwrap();
+        self.send_command(&cmd)?;
+        Ok(())
+    }
+
+    // Both peers send their parameters before reading the other's,
+    // so neither side waits on the other.
+    fn exchange_link_parameters(&mut self, ours: LinkParameters) -> Result<(), HandshakeError> {
+        let cmd = Command::LinkParameters{
+            max_packet_size: ours.max_packet_size,
+            forward_payload_size: ours.forward_payload_size,
+        };
+        self.send_command(&cmd)?;
+        let theirs = match self.recv_command()? {
+            Command::LinkParameters{max_packet_size, forward_payload_size} => LinkParameters {
+                max_packet_size,
+                forward_payload_size,
+            },
+            _ => return Err(HandshakeError::InvalidHandshakeFinalize),
+        };
+        self.peer_parameters = Some(theirs);
+        if theirs != ours {
+            return Err(HandshakeError::LinkParametersMismatch);
+        }
         Ok(())
     }
-        
+
+    /// Starts the handshake like initialize_transport on a new thread
+    /// and returns at once. The session is handed back by the pending
+    /// handshake once it finishes. The handshake timeout still applies,
+    /// and PendingHandshake::cancel aborts the handshake early.
+    pub fn initialize_async<T: Transport + 'static>(mut self, transport: T) -> Result<PendingHandshake, HandshakeError>{
+        let handle = transport.try_clone_transport()?;
+        let (result_tx, result_rx) = channel();
+        thread::spawn(move|| {
+            let result = self.initialize_until(Box::new(transport), None).map(|_| self);
+            let _ = result_tx.send(result);
+        });
+        Ok(PendingHandshake {
+            result: result_rx,
+            transport: handle,
+        })
+    }
+
     pub fn initialize(&mut self, tcp_stream: TcpStream) -> Result<(), HandshakeError>{
-        let reader_tcp_stream = tcp_stream.try_clone()?;
-        self.reader_tcp_stream = Some(reader_tcp_stream);
-        self.writer_tcp_stream = Some(tcp_stream);
-        self.handshake()?;
+        self.initialize_until(Box::new(tcp_stream), None)
+    }
+
+    /// Initializes the session like initialize, over any transport.
+    pub fn initialize_transport<T: Transport + 'static>(&mut self, transport: T) -> Result<(), HandshakeError>{
+        self.initialize_until(Box::new(transport), None)
+    }
+
+    /// Initializes the session like initialize, failing with
+    /// TimeoutError if the handshake, including finalization, is not
+    /// done by deadline. The configured handshake_timeout still
+    /// applies if it expires first.
+    pub fn initialize_with_deadline(&mut self, tcp_stream: TcpStream, deadline: Instant) -> Result<(), HandshakeError>{
+        self.initialize_until(Box::new(tcp_stream), Some(deadline))
+    }
+
+    fn initialize_until(&mut self, transport: Box<dyn Transport>, deadline: Option<Instant>) -> Result<(), HandshakeError>{
+        if let Some(ref mut builder) = self.handshake_builder {
+            builder.set_addresses(PeerAddresses {
+                local: transport.local_addr(),
+                remote: transport.peer_addr(),
+                process: transport.peer_process(),
+            });
+        }
+        self.reader_transport = Some(transport.try_clone_transport()?);
+        self.writer_transport = Some(transport);
+        self.set_state(SessionState::Handshaking);
+        let started = Instant::now();
+        self.handshake_deadline = match (self.handshake_timeout.map(|x| started + x), deadline) {
+            (Some(a), Some(b)) => Some(a.min(b)),
+            (a, b) => a.or(b),
+        };
+        if let Err(e) = self.handshake() {
+            if !self.is_initiator {
+                if let Some(delay) = self.rejection_delay {
+                    let elapsed = started.elapsed();
+                    if elapsed < delay {
+                        thread::sleep(delay - elapsed);
+                    }
+                }
+            }
+            let e = handshake_timeout_error(e);
+            self.log(|l| l.warning(self.id, &format!("handshake failed: {}", e)));
+            self.destroy_with_error(Some(&e));
+            return Err(e);
+        }
         Ok(())
     }
 
+    /// Initializes an initiator session like initialize, sending cmd
+    /// along with the final handshake message when the session enters
+    /// transport mode, instead of waiting for handshake finalization.
+    ///
+    /// The early command is sent before the responder has accepted
+    /// the session and is lost if it does not, in which case the
+    /// client cannot tell whether it was processed and may resend it
+    /// on a new session. Only idempotent commands are allowed.
+    pub fn initialize_with_early_command(&mut self, tcp_stream: TcpStream, cmd: Command) -> Result<(), HandshakeError> {
+        if !self.is_initiator || !cmd.is_idempotent() {
+            return Err(HandshakeError::InvalidEarlyCommand);
+        }
+        self.early_command = Some(cmd);
+        self.initialize(tcp_stream)
+    }
+
     pub fn into_transport_mode(mut self) -> Result<Self, HandshakeError> {
-        Ok(Self {
-            reader_tcp_stream: self.reader_tcp_stream,
-            writer_tcp_stream: self.writer_tcp_stream,
+        let early_command = self.early_command.take();
+        let builder = self.handshake_builder.take().unwrap();
+        let codec = match self.configured_codec {
+            Some(ref codec) => codec.clone(),
+            None => codec_for_version(builder.protocol_version()),
+        };
+        let mut session = Self {
+            id: self.id,
+            reader_transport: self.reader_transport,
+            writer_transport: self.writer_transport,
             is_initiator: self.is_initiator,
             handshake_builder: None,
-            transport_builder: Some(Arc::new(Mutex::new(self.handshake_builder.take().unwrap().into_transport_mode()?))),
-        })
+            transport_builder: Some(Arc::new(Mutex::new(builder.into_transport_mode()?))),
+            early_command: None,
+            pending_write: self.pending_write,
+            handshake_timeout: self.handshake_timeout,
+            handshake_deadline: self.handshake_deadline,
+            rejection_delay: self.rejection_delay,
+            received_commands: VecDeque::new(),
+            link_parameters: self.link_parameters,
+            peer_parameters: None,
+            read_deadline: None,
+            write_deadline: None,
+            read_buffer: vec![],
+            frame_len: None,
+            closing: self.closing,
+            state_transitions: self.state_transitions,
+            on_handshake_complete: self.on_handshake_complete,
+            on_close: self.on_close,
+            stats: self.stats,
+            rtt: self.rtt,
+            logger: self.logger,
+            trace: self.trace,
+            keepalive_interval: self.keepalive_interval,
+            idle_timeout: self.idle_timeout,
+            idle_closed: self.idle_closed,
+            paused: self.paused,
+            command_registry: self.command_registry,
+            codec,
+            configured_codec: self.configured_codec,
+            max_command_size: self.max_command_size,
+            reassembly_timeout: self.reassembly_timeout,
+            reassembly: None,
+            batched_commands: VecDeque::new(),
+            received_trace_id: None,
+            sequences: self.sequences,
+            last_sequence_received: None,
+            flow_control: self.flow_control,
+            credits: self.credits,
+            compression_threshold: self.compression_threshold,
+            peer_compression: self.peer_compression,
+            unknown_command_policy: self.unknown_command_policy,
+        };
+        if let Some(cmd) = early_command {
+            session.send_command(&cmd)?;
+        }
+        Ok(session)
     }
 
+    /// Sends cmd. Clones of a session may send from different threads
+    /// at once; their frames are serialized. A command too large for
+    /// one frame is sent as Fragment commands, which the peer's
+    /// session reassembles. If a write deadline set with
+    /// set_write_deadline passes, TimeoutError is returned and the
+    /// unwritten part of the frame is kept and written ahead of the
+    /// next command, so the session remains usable.
     pub fn send_command(&mut self, cmd: &Command) -> Result<(), SendMessageError> {
-        let ct = cmd.to_vec();
-        let ct_len = MAC_LEN + ct.len();
-        if ct_len > MAX_MSG_LEN {
+        self.send_with(|session| session.write_command(cmd))
+    }
+
+    // Sends with write unless the session is closing, mapping socket
+    // timeouts to TimeoutError.
+    fn send_with<T, F: FnOnce(&mut Self) -> Result<T, SendMessageError>>(&mut self, write: F) -> Result<T, SendMessageError> {
+        if self.closing.load(Ordering::SeqCst) {
+            return Err(SendMessageError::SessionClosed);
+        }
+        match write(self) {
+            Err(SendMessageError::IOError(ref e)) if is_timeout(e) => Err(SendMessageError::TimeoutError),
+            result => result,
+        }
+    }
+
+    /// Sends cmds in order like send_command, packing consecutive
+    /// small commands into Batch commands, which the peer's session
+    /// splits back out. Each batch fills one frame, saving the frame
+    /// header and MACs of every other command in it, which adds up on
+    /// links sending many acknowledgements or control commands. The
+    /// frames of cmds are written back to back.
+    pub fn send_commands(&mut self, cmds: &[Command]) -> Result<(), SendMessageError> {
+        self.send_with(|session| session.write_commands(cmds))
+    }
+
+    /// Returns a Padding command which is sent in a frame of exactly
+    /// frame_size bytes with this session's codec, or None if no
+    /// command is. A frame sent after the outgoing cipher state is
+    /// rekeyed is preceded by a Rekey frame.
+    pub fn padding_for_frame(&self, frame_size: usize) -> Option<Command> {
+        let target = frame_size.checked_sub(FRAME_OVERHEAD)?;
+        if MAC_LEN + target > NOISE_MESSAGE_MAX_SIZE {
+            return None
+        }
+        let mut size = target.checked_sub(self.codec.encode(&Command::Padding{ size: 0 }).len())?;
+        // Codecs encoding the size in a variable length may grow by
+        // more than the padding does.
+        loop {
+            let padding = Command::Padding{ size: size as u32 };
+            let len = self.codec.encode(&padding).len();
+            if len == target {
+                return Some(padding)
+            }
+            size = size.checked_sub(len.checked_sub(target)?)?;
+        }
+    }
+
+    /// Sends sphinx_packet in a SendPacket command like send_command,
+    /// but encodes it straight from the caller's buffer rather than
+    /// first copying it into a Command. The default codec copies the
+    /// packet once, into the frame plaintext.
+    pub fn send_packet(&mut self, sphinx_packet: &[u8]) -> Result<(), SendMessageError> {
+        self.send_with(|session| {
+            session.take_packet_credits(1)?;
+            let encoding = session.codec.encode_ref(&CommandRef::SendPacket{ sphinx_packet });
+            let mut frames = vec![];
+            let mut carried = vec![];
+            session.push_command_frames("SendPacket", encoding, &mut frames, &mut carried)?;
+            session.write_frames(frames, &carried)
+        })
+    }
+
+    /// Sends cmd in a Sequenced command numbered with the next
+    /// sequence number, which is returned. Sequence numbers start at 1
+    /// and are shared by clones. The peer's session acknowledges the
+    /// command once its recv_command returns it, and until then it is
+    /// listed by unacknowledged, so that callers can tell which
+    /// commands the peer never processed, for example to resend them
+    /// over a new session. A command whose write fails is listed too.
+    pub fn send_sequenced(&mut self, cmd: &Command) -> Result<u64, SendMessageError> {
+        self.send_with(|session| {
+            session.take_credits(::std::slice::from_ref(cmd))?;
+            // Numbering under the pending_write lock sends sequence
+            // numbers in order. The sequences lock is released before
+            // writing, as the receiving side takes it for each Ack.
+            let pending_write = session.pending_write.clone();
+            let mut pending_write = pending_write.lock().unwrap();
+            let sequence = {
+                let mut sequences = session.sequences.lock().unwrap();
+                let sequence = sequences.last_sent + 1;
+                sequences.last_sent = sequence;
+                sequences.unacknowledged.push_back((sequence, cmd.clone()));
+                sequence
+            };
+            let sequenced = Command::Sequenced{ sequence, command: session.codec.encode(cmd) };
+            session.check_supported(&sequenced)?;
+            let mut frames = vec![];
+            let mut carried = vec![cmd.name()];
+            session.push_command_frames(sequenced.name(), session.codec.encode(&sequenced), &mut frames, &mut carried)?;
+            session.write_frames_locked(&mut pending_write, frames, &carried)?;
+            Ok(sequence)
+        })
+    }
+
+    /// Sends cmd in a Traced command carrying trace_id, an opaque ID
+    /// such as a random correlation ID, which the peer's session
+    /// returns from received_trace_id after receiving the command.
+    /// The trace ID is encrypted along with the command, so that only
+    /// the peer sees it, and a tool following an exchange across
+    /// several links must send each hop's commands with it in turn.
+    pub fn send_traced(&mut self, cmd: &Command, trace_id: &[u8; TRACE_ID_SIZE]) -> Result<(), SendMessageError> {
+        let traced = Command::Traced{ trace_id: *trace_id, command: self.codec.encode(cmd) };
+        self.send_with(|session| {
+            session.check_supported(&traced)?;
+            session.take_credits(::std::slice::from_ref(cmd))?;
+            let mut frames = vec![];
+            let mut carried = vec![cmd.name()];
+            session.push_command_frames(traced.name(), session.codec.encode(&traced), &mut frames, &mut carried)?;
+            session.write_frames(frames, &carried)
+        })
+    }
+
+    /// Returns the trace ID of the command last returned by
+    /// recv_command or recv_command_into on this session, or None if
+    /// the peer sent it without one, see send_traced.
+    pub fn received_trace_id(&self) -> Option<[u8; TRACE_ID_SIZE]> {
+        self.received_trace_id
+    }
+
+    /// Grants the peer leave to send this many more SendPacket
+    /// commands when it uses flow control, typically as packets are
+    /// drained from the queue they are received into.
+    pub fn grant_credits(&mut self, packets: u32) -> Result<(), SendMessageError> {
+        self.send_command(&Command::Credit{ packets })
+    }
+
+    /// Returns the number of SendPacket commands that may be sent
+    /// before the peer grants more credits.
+    pub fn credits(&self) -> u64 {
+        *self.credits.0.lock().unwrap()
+    }
+
+    // Waits until the peer has granted credits for the SendPacket
+    // commands among cmds and takes them.
+    fn take_credits(&self, cmds: &[Command]) -> Result<(), SendMessageError> {
+        let packets = cmds.iter().filter(|x| match x { Command::SendPacket{..} => true, _ => false }).count() as u64;
+        self.take_packet_credits(packets)
+    }
+
+    fn take_packet_credits(&self, packets: u64) -> Result<(), SendMessageError> {
+        if !self.flow_control || packets == 0 {
+            return Ok(())
+        }
+        let (ref lock, ref condvar) = *self.credits;
+        let mut credits = lock.lock().unwrap();
+        while *credits < packets {
+            if self.state() == SessionState::Closed {
+                return Err(SendMessageError::SessionClosed);
+            }
+            credits = match remaining(self.write_deadline)? {
+                Some(timeout) => condvar.wait_timeout(credits, timeout).unwrap().0,
+                None => condvar.wait(credits).unwrap(),
+            };
+        }
+        *credits -= packets;
+        Ok(())
+    }
+
+    /// Returns the commands sent with send_sequenced that the peer has
+    /// not acknowledged, oldest first.
+    pub fn unacknowledged(&self) -> Vec<(u64, Command)> {
+        self.sequences.lock().unwrap().unacknowledged.iter().cloned().collect()
+    }
+
+    // Returns the plaintexts of the frames carrying encoding: encoding
+    // itself if it fits in one frame, otherwise Fragment commands.
+    fn fragment(&self, encoding: Vec<u8>) -> Result<Vec<Vec<u8>>, SendMessageError> {
+        if MAC_LEN + encoding.len() <= NOISE_MESSAGE_MAX_SIZE {
+            return Ok(vec![encoding])
+        }
+        if encoding.len() > u32::max_value() as usize {
             return Err(SendMessageError::InvalidMessageSize);
         }
+        let total_size = encoding.len() as u32;
+        let empty = Command::Fragment{ total_size, offset: total_size, payload: vec![] };
+        self.check_supported(&empty)?;
+        let chunk_size = NOISE_MESSAGE_MAX_SIZE - MAC_LEN - self.codec.encode(&empty).len() - LENGTH_SLACK;
+        let mut frames = vec![];
+        for (i, chunk) in encoding.chunks(chunk_size).enumerate() {
+            let fragment = self.codec.encode(&Command::Fragment{
+                total_size,
+                offset: (i * chunk_size) as u32,
+                payload: chunk.to_vec(),
+            });
+            if MAC_LEN + fragment.len() > NOISE_MESSAGE_MAX_SIZE {
+                return Err(SendMessageError::InvalidMessageSize);
+            }
+            frames.push(fragment);
+        }
+        Ok(frames)
+    }
+
+    // Adds the frames carrying cmd, given its encoding, to frames,
+    // adding cmd's name to carried if it is sent in fragments.
+    fn push_command_frames(&self, name: &'static str, encoding: Vec<u8>, frames: &mut Vec<(Vec<u8>, &'static str)>,
+                           carried: &mut Vec<&'static str>) -> Result<(), SendMessageError> {
+        let mut fragments = self.fragment(encoding)?;
+        if fragments.len() == 1 {
+            frames.push((fragments.pop().unwrap(), name));
+        } else {
+            carried.push(name);
+            frames.extend(fragments.into_iter().map(|x| (x, "Fragment")));
+        }
+        Ok(())
+    }
+
+    // Adds the batched encodings to frames, as a Batch command unless
+    // there is only one, adding their names to carried.
+    fn flush_batch(&self, batch: &mut Vec<(Vec<u8>, &'static str)>, frames: &mut Vec<(Vec<u8>, &'static str)>,
+                   carried: &mut Vec<&'static str>) {
+        if batch.len() < 2 {
+            frames.extend(batch.drain(..));
+            return
+        }
+        let mut commands = vec![];
+        for (encoding, name) in batch.drain(..) {
+            push_batch_entry(&mut commands, &encoding);
+            carried.push(name);
+        }
+        frames.push((self.codec.encode(&Command::Batch{ commands }), "Batch"));
+    }
+
+    // Returns the encoding of cmd and the name it is sent under,
+    // compressing it if the peer accepts that and it pays off, in
+    // which case cmd's name is added to carried.
+    fn encode_command(&self, cmd: &Command, carried: &mut Vec<&'static str>) -> (Vec<u8>, &'static str) {
+        let encoding = self.codec.encode(cmd);
+        let threshold = match self.compression_threshold {
+            Some(x) if cmd.is_compressible() && !self.is_katzenpost() => x,
+            _ => return (encoding, cmd.name()),
+        };
+        let max_size = match *self.peer_compression.lock().unwrap() {
+            Some(x) => x,
+            None => return (encoding, cmd.name()),
+        };
+        if encoding.len() < threshold || encoding.len() > max_size {
+            return (encoding, cmd.name())
+        }
+        let payload = match compress(&encoding) {
+            Some(x) => x,
+            None => return (encoding, cmd.name()),
+        };
+        if payload.len() >= encoding.len() {
+            return (encoding, cmd.name())
+        }
+        carried.push(cmd.name());
+        let compressed = Command::Compressed{
+            algorithm: COMPRESSION_ZSTD,
+            uncompressed_size: encoding.len() as u32,
+            payload,
+        };
+        (self.codec.encode(&compressed), compressed.name())
+    }
+
+    // Returns true if the session speaks Katzenpost's PROTOCOL_VERSION,
+    // which carries none of the commands this crate adds.
+    fn is_katzenpost(&self) -> bool {
+        self.protocol_version() == PROTOCOL_VERSION
+    }
+
+    // Fails with UnsupportedCommand if the session's protocol version
+    // does not carry cmd.
+    fn check_supported(&self, cmd: &Command) -> Result<(), SendMessageError> {
+        if !cmd.is_katzenpost() && self.is_katzenpost() {
+            return Err(SendMessageError::UnsupportedCommand(cmd.name()));
+        }
+        Ok(())
+    }
+
+    fn write_command(&mut self, cmd: &Command) -> Result<(), SendMessageError> {
+        self.check_supported(cmd)?;
+        self.take_credits(::std::slice::from_ref(cmd))?;
+        let mut frames = vec![];
+        let mut carried = vec![];
+        let (encoding, name) = self.encode_command(cmd, &mut carried);
+        self.push_command_frames(name, encoding, &mut frames, &mut carried)?;
+        self.write_frames(frames, &carried)
+    }
+
+    fn write_commands(&mut self, cmds: &[Command]) -> Result<(), SendMessageError> {
+        for cmd in cmds {
+            self.check_supported(cmd)?;
+        }
+        self.take_credits(cmds)?;
+        // Katzenpost has no Batch command.
+        let batching = !self.is_katzenpost();
+        let empty = self.codec.encode(&Command::Batch{ commands: vec![] });
+        let batch_size = NOISE_MESSAGE_MAX_SIZE - MAC_LEN - empty.len() - LENGTH_SLACK;
+        let mut frames = vec![];
+        let mut carried = vec![];
+        let mut batch = vec![];
+        let mut batch_len = 0;
+        for cmd in cmds {
+            let (encoding, name) = self.encode_command(cmd, &mut carried);
+            let entry_len = BATCH_ENTRY_OVERHEAD + encoding.len();
+            if batch_len + entry_len > batch_size {
+                self.flush_batch(&mut batch, &mut frames, &mut carried);
+                batch_len = 0;
+            }
+            if entry_len > batch_size || !batching {
+                self.push_command_frames(name, encoding, &mut frames, &mut carried)?;
+                continue
+            }
+            batch.push((encoding, name));
+            batch_len += entry_len;
+        }
+        self.flush_batch(&mut batch, &mut frames, &mut carried);
+        self.write_frames(frames, &carried)
+    }
+
+    // Encrypts and writes frames, given as plaintexts and the names
+    // they are traced and counted under. The commands they carry in
+    // fragments or batches are counted under the carried names.
+    fn write_frames(&mut self, frames: Vec<(Vec<u8>, &'static str)>, carried: &[&'static str]) -> Result<(), SendMessageError> {
+        // The frames are encrypted and written under the pending_write
+        // lock, so that they are sent back to back.
+        let pending_write = self.pending_write.clone();
+        let mut pending_write = pending_write.lock().unwrap();
+        self.write_frames_locked(&mut pending_write, frames, carried)
+    }
+
+    // Like write_frames, given the locked unwritten bytes.
+    fn write_frames_locked(&mut self, pending_write: &mut Vec<u8>, frames: Vec<(Vec<u8>, &'static str)>,
+                           carried: &[&'static str]) -> Result<(), SendMessageError> {
+        let mut to_send = mem::replace(pending_write, vec![]);
+        let mut builder = self.transport_builder.as_ref().unwrap().lock().unwrap();
+        let mut stats = self.stats.lock().unwrap();
+        for name in carried {
+            *stats.commands_sent.entry(name).or_insert(0) += 1;
+        }
+        for (ct, name) in frames {
+            let frame = builder.encrypt_message(&ct)?;
+            if let Some(ref trace) = self.trace {
+                trace(self.id, Direction::Sent, frame.len(), name);
+            }
+            to_send.extend(frame);
+            *stats.commands_sent.entry(name).or_insert(0) += 1;
+            if name != (Command::NoOp{}).name() {
+                stats.last_active = Some(Instant::now());
+            }
+            if builder.count_outgoing(ct.len()) {
+                if builder.rekey_policy() != RekeyPolicy::EveryMessage {
+                    // Tell the peer to rekey its incoming cipher state
+                    // along with ours.
+                    let rekey = builder.encrypt_message(&self.codec.encode(&Command::Rekey{}))?;
+                    if let Some(ref trace) = self.trace {
+                        trace(self.id, Direction::Sent, rekey.len(), Command::Rekey{}.name());
+                    }
+                    to_send.extend(rekey);
+                    *stats.commands_sent.entry(Command::Rekey{}.name()).or_insert(0) += 1;
+                }
+                builder.rekey_outgoing();
+                stats.rekeys += 1;
+            }
+        }
+        stats.last_sent = Some(Instant::now());
+        drop(stats);
+        drop(builder);
+
+        let writer = self.writer_transport.as_mut().unwrap();
+        let mut written = 0;
+        while written < to_send.len() {
+            if self.write_deadline.is_some() {
+                if let Err(e) = remaining(self.write_deadline).and_then(|x| writer.set_write_timeout(x)) {
+                    *pending_write = to_send.split_off(written);
+                    return Err(e.into());
+                }
+            }
+            match writer.write(&to_send[written..]) {
+                Ok(0) => return Err(io::Error::from(io::ErrorKind::WriteZero).into()),
+                Ok(n) => {
+                    written += n;
+                    self.stats.lock().unwrap().bytes_sent += n as u64;
+                },
+                Err(ref e) if e.kind() == io::ErrorKind::Interrupted => {},
+                Err(e) => {
+                    *pending_write = to_send.split_off(written);
+                    return Err(e.into());
+                },
+            }
+        }
+        Ok(())
+    }
 
-        let mut to_send = vec![];
-        to_send.extend(self.transport_builder.as_mut().unwrap().lock().unwrap().encrypt_message(&ct)?);
+    /// Sends cmd like send_command, failing with TimeoutError if it is
+    /// not written by deadline. The session is destroyed on any error.
+    pub fn send_command_with_deadline(&mut self, cmd: &Command, deadline: Instant) -> Result<(), SendMessageError> {
+        let write_deadline = mem::replace(&mut self.write_deadline, Some(deadline));
+        if let Err(e) = self.send_command(cmd) {
+            self.destroy_with_error(Some(&e));
+            self.write_deadline = write_deadline;
+            return Err(e);
+        }
+        self.set_write_deadline(write_deadline)
+    }
 
-        self.transport_builder.as_mut().unwrap().lock().unwrap().rekey_outgoing();
+    /// Sends cmd like send_command_with_deadline, with a deadline
+    /// of timeout from now.
+    pub fn send_command_with_timeout(&mut self, cmd: &Command, timeout: Duration) -> Result<(), SendMessageError> {
+        self.send_command_with_deadline(cmd, Instant::now() + timeout)
+    }
 
-        self.writer_tcp_stream.as_mut().unwrap().write_all(&to_send)?;
+    /// Bounds every later send_command by deadline, or removes the
+    /// bound given None. The deadline applies to the whole command,
+    /// including any rekey frame sent along with it.
+    pub fn set_write_deadline(&mut self, deadline: Option<Instant>) -> Result<(), SendMessageError> {
+        self.write_deadline = deadline;
+        if deadline.is_none() {
+            self.writer_transport.as_ref().unwrap().set_write_timeout(None)?;
+        }
         Ok(())
     }
 
+    /// Receives the next command. If a read deadline set with
+    /// set_read_deadline passes, TimeoutError is returned and the part
+    /// of the frame read so far is kept, so that a later call picks up
+    /// where this one left off.
     pub fn recv_command(&mut self) -> Result<Command, ReceiveMessageError> {
-        // Read, decrypt and parse the ciphertext header.
-        let mut header_ciphertext = vec![0u8; MAC_LEN + 4];
-        self.reader_tcp_stream.as_mut().unwrap().read_exact(&mut header_ciphertext)?;
-        let ct_len = self.transport_builder.as_mut().unwrap().lock().unwrap().decrypt_message_header(&header_ciphertext.to_vec())?;
+        if let Some((cmd, trace_id)) = self.received_commands.pop_front() {
+            self.received_trace_id = trace_id;
+            return Ok(cmd)
+        }
+        let result = self.recv_frame();
+        self.receive_result(result)
+    }
 
-        // Read and decrypt the ciphertext.
-        let mut ct = vec![0u8; ct_len as usize];
-        self.reader_tcp_stream.as_mut().unwrap().read_exact(&mut ct)?;
-        let body = self.transport_builder.as_mut().unwrap().lock().unwrap().decrypt_message(&ct)?;
+    /// Receives the next command like recv_command, decrypting it into
+    /// buf. SendPacket and Data commands borrow their payload from buf
+    /// rather than being copied to the heap. buf should hold a whole
+    /// frame, up to NOISE_MESSAGE_MAX_SIZE - MAC_SIZE bytes. If the
+    /// next frame is larger InvalidMessageSize is returned and the
+    /// frame may be received with a larger buffer.
+    pub fn recv_command_into<'a>(&mut self, buf: &'a mut [u8]) -> Result<CommandRef<'a>, ReceiveMessageError> {
+        if let Some((cmd, trace_id)) = self.received_commands.pop_front() {
+            self.received_trace_id = trace_id;
+            return Ok(CommandRef::Owned(cmd))
+        }
+        let result = self.recv_command_ref(buf);
+        self.receive_result(result)
+    }
+
+    // Maps and logs receive errors.
+    fn receive_result<T>(&self, result: Result<T, ReceiveMessageError>) -> Result<T, ReceiveMessageError> {
+        let result = match result {
+            Err(_) if self.idle_closed.load(Ordering::SeqCst) => Err(ReceiveMessageError::IdleTimeout),
+            Err(ReceiveMessageError::IOError(ref e)) if is_timeout(e) => Err(ReceiveMessageError::TimeoutError),
+            result => result,
+        };
+        if let Err(ref e) = result {
+            match e.kind() {
+                ErrorKind::Timeout => {},
+                ErrorKind::SessionClosed => self.log(|l| l.debug(self.id, &format!("receive failed: {}", e))),
+                _ => self.log(|l| l.error(self.id, &format!("receive failed: {}", e))),
+            }
+        }
+        result
+    }
 
-        self.transport_builder.as_mut().unwrap().lock().unwrap().rekey_incoming();
+    /// Receives a command like recv_command, failing with TimeoutError
+    /// if none arrives by deadline. The session is destroyed on any
+    /// error.
+    pub fn recv_command_with_deadline(&mut self, deadline: Instant) -> Result<Command, ReceiveMessageError> {
+        let read_deadline = mem::replace(&mut self.read_deadline, Some(deadline));
+        match self.recv_command() {
+            Ok(cmd) => {
+                self.set_read_deadline(read_deadline)?;
+                Ok(cmd)
+            },
+            Err(e) => {
+                self.destroy_with_error(Some(&e));
+                self.read_deadline = read_deadline;
+                Err(e)
+            },
+        }
+    }
 
-        Ok(Command::from_bytes(&body)?)
+    /// Bounds every later recv_command by deadline, or removes the
+    /// bound given None. The deadline applies to the whole command,
+    /// including link control frames handled along the way.
+    pub fn set_read_deadline(&mut self, deadline: Option<Instant>) -> Result<(), ReceiveMessageError> {
+        self.read_deadline = deadline;
+        if deadline.is_none() {
+            self.reader_transport.as_ref().unwrap().set_read_timeout(None)?;
+        }
+        Ok(())
     }
 
-    pub fn close(&mut self) {
-        self.transport_builder.as_mut().unwrap().lock().unwrap().rekey_outgoing();
-        self.transport_builder.as_mut().unwrap().lock().unwrap().rekey_incoming();
-        self.transport_builder.as_ref().unwrap().lock().unwrap().wipe();
-        let _ = self.reader_tcp_stream.as_mut().unwrap().shutdown(Shutdown::Both);
-        let _ = self.writer_tcp_stream.as_mut().unwrap().shutdown(Shutdown::Both);
+    /// Wraps the session in a byte stream carried in Data commands.
+    pub fn into_stream(self) -> Stream {
+        Stream::new(self)
     }
 
-    pub fn peer_credentials(&self) -> &PeerCredentials {
-        self.handshake_builder.as_ref().unwrap().peer_credentials()
+    /// Wraps the session in a multiplexer of byte streams, taking over
+    /// receiving on it.
+    pub fn into_mux(self) -> Mux {
+        Mux::new(self)
     }
 
-    pub fn clock_skew(&self) -> u32 {
-        self.transport_builder.as_ref().unwrap().lock().unwrap().clock_skew()
+    /// Returns a queue whose commands are sent by a background thread
+    /// using a clone of this session, in priority order.
+    pub fn send_queue(&self) -> SendQueue {
+        self.send_queue_with_limits(QueueLimits::default())
     }
 
-    pub fn from_client(&self) -> bool {
-        assert!(!self.is_initiator);
-        assert!(self.transport_builder.is_some());
-        self.transport_builder.as_ref().unwrap().lock().unwrap().authenticator.is_peer_client()
+    /// Returns a queue like send_queue, bounded by limits.
+    pub fn send_queue_with_limits(&self, limits: QueueLimits) -> SendQueue {
+        SendQueue::new(self.clone(), limits)
     }
-}
 
-#[cfg(test)]
-mod tests {
-    extern crate rand_core;
+    /// Receives commands on a background thread using a clone of this
+    /// session, delivering them on the first channel. The first receive
+    /// error is delivered on the second channel, after which the thread
+    /// exits. It also exits once the command receiver is dropped and
+    /// another command arrives. This session must not also receive.
+    pub fn command_channel(&self) -> (Receiver<Command>, Receiver<ReceiveMessageError>) {
+        let (command_tx, command_rx) = channel();
+        let (error_tx, error_rx) = channel();
+        let mut session = self.clone();
+        thread::spawn(move|| {
+            loop {
+                match session.recv_command() {
+                    Ok(cmd) => {
+                        if command_tx.send(cmd).is_err() {
+                            return
+                        }
+                    },
+                    Err(e) => {
+                        let _ = error_tx.send(e);
+                        return
+                    },
+                }
+            }
+        });
+        (command_rx, error_rx)
+    }
+
+    // Reads until read_buffer holds size bytes, keeping what was read
+    // if the read deadline passes.
+    fn fill_read_buffer(&mut self, size: usize) -> io::Result<Vec<u8>> {
+        let reader = self.reader_transport.as_mut().unwrap();
+        let mut chunk = vec![0u8; size - self.read_buffer.len()];
+        while self.read_buffer.len() < size {
+            if self.read_deadline.is_some() {
+                reader.set_read_timeout(remaining(self.read_deadline)?)?;
+            }
+            let want = size - self.read_buffer.len();
+            match reader.read(&mut chunk[..want]) {
+                Ok(0) => return Err(io::Error::from(io::ErrorKind::UnexpectedEof)),
+                Ok(n) => {
+                    self.read_buffer.extend_from_slice(&chunk[..n]);
+                    let mut stats = self.stats.lock().unwrap();
+                    stats.bytes_received += n as u64;
+                    stats.last_received = Some(Instant::now());
+                },
+                Err(ref e) if e.kind() == io::ErrorKind::Interrupted => {},
+                Err(e) => return Err(e),
+            }
+        }
+        Ok(mem::replace(&mut self.read_buffer, vec![]))
+    }
+
+    // Receives the next command, handling link control commands.
+    // Reads and decrypts the next frame into body, returning the
+    // plaintext length and the frame's size on the wire. A frame too
+    // large for body fails with InvalidMessageSize before its
+    // ciphertext is read, so that it may be received into a larger
+    // buffer.
+    fn recv_frame_into(&mut self, body: &mut [u8]) -> Result<(usize, usize), ReceiveMessageError> {
+        if self.frame_len.is_none() && self.read_buffer.is_empty() {
+            self.wait_while_paused()?;
+        }
+        // Read, decrypt and parse the ciphertext header.
+        let ct_len = match self.frame_len {
+            Some(x) => x,
+            None => {
+                let header_ciphertext = self.fill_read_buffer(MAC_LEN + 4)?;
+                let ct_len = self.transport_builder.as_mut().unwrap().lock().unwrap().decrypt_message_header(&header_ciphertext)?;
+                self.frame_len = Some(ct_len as usize);
+                ct_len as usize
+            },
+        };
+        if ct_len > body.len() + MAC_LEN {
+            return Err(ReceiveMessageError::InvalidMessageSize);
+        }
+
+        // Read and decrypt the ciphertext.
+        let ct = self.fill_read_buffer(ct_len)?;
+        self.frame_len = None;
+        let mut builder = self.transport_builder.as_ref().unwrap().lock().unwrap();
+        let len = builder.decrypt_message_into(&ct, body)?;
+        if builder.rekey_policy() == RekeyPolicy::EveryMessage {
+            builder.rekey_incoming();
+            self.stats.lock().unwrap().rekeys += 1;
+        }
+        drop(builder);
+        if let (Some(timeout), Some(reassembly)) = (self.reassembly_timeout, self.reassembly.as_ref()) {
+            if reassembly.started.elapsed() > timeout {
+                return Err(ReceiveMessageError::ReassemblyTimeout);
+            }
+        }
+        Ok((len, MAC_LEN + 4 + ct_len))
+    }
+
+    // Fails if a command other than a Fragment or Rekey arrives while
+    // a fragmented command is being reassembled.
+    fn check_interleaved(&self, name: &'static str) -> Result<(), ReceiveMessageError> {
+        match name {
+            _ if self.reassembly.is_none() => Ok(()),
+            "Fragment" | "Rekey" => Ok(()),
+            _ => Err(CommandError::InvalidFragment.into()),
+        }
+    }
+
+    fn count_received(&self, name: &'static str, wire_size: usize) {
+        if let Some(ref trace) = self.trace {
+            trace(self.id, Direction::Received, wire_size, name);
+        }
+        let mut stats = self.stats.lock().unwrap();
+        *stats.commands_received.entry(name).or_insert(0) += 1;
+        if name != (Command::NoOp{}).name() {
+            stats.last_active = Some(Instant::now());
+        }
+    }
+
+    // Handles link control commands, returning any other command.
+    fn handle_command(&mut self, cmd: Command) -> Result<Option<Command>, ReceiveMessageError> {
+        match cmd {
+            Command::Rekey{} => {
+                let mut builder = self.transport_builder.as_ref().unwrap().lock().unwrap();
+                if builder.rekey_policy() != RekeyPolicy::EveryMessage {
+                    builder.rekey_incoming();
+                    self.stats.lock().unwrap().rekeys += 1;
+                }
+                Ok(None)
+            },
+            Command::ReauthChallenge{ nonce } => {
+                let additional_data = self.transport_builder.as_ref().unwrap().lock().unwrap().additional_data().to_vec();
+                self.send_command(&Command::ReauthResponse{ nonce, additional_data })?;
+                Ok(None)
+            },
+            Command::Echo{ cookie } => {
+                self.send_command(&Command::EchoReply{ cookie })?;
+                Ok(None)
+            },
+            Command::Ping{ timestamp, cookie } => {
+                self.send_command(&Command::Pong{ timestamp, cookie })?;
+                Ok(None)
+            },
+            Command::GetVersion{} => {
+                let mut commands = command_ids();
+                if let Some(ref registry) = self.command_registry {
+                    commands.extend(registry.ids());
+                }
+                self.send_command(&Command::Version{
+                    implementation: IMPLEMENTATION.as_bytes().to_vec(),
+                    commands,
+                    max_message_size: cmp::min(self.max_command_size, u32::max_value() as usize) as u32,
+                })?;
+                Ok(None)
+            },
+            Command::Pong{ cookie, .. } => {
+                // Pongs to pings that ping gave up on are dropped.
+                let mut rtt = self.rtt.lock().unwrap();
+                match rtt.ping {
+                    Some((outstanding, sent)) if outstanding == cookie => {
+                        rtt.ping = None;
+                        rtt.sample(sent.elapsed());
+                        Ok(Some(cmd))
+                    },
+                    _ => Ok(None),
+                }
+            },
+            Command::Disconnect{..} => {
+                // The peer is closing: stop sending and shut down
+                // our write side so that it sees us finish.
+                self.closing.store(true, Ordering::SeqCst);
+                self.set_state(SessionState::Draining);
+                let _ = self.writer_transport.as_ref().unwrap().shutdown(Shutdown::Write);
+                Ok(Some(cmd))
+            },
+            Command::EchoReply{ cookie } => {
+                let mut rtt = self.rtt.lock().unwrap();
+                match rtt.outstanding {
+                    Some((outstanding, sent)) if outstanding == cookie => {
+                        rtt.outstanding = None;
+                        rtt.sample(sent.elapsed());
+                    },
+                    _ => {},
+                }
+                Ok(None)
+            },
+            Command::Error{ reason } => {
+                self.log(|l| l.warning(self.id, &format!("peer sent error reason {}", reason)));
+                Ok(Some(cmd))
+            },
+            Command::Sequenced{ sequence, command } => {
+                if self.last_sequence_received.map_or(false, |x| sequence <= x) {
+                    return Err(CommandError::InvalidSequence.into());
+                }
+                self.last_sequence_received = Some(sequence);
+                // A command the unknown command policy drops is still
+                // acknowledged, as the peer will never see it processed.
+                let cmd = match self.decode_command(&command)? {
+                    Some(cmd) => {
+                        if is_wrapper(&cmd) {
+                            return Err(CommandError::InvalidSequence.into())
+                        }
+                        *self.stats.lock().unwrap().commands_received.entry(cmd.name()).or_insert(0) += 1;
+                        self.handle_command(cmd)?
+                    },
+                    None => None,
+                };
+                // A peer closing with a sequenced Disconnect is not
+                // answered.
+                if !self.closing.load(Ordering::SeqCst) {
+                    self.send_command(&Command::Ack{ sequence })?;
+                }
+                Ok(cmd)
+            },
+            Command::Traced{ trace_id, command } => {
+                let cmd = match self.decode_command(&command)? {
+                    Some(x) => x,
+                    None => return Ok(None),
+                };
+                if is_wrapper(&cmd) {
+                    return Err(CommandError::TraceDecodeError.into())
+                }
+                *self.stats.lock().unwrap().commands_received.entry(cmd.name()).or_insert(0) += 1;
+                self.received_trace_id = Some(trace_id);
+                self.handle_command(cmd)
+            },
+            Command::Credit{ packets } => {
+                let (ref lock, ref condvar) = *self.credits;
+                let mut credits = lock.lock().unwrap();
+                *credits = credits.saturating_add(packets as u64);
+                condvar.notify_all();
+                Ok(None)
+            },
+            Command::Ack{ sequence } => {
+                let mut sequences = self.sequences.lock().unwrap();
+                if sequence > sequences.last_sent {
+                    return Err(CommandError::InvalidSequence.into());
+                }
+                while sequences.unacknowledged.front().map_or(false, |x| x.0 <= sequence) {
+                    sequences.unacknowledged.pop_front();
+                }
+                Ok(None)
+            },
+            Command::Batch{ commands } => {
+                for encoding in batch_entries(&commands)? {
+                    if encoding.len() > self.max_command_size {
+                        return Err(ReceiveMessageError::InvalidMessageSize);
+                    }
+                    let cmd = match self.decode_command(encoding)? {
+                        Some(x) => x,
+                        None => continue,
+                    };
+                    match cmd {
+                        Command::Batch{..} | Command::Fragment{..} => return Err(CommandError::BatchDecodeError.into()),
+                        _ => {},
+                    }
+                    *self.stats.lock().unwrap().commands_received.entry(cmd.name()).or_insert(0) += 1;
+                    self.received_trace_id = None;
+                    if let Some(cmd) = self.handle_command(cmd)? {
+                        self.batched_commands.push_back((cmd, self.received_trace_id));
+                    }
+                }
+                Ok(self.next_batched_command())
+            },
+            Command::Fragment{ total_size, offset, payload } => {
+                let encoding = match self.reassemble(total_size as usize, offset as usize, payload)? {
+                    Some(x) => x,
+                    None => return Ok(None),
+                };
+                let cmd = match self.decode_command(&encoding)? {
+                    Some(x) => x,
+                    None => return Ok(None),
+                };
+                if let Command::Fragment{..} = cmd {
+                    return Err(CommandError::InvalidFragment.into());
+                }
+                *self.stats.lock().unwrap().commands_received.entry(cmd.name()).or_insert(0) += 1;
+                self.handle_command(cmd)
+            },
+            Command::AcceptCompression{ max_size } => {
+                *self.peer_compression.lock().unwrap() = Some(max_size as usize);
+                Ok(None)
+            },
+            Command::Compressed{ algorithm, uncompressed_size, payload } => {
+                let uncompressed_size = uncompressed_size as usize;
+                if self.compression_threshold.is_none() || algorithm != COMPRESSION_ZSTD ||
+                    uncompressed_size > self.max_command_size {
+                    return Err(CommandError::InvalidCompression.into());
+                }
+                // Decompression stops at uncompressed_size bytes,
+                // however much the payload would expand to.
+                let encoding = match decompress(&payload, uncompressed_size) {
+                    Some(x) => x,
+                    None => return Err(CommandError::InvalidCompression.into()),
+                };
+                let cmd = self.codec.decode(&encoding)?;
+                if encoding.len() != uncompressed_size || !cmd.is_compressible() {
+                    return Err(CommandError::InvalidCompression.into());
+                }
+                *self.stats.lock().unwrap().commands_received.entry(cmd.name()).or_insert(0) += 1;
+                self.handle_command(cmd)
+            },
+            Command::Application{..} => {
+                let result = match self.command_registry {
+                    Some(ref registry) => registry.check(&cmd),
+                    None => Err(CommandError::UnregisteredCommand),
+                };
+                match result {
+                    Ok(()) => Ok(Some(cmd)),
+                    Err(CommandError::UnregisteredCommand) => {
+                        self.unknown_command(CommandError::UnregisteredCommand, &self.codec.encode(&cmd))?;
+                        Ok(None)
+                    },
+                    Err(e) => Err(e.into()),
+                }
+            },
+            _ => Ok(Some(cmd)),
+        }
+    }
+
+    // Adds a fragment to the command being reassembled, returning the
+    // command's encoding once it is complete. The peer's rekey frames
+    // may arrive between fragments but other commands may not.
+    fn reassemble(&mut self, total_size: usize, offset: usize, payload: Vec<u8>) -> Result<Option<Vec<u8>>, ReceiveMessageError> {
+        if total_size > self.max_command_size {
+            return Err(ReceiveMessageError::InvalidMessageSize);
+        }
+        let mut reassembly = match self.reassembly.take() {
+            Some(x) => x,
+            None => Reassembly {
+                encoding: vec![],
+                total_size,
+                started: Instant::now(),
+            },
+        };
+        if total_size != reassembly.total_size || offset != reassembly.encoding.len() ||
+            payload.is_empty() || payload.len() > total_size - offset {
+            return Err(CommandError::InvalidFragment.into());
+        }
+        reassembly.encoding.extend(payload);
+        if reassembly.encoding.len() < total_size {
+            self.reassembly = Some(reassembly);
+            return Ok(None)
+        }
+        Ok(Some(reassembly.encoding))
+    }
+
+    // Decodes a received command, returning None if the command's ID
+    // is unknown and the unknown command policy drops it.
+    fn decode_command(&self, encoding: &[u8]) -> Result<Option<Command>, ReceiveMessageError> {
+        match self.codec.decode(encoding) {
+            Ok(cmd) => Ok(Some(cmd)),
+            Err(CommandError::UnknownCommand) => {
+                self.unknown_command(CommandError::UnknownCommand, encoding)?;
+                Ok(None)
+            },
+            Err(e) => Err(e.into()),
+        }
+    }
+
+    // Applies the unknown command policy to a received command, failing
+    // with error unless the policy drops it.
+    fn unknown_command(&self, error: CommandError, encoding: &[u8]) -> Result<(), ReceiveMessageError> {
+        match self.unknown_command_policy {
+            UnknownCommandPolicy::Fail => return Err(error.into()),
+            UnknownCommandPolicy::Drop => {},
+            UnknownCommandPolicy::Handle(ref handler) => handler(self.id, encoding),
+        }
+        *self.stats.lock().unwrap().commands_received.entry("Unknown").or_insert(0) += 1;
+        Ok(())
+    }
+
+    // Fails if a command received in a frame of len bytes is larger
+    // than max_command_size. Batch and Fragment commands are checked
+    // by the commands they carry instead.
+    fn check_command_size(&self, cmd: &Command, len: usize) -> Result<(), ReceiveMessageError> {
+        match cmd {
+            Command::Batch{..} | Command::Fragment{..} => Ok(()),
+            _ if len > self.max_command_size => Err(ReceiveMessageError::InvalidMessageSize),
+            _ => Ok(()),
+        }
+    }
+
+    // Returns the next command of a received Batch, setting its trace
+    // ID.
+    fn next_batched_command(&mut self) -> Option<Command> {
+        let (cmd, trace_id) = self.batched_commands.pop_front()?;
+        self.received_trace_id = trace_id;
+        Some(cmd)
+    }
+
+    fn recv_frame(&mut self) -> Result<Command, ReceiveMessageError> {
+        if let Some(cmd) = self.next_batched_command() {
+            return Ok(cmd)
+        }
+        let mut body = Zeroizing::new([0u8; NOISE_MESSAGE_MAX_SIZE]);
+        loop {
+            let (len, wire_size) = self.recv_frame_into(&mut body[..])?;
+            self.received_trace_id = None;
+            let cmd = match self.decode_command(&body[..len])? {
+                Some(x) => x,
+                None => continue,
+            };
+            self.count_received(cmd.name(), wire_size);
+            self.check_interleaved(cmd.name())?;
+            self.check_command_size(&cmd, len)?;
+            if let Some(cmd) = self.handle_command(cmd)? {
+                return Ok(cmd)
+            }
+        }
+    }
+
+    fn recv_command_ref<'a>(&mut self, buf: &'a mut [u8]) -> Result<CommandRef<'a>, ReceiveMessageError> {
+        if let Some(cmd) = self.next_batched_command() {
+            return Ok(CommandRef::Owned(cmd))
+        }
+        loop {
+            let (len, wire_size) = self.recv_frame_into(buf)?;
+            self.received_trace_id = None;
+            // Borrowed commands are decoded again to return them, so
+            // that buf is only borrowed for 'a when returning.
+            let cmd = match self.codec.decode_ref(&buf[..len]) {
+                Ok(CommandRef::Owned(cmd)) => cmd,
+                Err(CommandError::UnknownCommand) => {
+                    self.unknown_command(CommandError::UnknownCommand, &buf[..len])?;
+                    continue
+                },
+                Err(e) => return Err(e.into()),
+                Ok(_) => {
+                    let cmd = self.codec.decode_ref(&buf[..len])?;
+                    self.count_received(cmd.name(), wire_size);
+                    self.check_interleaved(cmd.name())?;
+                    if len > self.max_command_size {
+                        return Err(ReceiveMessageError::InvalidMessageSize);
+                    }
+                    return Ok(cmd)
+                },
+            };
+            self.count_received(cmd.name(), wire_size);
+            self.check_interleaved(cmd.name())?;
+            self.check_command_size(&cmd, len)?;
+            if let Some(cmd) = self.handle_command(cmd)? {
+                return Ok(CommandRef::Owned(cmd))
+            }
+        }
+    }
+
+    /// Sends an Echo command to sample the round trip time. The sample
+    /// is taken when recv_command on this session or a clone receives
+    /// the peer's EchoReply, which peers send automatically while in
+    /// recv_command. A later call replaces a sample still outstanding.
+    pub fn send_echo(&mut self) -> Result<(), SendMessageError> {
+        let cookie = {
+            let mut rtt = self.rtt.lock().unwrap();
+            let mut cookie = [0u8; ECHO_COOKIE_SIZE];
+            BigEndian::write_u64(&mut cookie, rtt.next_cookie);
+            rtt.next_cookie += 1;
+            rtt.outstanding = Some((cookie, Instant::now()));
+            cookie
+        };
+        self.send_command(&Command::Echo{ cookie })
+    }
+
+    /// Sends a Ping command and receives until the peer's Pong, which
+    /// peers send automatically while in recv_command, returning the
+    /// round trip time. This probes the peer's session itself rather
+    /// than just its TCP stack. Commands received meanwhile are
+    /// returned by later receives. If the Pong has not arrived by
+    /// deadline TimeoutError is returned, and the session remains
+    /// usable.
+    pub fn ping(&mut self, deadline: Instant) -> Result<Duration, ReceiveMessageError> {
+        let sent = Instant::now();
+        let cookie = {
+            let mut rtt = self.rtt.lock().unwrap();
+            let mut cookie = [0u8; ECHO_COOKIE_SIZE];
+            BigEndian::write_u64(&mut cookie, rtt.next_cookie);
+            rtt.next_cookie += 1;
+            rtt.ping = Some((cookie, sent));
+            cookie
+        };
+        let timestamp = SystemTime::now().duration_since(UNIX_EPOCH).unwrap();
+        let timestamp = timestamp.as_secs() * 1_000_000 + timestamp.subsec_micros() as u64;
+        self.send_command(&Command::Ping{ timestamp, cookie })?;
+        let result = self.recv_until(deadline, |cmd| match cmd {
+            Command::Pong{ cookie: x, .. } if *x == cookie => Some(sent.elapsed()),
+            _ => None,
+        });
+        if result.is_err() {
+            self.rtt.lock().unwrap().ping = None;
+        }
+        result
+    }
+
+    /// Sends a GetVersion command and receives until the peer's
+    /// Version, which peers send automatically while in recv_command,
+    /// like ping.
+    pub fn peer_version(&mut self, deadline: Instant) -> Result<PeerVersion, ReceiveMessageError> {
+        self.send_command(&Command::GetVersion{})?;
+        self.recv_until(deadline, |cmd| match cmd {
+            Command::Version{ implementation, commands, max_message_size } => Some(PeerVersion{
+                implementation: String::from_utf8_lossy(implementation).into_owned(),
+                commands: commands.clone(),
+                max_message_size: *max_message_size,
+            }),
+            _ => None,
+        })
+    }
+
+    /// Opens a datagram channel over socket to the peer's socket at
+    /// peer_addr, see the datagram module: sends a DatagramKey command
+    /// and receives until the peer answers with its own from
+    /// accept_datagram_channel, keeping the commands received meanwhile
+    /// like ping. The session stays open, and may carry the commands
+    /// that must arrive.
+    pub fn open_datagram_channel(&mut self, socket: UdpSocket, peer_addr: SocketAddr,
+                                 deadline: Instant) -> Result<DatagramChannel, ReceiveMessageError> {
+        let mut key = Zeroizing::new([0u8; DATAGRAM_KEY_SIZE]);
+        if let Err(e) = getrandom::getrandom(&mut key[..]) {
+            return Err(ReceiveMessageError::IOError(io::Error::new(io::ErrorKind::Other, e.to_string())));
+        }
+        self.send_command(&Command::DatagramKey{ key: *key })?;
+        let peer_key = self.recv_until(deadline, |cmd| match cmd {
+            Command::DatagramKey{ key } => Some(*key),
+            _ => None,
+        })?;
+        Ok(DatagramChannel::new(socket, Some(peer_addr), key, peer_key))
+    }
+
+    /// Answers a DatagramKey command received with peer_key, returning
+    /// a channel over socket that sends to wherever the peer's
+    /// datagrams come from.
+    pub fn accept_datagram_channel(&mut self, socket: UdpSocket,
+                                   peer_key: &[u8; DATAGRAM_KEY_SIZE]) -> Result<DatagramChannel, SendMessageError> {
+        let mut key = Zeroizing::new([0u8; DATAGRAM_KEY_SIZE]);
+        if let Err(e) = getrandom::getrandom(&mut key[..]) {
+            return Err(SendMessageError::IOError(io::Error::new(io::ErrorKind::Other, e.to_string())));
+        }
+        self.send_command(&Command::DatagramKey{ key: *key })?;
+        Ok(DatagramChannel::new(socket, None, key, *peer_key))
+    }
+
+    // Receives until answer returns Some for a command or deadline
+    // passes, keeping the other commands for later receives.
+    fn recv_until<T, F: FnMut(&Command) -> Option<T>>(&mut self, deadline: Instant, mut answer: F) -> Result<T, ReceiveMessageError> {
+        let read_deadline = mem::replace(&mut self.read_deadline, Some(deadline));
+        let result = loop {
+            match self.recv_frame() {
+                Ok(cmd) => match answer(&cmd) {
+                    Some(x) => break Ok(x),
+                    None => self.received_commands.push_back((cmd, self.received_trace_id)),
+                },
+                Err(e) => break self.receive_result(Err(e)),
+            }
+        };
+        self.set_read_deadline(read_deadline)?;
+        result
+    }
+
+    /// Stops receiving new frames on this session and its clones
+    /// until resume is called. Receives block, or fail with
+    /// TimeoutError once the read deadline passes, while frames are
+    /// left unread so that TCP flow control pushes back on the peer.
+    /// The session stays open, but a paused session still counts as
+    /// idle for the idle timeout. A frame already partly read is
+    /// finished first.
+    pub fn pause(&self) {
+        *self.paused.0.lock().unwrap() = true;
+    }
+
+    /// Resumes receiving after pause.
+    pub fn resume(&self) {
+        *self.paused.0.lock().unwrap() = false;
+        self.paused.1.notify_all();
+    }
+
+    pub fn is_paused(&self) -> bool {
+        *self.paused.0.lock().unwrap()
+    }
+
+    fn wait_while_paused(&self) -> Result<(), ReceiveMessageError> {
+        let (ref lock, ref condvar) = *self.paused;
+        let mut paused = lock.lock().unwrap();
+        while *paused {
+            paused = match remaining(self.read_deadline)? {
+                Some(timeout) => condvar.wait_timeout(paused, timeout).unwrap().0,
+                None => condvar.wait(paused).unwrap(),
+            };
+        }
+        Ok(())
+    }
+
+    /// Returns the smoothed round trip time, or None before the first
+    /// EchoReply arrives.
+    pub fn smoothed_rtt(&self) -> Option<Duration> {
+        self.rtt.lock().unwrap().smoothed
+    }
+
+    /// Reauthenticates the peer mid-session with authenticator, for
+    /// example after a PKI update. The peer must echo a fresh nonce
+    /// together with its current additional data over this session,
+    /// proving it still holds the session keys, and is then checked
+    /// against authenticator. Peers answer automatically while in
+    /// recv_command. Commands received in the meantime are returned
+    /// by later calls to recv_command, so no other thread may receive
+    /// on this session concurrently.
+    ///
+    /// The session should be closed if reauthentication fails.
+    pub fn reauthenticate(&mut self, authenticator: PeerAuthenticator) -> Result<(), ReauthenticationError> {
+        let mut challenge = [0u8; REAUTH_NONCE_SIZE];
+        if getrandom::getrandom(&mut challenge).is_err() {
+            return Err(ReauthenticationError::RandomError);
+        }
+        self.send_command(&Command::ReauthChallenge{ nonce: challenge })?;
+        loop {
+            match self.recv_frame()? {
+                Command::ReauthResponse{ nonce, additional_data } if nonce == challenge => {
+                    let mut builder = self.transport_builder.as_ref().unwrap().lock().unwrap();
+                    builder.reauthenticate_peer(authenticator, additional_data)?;
+                    return Ok(())
+                },
+                cmd => self.received_commands.push_back((cmd, self.received_trace_id)),
+            }
+        }
+    }
+
+    /// Closes the connection and destroys the session keys, see destroy.
+    pub fn close(&mut self) {
+        self.destroy();
+    }
+
+    /// Closes the sending direction of the session, telling the peer
+    /// with a CloseWrite command, while receiving continues. Further
+    /// sends on this session and its clones fail with SessionClosed.
+    pub fn close_write(&mut self) -> Result<(), SendMessageError> {
+        self.check_supported(&Command::CloseWrite{})?;
+        self.closing.store(true, Ordering::SeqCst);
+        self.set_state(SessionState::Draining);
+        self.write_command(&Command::CloseWrite{})?;
+        self.writer_transport.as_ref().unwrap().shutdown(Shutdown::Write)?;
+        Ok(())
+    }
+
+    /// Sends an Error command with reason, one of the ERROR_* codes,
+    /// and then closes the session like close_gracefully.
+    pub fn close_with_error(&mut self, reason: u8, deadline: Instant) -> Result<(), SendMessageError> {
+        self.check_supported(&Command::Error{ reason })?;
+        self.write_deadline = Some(deadline);
+        if let Err(e) = self.send_command(&Command::Error{ reason }) {
+            self.destroy_with_error(Some(&e));
+            return Err(e);
+        }
+        self.close_gracefully(deadline)
+    }
+
+    /// Closes the session after telling the peer with a Disconnect
+    /// command with reason DISCONNECT_NORMAL, see
+    /// close_gracefully_with_reason.
+    pub fn close_gracefully(&mut self, deadline: Instant) -> Result<(), SendMessageError> {
+        self.close_gracefully_with_reason(DISCONNECT_NORMAL, deadline)
+    }
+
+    /// Closes the session after telling the peer why with a Disconnect
+    /// command carrying reason, one of the DISCONNECT_* codes; sessions
+    /// of Katzenpost's PROTOCOL_VERSION carry only DISCONNECT_NORMAL
+    /// and fail with UnsupportedCommand for any other, leaving the
+    /// session open. Otherwise further sends on
+    /// this session and its clones fail with SessionClosed.
+    /// Output already queued is flushed ahead of the Disconnect, the
+    /// write side is shut down and the peer is given until deadline to
+    /// close its side or answer with Disconnect. Anything else it sends
+    /// meanwhile is discarded. The session is destroyed in any case.
+    pub fn close_gracefully_with_reason(&mut self, reason: u8, deadline: Instant) -> Result<(), SendMessageError> {
+        self.check_supported(&Command::Disconnect{ reason })?;
+        self.closing.store(true, Ordering::SeqCst);
+        self.set_state(SessionState::Draining);
+        self.write_deadline = Some(deadline);
+        let result = self.write_command(&Command::Disconnect{ reason });
+        if result.is_ok() {
+            let _ = self.writer_transport.as_ref().unwrap().shutdown(Shutdown::Write);
+            self.read_deadline = Some(deadline);
+            self.received_commands.clear();
+            self.batched_commands.clear();
+            loop {
+                match self.recv_frame() {
+                    Ok(Command::Disconnect{..}) | Ok(Command::CloseWrite{}) | Err(_) => break,
+                    Ok(_) => {},
+                }
+            }
+        }
+        match result {
+            Err(ref e) => self.destroy_with_error(Some(e)),
+            Ok(()) => self.destroy(),
+        }
+        result
+    }
+
+    /// Shuts down the connection and zeroizes all handshake and
+    /// transport key material. The transport state is shared with
+    /// clones of this session, which fail to send or receive
+    /// afterwards.
+    pub fn destroy(&mut self) {
+        self.destroy_with_error(None);
+    }
+
+    // Destroys the session, calling on_close with error the first
+    // time any clone is destroyed.
+    fn destroy_with_error(&mut self, error: Option<&dyn Error>) {
+        if let Some(ref mut builder) = self.handshake_builder {
+            builder.destroy();
+        }
+        if let Some(ref builder) = self.transport_builder {
+            builder.lock().unwrap().destroy();
+        }
+        self.early_command = None;
+        self.pending_write.lock().unwrap().clear();
+        self.read_buffer.clear();
+        self.frame_len = None;
+        // Wake receivers waiting in pause so that they see the close.
+        self.resume();
+        if let Some(ref stream) = self.reader_transport {
+            let _ = stream.shutdown(Shutdown::Both);
+        }
+        if let Some(ref stream) = self.writer_transport {
+            let _ = stream.shutdown(Shutdown::Both);
+        }
+        if self.set_state(SessionState::Closed) {
+            match error {
+                Some(e) => self.log(|l| l.debug(self.id, &format!("session closed: {}", e))),
+                None => self.log(|l| l.debug(self.id, "session closed")),
+            }
+            if let Some(ref callback) = self.on_close {
+                callback(self.id, error);
+            }
+        }
+        // Wake senders waiting for credits so that they see the close.
+        let _credits = self.credits.0.lock().unwrap();
+        self.credits.1.notify_all();
+    }
+
+    /// Returns the authenticated peer's credentials, or None before
+    /// the peer is authenticated or if it is anonymous.
+    pub fn peer_credentials(&self) -> Option<PeerCredentials> {
+        match self.transport_builder {
+            Some(ref builder) => builder.lock().unwrap().peer_credentials().cloned(),
+            None => self.handshake_builder.as_ref().unwrap().peer_credentials().cloned(),
+        }
+    }
+
+    /// Returns the connection addresses reported by the transport.
+    pub fn peer_addresses(&self) -> PeerAddresses {
+        match self.transport_builder {
+            Some(ref builder) => builder.lock().unwrap().addresses(),
+            None => self.handshake_builder.as_ref().unwrap().addresses(),
+        }
+    }
+
+    /// Returns the Noise handshake hash once the handshake is
+    /// finished, for channel binding.
+    pub fn handshake_hash(&self) -> Option<Vec<u8>> {
+        match self.transport_builder {
+            Some(ref builder) => builder.lock().unwrap().handshake_hash().map(|x| x.to_vec()),
+            None => self.handshake_builder.as_ref().unwrap().handshake_hash().map(|x| x.to_vec()),
+        }
+    }
+
+    /// Returns the negotiated protocol version.
+    pub fn protocol_version(&self) -> u8 {
+        match self.transport_builder {
+            Some(ref builder) => builder.lock().unwrap().protocol_version(),
+            None => self.handshake_builder.as_ref().unwrap().protocol_version(),
+        }
+    }
+
+    /// Returns the protocol parameters the handshake used, or None
+    /// before the session is in transport mode.
+    pub fn negotiated_parameters(&self) -> Option<NegotiatedParameters> {
+        self.transport_builder.as_ref().map(|x| x.lock().unwrap().negotiated_parameters())
+    }
+
+    /// Returns the link parameters advertised by the peer, if the
+    /// session was configured to exchange them.
+    pub fn peer_parameters(&self) -> Option<LinkParameters> {
+        self.peer_parameters
+    }
+
+    /// Returns how many seconds the local clock is ahead of the
+    /// responder's, see MessageBuilder::clock_skew.
+    pub fn clock_skew(&self) -> i64 {
+        match self.transport_builder {
+            Some(ref builder) => builder.lock().unwrap().clock_skew(),
+            None => self.handshake_builder.as_ref().unwrap().clock_skew(),
+        }
+    }
+
+    /// Returns a snapshot of the session's traffic counters.
+    pub fn stats(&self) -> SessionStats {
+        self.stats.lock().unwrap().clone()
+    }
+
+    /// Returns true if this session started the handshake.
+    pub fn is_initiator(&self) -> bool {
+        self.is_initiator
+    }
+
+    pub fn from_client(&self) -> bool {
+        assert!(!self.is_initiator);
+        assert!(self.transport_builder.is_some());
+        self.transport_builder.as_ref().unwrap().lock().unwrap().authenticator.is_peer_client()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use std::{thread, time};
+    use std::time::Duration;
+    use std::net::TcpListener;
+    use std::net::{Shutdown, TcpStream, UdpSocket};
+    use std::io;
+    use std::io::prelude::*;
+    #[cfg(feature = "compression")]
+    use std::cell::Cell;
+    use std::collections::HashMap;
+    use std::sync::{Arc, Mutex};
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use super::{Session, SessionConfig, SessionState, LinkParameters, MAC_LEN, FRAME_OVERHEAD};
+    use super::super::logger::Logger;
+    use super::super::transport::Transport;
+    use super::super::websocket::{dial_websocket, listen_websocket};
+    use super::super::kcp::{dial_kcp, listen_kcp, KcpConfig};
+    #[cfg(feature = "quic")]
+    use super::super::quic::{dial_quic, listen_quic};
+    #[cfg(feature = "quic")]
+    use super::super::tls::{server_config as tls_server_config, unverified_client_config};
+    #[cfg(feature = "quic")]
+    use super::super::tls::tests::{TEST_CERT, TEST_KEY};
+    use super::super::mux::{MAX_OPEN_STREAMS, STREAM_WINDOW};
+    use super::super::registry::{ApplicationCommand, CommandRegistry};
+    use super::super::codec::{Codec, DefaultCodec};
+    use super::super::cbor::CborCodec;
+    use super::super::protobuf::ProtobufCodec;
+    use super::super::errors::{CommandError, HandshakeError, PkiError, ReceiveMessageError, SendMessageError};
+    use super::super::messages::{PeerAuthenticator, ProviderAuthenticatorState, ClientAuthenticatorState, RekeyPolicy,
+                                 FirstContactAuthenticatorState, HandshakePattern, Direction, UnknownCommandPolicy};
+    use super::super::constants::{PROTOCOL_VERSION, CBOR_PROTOCOL_VERSION, EXTENDED_PROTOCOL_VERSION, NOISE_MESSAGE_MAX_SIZE, IMPLEMENTATION};
+    use super::super::commands::{Command, CommandRef, MAX_DATA_SIZE, MAX_STREAM_DATA_SIZE, ERROR_OVERLOADED, ERROR_PROTOCOL_VIOLATION, DISCONNECT_NORMAL, DISCONNECT_SHUTDOWN,
+                                 DISCONNECT_IDLE_TIMEOUT, CONSENSUS_OK, DESCRIPTOR_CONFLICT, TRACE_ID_SIZE};
+    #[cfg(feature = "compression")]
+    use super::super::commands::COMPRESSION_ZSTD;
+    use super::super::stream::{send_stream, recv_stream};
+    use super::super::pki::{get_consensus, post_descriptor};
+    use super::super::queue::{QueueLimits, OverflowPolicy};
+    use self::rand_core::OsRng;
+
+    // Returns a connected client and server session pair in transport
+    // mode, with configure applied to both session configs.
+    fn config_pair<F: Fn(&mut SessionConfig)>(configure: F) -> (SessionConfig, SessionConfig) {
+        let client_secret = StaticSecret::new(OsRng);
+        let server_secret = StaticSecret::new(OsRng);
+
+        let mut client_map = HashMap::new();
+        client_map.insert(PublicKey::from(&client_secret), true);
+        let provider_auth = ProviderAuthenticatorState {
+            mix_map: HashMap::default(),
+            client_map: client_map,
+            from_client: false,
+            from_mix: false,
+        };
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let server_public_key = PublicKey::from(&server_secret);
+        let mut server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret, None, vec![]);
+        configure(&mut server_config);
+        let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(server_public_key), vec![]);
+        configure(&mut client_config);
+        (client_config, server_config)
+    }
+
+    fn session_pair<F: Fn(&mut SessionConfig)>(configure: F) -> (Session, Session) {
+        let (client_config, server_config) = config_pair(configure);
+        let listener = TcpListener::bind("127.0.0.1:0").expect("could not start server");
+        let server_addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let (stream, _) = listener.accept().unwrap();
+            let mut session = Session::new(server_config, false).unwrap();
+            session.initialize(stream).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            session
+        });
+
+        let mut session = Session::new(client_config, true).unwrap();
+        session.initialize(TcpStream::connect(server_addr).unwrap()).unwrap();
+        session = session.into_transport_mode().unwrap();
+        session.finalize_handshake().unwrap();
+        (session, server.join().unwrap())
+    }
+
+    // A transport that counts the bytes written through it.
+    struct CountingTransport {
+        stream: TcpStream,
+        written: Arc<Mutex<usize>>,
+    }
+
+    impl Read for CountingTransport {
+        fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+            self.stream.read(buf)
+        }
+    }
+
+    impl Write for CountingTransport {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            let n = self.stream.write(buf)?;
+            *self.written.lock().unwrap() += n;
+            Ok(n)
+        }
+
+        fn flush(&mut self) -> io::Result<()> {
+            self.stream.flush()
+        }
+    }
+
+    impl Transport for CountingTransport {
+        fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+            Ok(Box::new(CountingTransport {
+                stream: self.stream.try_clone()?,
+                written: self.written.clone(),
+            }))
+        }
+
+        fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+            self.stream.set_read_timeout(timeout)
+        }
+
+        fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+            self.stream.set_write_timeout(timeout)
+        }
+
+        fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+            self.stream.shutdown(how)
+        }
+    }
+
+    // The default encoding with every byte inverted.
+    struct InvertingCodec;
+
+    impl Codec for InvertingCodec {
+        fn encode(&self, cmd: &Command) -> Vec<u8> {
+            DefaultCodec.encode(cmd).iter().map(|x| !x).collect()
+        }
+
+        fn decode(&self, b: &[u8]) -> Result<Command, CommandError> {
+            DefaultCodec.decode(&b.iter().map(|x| !x).collect::<Vec<u8>>())
+        }
+    }
+
+    #[test]
+    fn cbor_negotiation_test() {
+        // only the server, which has no peer key, accepts both
+        let (mut client, mut server) = session_pair(|cfg| cfg.versions = if cfg.peer_public_key.is_some() {
+            vec![CBOR_PROTOCOL_VERSION]
+        } else {
+            vec![CBOR_PROTOCOL_VERSION, PROTOCOL_VERSION]
+        });
+        assert_eq!(server.protocol_version(), CBOR_PROTOCOL_VERSION);
+        let bytes_sent = client.stats().bytes_sent;
+        client.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        // {"type": "NoOp"} is 11 bytes
+        assert_eq!(client.stats().bytes_sent - bytes_sent, (4 + MAC_LEN + MAC_LEN + 11) as u64);
+    }
+
+    #[test]
+    fn max_command_size_test() {
+        let (mut client, mut server) = session_pair(|cfg| cfg.max_command_size = 1000);
+        // a batch may be larger than the commands in it
+        let cmds: Vec<Command> = (0..200).map(|sequence| Command::RetrieveMessage{ sequence }).collect();
+        client.send_commands(&cmds).unwrap();
+        for cmd in cmds {
+            assert_eq!(server.recv_command().unwrap(), cmd);
+        }
+        assert_eq!(server.stats().commands_received["Batch"], 1);
+
+        client.send_command(&Command::Data{ payload: vec![1u8; 1000] }).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::InvalidMessageSize) => {},
+            x => panic!("expected the command to be rejected, got {:?}", x),
+        }
+    }
+
+    #[test]
+    fn fragmentation_test() {
+        for &version in [EXTENDED_PROTOCOL_VERSION, CBOR_PROTOCOL_VERSION].iter() {
+            let (mut client, mut server) = session_pair(|cfg| cfg.versions = vec![version]);
+            let consensus: Vec<u8> = (0..200000u32).map(|x| x as u8).collect();
+            let cmd = Command::Consensus{ error_code: 0, payload: consensus };
+            let expected = cmd.clone();
+            let sender = thread::spawn(move|| {
+                client.send_command(&cmd).unwrap();
+                client.send_command(&Command::NoOp{}).unwrap();
+                client
+            });
+            assert_eq!(server.recv_command().unwrap(), expected);
+            assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+            let client = sender.join().unwrap();
+            let stats = server.stats();
+            assert_eq!(stats.commands_received["Consensus"], 1);
+            assert_eq!(stats.commands_received["Fragment"], 4);
+            assert_eq!(client.stats().commands_sent["Fragment"], 4);
+        }
+
+        // the receiver bounds reassembled commands
+        let (mut client, mut server) = session_pair(|cfg| cfg.max_command_size = MAX_DATA_SIZE);
+        let sender = thread::spawn(move|| {
+            client.send_command(&Command::Data{ payload: vec![0u8; MAX_DATA_SIZE + 1] }).unwrap();
+            client
+        });
+        match server.recv_command() {
+            Err(ReceiveMessageError::InvalidMessageSize) => {},
+            x => panic!("expected the command to be rejected, got {:?}", x),
+        }
+        sender.join().unwrap();
+
+        // only fragments may arrive during reassembly
+        let fragment = |offset| Command::Fragment{ total_size: 100, offset, payload: vec![1u8; 10] };
+        let (mut client, mut server) = session_pair(|_| {});
+        client.send_command(&fragment(0)).unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::InvalidFragment)) => {},
+            x => panic!("expected an interleaved command to be rejected, got {:?}", x),
+        }
+
+        // the reassembly timeout is checked on any frame
+        let (mut client, mut server) = session_pair(|cfg| cfg.reassembly_timeout = Some(Duration::from_millis(100)));
+        let receiver = thread::spawn(move|| server.recv_command());
+        client.send_command(&fragment(0)).unwrap();
+        thread::sleep(Duration::from_millis(150));
+        client.send_command(&Command::NoOp{}).unwrap();
+        match receiver.join().unwrap() {
+            Err(ReceiveMessageError::ReassemblyTimeout) => {},
+            x => panic!("expected a reassembly timeout, got {:?}", x),
+        }
+    }
+
+    #[test]
+    fn batch_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let cmds = vec![
+            Command::RetrieveMessage{ sequence: 1 },
+            Command::RetrieveMessage{ sequence: 2 },
+            Command::Data{ payload: vec![1u8; MAX_DATA_SIZE] },
+            Command::RetrieveMessage{ sequence: 3 },
+        ];
+        let expected = cmds.clone();
+        let sender = thread::spawn(move|| {
+            client.send_commands(&cmds).unwrap();
+            client
+        });
+        for cmd in expected {
+            assert_eq!(server.recv_command().unwrap(), cmd);
+        }
+        let client = sender.join().unwrap();
+        let stats = server.stats();
+        assert_eq!(stats.commands_received["Batch"], 1);
+        assert_eq!(stats.commands_received["RetrieveMessage"], 3);
+        assert_eq!(stats.commands_received["Data"], 1);
+        assert_eq!(client.stats().commands_sent, stats.commands_received);
+        assert_eq!(client.stats().bytes_sent, stats.bytes_received);
+    }
+
+    #[test]
+    fn padding_test() {
+        for codec in vec![Arc::new(DefaultCodec) as Arc<dyn Codec>, Arc::new(CborCodec), Arc::new(ProtobufCodec)] {
+            let (mut client, mut server) = session_pair(|cfg| cfg.codec = Some(codec.clone()));
+            for frame_size in vec![FRAME_OVERHEAD + 200, 1000, 20000] {
+                let padding = client.padding_for_frame(frame_size).unwrap();
+                let bytes_sent = client.stats().bytes_sent;
+                client.send_command(&padding).unwrap();
+                assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+                assert_eq!(client.stats().bytes_sent - bytes_sent, frame_size as u64);
+            }
+            assert!(client.padding_for_frame(FRAME_OVERHEAD).is_none());
+            assert!(client.padding_for_frame(NOISE_MESSAGE_MAX_SIZE + FRAME_OVERHEAD).is_none());
+        }
+    }
+
+    #[test]
+    fn send_packet_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let packet = vec![7u8; 1000];
+        client.send_packet(&packet).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::SendPacket{ sphinx_packet: packet.clone() });
+        let mut buf = vec![0u8; NOISE_MESSAGE_MAX_SIZE];
+        client.send_packet(&packet).unwrap();
+        assert_eq!(server.recv_command_into(&mut buf).unwrap(), CommandRef::SendPacket{ sphinx_packet: &packet });
+        assert_eq!(client.stats().commands_sent["SendPacket"], 2);
+    }
+
+    #[test]
+    fn sequenced_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        assert_eq!(client.send_sequenced(&Command::RetrieveMessage{ sequence: 7 }).unwrap(), 1);
+        assert_eq!(client.clone().send_sequenced(&Command::NoOp{}).unwrap(), 2);
+        assert_eq!(client.unacknowledged(), vec![(1, Command::RetrieveMessage{ sequence: 7 }), (2, Command::NoOp{})]);
+        assert_eq!(server.recv_command().unwrap(), Command::RetrieveMessage{ sequence: 7 });
+
+        // the acknowledgement arrives ahead of the next command
+        server.send_command(&Command::GetConsensus{ epoch: 1 }).unwrap();
+        assert_eq!(client.recv_command().unwrap(), Command::GetConsensus{ epoch: 1 });
+        assert_eq!(client.unacknowledged(), vec![(2, Command::NoOp{})]);
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(server.stats().commands_received["Sequenced"], 2);
+
+        // acknowledging a command never sent fails
+        server.send_command(&Command::Ack{ sequence: 3 }).unwrap();
+        match client.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::InvalidSequence)) => {},
+            x => panic!("expected an invalid sequence, got {:?}", x),
+        }
+    }
+
+    #[test]
+    fn traced_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let trace_id = [7u8; TRACE_ID_SIZE];
+        client.send_traced(&Command::GetConsensus{ epoch: 1 }, &trace_id).unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::GetConsensus{ epoch: 1 });
+        assert_eq!(server.received_trace_id(), Some(trace_id));
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(server.received_trace_id(), None);
+
+        // commands in a batch keep their own trace IDs
+        let traced = Command::Traced{ trace_id, command: Command::NoOp{}.to_vec() };
+        client.send_commands(&[Command::GetConsensus{ epoch: 2 }, traced]).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::GetConsensus{ epoch: 2 });
+        assert_eq!(server.received_trace_id(), None);
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(server.received_trace_id(), Some(trace_id));
+
+        // traced and sequenced commands do not nest
+        let sequenced = Command::Sequenced{ sequence: 1, command: Command::NoOp{}.to_vec() };
+        client.send_traced(&sequenced, &trace_id).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::TraceDecodeError)) => {},
+            x => panic!("expected a nested command to be rejected, got {:?}", x),
+        }
+        let (mut client, mut server) = session_pair(|_| {});
+        client.send_sequenced(&Command::Traced{ trace_id, command: Command::NoOp{}.to_vec() }).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::InvalidSequence)) => {},
+            x => panic!("expected a nested command to be rejected, got {:?}", x),
+        }
+    }
+
+    #[test]
+    fn codec_test() {
+        let (mut client, mut server) = session_pair(|cfg| cfg.codec = Some(Arc::new(InvertingCodec)));
+        client.send_command(&Command::SendPacket{ sphinx_packet: vec![1u8; 100] }).unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::SendPacket{ sphinx_packet: vec![1u8; 100] });
+        let mut buf = vec![0u8; NOISE_MESSAGE_MAX_SIZE];
+        assert_eq!(server.recv_command_into(&mut buf).unwrap(), CommandRef::Owned(Command::NoOp{}));
+
+        // a peer using another codec cannot be understood
+        server.codec = Arc::new(DefaultCodec);
+        client.send_command(&Command::NoOp{}).unwrap();
+        assert!(server.recv_command().is_err());
+    }
+
+    struct Flag;
+
+    impl ApplicationCommand for Flag {
+        const ID: u8 = 130;
+
+        fn marshal(&self) -> Vec<u8> {
+            vec![]
+        }
+
+        fn unmarshal(payload: &[u8]) -> Result<Self, CommandError> {
+            match payload.len() {
+                0 => Ok(Flag),
+                _ => Err(CommandError::MessageDecodeError),
+            }
+        }
+    }
+
+    #[test]
+    fn command_registry_test() {
+        let (mut client, mut server) = session_pair(|cfg| {
+            let mut registry = CommandRegistry::new();
+            registry.register::<Flag>("Flag").unwrap();
+            cfg.command_registry = Some(Arc::new(registry));
+        });
+        client.send_command(&Flag.to_command()).unwrap();
+        assert!(Flag::from_command(&server.recv_command().unwrap()).unwrap().is_ok());
+
+        client.send_command(&Command::Application{ id: 131, payload: vec![] }).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::UnregisteredCommand)) => {},
+            _ => panic!("expected an unregistered command to be rejected"),
+        }
+    }
+
+    // The default encoding, except that Data commands are sent as their
+    // payload, letting tests send arbitrary encodings.
+    struct RawCodec;
+
+    impl Codec for RawCodec {
+        fn encode(&self, cmd: &Command) -> Vec<u8> {
+            match cmd {
+                Command::Data{ payload } => payload.clone(),
+                _ => DefaultCodec.encode(cmd),
+            }
+        }
+
+        fn decode(&self, b: &[u8]) -> Result<Command, CommandError> {
+            DefaultCodec.decode(b)
+        }
+    }
+
+    #[test]
+    fn unknown_command_policy_test() {
+        let handled = Arc::new(Mutex::new(vec![]));
+        let handler_handled = handled.clone();
+        let (mut client, mut server) = session_pair(|cfg| {
+            let handled = handler_handled.clone();
+            cfg.codec = Some(Arc::new(RawCodec));
+            cfg.unknown_command_policy = UnknownCommandPolicy::Handle(Arc::new(move|_, encoding: &[u8]| {
+                handled.lock().unwrap().push(encoding[0]);
+            }));
+        });
+        let mut unknown = Command::NoOp{}.to_vec();
+        unknown[0] = 100;
+        client.send_command(&Command::Data{ payload: unknown.clone() }).unwrap();
+        client.send_command(&Command::Application{ id: 131, payload: vec![] }).unwrap();
+        client.send_sequenced(&Command::Data{ payload: unknown.clone() }).unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(*handled.lock().unwrap(), vec![100, 131, 100]);
+        assert_eq!(server.stats().commands_received.get("Unknown"), Some(&3));
+
+        let (mut client, mut server) = session_pair(|cfg| cfg.codec = Some(Arc::new(RawCodec)));
+        client.send_command(&Command::Data{ payload: unknown }).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::UnknownCommand)) => {},
+            _ => panic!("expected an unknown command to be rejected"),
+        }
+    }
+
+    #[test]
+    fn flow_control_test() {
+        let (mut client, mut server) = session_pair(|cfg| cfg.flow_control = true);
+        let packet = Command::SendPacket{ sphinx_packet: vec![1u8; 100] };
+        client.set_write_deadline(Some(time::Instant::now() + Duration::from_millis(100))).unwrap();
+        match client.send_command(&packet) {
+            Err(SendMessageError::TimeoutError) => {},
+            x => panic!("expected sending without credits to time out, got {:?}", x),
+        }
+        match client.send_sequenced(&packet) {
+            Err(SendMessageError::TimeoutError) => {},
+            x => panic!("expected sending without credits to time out, got {:?}", x),
+        }
+        assert!(client.unacknowledged().is_empty());
+        client.set_write_deadline(None).unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+
+        // credits arrive through a receiving clone
+        let (_commands, _errors) = client.command_channel();
+        server.grant_credits(2).unwrap();
+        client.send_commands(&[packet.clone(), packet.clone()]).unwrap();
+        assert_eq!(client.credits(), 0);
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(server.recv_command().unwrap(), packet);
+        assert_eq!(server.recv_command().unwrap(), packet);
+
+        server.grant_credits(1).unwrap();
+        client.send_command(&packet).unwrap();
+        assert_eq!(server.recv_command().unwrap(), packet);
+    }
+
+    #[test]
+    fn pause_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        server.pause();
+        assert!(server.is_paused());
+        client.send_command(&Command::NoOp{}).unwrap();
+
+        let mut paused = server.clone();
+        paused.set_read_deadline(Some(time::Instant::now() + Duration::from_millis(100))).unwrap();
+        match paused.recv_command() {
+            Err(ReceiveMessageError::TimeoutError) => {},
+            _ => panic!("expected a paused receive to time out"),
+        }
+        paused.set_read_deadline(None).unwrap();
+
+        let receiver = thread::spawn(move|| server.recv_command().unwrap());
+        thread::sleep(Duration::from_millis(50));
+        paused.resume();
+        assert_eq!(receiver.join().unwrap(), Command::NoOp{});
+    }
+
+    #[test]
+    fn recv_command_into_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        client.send_command(&Command::SendPacket{ sphinx_packet: vec![3u8; 1000] }).unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+        client.send_command(&Command::Data{ payload: vec![4u8; 100] }).unwrap();
+
+        let mut buf = vec![0u8; NOISE_MESSAGE_MAX_SIZE];
+        assert_eq!(server.recv_command_into(&mut buf).unwrap(), CommandRef::SendPacket{ sphinx_packet: &[3u8; 1000][..] });
+        assert_eq!(server.recv_command_into(&mut buf).unwrap(), CommandRef::Owned(Command::NoOp{}));
+
+        // a frame too large for the buffer is kept for a larger one
+        let mut small = [0u8; 16];
+        match server.recv_command_into(&mut small) {
+            Err(ReceiveMessageError::InvalidMessageSize) => {},
+            _ => panic!("expected the frame not to fit"),
+        }
+        assert_eq!(server.recv_command_into(&mut buf).unwrap().to_command(), Command::Data{ payload: vec![4u8; 100] });
+        assert_eq!(server.stats().commands_received.get("SendPacket"), Some(&1));
+    }
+
+    #[test]
+    fn initialize_async_test() {
+        let (client_config, server_config) = config_pair(|_| {});
+        let listener = TcpListener::bind("127.0.0.1:0").expect("could not start server");
+        let server_addr = listener.local_addr().unwrap();
+        let client = thread::spawn(move|| {
+            let mut session = Session::new(client_config, true).unwrap();
+            session.initialize(TcpStream::connect(server_addr).unwrap()).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            session
+        });
+        let (stream, _) = listener.accept().unwrap();
+        let mut pending = Session::new(server_config, false).unwrap().initialize_async(stream).unwrap();
+        let mut server = loop {
+            match pending.poll() {
+                Some(x) => break x.unwrap(),
+                None => thread::sleep(Duration::from_millis(10)),
+            }
+        };
+        server = server.into_transport_mode().unwrap();
+        server.finalize_handshake().unwrap();
+        let mut client = client.join().unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+
+        // a silent peer's handshake is cancelled
+        let (_, server_config) = config_pair(|_| {});
+        let _silent = TcpStream::connect(server_addr).unwrap();
+        let (stream, _) = listener.accept().unwrap();
+        let pending = Session::new(server_config, false).unwrap().initialize_async(stream).unwrap();
+        pending.cancel();
+        match pending.wait() {
+            Err(HandshakeError::IOError(_)) => {},
+            _ => panic!("expected the cancelled handshake to fail"),
+        }
+    }
+
+    #[test]
+    fn initialize_transport_test() {
+        let (client_config, server_config) = config_pair(|_| {});
+        let listener = TcpListener::bind("127.0.0.1:0").expect("could not start server");
+        let server_addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let (stream, _) = listener.accept().unwrap();
+            let mut session = Session::new(server_config, false).unwrap();
+            session.initialize(stream).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            assert_eq!(session.recv_command().unwrap(), Command::NoOp{});
+        });
+
+        let written = Arc::new(Mutex::new(0));
+        let transport = CountingTransport {
+            stream: TcpStream::connect(server_addr).unwrap(),
+            written: written.clone(),
+        };
+        let mut session = Session::new(client_config, true).unwrap();
+        session.initialize_transport(transport).unwrap();
+        session = session.into_transport_mode().unwrap();
+        session.finalize_handshake().unwrap();
+        session.send_command(&Command::NoOp{}).unwrap();
+        server.join().unwrap();
+        assert_eq!(*written.lock().unwrap() as u64, session.stats().bytes_sent);
+    }
+
+    #[test]
+    fn websocket_session_test() {
+        let (client_config, server_config) = config_pair(|_| {});
+        let listener = listen_websocket("127.0.0.1:0", "/").unwrap();
+        let server_addr = listener.local_addr().unwrap().to_string();
+        let server = thread::spawn(move|| {
+            let mut session = Session::new(server_config, false).unwrap();
+            session.initialize_transport(listener.accept(None).unwrap()).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            assert_eq!(session.recv_command().unwrap(), Command::SendPacket{ sphinx_packet: vec![1u8; 100] });
+            session.close_gracefully(time::Instant::now() + Duration::from_secs(5)).unwrap();
+        });
 
-    use std::{thread, time};
-    use std::time::Duration;
-    use std::net::TcpListener;
-    use std::net::TcpStream;
-    use std::collections::HashMap;
+        let mut session = Session::new(client_config, true).unwrap();
+        session.initialize_transport(dial_websocket(&server_addr, "/").unwrap()).unwrap();
+        session = session.into_transport_mode().unwrap();
+        session.finalize_handshake().unwrap();
+        session.send_command(&Command::SendPacket{ sphinx_packet: vec![1u8; 100] }).unwrap();
+        assert_eq!(session.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+        server.join().unwrap();
+    }
 
-    use x25519_dalek_ng::{PublicKey, StaticSecret};
+    #[test]
+    fn kcp_session_test() {
+        let (client_config, server_config) = config_pair(|_| {});
+        let listener = listen_kcp("127.0.0.1:0", &KcpConfig::fast()).unwrap();
+        let server_addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let mut session = Session::new(server_config, false).unwrap();
+            session.initialize_transport(listener.accept().unwrap()).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            assert_eq!(session.recv_command().unwrap(), Command::SendPacket{ sphinx_packet: vec![1u8; 5000] });
+            session.close_gracefully(time::Instant::now() + Duration::from_secs(5)).unwrap();
+        });
 
-    use super::{Session, SessionConfig};
-    use super::super::messages::{PeerAuthenticator, ProviderAuthenticatorState, ClientAuthenticatorState};
-    use super::super::commands::{Command};
-    use self::rand_core::OsRng;
+        let mut session = Session::new(client_config, true).unwrap();
+        session.initialize_transport(dial_kcp(server_addr, &KcpConfig::fast()).unwrap()).unwrap();
+        session = session.into_transport_mode().unwrap();
+        session.finalize_handshake().unwrap();
+        session.send_command(&Command::SendPacket{ sphinx_packet: vec![1u8; 5000] }).unwrap();
+        assert_eq!(session.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+        server.join().unwrap();
+    }
+
+    #[test]
+    #[cfg(feature = "quic")]
+    fn quic_session_test() {
+        let (client_config, server_config) = config_pair(|_| {});
+        let listener = listen_quic("127.0.0.1:0", tls_server_config(TEST_CERT, TEST_KEY).unwrap()).unwrap();
+        let server_addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let mut session = Session::new(server_config, false).unwrap();
+            session.initialize_transport(listener.accept().unwrap()).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            assert_eq!(session.recv_command().unwrap(), Command::SendPacket{ sphinx_packet: vec![1u8; 5000] });
+            session.close_gracefully(time::Instant::now() + Duration::from_secs(5)).unwrap();
+        });
 
+        let mut session = Session::new(client_config, true).unwrap();
+        session.initialize_transport(dial_quic(server_addr, "localhost", unverified_client_config()).unwrap()).unwrap();
+        session = session.into_transport_mode().unwrap();
+        session.finalize_handshake().unwrap();
+        session.send_command(&Command::SendPacket{ sphinx_packet: vec![1u8; 5000] }).unwrap();
+        assert_eq!(session.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+        server.join().unwrap();
+    }
 
     #[test]
     fn handshake_test() {
@@ -233,12 +2815,7 @@ mod tests {
             let listener = TcpListener::bind(server_addr.clone()).expect("could not start server");
 
             // server
-            let server_config = SessionConfig {
-                authenticator: provider_authenticator,
-                authentication_key: server_secret,
-                peer_public_key: None,
-                additional_data: vec![],
-            };
+            let server_config = SessionConfig::new(provider_authenticator, server_secret, None, vec![]);
             let mut session = Session::new(server_config, false).unwrap();
 
             for connection in listener.incoming() {
@@ -260,12 +2837,7 @@ mod tests {
         threads.push(thread::spawn(move|| {
             thread::sleep(Duration::from_secs(1));
             // client
-            let client_config = SessionConfig {
-                authenticator: client_authenticator,
-                authentication_key: client_secret,
-                peer_public_key: Some(PublicKey::from(&server_keypair_clone)),
-                additional_data: vec![],
-            };
+            let client_config = SessionConfig::new(client_authenticator, client_secret, Some(PublicKey::from(&server_keypair_clone)), vec![]);
             let mut session = Session::new(client_config, true).unwrap();
 
             let stream = TcpStream::connect(server_addr.clone()).expect("connection failed");
@@ -310,12 +2882,7 @@ mod tests {
             let listener = TcpListener::bind(server_addr.clone()).expect("could not start server");
 
             // server
-            let server_config = SessionConfig {
-                authenticator: provider_authenticator,
-                authentication_key: server_secret,
-                peer_public_key: None,
-                additional_data: vec![],
-            };
+            let server_config = SessionConfig::new(provider_authenticator, server_secret, None, vec![]);
             let mut session = Session::new(server_config, false).unwrap();
 
             for connection in listener.incoming() {
@@ -363,12 +2930,7 @@ mod tests {
         threads.push(thread::spawn(move|| {
             thread::sleep(Duration::from_secs(1));
             // client
-            let client_config = SessionConfig {
-                authenticator: client_authenticator,
-                authentication_key: client_secret,
-                peer_public_key: Some(PublicKey::from(&server_keypair_clone)),
-                additional_data: vec![],
-            };
+            let client_config = SessionConfig::new(client_authenticator, client_secret, Some(PublicKey::from(&server_keypair_clone)), vec![]);
             let mut session = Session::new(client_config, true).unwrap();
 
             let stream = TcpStream::connect(server_addr.clone()).expect("connection failed");
@@ -397,4 +2959,871 @@ mod tests {
             let _ = t.join();
         }
     }
+
+    #[test]
+    fn rekey_threshold_test() {
+        let (mut client, mut server) = session_pair(|cfg| {
+            cfg.rekey_policy = RekeyPolicy::Threshold {
+                messages: 3,
+                bytes: 64,
+            };
+        });
+
+        let cmd = Command::SendPacket{
+            sphinx_packet: vec![7u8; 20],
+        };
+        for _ in 0..10 {
+            client.send_command(&cmd).unwrap();
+            assert_eq!(server.recv_command().unwrap(), cmd);
+            server.send_command(&Command::NoOp{}).unwrap();
+            assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+        }
+        client.close();
+        server.close();
+    }
+
+    #[test]
+    fn early_command_test() {
+        let client_secret = StaticSecret::new(OsRng);
+        let server_secret = StaticSecret::new(OsRng);
+
+        let mut client_map = HashMap::new();
+        client_map.insert(PublicKey::from(&client_secret), true);
+        let provider_auth = ProviderAuthenticatorState {
+            mix_map: HashMap::default(),
+            client_map: client_map,
+            from_client: false,
+            from_mix: false,
+        };
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let server_public_key = PublicKey::from(&server_secret);
+        let server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret, None, vec![]);
+        let client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(server_public_key), vec![]);
+
+        let early = Command::SendPacket{
+            sphinx_packet: vec![1, 2, 3],
+        };
+        let listener = TcpListener::bind("127.0.0.1:0").expect("could not start server");
+        let server_addr = listener.local_addr().unwrap();
+        let server_early = early.clone();
+        let server = thread::spawn(move|| {
+            let (stream, _) = listener.accept().unwrap();
+            let mut session = Session::new(server_config, false).unwrap();
+            session.initialize(stream).unwrap();
+            session = session.into_transport_mode().unwrap();
+            session.finalize_handshake().unwrap();
+            assert_eq!(session.recv_command().unwrap(), server_early);
+            session.close();
+        });
+
+        let mut session = Session::new(client_config, true).unwrap();
+        let stream = TcpStream::connect(server_addr).unwrap();
+        assert!(session.initialize_with_early_command(stream.try_clone().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL }).is_err());
+        session.initialize_with_early_command(stream, early).unwrap();
+        session = session.into_transport_mode().unwrap();
+        session.finalize_handshake().unwrap();
+        server.join().unwrap();
+        session.close();
+    }
+
+    #[test]
+    fn handshake_timeout_test() {
+        let client_secret = StaticSecret::new(OsRng);
+        let server_secret = StaticSecret::new(OsRng);
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let mut client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(PublicKey::from(&server_secret)), vec![]);
+        client_config.handshake_timeout = Some(Duration::from_millis(200));
+
+        // The server accepts the connection but never responds.
+        let listener = TcpListener::bind("127.0.0.1:0").expect("could not start server");
+        let server_addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            let (stream1, _) = listener.accept().unwrap();
+            let (stream2, _) = listener.accept().unwrap();
+            thread::sleep(Duration::from_secs(2));
+            drop(stream1);
+            drop(stream2);
+        });
+
+        let mut session = Session::new(client_config.clone(), true).unwrap();
+        match session.initialize(TcpStream::connect(server_addr).unwrap()) {
+            Err(HandshakeError::TimeoutError) => {},
+            _ => panic!("expected handshake timeout"),
+        }
+
+        // an earlier deadline wins over the configured timeout
+        client_config.handshake_timeout = Some(Duration::from_secs(10));
+        let mut session = Session::new(client_config, true).unwrap();
+        let started = time::Instant::now();
+        let deadline = started + Duration::from_millis(200);
+        match session.initialize_with_deadline(TcpStream::connect(server_addr).unwrap(), deadline) {
+            Err(HandshakeError::TimeoutError) => {},
+            _ => panic!("expected handshake timeout"),
+        }
+        assert!(started.elapsed() < Duration::from_secs(2));
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn destroy_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let mut client_clone = client.clone();
+        client.destroy();
+        assert!(client.handshake_hash().is_none());
+        assert!(client_clone.send_command(&Command::NoOp{}).is_err());
+        assert!(server.recv_command().is_err());
+        server.destroy();
+    }
+
+    #[test]
+    fn reauthenticate_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let client_thread = thread::spawn(move|| {
+            // answers reauthentication challenges until the NoOp
+            assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+            client.close();
+        });
+
+        let accepting = PeerAuthenticator::FirstContact(FirstContactAuthenticatorState {
+            peer_public_key: None,
+        });
+        server.reauthenticate(accepting).unwrap();
+
+        let rejecting = PeerAuthenticator::Provider(ProviderAuthenticatorState {
+            mix_map: HashMap::default(),
+            client_map: HashMap::default(),
+            from_client: false,
+            from_mix: false,
+        });
+        assert!(server.reauthenticate(rejecting).is_err());
+
+        server.send_command(&Command::NoOp{}).unwrap();
+        client_thread.join().unwrap();
+        server.close();
+    }
+
+    #[test]
+    fn link_parameters_test() {
+        let (client, server) = session_pair(|cfg| {
+            cfg.link_parameters = Some(LinkParameters {
+                max_packet_size: 52000,
+                forward_payload_size: 51200,
+            });
+        });
+        assert_eq!(client.peer_parameters(), server.link_parameters);
+        assert_eq!(server.peer_parameters(), client.link_parameters);
+
+        let (client, _server) = session_pair(|_| {});
+        assert_eq!(client.peer_parameters(), None);
+    }
+
+    #[test]
+    fn rejection_delay_test() {
+        let delay = Duration::from_millis(300);
+        let server_secret = StaticSecret::new(OsRng);
+        let server_public_key = PublicKey::from(&server_secret);
+        let provider_auth = ProviderAuthenticatorState {
+            mix_map: HashMap::default(),
+            client_map: HashMap::default(),
+            from_client: false,
+            from_mix: false,
+        };
+        let mut server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret, None, vec![]);
+        server_config.rejection_delay = Some(delay);
+
+        let listener = TcpListener::bind("127.0.0.1:0").expect("could not start server");
+        let server_addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move|| {
+            for _ in 0..2 {
+                let (stream, _) = listener.accept().unwrap();
+                let mut session = Session::new(server_config.clone(), false).unwrap();
+                let started = time::Instant::now();
+                assert!(session.initialize(stream).is_err());
+                assert!(started.elapsed() >= delay);
+            }
+        });
+
+        // garbage final message
+        let sizes = HandshakePattern::XX.message_sizes();
+        let mut stream = TcpStream::connect(server_addr).unwrap();
+        let mut message = vec![0u8; sizes[0]];
+        message[0] = EXTENDED_PROTOCOL_VERSION;
+        stream.write_all(&message).unwrap();
+        let mut message = vec![0u8; sizes[1]];
+        stream.read_exact(&mut message).unwrap();
+        stream.write_all(&vec![0u8; sizes[2]]).unwrap();
+        let mut buf = vec![];
+        assert_eq!(stream.read_to_end(&mut buf).unwrap_or(0), 0);
+
+        // unauthorized client
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: server_public_key,
+        };
+        let client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), StaticSecret::new(OsRng), Some(server_public_key), vec![]);
+        let mut session = Session::new(client_config, true).unwrap();
+        session.initialize(TcpStream::connect(server_addr).unwrap()).unwrap();
+        session = session.into_transport_mode().unwrap();
+        assert!(session.finalize_handshake().is_err());
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn command_deadline_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        server.send_command(&Command::NoOp{}).unwrap();
+        let deadline = time::Instant::now() + Duration::from_millis(200);
+        assert_eq!(client.recv_command_with_deadline(deadline).unwrap(), Command::NoOp{});
+
+        // times out and leaves the session closed
+        match client.recv_command_with_deadline(deadline) {
+            Err(ReceiveMessageError::TimeoutError) => {},
+            _ => panic!("expected receive timeout"),
+        }
+        assert!(client.send_command(&Command::NoOp{}).is_err());
+        assert!(server.recv_command().is_err());
+    }
+
+    #[test]
+    fn send_timeout_test() {
+        let (mut client, _server) = session_pair(|_| {});
+        // the server never reads, so the socket buffers fill up
+        let cmd = Command::Data{ payload: vec![0u8; MAX_DATA_SIZE] };
+        let mut result = Ok(());
+        for _ in 0..10000 {
+            result = client.send_command_with_timeout(&cmd, Duration::from_millis(200));
+            if result.is_err() {
+                break
+            }
+        }
+        match result {
+            Err(SendMessageError::TimeoutError) => {},
+            _ => panic!("expected send timeout"),
+        }
+        assert_eq!(client.state(), SessionState::Closed);
+    }
+
+    #[test]
+    fn read_deadline_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        client.set_read_deadline(Some(time::Instant::now() + Duration::from_millis(200))).unwrap();
+        match client.recv_command() {
+            Err(ReceiveMessageError::TimeoutError) => {},
+            _ => panic!("expected receive timeout"),
+        }
+
+        // the session survives the timeout
+        client.set_read_deadline(None).unwrap();
+        server.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+    }
+
+    #[test]
+    fn command_channel_test() {
+        let (client, mut server) = session_pair(|_| {});
+        let (commands, errors) = client.command_channel();
+        server.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(commands.recv().unwrap(), Command::NoOp{});
+
+        server.close();
+        assert!(errors.recv().is_ok());
+        assert!(commands.recv().is_err());
+    }
+
+    #[test]
+    fn stream_test() {
+        let (client, server) = session_pair(|_| {});
+        let mut client = client.into_stream();
+        let mut server = server.into_stream();
+        let data = vec![7u8; MAX_DATA_SIZE + 100];
+        let writer = thread::spawn(move|| {
+            client.write_all(&data).unwrap();
+            client.session().send_command(&Command::Disconnect{ reason: DISCONNECT_NORMAL }).unwrap();
+            client
+        });
+        let mut received = vec![];
+        server.read_to_end(&mut received).unwrap();
+        assert_eq!(received, vec![7u8; MAX_DATA_SIZE + 100]);
+        writer.join().unwrap();
+    }
+
+    #[test]
+    fn mux_test() {
+        let (client, server) = session_pair(|_| {});
+        let mut client = client.into_mux();
+        let server = server.into_mux();
+        let mut first = client.open().unwrap();
+        let mut second = client.open().unwrap();
+        assert_eq!((first.id(), second.id()), (1, 3));
+        let data = vec![5u8; MAX_STREAM_DATA_SIZE + 100];
+        first.write_all(&data[..MAX_STREAM_DATA_SIZE]).unwrap();
+        second.write_all(b"second").unwrap();
+        client.session().send_command(&Command::NoOp{}).unwrap();
+        first.write_all(&data[MAX_STREAM_DATA_SIZE..]).unwrap();
+        first.close_write().unwrap();
+        drop(second);
+
+        let mut accepted_first = server.accept().unwrap();
+        let mut accepted_second = server.accept().unwrap();
+        assert_eq!((accepted_first.id(), accepted_second.id()), (1, 3));
+        let mut received = vec![];
+        accepted_second.read_to_end(&mut received).unwrap();
+        assert_eq!(received, b"second");
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        received.clear();
+        accepted_first.read_to_end(&mut received).unwrap();
+        assert_eq!(received, data);
+
+        // the other half of a stream stays open
+        accepted_first.write_all(b"reply").unwrap();
+        accepted_first.close_write().unwrap();
+        received.clear();
+        first.read_to_end(&mut received).unwrap();
+        assert_eq!(received, b"reply");
+    }
+
+    #[test]
+    fn mux_window_test() {
+        let (client, server) = session_pair(|_| {});
+        let mut client = client.into_mux();
+        let server = server.into_mux();
+        let mut stream = client.open().unwrap();
+        stream.set_write_timeout(Some(Duration::from_millis(200)));
+        let data = vec![6u8; STREAM_WINDOW as usize + 100];
+        let mut written = 0;
+        let error = loop {
+            match stream.write(&data[written..]) {
+                Ok(n) => written += n,
+                Err(e) => break e,
+            }
+        };
+        assert_eq!(error.kind(), io::ErrorKind::TimedOut);
+        assert_eq!(written, STREAM_WINDOW as usize);
+
+        // reading grants the rest
+        let mut accepted = server.accept().unwrap();
+        let mut received = vec![0u8; STREAM_WINDOW as usize];
+        accepted.read_exact(&mut received).unwrap();
+        stream.write_all(&data[written..]).unwrap();
+        stream.close_write().unwrap();
+        received.clear();
+        accepted.read_to_end(&mut received).unwrap();
+        assert_eq!(received.len(), 100);
+
+        // streams beyond the limit are refused
+        drop(accepted);
+        let mut streams = vec![stream];
+        for _ in 1..MAX_OPEN_STREAMS {
+            streams.push(client.open().unwrap());
+        }
+        assert!(client.open().is_err());
+    }
+
+    #[test]
+    fn bulk_transfer_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let document: Vec<u8> = (0..3 * MAX_DATA_SIZE as u32).map(|x| x as u8).collect();
+        let expected = document.clone();
+        let sender = thread::spawn(move|| {
+            assert_eq!(send_stream(&mut client, &mut &document[..]).unwrap(), document.len() as u64);
+            client.send_command(&Command::NoOp{}).unwrap();
+            client
+        });
+        let mut received = vec![];
+        recv_stream(&mut server, &mut received).unwrap();
+        assert_eq!(received, expected);
+
+        // the session carries commands again afterwards
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        sender.join().unwrap();
+    }
+
+    #[test]
+    fn pki_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let document = vec![3u8; 256 * 1024];
+        let expected = document.clone();
+        let authority = thread::spawn(move|| {
+            assert_eq!(server.recv_command().unwrap(), Command::GetConsensus{ epoch: 5 });
+            server.send_command(&Command::Consensus{ error_code: CONSENSUS_OK, payload: document }).unwrap();
+            match server.recv_command().unwrap() {
+                Command::PostDescriptor{ epoch: 5, .. } => {},
+                x => panic!("expected a descriptor, got {:?}", x),
+            }
+            server.send_command(&Command::PostDescriptorStatus{ error_code: DESCRIPTOR_CONFLICT }).unwrap();
+            server
+        });
+        assert_eq!(get_consensus(&mut client, 5).unwrap(), expected);
+        match post_descriptor(&mut client, 5, vec![1u8; 100]) {
+            Err(PkiError::Rejected(DESCRIPTOR_CONFLICT)) => {},
+            x => panic!("expected the descriptor to be rejected, got {:?}", x),
+        }
+        authority.join().unwrap();
+    }
+
+    #[test]
+    fn concurrent_send_test() {
+        let (client, mut server) = session_pair(|_| {});
+        let senders: Vec<_> = (0..4).map(|i| {
+            let mut session = client.clone();
+            thread::spawn(move|| {
+                for _ in 0..50 {
+                    session.send_command(&Command::SendPacket{ sphinx_packet: vec![i as u8; 1000] }).unwrap();
+                }
+            })
+        }).collect();
+        for _ in 0..200 {
+            match server.recv_command().unwrap() {
+                Command::SendPacket{..} => {},
+                cmd => panic!("unexpected command {:?}", cmd),
+            }
+        }
+        for sender in senders {
+            sender.join().unwrap();
+        }
+    }
+
+    #[test]
+    fn close_gracefully_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let mut client_clone = client.clone();
+        client.send_command(&Command::NoOp{}).unwrap();
+        let closer = thread::spawn(move|| {
+            client.close_gracefully(time::Instant::now() + Duration::from_secs(5)).unwrap();
+        });
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert_eq!(server.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+        server.close();
+        closer.join().unwrap();
+        match client_clone.send_command(&Command::NoOp{}) {
+            Err(SendMessageError::SessionClosed) => {},
+            _ => panic!("expected a closed session"),
+        }
+        let states: Vec<SessionState> = client_clone.state_transitions().iter().map(|x| x.0).collect();
+        assert_eq!(states, vec![SessionState::Init, SessionState::Handshaking, SessionState::Established,
+                                SessionState::Draining, SessionState::Closed]);
+    }
+
+    #[test]
+    fn peer_credentials_test() {
+        let (client, server) = session_pair(|_| {});
+        let server_credentials = client.peer_credentials().unwrap();
+        let client_credentials = server.peer_credentials().unwrap();
+        assert!(server_credentials.public_key != client_credentials.public_key);
+        assert!(client.clock_skew().abs() <= 1);
+        assert_eq!(server.clock_skew(), 0);
+        assert_eq!(client.peer_addresses().remote, server.peer_addresses().local);
+        assert_eq!(client.peer_addresses().local, server.peer_addresses().remote);
+    }
+
+    #[test]
+    fn stats_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        client.send_command(&Command::SendPacket{ sphinx_packet: vec![1u8; 100] }).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::SendPacket{ sphinx_packet: vec![1u8; 100] });
+
+        let client_stats = client.stats();
+        let server_stats = server.stats();
+        assert_eq!(client_stats.bytes_sent, server_stats.bytes_received);
+        assert_eq!(client_stats.bytes_received, server_stats.bytes_sent);
+        assert!(client_stats.bytes_sent > 100);
+        assert_eq!(client_stats.commands_sent.get("SendPacket"), Some(&1));
+        assert_eq!(server_stats.commands_received.get("SendPacket"), Some(&1));
+        // the handshake finalization NoOp
+        assert_eq!(client_stats.commands_received.get("NoOp"), Some(&1));
+        assert!(client_stats.handshake_duration.is_some());
+        // the default policy rekeys after every frame in each direction
+        assert_eq!(client_stats.rekeys, 2);
+    }
+
+    #[test]
+    fn echo_rtt_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        assert_eq!(client.smoothed_rtt(), None);
+        client.send_echo().unwrap();
+        client.send_command(&Command::NoOp{}).unwrap();
+
+        // the server answers the echo while receiving
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        server.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+        let rtt = client.smoothed_rtt().unwrap();
+        assert!(rtt < Duration::from_secs(5));
+        assert_eq!(server.smoothed_rtt(), None);
+    }
+
+    #[test]
+    fn ping_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let receiver = thread::spawn(move|| {
+            server.send_command(&Command::NoOp{}).unwrap();
+            assert_eq!(server.recv_command().unwrap(), Command::RetrieveMessage{ sequence: 1 });
+            server
+        });
+        let rtt = client.ping(time::Instant::now() + Duration::from_secs(5)).unwrap();
+        assert!(rtt < Duration::from_secs(5));
+        assert!(client.smoothed_rtt().unwrap() <= rtt);
+        // the command received while waiting is kept
+        assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+        client.send_command(&Command::RetrieveMessage{ sequence: 1 }).unwrap();
+        let server = receiver.join().unwrap();
+        assert_eq!(server.stats().commands_sent["Pong"], 1);
+
+        // nobody answers while the server is not receiving
+        match client.ping(time::Instant::now() + Duration::from_millis(100)) {
+            Err(ReceiveMessageError::TimeoutError) => {},
+            x => panic!("expected a timeout, got {:?}", x),
+        }
+    }
+
+    #[test]
+    fn peer_version_test() {
+        let (mut client, mut server) = session_pair(|cfg| {
+            let mut registry = CommandRegistry::new();
+            registry.register::<Flag>("Flag").unwrap();
+            cfg.command_registry = Some(Arc::new(registry));
+            cfg.max_command_size = 100000;
+        });
+        let receiver = thread::spawn(move|| {
+            assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        });
+        let version = client.peer_version(time::Instant::now() + Duration::from_secs(5)).unwrap();
+        assert_eq!(version.implementation, IMPLEMENTATION);
+        assert!(version.commands.contains(&0));
+        assert_eq!(version.commands.last(), Some(&Flag::ID));
+        assert_eq!(version.max_message_size, 100000);
+        client.send_command(&Command::NoOp{}).unwrap();
+        receiver.join().unwrap();
+    }
+
+    #[test]
+    fn datagram_channel_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let server_socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let server_addr = server_socket.local_addr().unwrap();
+        let receiver = thread::spawn(move|| {
+            let channel = match server.recv_command().unwrap() {
+                Command::DatagramKey{ key } => server.accept_datagram_channel(server_socket, &key).unwrap(),
+                x => panic!("expected a DatagramKey, got {:?}", x),
+            };
+            channel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+            let cmd = channel.recv_command().unwrap();
+            channel.send_command(&cmd).unwrap();
+        });
+        let client_socket = UdpSocket::bind("127.0.0.1:0").unwrap();
+        let channel = client.open_datagram_channel(client_socket, server_addr,
+                                                   time::Instant::now() + Duration::from_secs(5)).unwrap();
+        channel.set_read_timeout(Some(Duration::from_secs(5))).unwrap();
+        let cmd = Command::SendPacket{ sphinx_packet: vec![1u8; 100] };
+        channel.send_command(&cmd).unwrap();
+        assert_eq!(channel.recv_command().unwrap(), cmd);
+        receiver.join().unwrap();
+    }
+
+    #[test]
+    #[cfg(feature = "compression")]
+    fn compression_test() {
+        let (mut client, mut server) = session_pair(|cfg| cfg.compression_threshold = Some(1000));
+        let consensus = Command::Consensus{ error_code: CONSENSUS_OK, payload: vec![7u8; 200000] };
+        let bytes_received = server.stats().bytes_received;
+        client.send_command(&consensus).unwrap();
+        assert_eq!(server.recv_command().unwrap(), consensus);
+        assert!(server.stats().bytes_received - bytes_received < 10000);
+        assert_eq!(server.stats().commands_received["Compressed"], 1);
+        assert_eq!(server.stats().commands_received["Consensus"], 1);
+
+        // packets and small commands are sent as they are
+        let packet = Command::SendPacket{ sphinx_packet: vec![0u8; 5000] };
+        let small = Command::Consensus{ error_code: CONSENSUS_OK, payload: vec![7u8; 100] };
+        client.send_commands(&[packet.clone(), small.clone()]).unwrap();
+        assert_eq!(server.recv_command().unwrap(), packet);
+        assert_eq!(server.recv_command().unwrap(), small);
+        assert_eq!(server.stats().commands_received["Compressed"], 1);
+        assert_eq!(client.stats().commands_sent, server.stats().commands_received);
+
+        // a payload expanding past its stated size is rejected
+        let bomb = Command::Compressed{
+            algorithm: COMPRESSION_ZSTD,
+            uncompressed_size: 1000,
+            payload: zstd::bulk::compress(&consensus.to_vec(), 0).unwrap(),
+        };
+        client.send_command(&bomb).unwrap();
+        match server.recv_command() {
+            Err(ReceiveMessageError::CommandError(CommandError::InvalidCompression)) => {},
+            x => panic!("expected the command to be rejected, got {:?}", x),
+        }
+    }
+
+    #[test]
+    #[cfg(feature = "compression")]
+    fn compression_unsupported_test() {
+        // only the server is configured, so the client never compresses
+        let configured = Cell::new(true);
+        let (mut client, mut server) = session_pair(|cfg| if configured.replace(false) {
+            cfg.compression_threshold = Some(1000);
+        });
+        let consensus = Command::Consensus{ error_code: CONSENSUS_OK, payload: vec![7u8; 200000] };
+        client.send_command(&consensus).unwrap();
+        assert_eq!(server.recv_command().unwrap(), consensus);
+        server.send_command(&consensus).unwrap();
+        assert_eq!(client.recv_command().unwrap(), consensus);
+        assert!(!server.stats().commands_received.contains_key("Compressed"));
+        assert!(!client.stats().commands_received.contains_key("Compressed"));
+    }
+
+    #[test]
+    fn session_id_test() {
+        let (client, server) = session_pair(|_| {});
+        assert!(client.id() != server.id());
+        assert_eq!(client.clone().id(), client.id());
+    }
+
+    struct TestLogger {
+        messages: Mutex<Vec<(u64, String)>>,
+    }
+
+    impl Logger for TestLogger {
+        fn debug(&self, session_id: u64, message: &str) {
+            self.messages.lock().unwrap().push((session_id, format!("debug: {}", message)));
+        }
+
+        fn warning(&self, session_id: u64, message: &str) {
+            self.messages.lock().unwrap().push((session_id, format!("warning: {}", message)));
+        }
+
+        fn error(&self, session_id: u64, message: &str) {
+            self.messages.lock().unwrap().push((session_id, format!("error: {}", message)));
+        }
+    }
+
+    #[test]
+    fn logger_test() {
+        let logger = Arc::new(TestLogger{ messages: Mutex::new(vec![]) });
+        let (mut client, mut server) = session_pair(|cfg| cfg.logger = Some(logger.clone()));
+        client.close();
+        assert!(server.recv_command().is_err());
+
+        let messages = logger.messages.lock().unwrap();
+        assert!(messages.contains(&(client.id(), "debug: session established".to_string())));
+        assert!(messages.contains(&(server.id(), "debug: session established".to_string())));
+        assert!(messages.contains(&(client.id(), "debug: session closed".to_string())));
+        assert!(messages.iter().any(|x| x.0 == server.id() && x.1.starts_with("debug: receive failed")));
+    }
+
+    #[test]
+    fn trace_test() {
+        let frames = Arc::new(Mutex::new(vec![]));
+        let (mut client, mut server) = session_pair(|cfg| {
+            let frames = frames.clone();
+            cfg.trace = Some(Arc::new(move |id, direction, len, name| frames.lock().unwrap().push((id, direction, len, name))));
+        });
+        frames.lock().unwrap().clear();
+        client.send_command(&Command::RetrieveMessage{ sequence: 1 }).unwrap();
+        server.recv_command().unwrap();
+
+        let frames = frames.lock().unwrap();
+        assert_eq!(frames.len(), 2);
+        assert_eq!((frames[0].0, frames[0].1, frames[0].3), (client.id(), Direction::Sent, "RetrieveMessage"));
+        assert_eq!((frames[1].0, frames[1].1, frames[1].3), (server.id(), Direction::Received, "RetrieveMessage"));
+        assert_eq!(frames[0].2, frames[1].2);
+    }
+
+    #[test]
+    fn negotiated_parameters_test() {
+        let (client, server) = session_pair(|_| {});
+        let parameters = client.negotiated_parameters().unwrap();
+        assert_eq!(parameters, server.negotiated_parameters().unwrap());
+        assert_eq!(parameters.noise_protocol, "Noise_XXhfs_25519+Kyber1024_ChaChaPoly_BLAKE2b");
+        assert_eq!(parameters.pattern, HandshakePattern::XX);
+        assert_eq!(parameters.version, EXTENDED_PROTOCOL_VERSION);
+        assert!(!parameters.network_key);
+    }
+
+    #[test]
+    fn send_queue_test() {
+        let (client, mut server) = session_pair(|_| {});
+        let queue = client.send_queue();
+        for i in 0..10 {
+            queue.send(Command::RetrieveMessage{ sequence: i }).unwrap();
+        }
+        queue.flush().unwrap();
+        assert_eq!(queue.len(), 0);
+        for i in 0..10 {
+            assert_eq!(server.recv_command().unwrap(), Command::RetrieveMessage{ sequence: i });
+        }
+    }
+
+    #[test]
+    fn urgent_lane_test() {
+        let (mut client, mut server) = session_pair(|cfg| cfg.flow_control = true);
+        // the writer gives up waiting for credits once the test is done
+        client.set_write_deadline(Some(time::Instant::now() + Duration::from_secs(2))).unwrap();
+        let queue = client.send_queue_with_limits(QueueLimits {
+            max_commands: Some(1),
+            max_bytes: None,
+            policy: OverflowPolicy::WouldBlock,
+        });
+        let packet = Command::SendPacket{ sphinx_packet: vec![1u8; 100] };
+        queue.send(packet.clone()).unwrap();
+        while queue.len() > 0 {
+            thread::sleep(Duration::from_millis(1));
+        }
+        queue.send(packet.clone()).unwrap();
+        match queue.send(packet) {
+            Err(SendMessageError::WouldBlock) => {},
+            x => panic!("expected a full queue, got {:?}", x),
+        }
+
+        // a Disconnect passes the packets stuck behind flow control
+        queue.send(Command::Disconnect{ reason: DISCONNECT_NORMAL }).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+    }
+
+    #[test]
+    fn close_with_error_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let closer = thread::spawn(move|| {
+            server.close_with_error(ERROR_OVERLOADED, time::Instant::now() + Duration::from_secs(5)).unwrap();
+        });
+        assert_eq!(client.recv_command().unwrap(), Command::Error{ reason: ERROR_OVERLOADED });
+        assert_eq!(client.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+        client.close();
+        closer.join().unwrap();
+    }
+
+    #[test]
+    fn disconnect_reason_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        let closer = thread::spawn(move|| {
+            client.close_gracefully_with_reason(DISCONNECT_SHUTDOWN, time::Instant::now() + Duration::from_secs(5)).unwrap();
+        });
+        assert_eq!(server.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_SHUTDOWN });
+        // the receiver stops sending and the closer sees it finish
+        assert_eq!(server.state(), SessionState::Draining);
+        match server.send_command(&Command::NoOp{}) {
+            Err(SendMessageError::SessionClosed) => {},
+            _ => panic!("expected a draining session"),
+        }
+        closer.join().unwrap();
+        server.close();
+    }
+
+    #[test]
+    fn katzenpost_commands_test() {
+        // Katzenpost's protocol version carries none of the extensions
+        let (mut client, mut server) = session_pair(|cfg| cfg.versions = vec![PROTOCOL_VERSION]);
+        let deadline = time::Instant::now() + Duration::from_secs(5);
+        match client.close_gracefully_with_reason(DISCONNECT_SHUTDOWN, deadline) {
+            Err(SendMessageError::UnsupportedCommand("Disconnect")) => {},
+            _ => panic!("expected an unsupported Disconnect reason"),
+        }
+        match client.close_with_error(ERROR_PROTOCOL_VIOLATION, deadline) {
+            Err(SendMessageError::UnsupportedCommand("Error")) => {},
+            _ => panic!("expected an unsupported Error"),
+        }
+        match client.close_write() {
+            Err(SendMessageError::UnsupportedCommand("CloseWrite")) => {},
+            _ => panic!("expected an unsupported CloseWrite"),
+        }
+        match client.send_command(&Command::Data{ payload: vec![1u8; 8] }) {
+            Err(SendMessageError::UnsupportedCommand("Data")) => {},
+            _ => panic!("expected an unsupported Data"),
+        }
+        // the session stays open and consecutive commands go unbatched
+        let cmds = vec![Command::RetrieveMessage{ sequence: 1 }, Command::RetrieveMessage{ sequence: 2 }];
+        client.send_commands(&cmds).unwrap();
+        assert_eq!(server.recv_command().unwrap(), cmds[0]);
+        assert_eq!(server.recv_command().unwrap(), cmds[1]);
+        let closer = thread::spawn(move|| {
+            client.close_gracefully(deadline).unwrap();
+        });
+        assert_eq!(server.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_NORMAL });
+        server.close();
+        closer.join().unwrap();
+    }
+
+    #[test]
+    fn keepalive_test() {
+        let (mut client, mut server) = session_pair(|cfg| cfg.keepalive_interval = Some(Duration::from_millis(100)));
+        server.set_read_deadline(Some(time::Instant::now() + Duration::from_secs(2))).unwrap();
+        assert_eq!(server.recv_command().unwrap(), Command::NoOp{});
+        assert!(client.stats().last_sent.is_some());
+        client.close();
+    }
+
+    #[test]
+    fn idle_timeout_test() {
+        // only the client, which knows the server's key, times out
+        let (mut client, mut server) = session_pair(|cfg| {
+            if cfg.peer_public_key.is_some() {
+                cfg.idle_timeout = Some(Duration::from_millis(200));
+            }
+        });
+        match client.recv_command() {
+            Err(ReceiveMessageError::IdleTimeout) => {},
+            _ => panic!("expected an idle timeout"),
+        }
+        assert_eq!(client.state(), SessionState::Closed);
+        assert_eq!(server.recv_command().unwrap(), Command::Disconnect{ reason: DISCONNECT_IDLE_TIMEOUT });
+        server.close();
+
+        // keepalives from either side do not hold off the timeout
+        let (mut client, mut server) = session_pair(|cfg| {
+            cfg.keepalive_interval = Some(Duration::from_millis(50));
+            if cfg.peer_public_key.is_some() {
+                cfg.idle_timeout = Some(Duration::from_millis(300));
+            }
+        });
+        loop {
+            match client.recv_command() {
+                Ok(Command::NoOp{}) => {},
+                Err(ReceiveMessageError::IdleTimeout) => break,
+                _ => panic!("expected an idle timeout"),
+            }
+        }
+        loop {
+            match server.recv_command().unwrap() {
+                Command::NoOp{} => {},
+                cmd => {
+                    assert_eq!(cmd, Command::Disconnect{ reason: DISCONNECT_IDLE_TIMEOUT });
+                    break
+                },
+            }
+        }
+        server.close();
+    }
+
+    #[test]
+    fn close_write_test() {
+        let (mut client, mut server) = session_pair(|_| {});
+        client.send_command(&Command::RetrieveMessage{ sequence: 1 }).unwrap();
+        client.close_write().unwrap();
+        assert!(client.send_command(&Command::NoOp{}).is_err());
+
+        assert_eq!(server.recv_command().unwrap(), Command::RetrieveMessage{ sequence: 1 });
+        assert_eq!(server.recv_command().unwrap(), Command::CloseWrite{});
+        server.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+    }
+
+    #[test]
+    fn lifecycle_callbacks_test() {
+        let events = Arc::new(Mutex::new(vec![]));
+        let (mut client, server) = session_pair(|cfg| {
+            let handshake_events = events.clone();
+            let close_events = events.clone();
+            cfg.on_handshake_complete = Some(Arc::new(move |_, _| handshake_events.lock().unwrap().push("established")));
+            cfg.on_close = Some(Arc::new(move |_, e| close_events.lock().unwrap().push(if e.is_some() { "error" } else { "closed" })));
+        });
+        let mut client_clone = client.clone();
+        client.close();
+        client_clone.close();
+        drop(server);
+        let events = events.lock().unwrap();
+        assert_eq!(events.iter().filter(|x| **x == "established").count(), 2);
+        assert_eq!(events.iter().filter(|x| **x == "closed").count(), 1);
+    }
 }
@@ -0,0 +1,309 @@
+// testing.rs - in-process fixtures for testing applications
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! Fixtures for unit testing code built on sessions without binding
+//! ports. pipe returns two connected in-memory transports, and
+//! session_pair runs the real handshake over one, returning two
+//! sessions in transport mode that frame and encrypt commands just as
+//! they would over TCP.
+
+use std::collections::VecDeque;
+use std::io;
+use std::io::prelude::*;
+use std::net::Shutdown;
+use std::sync::{Arc, Condvar, Mutex, MutexGuard};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::errors::HandshakeError;
+use super::messages::SessionConfig;
+use super::sync::Session;
+use super::transport::Transport;
+
+/// The most bytes buffered in each direction of a pipe before writes
+/// wait for the reader.
+pub const PIPE_CAPACITY: usize = 256 * 1024;
+
+struct Buffer {
+    data: VecDeque<u8>,
+    // Set once the writing end shuts down writes or the reading end
+    // shuts down reads.
+    write_closed: bool,
+    read_closed: bool,
+}
+
+// One direction of a pipe.
+struct Direction {
+    buffer: Mutex<Buffer>,
+    changed: Condvar,
+}
+
+impl Direction {
+    fn new() -> Arc<Direction> {
+        Arc::new(Direction {
+            buffer: Mutex::new(Buffer {
+                data: VecDeque::new(),
+                write_closed: false,
+                read_closed: false,
+            }),
+            changed: Condvar::new(),
+        })
+    }
+
+    fn close(&self, write: bool, read: bool) {
+        let mut buffer = self.buffer.lock().unwrap();
+        buffer.write_closed |= write;
+        buffer.read_closed |= read;
+        self.changed.notify_all();
+    }
+}
+
+struct Timeouts {
+    read: Option<Duration>,
+    write: Option<Duration>,
+}
+
+// Shared by the clones of an end; dropping the last closes both
+// directions, as closing a socket would.
+struct End {
+    incoming: Arc<Direction>,
+    outgoing: Arc<Direction>,
+    timeouts: Mutex<Timeouts>,
+}
+
+impl Drop for End {
+    fn drop(&mut self) {
+        self.outgoing.close(true, false);
+        self.incoming.close(false, true);
+    }
+}
+
+/// One end of an in-memory pipe, implementing Transport. Reads wait
+/// for the other end to write and return end of file once it shuts
+/// down writes or is dropped; writes wait while PIPE_CAPACITY bytes
+/// are unread, and fail with BrokenPipe once the other end stops
+/// reading.
+pub struct Pipe {
+    end: Arc<End>,
+}
+
+/// Returns the two ends of an in-memory pipe.
+pub fn pipe() -> (Pipe, Pipe) {
+    let (a, b) = (Direction::new(), Direction::new());
+    let end = |incoming: &Arc<Direction>, outgoing: &Arc<Direction>| Pipe {
+        end: Arc::new(End {
+            incoming: incoming.clone(),
+            outgoing: outgoing.clone(),
+            timeouts: Mutex::new(Timeouts {
+                read: None,
+                write: None,
+            }),
+        }),
+    };
+    (end(&a, &b), end(&b, &a))
+}
+
+// Waits on direction until deadline, failing with WouldBlock once it
+// passes as a socket with a timeout would.
+fn wait<'a>(direction: &'a Direction, buffer: MutexGuard<'a, Buffer>,
+            deadline: Option<Instant>) -> io::Result<MutexGuard<'a, Buffer>> {
+    match deadline {
+        None => Ok(direction.changed.wait(buffer).unwrap()),
+        Some(deadline) => {
+            let now = Instant::now();
+            if now >= deadline {
+                return Err(io::Error::from(io::ErrorKind::WouldBlock));
+            }
+            Ok(direction.changed.wait_timeout(buffer, deadline - now).unwrap().0)
+        },
+    }
+}
+
+impl Read for Pipe {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let direction = &self.end.incoming;
+        let deadline = self.end.timeouts.lock().unwrap().read.map(|x| Instant::now() + x);
+        let mut buffer = direction.buffer.lock().unwrap();
+        loop {
+            if buffer.read_closed || buf.is_empty() {
+                return Ok(0)
+            }
+            if !buffer.data.is_empty() {
+                let n = buffer.data.len().min(buf.len());
+                for (i, x) in buffer.data.drain(..n).enumerate() {
+                    buf[i] = x;
+                }
+                direction.changed.notify_all();
+                return Ok(n)
+            }
+            if buffer.write_closed {
+                return Ok(0)
+            }
+            buffer = wait(direction, buffer, deadline)?;
+        }
+    }
+}
+
+impl Write for Pipe {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let direction = &self.end.outgoing;
+        let deadline = self.end.timeouts.lock().unwrap().write.map(|x| Instant::now() + x);
+        let mut buffer = direction.buffer.lock().unwrap();
+        loop {
+            if buffer.write_closed || buffer.read_closed {
+                return Err(io::Error::from(io::ErrorKind::BrokenPipe));
+            }
+            if buf.is_empty() {
+                return Ok(0)
+            }
+            if buffer.data.len() < PIPE_CAPACITY {
+                let n = (PIPE_CAPACITY - buffer.data.len()).min(buf.len());
+                buffer.data.extend(&buf[..n]);
+                direction.changed.notify_all();
+                return Ok(n)
+            }
+            buffer = wait(direction, buffer, deadline)?;
+        }
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        Ok(())
+    }
+}
+
+impl Transport for Pipe {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(Pipe {
+            end: self.end.clone(),
+        }))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.end.timeouts.lock().unwrap().read = timeout;
+        Ok(())
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.end.timeouts.lock().unwrap().write = timeout;
+        Ok(())
+    }
+
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        if how != Shutdown::Read {
+            self.end.outgoing.close(true, false);
+        }
+        if how != Shutdown::Write {
+            self.end.incoming.close(false, true);
+        }
+        Ok(())
+    }
+}
+
+fn handshake(config: SessionConfig, is_initiator: bool, transport: Pipe) -> Result<Session, HandshakeError> {
+    let mut session = Session::new(config, is_initiator)?;
+    session.initialize_transport(transport)?;
+    session = session.into_transport_mode()?;
+    session.finalize_handshake()?;
+    Ok(session)
+}
+
+/// Runs the handshake between a client with client_config and a
+/// server with server_config over a pipe, returning the client and
+/// server sessions in transport mode. Either side's handshake error
+/// is returned, the client's first.
+pub fn session_pair(client_config: SessionConfig, server_config: SessionConfig)
+                    -> Result<(Session, Session), HandshakeError> {
+    let (client, server) = pipe();
+    let server = thread::spawn(move|| handshake(server_config, false, server));
+    // A failed handshake drops its end, so the other side fails too
+    // rather than waiting.
+    let client = handshake(client_config, true, client);
+    let server = server.join().expect("server handshake panicked");
+    Ok((client?, server?))
+}
+
+
+#[cfg(test)]
+mod tests {
+    extern crate rand_core;
+
+    use std::collections::HashMap;
+
+    use x25519_dalek_ng::{PublicKey, StaticSecret};
+
+    use self::rand_core::OsRng;
+
+    use super::*;
+    use super::super::commands::Command;
+    use super::super::messages::{PeerAuthenticator, ProviderAuthenticatorState, ClientAuthenticatorState};
+
+    #[test]
+    fn pipe_test() {
+        let (mut a, mut b) = pipe();
+        let data: Vec<u8> = (0..PIPE_CAPACITY as u32 + 1000).map(|x| x as u8).collect();
+        let expected = data.clone();
+        let mut writer = a.try_clone_transport().unwrap();
+        let writer = thread::spawn(move|| {
+            writer.write_all(&data).unwrap();
+            writer.shutdown(Shutdown::Write).unwrap();
+        });
+        let mut received = vec![];
+        b.read_to_end(&mut received).unwrap();
+        assert_eq!(received, expected);
+        writer.join().unwrap();
+
+        b.set_read_timeout(Some(Duration::from_millis(10))).unwrap();
+        b.write_all(b"reply").unwrap();
+        let mut reply = [0u8; 5];
+        a.read_exact(&mut reply).unwrap();
+        assert_eq!(&reply, b"reply");
+        drop(a);
+        assert_eq!(b.write(b"late").unwrap_err().kind(), io::ErrorKind::BrokenPipe);
+
+        let (a, mut b) = pipe();
+        b.set_read_timeout(Some(Duration::from_millis(10))).unwrap();
+        assert_eq!(b.read(&mut reply).unwrap_err().kind(), io::ErrorKind::WouldBlock);
+        drop(a);
+        assert_eq!(b.read(&mut reply).unwrap(), 0);
+    }
+
+    #[test]
+    fn session_pair_test() {
+        let client_secret = StaticSecret::new(OsRng);
+        let server_secret = StaticSecret::new(OsRng);
+        let mut client_map = HashMap::new();
+        client_map.insert(PublicKey::from(&client_secret), true);
+        let provider_auth = ProviderAuthenticatorState {
+            mix_map: HashMap::default(),
+            client_map: client_map,
+            from_client: false,
+            from_mix: false,
+        };
+        let client_auth = ClientAuthenticatorState{
+            peer_public_key: PublicKey::from(&server_secret),
+        };
+        let server_public_key = PublicKey::from(&server_secret);
+        let server_config = SessionConfig::new(PeerAuthenticator::Provider(provider_auth), server_secret, None, vec![]);
+        let client_config = SessionConfig::new(PeerAuthenticator::Client(client_auth), client_secret, Some(server_public_key), vec![]);
+
+        let (mut client, mut server) = session_pair(client_config, server_config).unwrap();
+        let cmd = Command::SendPacket{ sphinx_packet: vec![1u8; 5000] };
+        client.send_command(&cmd).unwrap();
+        assert_eq!(server.recv_command().unwrap(), cmd);
+        server.send_command(&Command::NoOp{}).unwrap();
+        assert_eq!(client.recv_command().unwrap(), Command::NoOp{});
+    }
+}
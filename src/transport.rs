@@ -0,0 +1,226 @@
+// transport.rs - byte stream transports for sessions
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! The byte stream a session runs over. TCP is the usual transport,
+//! but anything that can be read, written, shared between a reader
+//! and a writer and shut down will do, such as pipes, serial links,
+//! pluggable transport shims and in-process test fixtures such as
+//! testing::pipe. Unix domain sockets also report the credentials of
+//! the peer process, which authenticators may check, see
+//! ProcessRestrictedAuthenticatorState.
+
+#[cfg(unix)]
+extern crate libc;
+
+use std::io;
+use std::io::prelude::*;
+use std::net::{Shutdown, SocketAddr, TcpStream};
+use std::time::Duration;
+#[cfg(unix)]
+use std::fs;
+#[cfg(unix)]
+use std::os::unix::fs::FileTypeExt;
+#[cfg(unix)]
+use std::os::unix::net::{UnixListener, UnixStream};
+#[cfg(unix)]
+use std::path::Path;
+
+use super::messages::PeerProcess;
+
+/// A reliable, ordered byte stream for a session, see
+/// Session::initialize_transport.
+pub trait Transport: Read + Write + Send {
+    /// Returns another handle to the same stream. Sessions read
+    /// through one handle while writing through another.
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>>;
+
+    /// Bounds each later read, or removes the bound given None. A
+    /// read that times out fails with WouldBlock or TimedOut.
+    /// Transports that cannot time out may ignore this, in which case
+    /// read deadlines are not enforced.
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()>;
+
+    /// Like set_read_timeout, for writes.
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()>;
+
+    /// Shuts down the given directions of the stream for every handle,
+    /// unblocking reads and writes in progress.
+    fn shutdown(&self, how: Shutdown) -> io::Result<()>;
+
+    /// Returns the address of the remote end, if the transport has one.
+    fn peer_addr(&self) -> Option<SocketAddr> {
+        None
+    }
+
+    /// Returns the address of the local end, if the transport has one.
+    fn local_addr(&self) -> Option<SocketAddr> {
+        None
+    }
+
+    /// Returns the credentials of the process at the remote end, if
+    /// the transport is local and the platform reports them.
+    fn peer_process(&self) -> Option<PeerProcess> {
+        None
+    }
+}
+
+impl Transport for TcpStream {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(TcpStream::try_clone(self)?))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        TcpStream::set_read_timeout(self, timeout)
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        TcpStream::set_write_timeout(self, timeout)
+    }
+
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        TcpStream::shutdown(self, how)
+    }
+
+    fn peer_addr(&self) -> Option<SocketAddr> {
+        TcpStream::peer_addr(self).ok()
+    }
+
+    fn local_addr(&self) -> Option<SocketAddr> {
+        TcpStream::local_addr(self).ok()
+    }
+}
+
+#[cfg(unix)]
+impl Transport for UnixStream {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(UnixStream::try_clone(self)?))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        UnixStream::set_read_timeout(self, timeout)
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        UnixStream::set_write_timeout(self, timeout)
+    }
+
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        UnixStream::shutdown(self, how)
+    }
+
+    fn peer_process(&self) -> Option<PeerProcess> {
+        unix_peer_process(self)
+    }
+}
+
+// SO_PEERCRED reports the credentials the peer had when it connected.
+#[cfg(any(target_os = "linux", target_os = "android"))]
+fn unix_peer_process(stream: &UnixStream) -> Option<PeerProcess> {
+    use std::mem;
+    use std::os::unix::io::AsRawFd;
+
+    let mut credentials = libc::ucred{ pid: 0, uid: 0, gid: 0 };
+    let mut len = mem::size_of::<libc::ucred>() as libc::socklen_t;
+    let result = unsafe {
+        libc::getsockopt(stream.as_raw_fd(), libc::SOL_SOCKET, libc::SO_PEERCRED,
+                         &mut credentials as *mut libc::ucred as *mut libc::c_void, &mut len)
+    };
+    if result != 0 || len as usize != mem::size_of::<libc::ucred>() {
+        return None
+    }
+    Some(PeerProcess{ pid: Some(credentials.pid as u32), uid: credentials.uid, gid: credentials.gid })
+}
+
+// The BSDs report the effective IDs but not the pid.
+#[cfg(any(target_os = "macos", target_os = "ios", target_os = "freebsd", target_os = "openbsd",
+          target_os = "netbsd", target_os = "dragonfly"))]
+fn unix_peer_process(stream: &UnixStream) -> Option<PeerProcess> {
+    use std::os::unix::io::AsRawFd;
+
+    let (mut uid, mut gid) = (0, 0);
+    if unsafe { libc::getpeereid(stream.as_raw_fd(), &mut uid, &mut gid) } != 0 {
+        return None
+    }
+    Some(PeerProcess{ pid: None, uid, gid })
+}
+
+#[cfg(all(unix, not(any(target_os = "linux", target_os = "android", target_os = "macos", target_os = "ios",
+                        target_os = "freebsd", target_os = "openbsd", target_os = "netbsd", target_os = "dragonfly"))))]
+fn unix_peer_process(_stream: &UnixStream) -> Option<PeerProcess> {
+    None
+}
+
+/// Connects to the Unix domain socket at path.
+#[cfg(unix)]
+pub fn dial_unix<P: AsRef<Path>>(path: P) -> io::Result<UnixStream> {
+    UnixStream::connect(path)
+}
+
+/// Listens on a Unix domain socket at path, first removing a socket
+/// left there by an earlier listener. Any other file at path is an
+/// error. Sessions accepted from it learn each peer's process
+/// credentials.
+#[cfg(unix)]
+pub fn listen_unix<P: AsRef<Path>>(path: P) -> io::Result<UnixListener> {
+    let path = path.as_ref();
+    match fs::symlink_metadata(path) {
+        Ok(ref metadata) if metadata.file_type().is_socket() => fs::remove_file(path)?,
+        Ok(_) => return Err(io::Error::new(io::ErrorKind::AlreadyExists, "not a socket")),
+        Err(ref e) if e.kind() == io::ErrorKind::NotFound => {},
+        Err(e) => return Err(e),
+    }
+    UnixListener::bind(path)
+}
+
+
+#[cfg(all(test, unix))]
+mod tests {
+    use std::env;
+    use std::os::unix::fs::MetadataExt;
+    use std::process;
+    use std::thread;
+
+    use super::*;
+
+    #[test]
+    fn unix_transport_test() {
+        let path = env::temp_dir().join(format!("mix_link_transport_test_{}.sock", process::id()));
+        let listener = listen_unix(&path).unwrap();
+        // a socket left behind is replaced
+        let listener = { drop(listener); listen_unix(&path).unwrap() };
+        let server = thread::spawn(move|| {
+            let (stream, _) = listener.accept().unwrap();
+            let mut stream: Box<dyn Transport> = Box::new(stream);
+            let process = stream.peer_process();
+            stream.write_all(b"hello").unwrap();
+            process
+        });
+        let mut client = dial_unix(&path).unwrap();
+        let mut received = [0u8; 5];
+        client.read_exact(&mut received).unwrap();
+        assert_eq!(&received, b"hello");
+
+        let process = server.join().unwrap();
+        if cfg!(any(target_os = "linux", target_os = "android")) {
+            let metadata = fs::metadata(&path).unwrap();
+            let process = process.unwrap();
+            assert_eq!(process.pid, Some(process::id()));
+            assert_eq!(process.uid, metadata.uid());
+        }
+        fs::remove_file(&path).unwrap();
+        assert!(listen_unix(env::temp_dir()).is_err());
+    }
+}
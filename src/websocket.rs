@@ -0,0 +1,613 @@
+// websocket.rs - sessions over WebSocket connections
+// Copyright (C) 2021  David Anthony Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//! A WebSocket (RFC 6455) transport, for clients behind proxies and
+//! firewalls that only pass HTTP. The session's frames are carried
+//! in binary WebSocket messages over a TCP connection upgraded from
+//! HTTP; the Noise handshake still authenticates the peers, so the
+//! WebSocket layer adds no security of its own. TLS is left to a
+//! terminating proxy in front of the listener.
+
+extern crate base64;
+extern crate getrandom;
+
+use std::io;
+use std::io::prelude::*;
+use std::net::{Shutdown, SocketAddr, TcpListener, TcpStream, ToSocketAddrs};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use byteorder::{ByteOrder, BigEndian};
+
+use self::base64::Engine;
+use self::base64::engine::general_purpose::STANDARD;
+
+use super::transport::Transport;
+
+// Appended to the client's key to derive Sec-WebSocket-Accept.
+const ACCEPT_GUID: &str = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11";
+
+// Bounds the HTTP request and response heads of the handshake.
+const MAX_HEAD_SIZE: usize = 8192;
+
+const OPCODE_CONTINUATION: u8 = 0x0;
+const OPCODE_BINARY: u8 = 0x2;
+const OPCODE_CLOSE: u8 = 0x8;
+const OPCODE_PING: u8 = 0x9;
+const OPCODE_PONG: u8 = 0xa;
+
+const MAX_CONTROL_PAYLOAD_SIZE: usize = 125;
+
+fn invalid_data(message: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, message.to_string())
+}
+
+// SHA-1, used only to derive Sec-WebSocket-Accept, which guards
+// against confused HTTP intermediaries rather than attackers.
+fn sha1(data: &[u8]) -> [u8; 20] {
+    let mut h: [u32; 5] = [0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0];
+    let mut message = data.to_vec();
+    message.push(0x80);
+    while message.len() % 64 != 56 {
+        message.push(0);
+    }
+    let mut length = [0u8; 8];
+    BigEndian::write_u64(&mut length, data.len() as u64 * 8);
+    message.extend(&length);
+    for block in message.chunks(64) {
+        let mut w = [0u32; 80];
+        for i in 0..16 {
+            w[i] = BigEndian::read_u32(&block[4 * i..]);
+        }
+        for i in 16..80 {
+            w[i] = (w[i - 3] ^ w[i - 8] ^ w[i - 14] ^ w[i - 16]).rotate_left(1);
+        }
+        let (mut a, mut b, mut c, mut d, mut e) = (h[0], h[1], h[2], h[3], h[4]);
+        for (i, x) in w.iter().enumerate() {
+            let (f, k) = match i {
+                0..=19 => ((b & c) | (!b & d), 0x5a827999),
+                20..=39 => (b ^ c ^ d, 0x6ed9eba1),
+                40..=59 => ((b & c) | (b & d) | (c & d), 0x8f1bbcdc),
+                _ => (b ^ c ^ d, 0xca62c1d6),
+            };
+            let t = a.rotate_left(5).wrapping_add(f).wrapping_add(e).wrapping_add(k).wrapping_add(*x);
+            e = d;
+            d = c;
+            c = b.rotate_left(30);
+            b = a;
+            a = t;
+        }
+        for (x, y) in h.iter_mut().zip([a, b, c, d, e].iter()) {
+            *x = x.wrapping_add(*y);
+        }
+    }
+    let mut out = [0u8; 20];
+    for i in 0..5 {
+        BigEndian::write_u32(&mut out[4 * i..], h[i]);
+    }
+    out
+}
+
+fn accept_key(key: &str) -> String {
+    STANDARD.encode(&sha1(format!("{}{}", key, ACCEPT_GUID).as_bytes()))
+}
+
+// Reads an HTTP head up to and including the blank line ending it,
+// a byte at a time so that no frame bytes after it are consumed.
+fn read_head(stream: &mut TcpStream) -> io::Result<String> {
+    let mut head = vec![];
+    let mut byte = [0u8; 1];
+    while !head.ends_with(b"\r\n\r\n") {
+        if head.len() == MAX_HEAD_SIZE {
+            return Err(invalid_data("WebSocket handshake too large"));
+        }
+        if stream.read(&mut byte)? == 0 {
+            return Err(io::Error::from(io::ErrorKind::UnexpectedEof));
+        }
+        head.push(byte[0]);
+    }
+    String::from_utf8(head).map_err(|_| invalid_data("WebSocket handshake is not UTF-8"))
+}
+
+// Returns the value of an HTTP header, matching its name case
+// insensitively.
+fn header<'a>(head: &'a str, name: &str) -> Option<&'a str> {
+    head.split("\r\n").skip(1).filter_map(|line| {
+        let mut parts = line.splitn(2, ':');
+        match (parts.next(), parts.next()) {
+            (Some(key), Some(value)) if key.trim().eq_ignore_ascii_case(name) => Some(value.trim()),
+            _ => None,
+        }
+    }).next()
+}
+
+// Returns true if a comma separated header lists token.
+fn header_has(head: &str, name: &str, token: &str) -> bool {
+    header(head, name).map_or(false, |x| x.split(',').any(|y| y.trim().eq_ignore_ascii_case(token)))
+}
+
+struct ReadState {
+    // The header of the next frame, as much of it as has been read.
+    header: Vec<u8>,
+    // The payload left of the frame being read, and its mask.
+    remaining: u64,
+    mask: Option<[u8; 4]>,
+    offset: usize,
+    // The opcode and payload of a control frame being read.
+    control: Option<(u8, usize)>,
+    control_payload: Vec<u8>,
+    closed: bool,
+}
+
+struct WriteState {
+    stream: TcpStream,
+    // The bytes of frames not yet sent, kept so that a write that
+    // times out loses nothing.
+    unsent: Vec<u8>,
+    close_sent: bool,
+}
+
+impl WriteState {
+    // Sends the unsent bytes, keeping whatever a failed write leaves.
+    fn send(&mut self) -> io::Result<()> {
+        while !self.unsent.is_empty() {
+            match self.stream.write(&self.unsent) {
+                Ok(0) => return Err(io::Error::from(io::ErrorKind::WriteZero)),
+                Ok(n) => {
+                    self.unsent.drain(..n);
+                },
+                Err(ref e) if e.kind() == io::ErrorKind::Interrupted => {},
+                Err(e) => return Err(e),
+            }
+        }
+        Ok(())
+    }
+}
+
+/// A WebSocket connection, implementing Transport. Each write is sent
+/// as one binary message. Pings are answered while reading, and a
+/// Close frame from the peer reads as end of file. Reads and writes
+/// resume after timing out, so read and write deadlines work as they
+/// do over TCP: the rest of a frame a timed out write leaves unsent
+/// goes out first on the next write or flush.
+pub struct WebSocket {
+    stream: TcpStream,
+    is_client: bool,
+    read: Arc<Mutex<ReadState>>,
+    write: Arc<Mutex<WriteState>>,
+}
+
+impl WebSocket {
+    fn new(stream: TcpStream, is_client: bool) -> io::Result<WebSocket> {
+        Ok(WebSocket {
+            write: Arc::new(Mutex::new(WriteState {
+                stream: stream.try_clone()?,
+                unsent: vec![],
+                close_sent: false,
+            })),
+            stream,
+            is_client,
+            read: Arc::new(Mutex::new(ReadState {
+                header: vec![],
+                remaining: 0,
+                mask: None,
+                offset: 0,
+                control: None,
+                control_payload: vec![],
+                closed: false,
+            })),
+        })
+    }
+
+    /// Performs the client's opening handshake over stream, which may
+    /// already run through a proxy, requesting path from host.
+    pub fn client(mut stream: TcpStream, host: &str, path: &str) -> io::Result<WebSocket> {
+        let mut nonce = [0u8; 16];
+        getrandom::getrandom(&mut nonce).map_err(|e| io::Error::new(io::ErrorKind::Other, e.to_string()))?;
+        let key = STANDARD.encode(&nonce);
+        let request = format!("GET {} HTTP/1.1\r\nHost: {}\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\
+                               Sec-WebSocket-Key: {}\r\nSec-WebSocket-Version: 13\r\n\r\n", path, host, key);
+        stream.write_all(request.as_bytes())?;
+        let head = read_head(&mut stream)?;
+        let status = head.split(' ').nth(1);
+        if !head.starts_with("HTTP/1.1 ") || status != Some("101") {
+            return Err(invalid_data("WebSocket upgrade refused"));
+        }
+        if !header_has(&head, "Upgrade", "websocket") || header(&head, "Sec-WebSocket-Accept") != Some(&accept_key(&key)[..]) {
+            return Err(invalid_data("invalid WebSocket upgrade response"));
+        }
+        WebSocket::new(stream, true)
+    }
+
+    /// Performs the server's opening handshake over stream, accepting
+    /// an upgrade of path. A refused request is answered with an HTTP
+    /// error before failing.
+    pub fn server(mut stream: TcpStream, path: &str) -> io::Result<WebSocket> {
+        let head = read_head(&mut stream)?;
+        let mut request_line = head.split("\r\n").next().unwrap_or("").split(' ');
+        let (method, target) = (request_line.next(), request_line.next());
+        let refusal = if method != Some("GET") || target != Some(path) {
+            Some("404 Not Found\r\n")
+        } else if header(&head, "Sec-WebSocket-Version") != Some("13") {
+            Some("426 Upgrade Required\r\nSec-WebSocket-Version: 13\r\n")
+        } else if !header_has(&head, "Upgrade", "websocket") || !header_has(&head, "Connection", "upgrade") ||
+            header(&head, "Sec-WebSocket-Key").is_none() {
+            Some("400 Bad Request\r\n")
+        } else {
+            None
+        };
+        if let Some(status) = refusal {
+            let _ = stream.write_all(format!("HTTP/1.1 {}Content-Length: 0\r\nConnection: close\r\n\r\n", status).as_bytes());
+            return Err(invalid_data("invalid WebSocket upgrade request"));
+        }
+        let accept = accept_key(header(&head, "Sec-WebSocket-Key").unwrap());
+        let response = format!("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\
+                                Sec-WebSocket-Accept: {}\r\n\r\n", accept);
+        stream.write_all(response.as_bytes())?;
+        WebSocket::new(stream, false)
+    }
+
+    // Queues one frame and sends what is unsent.
+    fn write_frame(&self, state: &mut WriteState, opcode: u8, payload: &[u8]) -> io::Result<()> {
+        let frame = self.frame(opcode, payload)?;
+        state.unsent.extend(frame);
+        state.send()
+    }
+
+    // Encodes one frame, masked if this is the client.
+    fn frame(&self, opcode: u8, payload: &[u8]) -> io::Result<Vec<u8>> {
+        let mut frame = vec![0x80 | opcode];
+        let mask_bit = if self.is_client { 0x80 } else { 0 };
+        if payload.len() < 126 {
+            frame.push(mask_bit | payload.len() as u8);
+        } else if payload.len() <= 0xffff {
+            frame.push(mask_bit | 126);
+            frame.extend(&[(payload.len() >> 8) as u8, payload.len() as u8]);
+        } else {
+            frame.push(mask_bit | 127);
+            let mut length = [0u8; 8];
+            BigEndian::write_u64(&mut length, payload.len() as u64);
+            frame.extend(&length);
+        }
+        let start = frame.len();
+        frame.extend(payload);
+        if self.is_client {
+            let mut mask = [0u8; 4];
+            getrandom::getrandom(&mut mask).map_err(|e| io::Error::new(io::ErrorKind::Other, e.to_string()))?;
+            for (i, x) in frame[start..].iter_mut().enumerate() {
+                *x ^= mask[i % 4];
+            }
+            frame.splice(start..start, mask.iter().cloned());
+        }
+        Ok(frame)
+    }
+
+    fn send_close(&self) -> io::Result<()> {
+        let mut state = self.write.lock().unwrap();
+        if state.close_sent {
+            return Ok(())
+        }
+        state.close_sent = true;
+        self.write_frame(&mut state, OPCODE_CLOSE, &[])
+    }
+
+    // Reads into buf, keeping what was read in state so that a read
+    // that times out loses nothing.
+    fn read_some(&self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = (&self.stream).read(buf)?;
+        if n == 0 {
+            return Err(io::Error::from(io::ErrorKind::UnexpectedEof));
+        }
+        Ok(n)
+    }
+
+    // Reads the next frame header into state, returning false at end
+    // of file on a frame boundary.
+    fn read_header(&self, state: &mut ReadState) -> io::Result<bool> {
+        loop {
+            let needed = match state.header.len() {
+                0 | 1 => 2,
+                _ => {
+                    let mask = if state.header[1] & 0x80 != 0 { 4 } else { 0 };
+                    match state.header[1] & 0x7f {
+                        126 => 4 + mask,
+                        127 => 10 + mask,
+                        _ => 2 + mask,
+                    }
+                },
+            };
+            if state.header.len() == needed {
+                return Ok(true)
+            }
+            let mut chunk = [0u8; 14];
+            let n = match self.read_some(&mut chunk[..needed - state.header.len()]) {
+                Err(ref e) if e.kind() == io::ErrorKind::UnexpectedEof && state.header.is_empty() => return Ok(false),
+                x => x?,
+            };
+            state.header.extend(&chunk[..n]);
+        }
+    }
+
+    // Handles a complete control frame.
+    fn handle_control(&self, state: &mut ReadState, opcode: u8) -> io::Result<()> {
+        match opcode {
+            // A pong the socket does not take at once goes out with
+            // the next write.
+            OPCODE_PING => {
+                let mut write = self.write.lock().unwrap();
+                if !write.close_sent {
+                    let frame = self.frame(OPCODE_PONG, &state.control_payload)?;
+                    write.unsent.extend(frame);
+                    let _ = write.send();
+                }
+            },
+            OPCODE_CLOSE => {
+                state.closed = true;
+                self.send_close()?;
+            },
+            _ => {},
+        }
+        Ok(())
+    }
+}
+
+impl Read for WebSocket {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        if buf.is_empty() {
+            return Ok(0)
+        }
+        let read = self.read.clone();
+        let mut state = read.lock().unwrap();
+        loop {
+            if state.closed {
+                return Ok(0)
+            }
+            if let Some((opcode, len)) = state.control {
+                while state.control_payload.len() < len {
+                    let mut chunk = [0u8; MAX_CONTROL_PAYLOAD_SIZE];
+                    let n = self.read_some(&mut chunk[..len - state.control_payload.len()])?;
+                    let offset = state.control_payload.len();
+                    if let Some(mask) = state.mask {
+                        for (i, x) in chunk[..n].iter_mut().enumerate() {
+                            *x ^= mask[(offset + i) % 4];
+                        }
+                    }
+                    state.control_payload.extend(&chunk[..n]);
+                }
+                state.control = None;
+                self.handle_control(&mut state, opcode)?;
+                state.control_payload.clear();
+                continue
+            }
+            if state.remaining > 0 {
+                let len = buf.len().min(state.remaining.min(usize::max_value() as u64) as usize);
+                let n = self.read_some(&mut buf[..len])?;
+                if let Some(mask) = state.mask {
+                    for (i, x) in buf[..n].iter_mut().enumerate() {
+                        *x ^= mask[(state.offset + i) % 4];
+                    }
+                }
+                state.offset += n;
+                state.remaining -= n as u64;
+                return Ok(n)
+            }
+            if !self.read_header(&mut state)? {
+                return Ok(0)
+            }
+            let header = ::std::mem::replace(&mut state.header, vec![]);
+            let (fin, opcode, masked) = (header[0] & 0x80 != 0, header[0] & 0x0f, header[1] & 0x80 != 0);
+            if header[0] & 0x70 != 0 || masked == self.is_client {
+                return Err(invalid_data("invalid WebSocket frame"));
+            }
+            let (len, mask_offset) = match header[1] & 0x7f {
+                126 => (BigEndian::read_u16(&header[2..4]) as u64, 4),
+                127 => (BigEndian::read_u64(&header[2..10]), 10),
+                x => (x as u64, 2),
+            };
+            state.mask = if masked { Some(*array_ref![header, mask_offset, 4]) } else { None };
+            state.offset = 0;
+            match opcode {
+                OPCODE_CONTINUATION | OPCODE_BINARY => state.remaining = len,
+                OPCODE_CLOSE | OPCODE_PING | OPCODE_PONG if fin && len as usize <= MAX_CONTROL_PAYLOAD_SIZE => {
+                    state.control = Some((opcode, len as usize));
+                },
+                _ => return Err(invalid_data("invalid WebSocket frame")),
+            }
+        }
+    }
+}
+
+impl Write for WebSocket {
+    fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+        let mut state = self.write.lock().unwrap();
+        if state.close_sent {
+            return Err(io::Error::from(io::ErrorKind::BrokenPipe));
+        }
+        // buf counts as written once its frame is queued; a failure
+        // sending it is returned by the next write or flush.
+        state.send()?;
+        let frame = self.frame(OPCODE_BINARY, buf)?;
+        state.unsent.extend(frame);
+        let _ = state.send();
+        Ok(buf.len())
+    }
+
+    fn flush(&mut self) -> io::Result<()> {
+        self.write.lock().unwrap().send()
+    }
+}
+
+impl Transport for WebSocket {
+    fn try_clone_transport(&self) -> io::Result<Box<dyn Transport>> {
+        Ok(Box::new(WebSocket {
+            stream: self.stream.try_clone()?,
+            is_client: self.is_client,
+            read: self.read.clone(),
+            write: self.write.clone(),
+        }))
+    }
+
+    fn set_read_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.stream.set_read_timeout(timeout)
+    }
+
+    fn set_write_timeout(&self, timeout: Option<Duration>) -> io::Result<()> {
+        self.stream.set_write_timeout(timeout)
+    }
+
+    /// Sends a Close frame before shutting down writes.
+    fn shutdown(&self, how: Shutdown) -> io::Result<()> {
+        if how != Shutdown::Read {
+            let _ = self.send_close();
+        }
+        self.stream.shutdown(how)
+    }
+
+    fn peer_addr(&self) -> Option<SocketAddr> {
+        self.stream.peer_addr().ok()
+    }
+
+    fn local_addr(&self) -> Option<SocketAddr> {
+        self.stream.local_addr().ok()
+    }
+}
+
+/// Connects to addr, a host and port, and upgrades the connection to
+/// a WebSocket at path.
+pub fn dial_websocket(addr: &str, path: &str) -> io::Result<WebSocket> {
+    WebSocket::client(TcpStream::connect(addr)?, addr, path)
+}
+
+/// Accepts WebSocket connections at a path.
+pub struct WebSocketListener {
+    listener: TcpListener,
+    path: String,
+}
+
+impl WebSocketListener {
+    pub fn local_addr(&self) -> io::Result<SocketAddr> {
+        self.listener.local_addr()
+    }
+
+    /// Accepts a connection and performs the server's handshake on it.
+    /// A refused handshake fails this call only, so callers should
+    /// keep accepting. The handshake is bounded by timeout if given.
+    pub fn accept(&self, timeout: Option<Duration>) -> io::Result<WebSocket> {
+        let (stream, _) = self.listener.accept()?;
+        stream.set_read_timeout(timeout)?;
+        stream.set_write_timeout(timeout)?;
+        let websocket = WebSocket::server(stream, &self.path)?;
+        websocket.stream.set_read_timeout(None)?;
+        websocket.stream.set_write_timeout(None)?;
+        Ok(websocket)
+    }
+}
+
+/// Listens on addr for WebSocket connections at path.
+pub fn listen_websocket<A: ToSocketAddrs>(addr: A, path: &str) -> io::Result<WebSocketListener> {
+    Ok(WebSocketListener {
+        listener: TcpListener::bind(addr)?,
+        path: path.to_string(),
+    })
+}
+
+
+#[cfg(test)]
+mod tests {
+    use std::sync::mpsc;
+    use std::thread;
+
+    use super::*;
+
+    #[test]
+    fn accept_key_test() {
+        // the example of RFC 6455 section 1.3
+        assert_eq!(accept_key("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=");
+    }
+
+    #[test]
+    fn websocket_test() {
+        let listener = listen_websocket("127.0.0.1:0", "/link").unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let refused = addr.clone();
+        let server = thread::spawn(move|| {
+            assert!(listener.accept(None).is_err());
+            let mut server = listener.accept(None).unwrap();
+            let mut received = vec![0u8; 70000];
+            server.read_exact(&mut received).unwrap();
+            server.write_all(&received).unwrap();
+            let mut rest = vec![];
+            server.read_to_end(&mut rest).unwrap();
+            assert!(rest.is_empty());
+        });
+        assert!(dial_websocket(&refused, "/other").is_err());
+
+        let mut client = dial_websocket(&addr, "/link").unwrap();
+        let data: Vec<u8> = (0..70000u32).map(|x| x as u8).collect();
+        client.write_all(&data[..100]).unwrap();
+        // pings from the client are answered by the server's reads
+        {
+            let mut state = client.write.lock().unwrap();
+            client.write_frame(&mut state, OPCODE_PING, b"ping").unwrap();
+        }
+        client.write_all(&data[100..]).unwrap();
+        let mut received = vec![0u8; data.len()];
+        let mut reader = client.try_clone_transport().unwrap();
+        reader.read_exact(&mut received).unwrap();
+        assert_eq!(received, data);
+
+        Transport::shutdown(&client, Shutdown::Write).unwrap();
+        let mut rest = vec![];
+        reader.read_to_end(&mut rest).unwrap();
+        assert!(rest.is_empty());
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn write_timeout_test() {
+        let listener = listen_websocket("127.0.0.1:0", "/link").unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let (written_tx, written) = mpsc::channel();
+        let server = thread::spawn(move|| {
+            let mut server = listener.accept(None).unwrap();
+            let total: usize = written.recv().unwrap();
+            let mut received = vec![0u8; total];
+            server.read_exact(&mut received).unwrap();
+            received
+        });
+
+        // writes time out while the server does not read
+        let mut client = dial_websocket(&addr, "/link").unwrap();
+        client.set_write_timeout(Some(Duration::from_millis(100))).unwrap();
+        let data: Vec<u8> = (0..65536u32).map(|x| x as u8).collect();
+        let mut expected = vec![];
+        loop {
+            match client.write(&data) {
+                Ok(n) => expected.extend_from_slice(&data[..n]),
+                Err(e) => {
+                    assert!(e.kind() == io::ErrorKind::WouldBlock || e.kind() == io::ErrorKind::TimedOut);
+                    break
+                },
+            }
+        }
+
+        // nothing counted as written is lost
+        written_tx.send(expected.len()).unwrap();
+        client.set_write_timeout(None).unwrap();
+        client.flush().unwrap();
+        assert_eq!(server.join().unwrap(), expected);
+    }
+}
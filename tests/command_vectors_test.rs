@@ -27,7 +27,7 @@ extern crate mix_link;
 use std::fs::File;
 use std::io::Read;
 
-use mix_link::commands::{Command};
+use mix_link::commands::{Command, DISCONNECT_NORMAL};
 
 use sphinxcrypto::constants::SURB_ID_SIZE;
 
@@ -83,7 +83,7 @@ fn command_vector_test() {
     let disconnect_bytes = hex::decode(tests.Disconnect).unwrap();
     let cmd = Command::from_bytes(&disconnect_bytes).unwrap();
     match cmd {
-        Command::Disconnect{} => {
+        Command::Disconnect{ reason: DISCONNECT_NORMAL } => {
         },
         _ => {
             panic!("not a Disconnect command");